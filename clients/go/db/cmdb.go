@@ -8,7 +8,6 @@ import (
 	sfMediators "github.com/foliagecp/sdk/statefun/mediator"
 	sfp "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
-	"github.com/nats-io/nats.go"
 )
 
 type TriggerType = string
@@ -25,13 +24,13 @@ type CMDBSyncClient struct {
 	ShadowObjectCanBeRecevier bool
 }
 
-func NewCMDBSyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string) (CMDBSyncClient, error) {
+func NewCMDBSyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string, connection *statefun.NatsConnectionConfig) (CMDBSyncClient, error) {
 	var err error
-	nc, err := nats.Connect(NatsURL)
+	nc, err := connectNats(NatsURL, connection)
 	if err != nil {
 		return CMDBSyncClient{}, err
 	}
-	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName)
+	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName, connection)
 	return NewCMDBSyncClientFromRequestFunction(request)
 }
 
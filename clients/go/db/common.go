@@ -28,20 +28,34 @@ func OpErrorFromOpMsg(om sfMediators.OpMsg) error {
 	return &OpError{om.Status, om.Details}
 }
 
-func buildNatsData(callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON) []byte {
+// buildNatsData builds the envelope of a request with the caller domain and principal of the connection config, signed
+// with its signing config if it is set
+func buildNatsData(target string, callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON, connection *sf.NatsConnectionConfig) ([]byte, error) {
 	data := easyjson.NewJSONObject()
 	data.SetByPath("caller_typename", easyjson.NewJSON(callerTypename))
 	data.SetByPath("caller_id", easyjson.NewJSON(callerID))
+	callerDomain, callerPrincipal := connection.Caller()
+	if len(callerDomain) > 0 {
+		data.SetByPath(sf.CallerDomainNatsDataPath, easyjson.NewJSON(callerDomain))
+	}
+	if len(callerPrincipal) > 0 {
+		data.SetByPath(sf.CallerPrincipalNatsDataPath, easyjson.NewJSON(callerPrincipal))
+	}
 	if payload != nil {
 		data.SetByPath("payload", *payload)
 	}
 	if options != nil {
 		data.SetByPath("options", *options)
 	}
-	return data.ToBytes()
+	if signing := connection.EnvelopeSigning(); signing != nil {
+		return signing.Sign(&data, target)
+	}
+	return data.ToBytes(), nil
 }
 
-func getRequestFunc(nc *nats.Conn, NatsRequestTimeoutSec int, HubDomainName string) sfp.SFRequestFunc {
+// getRequestFunc returns a request function which builds envelopes of requests with the connection config
+// (see statefun.NatsConnectionConfig.SetEnvelopeSigning and SetCaller)
+func getRequestFunc(nc *nats.Conn, NatsRequestTimeoutSec int, HubDomainName string, connection *sf.NatsConnectionConfig) sfp.SFRequestFunc {
 	return func(r sfp.RequestProvider, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, timeout ...time.Duration) (*easyjson.JSON, error) {
 		targetDomain := HubDomainName
 		tokens := strings.Split(targetID, sf.ObjectIDDomainSeparator)
@@ -49,9 +63,13 @@ func getRequestFunc(nc *nats.Conn, NatsRequestTimeoutSec int, HubDomainName stri
 			targetDomain = tokens[0]
 		}
 
+		data, err := buildNatsData(targetTypename+"."+targetID, "cli", "cli", payload, options, connection)
+		if err != nil {
+			return nil, err
+		}
 		resp, err := nc.Request(
 			fmt.Sprintf("%s.%s.%s.%s", sf.RequestPrefix, targetDomain, targetTypename, targetID),
-			buildNatsData("cli", "cli", payload, options),
+			data,
 			time.Duration(NatsRequestTimeoutSec)*time.Second,
 		)
 		if err == nil {
@@ -68,3 +86,8 @@ func seqFree(name string) string {
 	//return name + "===" + system.GetUniqueStrID()
 	return name
 }
+
+// connectNats connects with the connection config, nil - with default options
+func connectNats(NatsURL string, connection *sf.NatsConnectionConfig) (*nats.Conn, error) {
+	return sf.ConnectNats(NatsURL, connection)
+}
@@ -3,8 +3,8 @@ package db
 import (
 	"fmt"
 
+	sf "github.com/foliagecp/sdk/statefun"
 	sfp "github.com/foliagecp/sdk/statefun/plugins"
-	"github.com/nats-io/nats.go"
 )
 
 type DBSyncClient struct {
@@ -12,15 +12,16 @@ type DBSyncClient struct {
 	Graph   GraphSyncClient
 	CMDB    CMDBSyncClient
 	Query   QuerySyncClient
+	Locks   LocksSyncClient
 }
 
-func NewDBSyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string) (DBSyncClient, error) {
+func NewDBSyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string, connection *sf.NatsConnectionConfig) (DBSyncClient, error) {
 	var err error
-	nc, err := nats.Connect(NatsURL)
+	nc, err := connectNats(NatsURL, connection)
 	if err != nil {
 		return DBSyncClient{}, err
 	}
-	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName)
+	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName, connection)
 	return NewDBSyncClientFromRequestFunction(request)
 }
 
@@ -45,10 +46,15 @@ func NewDBSyncClientFromRequestFunction(request sfp.SFRequestFunc) (DBSyncClient
 	if err != nil {
 		return DBSyncClient{}, err
 	}
+	locks, err := NewLocksSyncClientFromRequestFunction(request)
+	if err != nil {
+		return DBSyncClient{}, err
+	}
 	return DBSyncClient{
 		Request: request,
 		Graph:   graph,
 		CMDB:    cmdb,
 		Query:   query,
+		Locks:   locks,
 	}, nil
 }
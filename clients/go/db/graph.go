@@ -4,23 +4,23 @@ import (
 	"fmt"
 
 	"github.com/foliagecp/easyjson"
+	sf "github.com/foliagecp/sdk/statefun"
 	sfMediators "github.com/foliagecp/sdk/statefun/mediator"
 	sfp "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
-	"github.com/nats-io/nats.go"
 )
 
 type GraphSyncClient struct {
 	request sfp.SFRequestFunc
 }
 
-func NewGraphSyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string) (GraphSyncClient, error) {
+func NewGraphSyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string, connection *sf.NatsConnectionConfig) (GraphSyncClient, error) {
 	var err error
-	nc, err := nats.Connect(NatsURL)
+	nc, err := connectNats(NatsURL, connection)
 	if err != nil {
 		return GraphSyncClient{}, err
 	}
-	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName)
+	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName, connection)
 	return NewGraphSyncClientFromRequestFunction(request)
 }
 
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+	sf "github.com/foliagecp/sdk/statefun"
+	sfMediators "github.com/foliagecp/sdk/statefun/mediator"
+	sfp "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+const (
+	locksFunctionsID = "locks"
+)
+
+type LocksSyncClient struct {
+	request sfp.SFRequestFunc
+}
+
+func NewLocksSyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string, connection *sf.NatsConnectionConfig) (LocksSyncClient, error) {
+	var err error
+	nc, err := connectNats(NatsURL, connection)
+	if err != nil {
+		return LocksSyncClient{}, err
+	}
+	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName, connection)
+	return NewLocksSyncClientFromRequestFunction(request)
+}
+
+/*
+ctx.Request
+// or
+runtime.Request
+*/
+func NewLocksSyncClientFromRequestFunction(request sfp.SFRequestFunc) (LocksSyncClient, error) {
+	if request == nil {
+		return LocksSyncClient{}, fmt.Errorf("request must not be nil")
+	}
+	return LocksSyncClient{request: request}, nil
+}
+
+// List returns held locks and found lock wait-for cycles, see functions.locks.list for the format
+func (lc LocksSyncClient) List() (easyjson.JSON, error) {
+	om := sfMediators.OpMsgFromSfReply(lc.request(sfp.AutoRequestSelect, "functions.locks.list", locksFunctionsID, nil, nil))
+	return om.Data, OpErrorFromOpMsg(om)
+}
+
+// ForceRelease unlocks KV mutex with the key regardless of its holder
+func (lc LocksSyncClient) ForceRelease(key string) error {
+	payload := easyjson.NewJSONObjectWithKeyValue("key", easyjson.NewJSON(key))
+	return OpErrorFromOpMsg(sfMediators.OpMsgFromSfReply(lc.request(sfp.AutoRequestSelect, "functions.locks.force_release", locksFunctionsID, &payload, nil)))
+}
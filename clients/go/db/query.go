@@ -4,22 +4,22 @@ import (
 	"fmt"
 
 	"github.com/foliagecp/easyjson"
+	sf "github.com/foliagecp/sdk/statefun"
 	sfMediators "github.com/foliagecp/sdk/statefun/mediator"
 	sfp "github.com/foliagecp/sdk/statefun/plugins"
-	"github.com/nats-io/nats.go"
 )
 
 type QuerySyncClient struct {
 	request sfp.SFRequestFunc
 }
 
-func NewQuerySyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string) (QuerySyncClient, error) {
+func NewQuerySyncClient(NatsURL string, NatsRequestTimeoutSec int, HubDomainName string, connection *sf.NatsConnectionConfig) (QuerySyncClient, error) {
 	var err error
-	nc, err := nats.Connect(NatsURL)
+	nc, err := connectNats(NatsURL, connection)
 	if err != nil {
 		return QuerySyncClient{}, err
 	}
-	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName)
+	request := getRequestFunc(nc, NatsRequestTimeoutSec, HubDomainName, connection)
 	return NewQuerySyncClientFromRequestFunction(request)
 }
 
@@ -0,0 +1,155 @@
+// Foliage KV backup tool.
+// Backs up the cache bucket of a domain into an archive under the coordinated write barrier of all its running
+// stores, and restores archives into a bucket (see statefun/cache/backup.go).
+//
+//	kvbackup -bucket hub_main_cache_cache_bucket -file backup.tgz backup
+//	kvbackup -bucket hub_main_cache_cache_bucket -file backup.tgz -conflict newer restore
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+)
+
+type options struct {
+	natsURL        string
+	jsDomain       string
+	bucket         string
+	kvStorePrefix  string
+	file           string
+	conflict       string
+	barrierTimeout time.Duration
+}
+
+var conflictPolicies = map[string]cache.BackupConflictPolicy{
+	"skip":      cache.RestoreSkipExisting,
+	"overwrite": cache.RestoreOverwrite,
+	"newer":     cache.RestoreKeepNewer,
+	"fail":      cache.RestoreFailOnConflict,
+}
+
+func main() {
+	opts := options{}
+	flag.StringVar(&opts.natsURL, "nats", nats.DefaultURL, "NATS URL")
+	flag.StringVar(&opts.jsDomain, "js-domain", "", "JetStream domain of the bucket, empty - the one of the server")
+	flag.StringVar(&opts.bucket, "bucket", "", "KV bucket: <domain>_<cache_id>_cache_bucket")
+	flag.StringVar(&opts.kvStorePrefix, "prefix", cache.KVStorePrefix, "KV store prefix of the cache, restore: the one of the archive if not set")
+	flag.StringVar(&opts.file, "file", "", "Archive file, \"-\" - stdout for backup and stdin for restore")
+	flag.StringVar(&opts.conflict, "conflict", "skip", "Restore policy for existing values: skip, overwrite, newer, fail")
+	flag.DurationVar(&opts.barrierTimeout, "barrier-timeout", cache.BackupBarrierTimeout, "Max time to wait for all stores to acknowledge the write barrier")
+	logLevel := flag.Int("ll", 3, "Log level [0;6]: panic, fatal, error, warn, info, debug, trace")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] backup|restore\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *logLevel < 0 || *logLevel > 6 {
+		fmt.Println("Please select logging level from [0;6]")
+		os.Exit(2)
+	}
+	if flag.NArg() != 1 || len(opts.bucket) == 0 || len(opts.file) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	// Each level has a factor of 4: -8, -4, 0, 4, 8, 12, 16
+	lg.SetDefaultOptions(os.Stderr, lg.LogLevel((4-*logLevel)*4), false)
+
+	result, err := run(context.Background(), flag.Arg(0), opts)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "kvbackup: %s", err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(os.Stderr, result) // Stdout may carry the archive
+}
+
+// run executes the command and returns its manifest (and report for restore) as JSON
+func run(ctx context.Context, command string, opts options) (string, error) {
+	nc, err := statefun.ConnectNats(opts.natsURL, nil)
+	if err != nil {
+		return "", err
+	}
+	defer nc.Close()
+	jsOpts := []nats.JSOpt{}
+	if len(opts.jsDomain) > 0 {
+		jsOpts = append(jsOpts, nats.Domain(opts.jsDomain))
+	}
+	js, err := nc.JetStream(jsOpts...)
+	if err != nil {
+		return "", err
+	}
+	kv, err := js.KeyValue(opts.bucket)
+	if err != nil {
+		return "", fmt.Errorf("bucket %s: %w", opts.bucket, err)
+	}
+
+	var result any
+	switch command {
+	case "backup":
+		f, err := openArchive(opts.file, true)
+		if err != nil {
+			return "", err
+		}
+		backupConfig := cache.NewBackupConfig().SetKVStorePrefix(opts.kvStorePrefix).SetBarrierTimeout(opts.barrierTimeout)
+		manifest, err := cache.Backup(ctx, js, kv, f, backupConfig)
+		closeErr := f.Close()
+		if err != nil {
+			return "", err
+		}
+		if closeErr != nil {
+			return "", closeErr
+		}
+		result = manifest
+	case "restore":
+		conflictPolicy, ok := conflictPolicies[opts.conflict]
+		if !ok {
+			return "", fmt.Errorf("unknown conflict policy %q", opts.conflict)
+		}
+		f, err := openArchive(opts.file, false)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+		restoreConfig := cache.NewRestoreConfig().SetConflictPolicy(conflictPolicy)
+		if opts.kvStorePrefix != cache.KVStorePrefix {
+			restoreConfig.SetKVStorePrefix(opts.kvStorePrefix)
+		}
+		manifest, report, err := cache.Restore(ctx, js, kv, f, restoreConfig)
+		if err != nil {
+			return "", err
+		}
+		result = map[string]any{"manifest": manifest, "report": report}
+	default:
+		return "", fmt.Errorf("unknown command %q, backup or restore expected", command)
+	}
+
+	bytes, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes), nil
+}
+
+// openArchive opens the archive file for writing or reading, "-" - stdout or stdin
+func openArchive(file string, write bool) (*os.File, error) {
+	switch {
+	case file == "-" && write:
+		return os.Stdout, nil
+	case file == "-":
+		return os.Stdin, nil
+	case write:
+		return os.Create(file)
+	default:
+		return os.Open(file)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+)
+
+func TestRun(t *testing.T) {
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "hub_test_cache_bucket"})
+	require.NoError(t, err)
+
+	// Value as the cache writes it: update time, append flag, value
+	value := make([]byte, 9, 12)
+	binary.BigEndian.PutUint64(value, 100)
+	value[8] = 1
+	value = append(value, []byte(`{}`)...)
+	_, err = kv.Put(cache.KVStorePrefix+".hub/a", value)
+	require.NoError(t, err)
+
+	options := options{
+		natsURL:        srv.ClientURL(),
+		bucket:         "hub_test_cache_bucket",
+		kvStorePrefix:  cache.KVStorePrefix,
+		file:           filepath.Join(t.TempDir(), "backup.tgz"),
+		conflict:       "skip",
+		barrierTimeout: cache.BackupBarrierTimeout,
+	}
+	result, err := run(context.Background(), "backup", options)
+	require.NoError(t, err)
+	manifest, ok := easyjson.JSONFromString(result)
+	require.True(t, ok)
+	require.Equal(t, float64(1), manifest.GetByPath("keys").AsNumericDefault(0))
+
+	require.NoError(t, kv.Purge(cache.KVStorePrefix+".hub/a"))
+	result, err = run(context.Background(), "restore", options)
+	require.NoError(t, err)
+	restored, ok := easyjson.JSONFromString(result)
+	require.True(t, ok)
+	require.Equal(t, float64(1), restored.GetByPath("report.restored").AsNumericDefault(0))
+	entry, err := kv.Get(cache.KVStorePrefix + ".hub/a")
+	require.NoError(t, err)
+	require.Equal(t, value, entry.Value())
+
+	options.conflict = "unknown"
+	_, err = run(context.Background(), "restore", options)
+	require.Error(t, err)
+	_, err = run(context.Background(), "verify", options)
+	require.Error(t, err)
+}
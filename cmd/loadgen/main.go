@@ -0,0 +1,271 @@
+// Foliage load generator.
+// Starts a runtime against an embedded NATS server (or the one given by -nats), registers synthetic function types
+// of configurable cost, drives signal and request load at the target rate and reports latency, throughput,
+// refusals and worker pool utilization.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats-server/v2/server"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	typenameTmpl   = "functions.loadgen.synthetic.%d"
+	sentAtPath     = "sent_at"
+	samplePeriod   = 100 * time.Millisecond
+	startupTimeout = 30 * time.Second
+)
+
+type options struct {
+	natsURL        string
+	duration       time.Duration
+	rate           int
+	requestShare   float64
+	functions      int
+	ids            int
+	cost           time.Duration
+	costCPU        bool
+	state          bool
+	localCalls     bool
+	maxInFlight    int
+	requestTimeout time.Duration
+	drain          time.Duration
+	seed           int64
+	jsonReport     bool
+}
+
+func main() {
+	opts := options{}
+	flag.StringVar(&opts.natsURL, "nats", "", "NATS URL, empty - start an embedded NATS server with JetStream")
+	flag.DurationVar(&opts.duration, "duration", 10*time.Second, "Duration of the load")
+	flag.IntVar(&opts.rate, "rate", 1000, "Target rate of calls per second")
+	flag.Float64Var(&opts.requestShare, "requests", 0.5, "Share of requests among calls [0;1], the rest are signals")
+	flag.IntVar(&opts.functions, "functions", 1, "Number of synthetic function types, calls are spread evenly")
+	flag.IntVar(&opts.ids, "ids", 100, "Number of ids per function type, calls are spread evenly")
+	flag.DurationVar(&opts.cost, "cost", time.Millisecond, "Time a synthetic function spends on a call")
+	flag.BoolVar(&opts.costCPU, "cpu", false, "Spend the cost busy on CPU instead of sleeping")
+	flag.BoolVar(&opts.state, "state", true, "Update the function context on every call")
+	flag.BoolVar(&opts.localCalls, "local", false, "Send calls via golang instead of NATS")
+	flag.IntVar(&opts.maxInFlight, "in-flight", 1000, "Max calls being sent at once, calls over it are counted as skipped")
+	flag.DurationVar(&opts.requestTimeout, "timeout", 10*time.Second, "Request timeout")
+	flag.DurationVar(&opts.drain, "drain", 30*time.Second, "Max time to wait for signals sent during the load to be handled")
+	flag.Int64Var(&opts.seed, "seed", 1, "Seed of the sequence of calls")
+	flag.BoolVar(&opts.jsonReport, "json", false, "Print the report as JSON")
+	logLevel := flag.Int("ll", 3, "Log level [0;6]: panic, fatal, error, warn, info, debug, trace")
+	flag.Parse()
+
+	if *logLevel < 0 || *logLevel > 6 {
+		fmt.Println("Please select logging level from [0;6]")
+		os.Exit(2)
+	}
+	if opts.rate <= 0 || opts.functions <= 0 || opts.ids <= 0 || opts.maxInFlight <= 0 || opts.requestShare < 0 || opts.requestShare > 1 {
+		fmt.Println("Invalid options, see -h")
+		os.Exit(2)
+	}
+	// Each level has a factor of 4: -8, -4, 0, 4, 8, 12, 16
+	lg.SetDefaultOptions(os.Stderr, lg.LogLevel((4-*logLevel)*4), false)
+
+	report, err := run(opts)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "loadgen: %s", err)
+		os.Exit(1)
+	}
+	if opts.jsonReport {
+		fmt.Println(report.toJSON().ToString())
+	} else {
+		report.print(os.Stdout)
+	}
+}
+
+func run(opts options) (*report, error) {
+	natsURL := opts.natsURL
+	if len(natsURL) == 0 {
+		srv, storeDir, err := startEmbeddedNats()
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(storeDir)
+		defer srv.Shutdown()
+		natsURL = srv.ClientURL()
+	}
+
+	system.GlobalPrometrics = system.NewPrometrics("", ":0")
+
+	runtime, err := statefun.NewRuntime(*statefun.NewRuntimeConfigSimple(natsURL, "loadgen"))
+	if err != nil {
+		return nil, err
+	}
+
+	signalLatencies := newLatencies()
+	ftConfig := statefun.NewFunctionTypeConfig().
+		SetAllowedSignalProviders(sfPlugins.AutoSignalSelect).
+		SetAllowedRequestProviders(sfPlugins.AutoRequestSelect)
+	typenames := make([]string, opts.functions)
+	functionTypes := make([]*statefun.FunctionType, opts.functions)
+	for i := range typenames {
+		typenames[i] = fmt.Sprintf(typenameTmpl, i)
+		functionTypes[i] = statefun.NewFunctionType(runtime, typenames[i], syntheticFunction(opts, signalLatencies), *ftConfig)
+	}
+
+	started := make(chan struct{})
+	runtime.RegisterOnAfterStartFunction(func(ctx context.Context, r *statefun.Runtime) error {
+		close(started)
+		return nil
+	}, false)
+	stopped := make(chan error, 1)
+	go func() { stopped <- runtime.Start(context.Background(), cache.NewCacheConfig("loadgen")) }()
+	select {
+	case err := <-stopped:
+		return nil, err
+	case <-started:
+	case <-time.After(startupTimeout):
+		return nil, fmt.Errorf("runtime did not start in %s", startupTimeout)
+	}
+	defer func() {
+		runtime.Shutdown()
+		<-stopped
+	}()
+
+	sampler := newPoolSampler(functionTypes)
+	stopSampling := sampler.start()
+	rep := drive(opts, runtime, typenames, signalLatencies)
+	stopSampling()
+
+	for _, ft := range functionTypes {
+		rep.Refusals += ft.Refusals()
+	}
+	rep.WorkerPool = sampler.result()
+	return rep, nil
+}
+
+func startEmbeddedNats() (*server.Server, string, error) {
+	storeDir, err := os.MkdirTemp("", "loadgen-nats-")
+	if err != nil {
+		return nil, "", err
+	}
+	srv, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, JetStream: true, StoreDir: storeDir})
+	if err != nil {
+		os.RemoveAll(storeDir)
+		return nil, "", err
+	}
+	go srv.Start()
+	if !srv.ReadyForConnections(startupTimeout) {
+		srv.Shutdown()
+		os.RemoveAll(storeDir)
+		return nil, "", fmt.Errorf("embedded NATS server did not start in %s", startupTimeout)
+	}
+	return srv, storeDir, nil
+}
+
+func syntheticFunction(opts options, signalLatencies *latencies) statefun.FunctionLogicHandler {
+	return func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		if opts.costCPU {
+			for start := time.Now(); time.Since(start) < opts.cost; {
+			}
+		} else if opts.cost > 0 {
+			time.Sleep(opts.cost)
+		}
+
+		if opts.state {
+			funcCtx := ctx.GetFunctionContext()
+			funcCtx.SetByPath("calls", easyjson.NewJSON(funcCtx.GetByPath("calls").AsNumericDefault(0)+1))
+			ctx.SetFunctionContext(funcCtx)
+		}
+
+		if ctx.Reply != nil {
+			ctx.Reply.With(easyjson.NewJSONObject().GetPtr())
+			return
+		}
+		if sentAt, err := time.Parse(time.RFC3339Nano, ctx.Payload.GetByPath(sentAtPath).AsStringDefault("")); err == nil {
+			signalLatencies.add(time.Since(sentAt))
+		}
+	}
+}
+
+// drive sends calls at the target rate for the duration and waits for sent signals to be handled
+func drive(opts options, runtime *statefun.Runtime, typenames []string, signalLatencies *latencies) *report {
+	signalProvider, requestProvider := sfPlugins.JetstreamGlobalSignal, sfPlugins.NatsCoreGlobalRequest
+	if opts.localCalls {
+		signalProvider, requestProvider = sfPlugins.GolangLocalSignal, sfPlugins.GolangLocalRequest
+	}
+
+	rep := &report{options: opts}
+	requestLatencies := newLatencies()
+	var signalsSent, signalErrors, requestsSent, requestErrors, skipped atomic.Uint64
+	inFlight := make(chan struct{}, opts.maxInFlight)
+	random := rand.New(rand.NewSource(opts.seed))
+	wg := sync.WaitGroup{}
+
+	interval := time.Second / time.Duration(opts.rate)
+	start := time.Now()
+	for call := 0; ; call++ {
+		next := start.Add(time.Duration(call) * interval)
+		if next.Sub(start) >= opts.duration {
+			break
+		}
+		if d := time.Until(next); d > 0 {
+			time.Sleep(d)
+		}
+
+		typename := typenames[call%len(typenames)]
+		id := fmt.Sprintf("id%d", (call/len(typenames))%opts.ids)
+		isRequest := random.Float64() < opts.requestShare
+		select {
+		case inFlight <- struct{}{}:
+		default:
+			skipped.Add(1)
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			sentAt := time.Now()
+			payload := easyjson.NewJSONObjectWithKeyValue(sentAtPath, easyjson.NewJSON(sentAt.Format(time.RFC3339Nano)))
+			if isRequest {
+				requestsSent.Add(1)
+				if _, err := runtime.Request(requestProvider, typename, id, &payload, nil, opts.requestTimeout); err != nil {
+					requestErrors.Add(1)
+					return
+				}
+				requestLatencies.add(time.Since(sentAt))
+				return
+			}
+			signalsSent.Add(1)
+			if err := runtime.Signal(signalProvider, typename, id, &payload, nil); err != nil {
+				signalErrors.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	rep.Elapsed = time.Since(start)
+
+	drainUntil := time.Now().Add(opts.drain)
+	for uint64(signalLatencies.count()) < signalsSent.Load()-signalErrors.Load() && time.Now().Before(drainUntil) {
+		time.Sleep(samplePeriod)
+	}
+	rep.Drained = time.Since(start)
+
+	rep.Signals = callStats{Sent: signalsSent.Load(), Errors: signalErrors.Load(), Latency: signalLatencies.summary()}
+	rep.Requests = callStats{Sent: requestsSent.Load(), Errors: requestErrors.Load(), Latency: requestLatencies.summary()}
+	rep.Skipped = skipped.Load()
+	return rep
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	for _, localCalls := range []bool{true, false} {
+		t.Run(fmt.Sprintf("local=%t", localCalls), func(t *testing.T) {
+			opts := options{
+				duration:       500 * time.Millisecond,
+				rate:           100,
+				requestShare:   0.5,
+				functions:      2,
+				ids:            5,
+				state:          true,
+				localCalls:     localCalls,
+				maxInFlight:    100,
+				requestTimeout: 5 * time.Second,
+				drain:          10 * time.Second,
+				seed:           1,
+			}
+			rep, err := run(opts)
+			require.NoError(t, err)
+
+			require.Zero(t, rep.Skipped)
+			require.EqualValues(t, 50, rep.Signals.Sent+rep.Requests.Sent)
+			require.NotZero(t, rep.Signals.Sent)
+			require.NotZero(t, rep.Requests.Sent)
+			require.Zero(t, rep.Signals.Errors)
+			require.Zero(t, rep.Requests.Errors)
+			require.Equal(t, 50, rep.handled(), "all sent signals are drained")
+			require.Zero(t, rep.Refusals)
+			require.Equal(t, []string{"functions.loadgen.synthetic.0", "functions.loadgen.synthetic.1"}, rep.typenames())
+
+			out := bytes.Buffer{}
+			rep.print(&out)
+			require.Contains(t, out.String(), "Target: 100 calls/s for 500ms")
+			require.Equal(t, float64(rep.Signals.Sent), rep.toJSON().GetByPath("signals.handled").AsNumericDefault(0))
+		})
+	}
+}
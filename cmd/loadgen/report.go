@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+)
+
+type latencies struct {
+	mutex  sync.Mutex
+	values []time.Duration
+}
+
+func newLatencies() *latencies {
+	return &latencies{}
+}
+
+func (l *latencies) add(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.values = append(l.values, d)
+}
+
+func (l *latencies) count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.values)
+}
+
+func (l *latencies) summary() latencySummary {
+	l.mutex.Lock()
+	values := append([]time.Duration{}, l.values...)
+	l.mutex.Unlock()
+
+	summary := latencySummary{Count: len(values)}
+	if len(values) == 0 {
+		return summary
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	percentile := func(p float64) time.Duration {
+		return values[int(math.Ceil(p*float64(len(values))))-1]
+	}
+	summary.P50 = percentile(0.5)
+	summary.P99 = percentile(0.99)
+	summary.Max = values[len(values)-1]
+	return summary
+}
+
+type latencySummary struct {
+	Count int
+	P50   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+type callStats struct {
+	Sent    uint64
+	Errors  uint64 // Sending failed or, for requests, no reply in time
+	Latency latencySummary
+}
+
+// poolUtilization is the share of max workers busy with calls and the fill of the task queue, percents
+type poolUtilization struct {
+	BusyAvg  float64
+	BusyMax  float64
+	QueueAvg float64
+	QueueMax float64
+}
+
+type poolSampler struct {
+	functionTypes []*statefun.FunctionType
+	samples       int
+	utilization   map[string]*poolUtilization
+}
+
+func newPoolSampler(functionTypes []*statefun.FunctionType) *poolSampler {
+	return &poolSampler{functionTypes: functionTypes, utilization: map[string]*poolUtilization{}}
+}
+
+// start samples worker pools until the returned function is called
+func (ps *poolSampler) start() (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(samplePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ps.sample()
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (ps *poolSampler) sample() {
+	ps.samples++
+	for i, ft := range ps.functionTypes {
+		typename := fmt.Sprintf(typenameTmpl, i)
+		u, ok := ps.utilization[typename]
+		if !ok {
+			u = &poolUtilization{}
+			ps.utilization[typename] = u
+		}
+		loaded, idle := ft.WorkerPool().GetWorkerPercentage()
+		busy, queue := loaded-idle, ft.WorkerPool().GetWorkerPoolLoadPercentage()
+		u.BusyAvg += busy
+		u.BusyMax = math.Max(u.BusyMax, busy)
+		u.QueueAvg += queue
+		u.QueueMax = math.Max(u.QueueMax, queue)
+	}
+}
+
+func (ps *poolSampler) result() map[string]poolUtilization {
+	result := map[string]poolUtilization{}
+	for typename, u := range ps.utilization {
+		r := *u
+		if ps.samples > 0 {
+			r.BusyAvg /= float64(ps.samples)
+			r.QueueAvg /= float64(ps.samples)
+		}
+		result[typename] = r
+	}
+	return result
+}
+
+type report struct {
+	options    options
+	Elapsed    time.Duration // Time of sending
+	Drained    time.Duration // Time of sending and handling of sent signals
+	Signals    callStats
+	Requests   callStats
+	Skipped    uint64 // Calls not sent because max in flight was reached
+	Refusals   uint64 // Messages refused by function types
+	WorkerPool map[string]poolUtilization
+}
+
+func (rep *report) handled() int {
+	return rep.Signals.Latency.Count + rep.Requests.Latency.Count
+}
+
+func (rep *report) throughput() float64 {
+	if rep.Drained <= 0 {
+		return 0
+	}
+	return float64(rep.handled()) / rep.Drained.Seconds()
+}
+
+func (rep *report) typenames() []string {
+	typenames := make([]string, 0, len(rep.WorkerPool))
+	for typename := range rep.WorkerPool {
+		typenames = append(typenames, typename)
+	}
+	sort.Strings(typenames)
+	return typenames
+}
+
+func (rep *report) print(w io.Writer) {
+	o := rep.options
+	fmt.Fprintf(w, "Target: %d calls/s for %s, %.0f%% requests, %d function type(s) x %d ids, cost %s\n",
+		o.rate, o.duration, o.requestShare*100, o.functions, o.ids, o.cost)
+	fmt.Fprintf(w, "Sent in %s, handled in %s, throughput %.1f calls/s\n", rep.Elapsed.Round(time.Millisecond), rep.Drained.Round(time.Millisecond), rep.throughput())
+	for _, kind := range []struct {
+		name  string
+		stats callStats
+	}{{"Signals", rep.Signals}, {"Requests", rep.Requests}} {
+		fmt.Fprintf(w, "%-9s sent %d, handled %d, errors %d, p50 %s, p99 %s, max %s\n", kind.name+":",
+			kind.stats.Sent, kind.stats.Latency.Count, kind.stats.Errors, kind.stats.Latency.P50, kind.stats.Latency.P99, kind.stats.Latency.Max)
+	}
+	fmt.Fprintf(w, "Refusals: %d, skipped by generator: %d\n", rep.Refusals, rep.Skipped)
+	for _, typename := range rep.typenames() {
+		u := rep.WorkerPool[typename]
+		fmt.Fprintf(w, "Worker pool %s: busy avg %.1f%% max %.1f%%, queue avg %.1f%% max %.1f%%\n", typename, u.BusyAvg, u.BusyMax, u.QueueAvg, u.QueueMax)
+	}
+}
+
+func (rep *report) toJSON() *easyjson.JSON {
+	ms := func(d time.Duration) easyjson.JSON { return easyjson.NewJSON(float64(d.Microseconds()) / 1000) }
+
+	j := easyjson.NewJSONObject()
+	j.SetByPath("elapsed_ms", ms(rep.Elapsed))
+	j.SetByPath("drained_ms", ms(rep.Drained))
+	j.SetByPath("throughput", easyjson.NewJSON(rep.throughput()))
+	for name, stats := range map[string]callStats{"signals": rep.Signals, "requests": rep.Requests} {
+		j.SetByPath(name+".sent", easyjson.NewJSON(stats.Sent))
+		j.SetByPath(name+".handled", easyjson.NewJSON(stats.Latency.Count))
+		j.SetByPath(name+".errors", easyjson.NewJSON(stats.Errors))
+		j.SetByPath(name+".p50_ms", ms(stats.Latency.P50))
+		j.SetByPath(name+".p99_ms", ms(stats.Latency.P99))
+		j.SetByPath(name+".max_ms", ms(stats.Latency.Max))
+	}
+	j.SetByPath("refusals", easyjson.NewJSON(rep.Refusals))
+	j.SetByPath("skipped", easyjson.NewJSON(rep.Skipped))
+	pools := easyjson.NewJSONArray()
+	for _, typename := range rep.typenames() {
+		u := rep.WorkerPool[typename]
+		pool := easyjson.NewJSONObjectWithKeyValue("typename", easyjson.NewJSON(typename))
+		pool.SetByPath("busy_avg", easyjson.NewJSON(u.BusyAvg))
+		pool.SetByPath("busy_max", easyjson.NewJSON(u.BusyMax))
+		pool.SetByPath("queue_avg", easyjson.NewJSON(u.QueueAvg))
+		pool.SetByPath("queue_max", easyjson.NewJSON(u.QueueMax))
+		pools.AddToArray(pool)
+	}
+	j.SetByPath("worker_pools", pools)
+	return &j
+}
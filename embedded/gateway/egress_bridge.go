@@ -0,0 +1,495 @@
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/gorilla/websocket"
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+EgressBridge streams NatsCoreEgress messages (egress.<typename>.<id>) to WebSocket clients.
+
+Client messages:
+
+	{"op": "subscribe", "id": string, "typename": string, "object_id": string, "resume_from_seq": uint64 - optional}
+	{"op": "unsubscribe", "id": string}
+
+typename and object_id may contain NATS wildcards ("*" for a single token, ">" for the rest of the subject).
+resume_from_seq requires durable egress, delivery starts from the given egress stream sequence.
+
+Server messages:
+
+	{"type": "subscribed", "id": string}
+	{"type": "unsubscribed", "id": string}
+	{"type": "error", "id": string, "details": string}
+	{"type": "egress", "id": string, "subject": string, "typename": string, "object_id": string, "seq": uint64, "payload": json}
+
+typename and object_id of an egress message are set only when the subscription's typename has no wildcards,
+seq is set only with durable egress.
+Clients authenticate with "Authorization: Bearer <token>" or "?token=<token>" since browsers cannot set headers on WebSocket.
+Like the HTTP gateway, a bridge without tokens refuses to start unless it is explicitly made insecure with
+EgressBridgeConfig.SetInsecureNoAuth.
+
+Every client has a buffer of clientBufferSize messages, a client which does not read fast enough to keep it from
+overflowing is disconnected with "client is too slow", so a slow client never slows down NATS or other clients.
+*/
+
+const (
+	EgressBridgeMaxSubscriptionsPerClient = 16
+	EgressBridgeClientBufferSize          = 256
+	EgressDurableStreamName               = "egress_durable"
+	EgressDurableStreamMaxMsgs            = 100000
+	EgressDurableStreamMaxBytes           = 1024 * 1024 * 256
+
+	egressSubjectPrefix      = "egress."
+	egressBridgeWriteTimeout = 10 * time.Second
+	egressBridgePongTimeout  = 60 * time.Second
+	egressBridgePingInterval = egressBridgePongTimeout * 9 / 10
+)
+
+var ErrEgressBridgeNoTokens = errors.New("egress bridge has no tokens configured, add tokens or allow unauthenticated clients with SetInsecureNoAuth")
+
+type EgressBridgeConfig struct {
+	tokens                    []string
+	insecureNoAuth            bool
+	allowedOrigins            map[string]struct{}
+	maxSubscriptionsPerClient int
+	clientBufferSize          int
+	durableEgress             bool
+	durableEgressMaxAge       time.Duration
+	durableEgressMaxMsgs      int64
+	durableEgressMaxBytes     int64
+	tenant                    string
+}
+
+func NewEgressBridgeConfig() *EgressBridgeConfig {
+	return &EgressBridgeConfig{
+		allowedOrigins:            map[string]struct{}{},
+		maxSubscriptionsPerClient: EgressBridgeMaxSubscriptionsPerClient,
+		clientBufferSize:          EgressBridgeClientBufferSize,
+		durableEgressMaxMsgs:      EgressDurableStreamMaxMsgs,
+		durableEgressMaxBytes:     EgressDurableStreamMaxBytes,
+	}
+}
+
+// AddTokens adds bearer tokens accepted by the bridge
+func (c *EgressBridgeConfig) AddTokens(tokens ...string) *EgressBridgeConfig {
+	c.tokens = append(c.tokens, tokens...)
+	return c
+}
+
+// SetInsecureNoAuth lets the bridge without tokens serve clients without authentication
+func (c *EgressBridgeConfig) SetInsecureNoAuth(insecureNoAuth bool) *EgressBridgeConfig {
+	c.insecureNoAuth = insecureNoAuth
+	return c
+}
+
+// AllowOrigins allows WebSocket connections from pages of other origins, "*" allows any origin
+func (c *EgressBridgeConfig) AllowOrigins(origins ...string) *EgressBridgeConfig {
+	for _, origin := range origins {
+		c.allowedOrigins[origin] = struct{}{}
+	}
+	return c
+}
+
+func (c *EgressBridgeConfig) SetMaxSubscriptionsPerClient(maxSubscriptionsPerClient int) *EgressBridgeConfig {
+	c.maxSubscriptionsPerClient = maxSubscriptionsPerClient
+	return c
+}
+
+// SetClientBufferSize sets how many messages may wait for a slow client before it is disconnected
+func (c *EgressBridgeConfig) SetClientBufferSize(clientBufferSize int) *EgressBridgeConfig {
+	c.clientBufferSize = clientBufferSize
+	return c
+}
+
+// SetDurableEgress makes egress durable by storing it in a JetStream stream for maxAge (0 - unlimited),
+// so clients can resume from a sequence after reconnect
+func (c *EgressBridgeConfig) SetDurableEgress(durableEgress bool, maxAge time.Duration) *EgressBridgeConfig {
+	c.durableEgress = durableEgress
+	c.durableEgressMaxAge = maxAge
+	return c
+}
+
+// SetDurableEgressLimits limits the durable egress stream, the oldest messages are discarded (-1 - unlimited).
+// Limits apply when the stream is created.
+func (c *EgressBridgeConfig) SetDurableEgressLimits(maxMsgs int64, maxBytes int64) *EgressBridgeConfig {
+	c.durableEgressMaxMsgs = maxMsgs
+	c.durableEgressMaxBytes = maxBytes
+	return c
+}
+
+// SetTenant bridges egress of runtimes configured with RuntimeConfig.SetTenant only
+func (c *EgressBridgeConfig) SetTenant(tenant string) *EgressBridgeConfig {
+	c.tenant = tenant
+	return c
+}
+
+func (c *EgressBridgeConfig) subjectPrefix() string {
+	if len(c.tenant) == 0 {
+		return egressSubjectPrefix
+	}
+	return c.tenant + "." + egressSubjectPrefix
+}
+
+func (c *EgressBridgeConfig) durableStreamName() string {
+	if len(c.tenant) == 0 {
+		return EgressDurableStreamName
+	}
+	return c.tenant + "-" + EgressDurableStreamName
+}
+
+type EgressBridge struct {
+	nc       *nats.Conn
+	js       nats.JetStreamContext
+	config   *EgressBridgeConfig
+	upgrader websocket.Upgrader
+}
+
+func NewEgressBridge(nc *nats.Conn, config *EgressBridgeConfig) (*EgressBridge, error) {
+	if len(config.tokens) == 0 {
+		if !config.insecureNoAuth {
+			return nil, ErrEgressBridgeNoTokens
+		}
+		lg.Logf(lg.WarnLevel, "Egress bridge has no tokens configured, clients are not authenticated")
+	}
+	eb := &EgressBridge{nc: nc, config: config}
+	eb.upgrader = websocket.Upgrader{CheckOrigin: eb.checkOrigin}
+
+	if config.durableEgress {
+		js, err := nc.JetStream()
+		if err != nil {
+			return nil, err
+		}
+		eb.js = js
+		if _, err := js.StreamInfo(config.durableStreamName()); err != nil {
+			if !errors.Is(err, nats.ErrStreamNotFound) {
+				return nil, err
+			}
+			if _, err := js.AddStream(&nats.StreamConfig{
+				Name:      config.durableStreamName(),
+				Subjects:  []string{config.subjectPrefix() + ">"},
+				Retention: nats.LimitsPolicy,
+				Discard:   nats.DiscardOld,
+				MaxAge:    config.durableEgressMaxAge,
+				MaxMsgs:   config.durableEgressMaxMsgs,
+				MaxBytes:  config.durableEgressMaxBytes,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return eb, nil
+}
+
+// StartEgressBridgeServer serves the bridge on /egress until ctx is done
+func StartEgressBridgeServer(ctx context.Context, port string, nc *nats.Conn, config *EgressBridgeConfig) error {
+	eb, err := NewEgressBridge(nc, config)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/egress", eb)
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			lg.Logf(lg.ErrorLevel, "Egress bridge shutdown failed: %s", err)
+		}
+	}()
+
+	lg.Logf(lg.InfoLevel, "Egress bridge is listening on :%s", port)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (eb *EgressBridge) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if _, ok := eb.config.allowedOrigins["*"]; ok {
+		return true
+	}
+	if _, ok := eb.config.allowedOrigins[origin]; ok {
+		return true
+	}
+	return strings.TrimPrefix(strings.TrimPrefix(origin, "https://"), "http://") == r.Host
+}
+
+func (eb *EgressBridge) authorized(r *http.Request) bool {
+	if len(eb.config.tokens) == 0 {
+		return eb.config.insecureNoAuth
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	for _, t := range eb.config.tokens {
+		if len(token) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (eb *EgressBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !eb.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		replyError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+		return
+	}
+	conn, err := eb.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrader has already replied with an error
+	}
+
+	c := &egressBridgeClient{
+		bridge:        eb,
+		conn:          conn,
+		send:          make(chan []byte, eb.config.clientBufferSize),
+		done:          make(chan struct{}),
+		subscriptions: map[string]*nats.Subscription{},
+	}
+	go c.writeLoop()
+	c.readLoop()
+}
+
+type egressBridgeClient struct {
+	bridge *EgressBridge
+	conn   *websocket.Conn
+	send   chan []byte
+	done   chan struct{}
+
+	mutex         sync.Mutex
+	closed        bool
+	subscriptions map[string]*nats.Subscription
+}
+
+func (c *egressBridgeClient) close(reason string) {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return
+	}
+	c.closed = true
+	for _, sub := range c.subscriptions {
+		system.MsgOnErrorReturn(sub.Unsubscribe())
+	}
+	c.subscriptions = map[string]*nats.Subscription{}
+	c.mutex.Unlock()
+
+	if len(reason) > 0 {
+		_ = c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(egressBridgeWriteTimeout))
+	}
+	close(c.done)
+	c.conn.Close()
+}
+
+// enqueue never blocks NATS handlers, a client which cannot keep up is disconnected
+func (c *egressBridgeClient) enqueue(msg easyjson.JSON) {
+	select {
+	case c.send <- msg.ToBytes():
+	case <-c.done:
+	default:
+		go c.close("client is too slow")
+	}
+}
+
+func (c *egressBridgeClient) replyError(id string, details string) {
+	msg := easyjson.NewJSONObject()
+	msg.SetByPath("type", easyjson.NewJSON("error"))
+	msg.SetByPath("id", easyjson.NewJSON(id))
+	msg.SetByPath("details", easyjson.NewJSON(details))
+	c.enqueue(msg)
+}
+
+func (c *egressBridgeClient) reply(msgType string, id string) {
+	msg := easyjson.NewJSONObject()
+	msg.SetByPath("type", easyjson.NewJSON(msgType))
+	msg.SetByPath("id", easyjson.NewJSON(id))
+	c.enqueue(msg)
+}
+
+func (c *egressBridgeClient) writeLoop() {
+	ticker := time.NewTicker(egressBridgePingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case data := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(egressBridgeWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				c.close("")
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(egressBridgeWriteTimeout)); err != nil {
+				c.close("")
+				return
+			}
+		}
+	}
+}
+
+func (c *egressBridgeClient) readLoop() {
+	defer c.close("")
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(egressBridgePongTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(egressBridgePongTimeout))
+	})
+	c.conn.SetReadLimit(64 * 1024)
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(egressBridgePongTimeout))
+
+		msg, ok := easyjson.JSONFromBytes(data)
+		if !ok {
+			c.replyError("", "message is not a valid JSON")
+			continue
+		}
+		id := msg.GetByPath("id").AsStringDefault("")
+		if len(id) == 0 {
+			c.replyError("", "id is required")
+			continue
+		}
+		switch op := msg.GetByPath("op").AsStringDefault(""); op {
+		case "subscribe":
+			if err := c.subscribe(id, msg); err != nil {
+				c.replyError(id, err.Error())
+			}
+		case "unsubscribe":
+			c.unsubscribe(id)
+			c.reply("unsubscribed", id)
+		default:
+			c.replyError(id, fmt.Sprintf("unknown op: %s", op))
+		}
+	}
+}
+
+func validSubjectPattern(pattern string) bool {
+	if len(pattern) == 0 {
+		return false
+	}
+	tokens := strings.Split(pattern, ".")
+	for i, token := range tokens {
+		if len(token) == 0 || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+		if strings.Contains(token, ">") && (token != ">" || i != len(tokens)-1) {
+			return false
+		}
+		if strings.Contains(token, "*") && token != "*" {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *egressBridgeClient) subscribe(id string, msg easyjson.JSON) error {
+	typename := msg.GetByPath("typename").AsStringDefault("")
+	objectID := msg.GetByPath("object_id").AsStringDefault(">")
+	if !validSubjectPattern(typename) || strings.HasSuffix(typename, ">") {
+		return fmt.Errorf("invalid typename pattern: %s", typename)
+	}
+	if !validSubjectPattern(objectID) {
+		return fmt.Errorf("invalid object_id pattern: %s", objectID)
+	}
+	subjectPrefix := c.bridge.config.subjectPrefix()
+	subject := subjectPrefix + typename + "." + objectID
+	typenameIsExact := !strings.Contains(typename, "*")
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return fmt.Errorf("connection is closed")
+	}
+	if _, ok := c.subscriptions[id]; ok {
+		return fmt.Errorf("subscription %s already exists", id)
+	}
+	if len(c.subscriptions) >= c.bridge.config.maxSubscriptionsPerClient {
+		return fmt.Errorf("subscriptions limit of %d is reached", c.bridge.config.maxSubscriptionsPerClient)
+	}
+
+	ready := make(chan struct{}) // Egress must not overtake the "subscribed" reply
+	handler := func(m *nats.Msg) {
+		select {
+		case <-ready:
+		case <-c.done:
+			return
+		}
+		out := easyjson.NewJSONObject()
+		out.SetByPath("type", easyjson.NewJSON("egress"))
+		out.SetByPath("id", easyjson.NewJSON(id))
+		out.SetByPath("subject", easyjson.NewJSON(m.Subject))
+		if typenameIsExact {
+			out.SetByPath("typename", easyjson.NewJSON(typename))
+			out.SetByPath("object_id", easyjson.NewJSON(strings.TrimPrefix(m.Subject, subjectPrefix+typename+".")))
+		}
+		if meta, err := m.Metadata(); err == nil {
+			out.SetByPath("seq", easyjson.NewJSON(meta.Sequence.Stream))
+		}
+		if payload, ok := easyjson.JSONFromBytes(m.Data); ok {
+			out.SetByPath("payload", payload)
+		}
+		c.enqueue(out)
+	}
+
+	var sub *nats.Subscription
+	var err error
+	resumeFromSeq := uint64(msg.GetByPath("resume_from_seq").AsNumericDefault(0))
+	if c.bridge.js != nil {
+		startOpt := nats.DeliverNew()
+		if resumeFromSeq > 0 {
+			startOpt = nats.StartSequence(resumeFromSeq)
+		}
+		sub, err = c.bridge.js.Subscribe(subject, handler, nats.OrderedConsumer(), startOpt, nats.BindStream(c.bridge.config.durableStreamName()))
+	} else {
+		if resumeFromSeq > 0 {
+			return fmt.Errorf("resume_from_seq requires durable egress")
+		}
+		sub, err = c.bridge.nc.Subscribe(subject, handler)
+	}
+	if err != nil {
+		return err
+	}
+	c.subscriptions[id] = sub
+	c.reply("subscribed", id)
+	close(ready)
+	return nil
+}
+
+func (c *egressBridgeClient) unsubscribe(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if sub, ok := c.subscriptions[id]; ok {
+		system.MsgOnErrorReturn(sub.Unsubscribe())
+		delete(c.subscriptions, id)
+	}
+}
@@ -0,0 +1,168 @@
+package gateway
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/gorilla/websocket"
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func startEgressBridgeTestNats(t *testing.T) *nats.Conn {
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsservertest.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+func dialEgressBridge(srv *httptest.Server, query string, token string) (*websocket.Conn, int, error) {
+	header := http.Header{}
+	if len(token) > 0 {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/egress"+query, header)
+	if resp == nil {
+		return conn, 0, err
+	}
+	defer resp.Body.Close()
+	return conn, resp.StatusCode, err
+}
+
+func readEgressBridgeMsg(t *testing.T, conn *websocket.Conn) easyjson.JSON {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, data, err := conn.ReadMessage()
+	require.NoError(t, err)
+	msg, ok := easyjson.JSONFromBytes(data)
+	require.True(t, ok)
+	return msg
+}
+
+func TestEgressBridgeRefusesToStartWithoutTokens(t *testing.T) {
+	nc := startEgressBridgeTestNats(t)
+
+	_, err := NewEgressBridge(nc, NewEgressBridgeConfig())
+	require.ErrorIs(t, err, ErrEgressBridgeNoTokens)
+	require.ErrorIs(t, StartEgressBridgeServer(context.Background(), "0", nc, NewEgressBridgeConfig()), ErrEgressBridgeNoTokens)
+
+	eb, err := NewEgressBridge(nc, NewEgressBridgeConfig().SetInsecureNoAuth(true))
+	require.NoError(t, err)
+	srv := httptest.NewServer(eb)
+	defer srv.Close()
+	conn, _, err := dialEgressBridge(srv, "", "")
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestEgressBridgeAuth(t *testing.T) {
+	nc := startEgressBridgeTestNats(t)
+	eb, err := NewEgressBridge(nc, NewEgressBridgeConfig().AddTokens("t1", "t2"))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	mux.Handle("/egress", eb)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	_, code, err := dialEgressBridge(srv, "", "")
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, code)
+	_, code, err = dialEgressBridge(srv, "", "wrong")
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, code)
+	_, code, err = dialEgressBridge(srv, "?token=wrong", "")
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, code)
+
+	conn, _, err := dialEgressBridge(srv, "", "t2")
+	require.NoError(t, err)
+	conn.Close()
+
+	// Browsers pass the token in the query
+	conn, _, err = dialEgressBridge(srv, "?token=t1", "")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.WriteJSON(map[string]string{"op": "subscribe", "id": "s", "typename": "functions.test.echo"}))
+	require.Equal(t, "subscribed", readEgressBridgeMsg(t, conn).GetByPath("type").AsStringDefault(""))
+	require.NoError(t, nc.Publish("egress.functions.test.echo.a", []byte(`{"x":1}`)))
+	msg := readEgressBridgeMsg(t, conn)
+	require.Equal(t, "egress", msg.GetByPath("type").AsStringDefault(""))
+	require.Equal(t, "a", msg.GetByPath("object_id").AsStringDefault(""))
+	require.Equal(t, `{"x":1}`, msg.GetByPath("payload").ToString())
+}
+
+func TestEgressBridgeDisconnectsSlowClient(t *testing.T) {
+	nc := startEgressBridgeTestNats(t)
+	eb, err := NewEgressBridge(nc, NewEgressBridgeConfig().SetInsecureNoAuth(true).SetClientBufferSize(1))
+	require.NoError(t, err)
+
+	// A client whose writes are stuck: nothing drains its buffer
+	subscribed := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := eb.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			subscribed <- err
+			return
+		}
+		c := &egressBridgeClient{
+			bridge:        eb,
+			conn:          conn,
+			send:          make(chan []byte, eb.config.clientBufferSize),
+			done:          make(chan struct{}),
+			subscriptions: map[string]*nats.Subscription{},
+		}
+		subscribed <- c.subscribe("s", easyjson.NewJSONObjectWithKeyValue("typename", easyjson.NewJSON("functions.test.echo")))
+	}))
+	defer srv.Close()
+
+	conn, _, err := dialEgressBridge(srv, "", "")
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, <-subscribed)
+
+	// "subscribed" reply takes the whole buffer, the next message overflows it
+	require.NoError(t, nc.Publish("egress.functions.test.echo.a", []byte(`{"x":1}`)))
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, _, err = conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	require.ErrorAs(t, err, &closeErr)
+	require.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+	require.Equal(t, "client is too slow", closeErr.Text)
+}
+
+func TestEgressBridgeDurableStreamLimits(t *testing.T) {
+	nc := startEgressBridgeTestNats(t)
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	_, err = NewEgressBridge(nc, NewEgressBridgeConfig().SetInsecureNoAuth(true).SetDurableEgress(true, time.Hour))
+	require.NoError(t, err)
+	info, err := js.StreamInfo(EgressDurableStreamName)
+	require.NoError(t, err)
+	require.Equal(t, int64(EgressDurableStreamMaxMsgs), info.Config.MaxMsgs)
+	require.Equal(t, int64(EgressDurableStreamMaxBytes), info.Config.MaxBytes)
+	require.Equal(t, nats.DiscardOld, info.Config.Discard)
+
+	config := NewEgressBridgeConfig().SetInsecureNoAuth(true).SetDurableEgress(true, 0).SetDurableEgressLimits(2, -1).SetTenant("t")
+	_, err = NewEgressBridge(nc, config)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, nc.Publish("t.egress.functions.test.echo.a", []byte(`{}`)))
+	}
+	require.NoError(t, nc.Flush())
+	require.Eventually(t, func() bool {
+		info, err := js.StreamInfo(config.durableStreamName())
+		return err == nil && info.State.Msgs == 2 && info.State.FirstSeq == 2
+	}, 5*time.Second, 50*time.Millisecond, "the oldest message is discarded")
+}
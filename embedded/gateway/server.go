@@ -0,0 +1,379 @@
+// Foliage HTTP gateway package.
+// Exposes signals and requests to stateful functions over HTTP/JSON for systems which do not speak NATS
+package gateway
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Routes:
+
+	POST /signal/{typename}/{id}  -> Runtime.Signal, replies 202 {"status": "ok"}
+	POST /request/{typename}/{id} -> Runtime.Request, replies 200 with the function's reply
+	GET  /openapi.json            -> OpenAPI document of all exposed function types
+
+Request body is the payload of the call and must be a JSON value (empty body means empty object).
+Only allow-listed function types registered in the gateway's runtime are exposed, others are refused and not
+documented.
+Call options may be passed as a JSON object in the "Foliage-Options" header.
+Every call must carry "Authorization: Bearer <token>" with one of the configured tokens. A gateway without tokens
+refuses to start unless it is explicitly made insecure with Config.SetInsecureNoAuth.
+Errors are replied as {"status": "failed", "details": string}.
+*/
+
+const (
+	MaxBodyBytes      = 1024 * 1024
+	RequestTimeoutSec = 60
+
+	optionsHeader = "Foliage-Options"
+)
+
+var ErrNoTokens = errors.New("HTTP gateway has no tokens configured, add tokens or allow unauthenticated callers with SetInsecureNoAuth")
+
+type Config struct {
+	allowedTypenames  map[string]struct{}
+	tokens            []string
+	insecureNoAuth    bool
+	maxBodyBytes      int64
+	requestTimeoutSec int
+	title             string
+}
+
+func NewConfig() *Config {
+	return &Config{
+		allowedTypenames:  map[string]struct{}{},
+		maxBodyBytes:      MaxBodyBytes,
+		requestTimeoutSec: RequestTimeoutSec,
+		title:             "Foliage HTTP gateway",
+	}
+}
+
+// AllowTypenames exposes function types registered in the gateway's runtime through it, nothing is exposed by default
+func (c *Config) AllowTypenames(typenames ...string) *Config {
+	for _, typename := range typenames {
+		c.allowedTypenames[typename] = struct{}{}
+	}
+	return c
+}
+
+// AddTokens adds bearer tokens accepted by the gateway
+func (c *Config) AddTokens(tokens ...string) *Config {
+	c.tokens = append(c.tokens, tokens...)
+	return c
+}
+
+// SetInsecureNoAuth lets the gateway without tokens serve callers without authentication
+func (c *Config) SetInsecureNoAuth(insecureNoAuth bool) *Config {
+	c.insecureNoAuth = insecureNoAuth
+	return c
+}
+
+func (c *Config) SetMaxBodyBytes(maxBodyBytes int64) *Config {
+	c.maxBodyBytes = maxBodyBytes
+	return c
+}
+
+func (c *Config) SetRequestTimeoutSec(requestTimeoutSec int) *Config {
+	c.requestTimeoutSec = requestTimeoutSec
+	return c
+}
+
+// SetTitle sets the title of the generated OpenAPI document
+func (c *Config) SetTitle(title string) *Config {
+	c.title = title
+	return c
+}
+
+type Gateway struct {
+	runtime *statefun.Runtime
+	config  *Config
+}
+
+func NewGateway(runtime *statefun.Runtime, config *Config) (*Gateway, error) {
+	if len(config.tokens) == 0 {
+		if !config.insecureNoAuth {
+			return nil, ErrNoTokens
+		}
+		lg.Logf(lg.WarnLevel, "HTTP gateway has no tokens configured, callers are not authenticated")
+	}
+	return &Gateway{runtime: runtime, config: config}, nil
+}
+
+func (g *Gateway) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signal/", g.handleCall(false))
+	mux.HandleFunc("/request/", g.handleCall(true))
+	mux.HandleFunc("/openapi.json", g.handleOpenAPI)
+	return mux
+}
+
+// StartGatewayServer serves the gateway until ctx is done
+func StartGatewayServer(ctx context.Context, port string, runtime *statefun.Runtime, config *Config) error {
+	gateway, err := NewGateway(runtime, config)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Addr:              ":" + port,
+		Handler:           gateway.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			lg.Logf(lg.ErrorLevel, "HTTP gateway shutdown failed: %s", err)
+		}
+	}()
+
+	lg.Logf(lg.InfoLevel, "HTTP gateway is listening on :%s", port)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func replyError(w http.ResponseWriter, code int, details string) {
+	reply := easyjson.NewJSONObject()
+	reply.SetByPath("status", easyjson.NewJSON("failed"))
+	reply.SetByPath("details", easyjson.NewJSON(details))
+	replyJSON(w, code, reply.ToBytes())
+}
+
+func replyJSON(w http.ResponseWriter, code int, data []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(data)
+}
+
+func (g *Gateway) authorized(r *http.Request) bool {
+	if len(g.config.tokens) == 0 {
+		return g.config.insecureNoAuth
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	for _, t := range g.config.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// exposedTypenames returns sorted allow-listed typenames which are registered in the runtime
+func (g *Gateway) exposedTypenames() []string {
+	typenames := []string{}
+	for _, typename := range g.runtime.RegisteredFunctionTypes() {
+		if _, ok := g.config.allowedTypenames[typename]; ok {
+			typenames = append(typenames, typename)
+		}
+	}
+	return typenames
+}
+
+// callAllowed tells if the function type may be called the given way
+func callAllowed(ftConfig statefun.FunctionTypeConfig, isRequest bool) bool {
+	if isRequest {
+		return ftConfig.IsRequestProviderAllowed(sfPlugins.NatsCoreGlobalRequest) || ftConfig.IsRequestProviderAllowed(sfPlugins.GolangLocalRequest)
+	}
+	return ftConfig.IsSignalProviderAllowed(sfPlugins.JetstreamGlobalSignal) || ftConfig.IsSignalProviderAllowed(sfPlugins.GolangLocalSignal)
+}
+
+func (g *Gateway) handleCall(isRequest bool) http.HandlerFunc {
+	prefix := "/signal/"
+	if isRequest {
+		prefix = "/request/"
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			replyError(w, http.StatusMethodNotAllowed, "only POST is supported")
+			return
+		}
+		if !g.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			replyError(w, http.StatusUnauthorized, "invalid or missing bearer token")
+			return
+		}
+
+		typename, id, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		if !ok || len(typename) == 0 || len(id) == 0 {
+			replyError(w, http.StatusNotFound, fmt.Sprintf("expected %s{typename}/{id}", prefix))
+			return
+		}
+		if _, ok := g.config.allowedTypenames[typename]; !ok {
+			replyError(w, http.StatusForbidden, fmt.Sprintf("function type %s is not exposed", typename))
+			return
+		}
+		ftConfig, registered := g.runtime.FunctionTypeConfig(typename)
+		if !registered {
+			replyError(w, http.StatusNotFound, fmt.Sprintf("function type %s is not registered", typename))
+			return
+		}
+		if !callAllowed(ftConfig, isRequest) {
+			replyError(w, http.StatusMethodNotAllowed, fmt.Sprintf("function type %s does not accept this call", typename))
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, g.config.maxBodyBytes))
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				replyError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %d bytes", g.config.maxBodyBytes))
+				return
+			}
+			replyError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		payload := easyjson.NewJSONObject()
+		if len(body) > 0 {
+			p, ok := easyjson.JSONFromBytes(body)
+			if !ok {
+				replyError(w, http.StatusBadRequest, "request body is not a valid JSON")
+				return
+			}
+			payload = p
+		}
+		var options *easyjson.JSON
+		if o := r.Header.Get(optionsHeader); len(o) > 0 {
+			opts, ok := easyjson.JSONFromString(o)
+			if !ok || !opts.IsObject() {
+				replyError(w, http.StatusBadRequest, fmt.Sprintf("%s header must be a JSON object", optionsHeader))
+				return
+			}
+			options = &opts
+		}
+
+		if isRequest {
+			reply, err := g.runtime.Request(sfPlugins.AutoRequestSelect, typename, id, &payload, options, time.Duration(g.config.requestTimeoutSec)*time.Second)
+			if err != nil {
+				replyError(w, http.StatusBadGateway, err.Error())
+				return
+			}
+			replyJSON(w, http.StatusOK, reply.ToBytes())
+			return
+		}
+
+		if err := g.runtime.Signal(sfPlugins.AutoSignalSelect, typename, id, &payload, options); err != nil {
+			replyError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		reply := easyjson.NewJSONObjectWithKeyValue("status", easyjson.NewJSON("ok"))
+		replyJSON(w, http.StatusAccepted, reply.ToBytes())
+	}
+}
+
+func (g *Gateway) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		replyError(w, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+	data, err := json.MarshalIndent(g.OpenAPI(), "", "  ")
+	if err != nil {
+		replyError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	replyJSON(w, http.StatusOK, data)
+}
+
+// OpenAPI generates an OpenAPI 3 document for all exposed function types
+func (g *Gateway) OpenAPI() map[string]any {
+	errorResponse := func(description string) map[string]any {
+		return map[string]any{
+			"description": description,
+			"content":     map[string]any{"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Error"}}},
+		}
+	}
+	operation := func(typename string, isRequest bool) map[string]any {
+		kind := "signal"
+		summary := fmt.Sprintf("Signal %s", typename)
+		responses := map[string]any{
+			"202": map[string]any{"description": "Signal was sent"},
+		}
+		if isRequest {
+			kind = "request"
+			summary = fmt.Sprintf("Request %s", typename)
+			responses = map[string]any{
+				"200": map[string]any{
+					"description": "Reply of the function",
+					"content":     map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object"}}},
+				},
+			}
+		}
+		responses["400"] = errorResponse("Invalid payload or options")
+		responses["401"] = errorResponse("Unauthorized")
+		responses["413"] = errorResponse("Payload is too large")
+		responses["502"] = errorResponse("Call failed")
+
+		op := map[string]any{
+			"summary":     summary,
+			"operationId": fmt.Sprintf("%s_%s", kind, strings.ReplaceAll(typename, ".", "_")),
+			"parameters": []any{
+				map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+				map[string]any{"name": optionsHeader, "in": "header", "required": false, "description": "Call options as a JSON object", "schema": map[string]any{"type": "string"}},
+			},
+			"requestBody": map[string]any{
+				"required": false,
+				"content":  map[string]any{"application/json": map[string]any{"schema": map[string]any{"type": "object"}}},
+			},
+			"responses": responses,
+		}
+		if len(g.config.tokens) > 0 {
+			op["security"] = []any{map[string]any{"bearerAuth": []any{}}}
+		}
+		return op
+	}
+
+	paths := map[string]any{}
+	for _, typename := range g.exposedTypenames() {
+		ftConfig, _ := g.runtime.FunctionTypeConfig(typename)
+		if callAllowed(ftConfig, false) {
+			paths[fmt.Sprintf("/signal/%s/{id}", typename)] = map[string]any{"post": operation(typename, false)}
+		}
+		if callAllowed(ftConfig, true) {
+			paths[fmt.Sprintf("/request/%s/{id}", typename)] = map[string]any{"post": operation(typename, true)}
+		}
+	}
+
+	components := map[string]any{
+		"schemas": map[string]any{
+			"Error": map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"status":  map[string]any{"type": "string"},
+					"details": map[string]any{"type": "string"},
+				},
+			},
+		},
+	}
+	if len(g.config.tokens) > 0 {
+		components["securitySchemes"] = map[string]any{"bearerAuth": map[string]any{"type": "http", "scheme": "bearer"}}
+	}
+
+	return map[string]any{
+		"openapi":    "3.0.3",
+		"info":       map[string]any{"title": g.config.title, "version": "1.0.0"},
+		"paths":      paths,
+		"components": components,
+	}
+}
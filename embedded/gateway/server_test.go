@@ -0,0 +1,142 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+	sfTest "github.com/foliagecp/sdk/statefun/test"
+)
+
+type gatewaySuite struct {
+	sfTest.StatefunMemoryTestSuite
+}
+
+func (s *gatewaySuite) startGateway(config *Config) *httptest.Server {
+	s.RegisterFunction("functions.test.echo", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		funcCtx := ctx.GetFunctionContext()
+		funcCtx.SetByPath("last", *ctx.Payload)
+		ctx.SetFunctionContext(funcCtx)
+		if ctx.Reply != nil {
+			ctx.Reply.With(easyjson.NewJSONObjectWithKeyValue("echo", *ctx.Payload).GetPtr())
+		}
+	}, *statefun.NewFunctionTypeConfig().SetAllowedRequestProviders(sfPlugins.AutoRequestSelect))
+	s.RegisterFunction("functions.test.signal_only", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {}, *statefun.NewFunctionTypeConfig())
+	s.Require().NoError(s.StartRuntime())
+
+	gateway, err := NewGateway(s.Runtime(), config)
+	s.Require().NoError(err)
+	srv := httptest.NewServer(gateway.Handler())
+	s.T().Cleanup(srv.Close)
+	return srv
+}
+
+func (s *gatewaySuite) post(srv *httptest.Server, path string, body string, token string) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, srv.URL+path, strings.NewReader(body))
+	s.Require().NoError(err)
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	s.Require().NoError(err)
+	return resp.StatusCode, string(data)
+}
+
+func (s *gatewaySuite) TestRefusesToStartWithoutTokens() {
+	_, err := NewGateway(s.Runtime(), NewConfig().AllowTypenames("functions.test.echo"))
+	s.Require().ErrorIs(err, ErrNoTokens)
+	s.Require().ErrorIs(StartGatewayServer(context.Background(), "0", s.Runtime(), NewConfig()), ErrNoTokens)
+
+	_, err = NewGateway(s.Runtime(), NewConfig().SetInsecureNoAuth(true))
+	s.Require().NoError(err)
+}
+
+func (s *gatewaySuite) TestAuth() {
+	srv := s.startGateway(NewConfig().AllowTypenames("functions.test.echo").AddTokens("t1", "t2"))
+
+	code, _ := s.post(srv, "/request/functions.test.echo/a", `{"x":1}`, "")
+	s.Require().Equal(http.StatusUnauthorized, code)
+	code, _ = s.post(srv, "/request/functions.test.echo/a", `{"x":1}`, "wrong")
+	s.Require().Equal(http.StatusUnauthorized, code)
+
+	code, body := s.post(srv, "/request/functions.test.echo/a", `{"x":1}`, "t2")
+	s.Require().Equal(http.StatusOK, code, body)
+	s.Require().JSONEq(`{"echo":{"x":1}}`, body)
+}
+
+func (s *gatewaySuite) TestInsecureNoAuth() {
+	srv := s.startGateway(NewConfig().AllowTypenames("functions.test.echo").SetInsecureNoAuth(true))
+
+	code, body := s.post(srv, "/signal/functions.test.echo/a", `{"x":2}`, "")
+	s.Require().Equal(http.StatusAccepted, code, body)
+	funcCtx, err := s.FunctionContext("functions.test.echo", "a")
+	s.Require().NoError(err)
+	s.Require().Equal(float64(2), funcCtx.GetByPath("last.x").AsNumericDefault(0))
+}
+
+func (s *gatewaySuite) TestAllowList() {
+	srv := s.startGateway(NewConfig().AllowTypenames("functions.test.echo", "functions.test.signal_only", "functions.test.unregistered").AddTokens("t").SetMaxBodyBytes(16))
+
+	code, _ := s.post(srv, "/request/functions.test.hidden/a", `{}`, "t")
+	s.Require().Equal(http.StatusForbidden, code)
+	code, _ = s.post(srv, "/signal/functions.test.unregistered/a", `{}`, "t")
+	s.Require().Equal(http.StatusNotFound, code, "allow-listed but not registered")
+	code, _ = s.post(srv, "/request/functions.test.signal_only/a", `{}`, "t")
+	s.Require().Equal(http.StatusMethodNotAllowed, code, "requests are not allowed by the function type")
+	code, _ = s.post(srv, "/signal/functions.test.signal_only/a", `{}`, "t")
+	s.Require().Equal(http.StatusAccepted, code)
+
+	code, _ = s.post(srv, "/request/functions.test.echo/a", `{"x":"`+strings.Repeat("a", 32)+`"}`, "t")
+	s.Require().Equal(http.StatusRequestEntityTooLarge, code)
+	code, _ = s.post(srv, "/request/functions.test.echo/a", `{`, "t")
+	s.Require().Equal(http.StatusBadRequest, code)
+}
+
+func (s *gatewaySuite) TestOpenAPI() {
+	srv := s.startGateway(NewConfig().AllowTypenames("functions.test.echo", "functions.test.signal_only", "functions.test.unregistered").AddTokens("t").SetTitle("Test"))
+
+	resp, err := http.Get(srv.URL + "/openapi.json")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Require().Equal(http.StatusOK, resp.StatusCode)
+
+	doc := struct {
+		Info       struct{ Title string }
+		Paths      map[string]map[string]struct{ Security []map[string]any }
+		Components struct{ SecuritySchemes map[string]any }
+	}{}
+	s.Require().NoError(json.NewDecoder(resp.Body).Decode(&doc))
+	s.Require().Equal("Test", doc.Info.Title)
+
+	paths := []string{}
+	for path, ops := range doc.Paths {
+		paths = append(paths, path)
+		s.Require().NotEmpty(ops["post"].Security, path)
+	}
+	s.Require().ElementsMatch([]string{
+		"/signal/functions.test.echo/{id}",
+		"/request/functions.test.echo/{id}",
+		"/signal/functions.test.signal_only/{id}",
+	}, paths)
+	s.Require().Contains(doc.Components.SecuritySchemes, "bearerAuth")
+}
+
+func TestGatewaySuite(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	suite.Run(t, new(gatewaySuite))
+}
@@ -39,6 +39,10 @@ const (
 func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
 	RegisterPolyTypeFunctions(runtime)
 
+	runtime.RegisterLockInfoSource(LockSourceGraphKeys, func() []statefun.LockInfo {
+		return graphKeyLocks.list(runtime.InstanceID())
+	})
+
 	// High-Level API Helpers
 	statefun.NewFunctionType(runtime, "functions.cmdb.api.delete_object_filtered_out_links", DeleteObjectFilteredOutLinksStatefun, *statefun.NewFunctionTypeConfig().SetAllowedRequestProviders(sfPlugins.AutoRequestSelect).SetAllowedSignalProviders())
 
@@ -0,0 +1,89 @@
+package crud
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	LockSourceGraphKeys = "graph_keys"
+)
+
+// graphKeyLocksInfo mirrors graphIdKeyMutex state so that it can be introspected and checked for deadlocks
+type graphKeyLocksInfo struct {
+	mutex sync.Mutex
+	locks map[string]*statefun.LockInfo
+}
+
+var graphKeyLocks = &graphKeyLocksInfo{locks: map[string]*statefun.LockInfo{}}
+
+func (gi *graphKeyLocksInfo) get(key string) *statefun.LockInfo {
+	li, ok := gi.locks[key]
+	if !ok {
+		li = &statefun.LockInfo{Key: key, Source: LockSourceGraphKeys, Holders: []statefun.LockHolder{}, Waiters: []statefun.LockWaiter{}}
+		gi.locks[key] = li
+	}
+	return li
+}
+
+func (gi *graphKeyLocksInfo) waiting(key string, owner statefun.LockOwner, exclusive bool) {
+	gi.mutex.Lock()
+	defer gi.mutex.Unlock()
+	li := gi.get(key)
+	li.Waiters = append(li.Waiters, statefun.LockWaiter{Owner: owner, Exclusive: exclusive, Since: system.GetCurrentTimeNs()})
+}
+
+func (gi *graphKeyLocksInfo) acquired(key string, owner statefun.LockOwner, exclusive bool) {
+	gi.mutex.Lock()
+	defer gi.mutex.Unlock()
+	li := gi.get(key)
+	for i, w := range li.Waiters {
+		if w.Owner == owner && w.Exclusive == exclusive {
+			li.Waiters = append(li.Waiters[:i], li.Waiters[i+1:]...)
+			break
+		}
+	}
+	li.Holders = append(li.Holders, statefun.LockHolder{Owner: owner, Exclusive: exclusive, AcquiredAt: system.GetCurrentTimeNs()})
+}
+
+func (gi *graphKeyLocksInfo) released(key string, owner statefun.LockOwner, exclusive bool) {
+	gi.mutex.Lock()
+	defer gi.mutex.Unlock()
+	li, ok := gi.locks[key]
+	if !ok {
+		return
+	}
+	for i, h := range li.Holders {
+		if h.Owner == owner && h.Exclusive == exclusive {
+			li.Holders = append(li.Holders[:i], li.Holders[i+1:]...)
+			break
+		}
+	}
+	if len(li.Holders) == 0 && len(li.Waiters) == 0 {
+		delete(gi.locks, key)
+	}
+}
+
+// list returns a snapshot of held graph key locks, owners get runtimeID since the locks are in-process
+func (gi *graphKeyLocksInfo) list(runtimeID string) []statefun.LockInfo {
+	gi.mutex.Lock()
+	defer gi.mutex.Unlock()
+	result := make([]statefun.LockInfo, 0, len(gi.locks))
+	for _, li := range gi.locks {
+		snapshot := statefun.LockInfo{Key: li.Key, Source: li.Source, Holders: make([]statefun.LockHolder, 0, len(li.Holders)), Waiters: make([]statefun.LockWaiter, 0, len(li.Waiters))}
+		for _, h := range li.Holders {
+			h.Owner.Runtime = runtimeID
+			snapshot.Holders = append(snapshot.Holders, h)
+		}
+		for _, w := range li.Waiters {
+			w.Owner.Runtime = runtimeID
+			snapshot.Waiters = append(snapshot.Waiters, w)
+		}
+		result = append(result, snapshot)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/foliagecp/easyjson"
 
+	"github.com/foliagecp/sdk/statefun"
 	sfMediators "github.com/foliagecp/sdk/statefun/mediator"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
@@ -96,17 +97,22 @@ func operationKeysMutexLock(ctx *sfPlugins.StatefunContextProcessor, keys []stri
 	//fmt.Printf("---- caller %s:%s\n", ctx.Caller.Typename, ctx.Caller.ID)
 	keys = system.UniqueStrings(keys)
 	sort.Strings(keys)
+	owner := statefun.LockOwner{Typename: ctx.Self.Typename, Id: ctx.Self.ID}
 	for _, k := range keys {
 		if writeOperation {
 			if !ctx.Payload.PathExists(fmt.Sprintf("__parent_holds_locks.%s.w", k)) {
 				//fmt.Printf("-- locking w key: %s\n", k)
+				graphKeyLocks.waiting(k, owner, true)
 				graphIdKeyMutex.Lock(k)
+				graphKeyLocks.acquired(k, owner, true)
 				ctx.Payload.SetByPath(fmt.Sprintf("__key_locks.%s.w", k), easyjson.NewJSON(true))
 			}
 		} else {
 			if !ctx.Payload.PathExists(fmt.Sprintf("__parent_holds_locks.%s", k)) {
 				//fmt.Printf("-- locking r key: %s\n", k)
+				graphKeyLocks.waiting(k, owner, false)
 				graphIdKeyMutex.RLock(k)
+				graphKeyLocks.acquired(k, owner, false)
 				ctx.Payload.SetByPath(fmt.Sprintf("__key_locks.%s.r", k), easyjson.NewJSON(true))
 			}
 		}
@@ -117,15 +123,18 @@ func operationKeysMutexLock(ctx *sfPlugins.StatefunContextProcessor, keys []stri
 func operationKeysMutexUnlock(ctx *sfPlugins.StatefunContextProcessor) {
 	if ctx.Payload.PathExists("__key_locks") {
 		//fmt.Printf("---- Graph Key Unlocking <<<< %s %s\n", ctx.Self.Typename, ctx.Self.ID)
+		owner := statefun.LockOwner{Typename: ctx.Self.Typename, Id: ctx.Self.ID}
 		for _, k := range ctx.Payload.GetByPath("__key_locks").ObjectKeys() {
 			for _, t := range ctx.Payload.GetByPath(fmt.Sprintf("__key_locks.%s", k)).ObjectKeys() {
 				switch t {
 				case "w":
 					//fmt.Printf("-- unlocking w key: %s\n", k)
 					graphIdKeyMutex.Unlock(k)
+					graphKeyLocks.released(k, owner, true)
 				case "r":
 					//fmt.Printf("-- unlocking r key: %s\n", k)
 					graphIdKeyMutex.RUnlock(k)
+					graphKeyLocks.released(k, owner, false)
 				}
 			}
 		}
@@ -0,0 +1,94 @@
+// Foliage locks package.
+// Provides stateful functions for introspection of distributed locks
+package locks
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfMediators "github.com/foliagecp/sdk/statefun/mediator"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
+	statefun.NewFunctionType(runtime, "functions.locks.list", ListLocks(runtime), *statefun.NewFunctionTypeConfig().SetAllowedRequestProviders(sfPlugins.AutoRequestSelect))
+	statefun.NewFunctionType(runtime, "functions.locks.force_release", ForceReleaseLock(runtime), *statefun.NewFunctionTypeConfig().SetAllowedRequestProviders(sfPlugins.AutoRequestSelect))
+}
+
+/*
+Lists held locks: KV mutexes of the domain and in-process locks (e.g. graph key locks) of the runtime which handled the request.
+
+Request:
+
+	payload: json - optional
+
+Reply:
+
+	payload: json
+		status: string
+		details: string
+		data: json
+			locks: json array
+				key: string
+				source: string // "kv_mutex", "graph_keys", ...
+				holders: json array // [{"owner": {"runtime": string, "typename": string, "id": string}, "exclusive": bool, "acquired_at": int64}, ...]
+				waiters: json array // [{"owner": {...}, "exclusive": bool, "since": int64}, ...]
+			cycles: json array // Lock wait-for cycles, each one is an array of owners
+*/
+func ListLocks(runtime *statefun.Runtime) statefun.FunctionLogicHandler {
+	return func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		om := sfMediators.NewOpMediator(ctx)
+
+		locks, err := runtime.ListLocks()
+		if err != nil {
+			om.AggregateOpMsg(sfMediators.OpMsgFailed(err.Error())).Reply()
+			return
+		}
+
+		bytes, err := json.Marshal(map[string]any{
+			"locks":  locks,
+			"cycles": statefun.FindLockWaitCycles(locks),
+		})
+		if err != nil {
+			om.AggregateOpMsg(sfMediators.OpMsgFailed(err.Error())).Reply()
+			return
+		}
+		data, _ := easyjson.JSONFromBytes(bytes)
+		om.AggregateOpMsg(sfMediators.OpMsgOk(data)).Reply()
+	}
+}
+
+/*
+Force releases a KV mutex regardless of its holder. Must be used only to resolve hung locks.
+
+Request:
+
+	payload: json
+		key: string // Key of the lock as shown by functions.locks.list
+
+Reply:
+
+	payload: json
+		status: string
+		details: string
+*/
+func ForceReleaseLock(runtime *statefun.Runtime) statefun.FunctionLogicHandler {
+	return func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		om := sfMediators.NewOpMediator(ctx)
+
+		key, ok := ctx.Payload.GetByPath("key").AsString()
+		if !ok || len(key) == 0 {
+			om.AggregateOpMsg(sfMediators.OpMsgFailed("'key' undefined")).Reply()
+			return
+		}
+
+		if err := statefun.KeyMutexForceUnlock(context.TODO(), runtime, key); err != nil {
+			om.AggregateOpMsg(sfMediators.OpMsgFailed(err.Error())).Reply()
+			return
+		}
+		om.AggregateOpMsg(sfMediators.OpMsgOk(easyjson.NewJSONNull())).Reply()
+	}
+}
@@ -219,7 +219,18 @@ func KeyValid(key string) bool {
 	return validKeyRe.MatchString(key)
 }
 
+// DirectKeyValue is a nats.KeyValue not backed by a JetStream stream (e.g. MemoryKeyValue), KVPut, KVUpdate, KVGet
+// and KVDelete call its own methods instead of publishing into the stream
+type DirectKeyValue interface {
+	nats.KeyValue
+	// DeleteLastRevision removes the latest revision of the key as if its message was deleted from the stream
+	DeleteLastRevision(key string) error
+}
+
 func KVDelete(js nats.JetStreamContext, kv nats.KeyValue, key string) error {
+	if dkv, ok := kv.(DirectKeyValue); ok {
+		return dkv.DeleteLastRevision(key)
+	}
 	streamName := fmt.Sprintf(kvBucketNameTmpl, kv.Bucket())
 	topicName := fmt.Sprintf("$KV.%s.%s", kv.Bucket(), key)
 	rms, err := js.GetLastMsg(streamName, topicName)
@@ -233,6 +244,9 @@ func KVPut(js nats.JetStreamContext, kv nats.KeyValue, key string, value []byte)
 	if !KeyValid(key) {
 		return 0, nats.ErrInvalidKey
 	}
+	if dkv, ok := kv.(DirectKeyValue); ok {
+		return dkv.Put(key, value)
+	}
 
 	var b strings.Builder
 
@@ -264,6 +278,9 @@ func KVUpdate(js nats.JetStreamContext, kv nats.KeyValue, key string, value []by
 	if !KeyValid(key) {
 		return 0, nats.ErrInvalidKey
 	}
+	if dkv, ok := kv.(DirectKeyValue); ok {
+		return dkv.Update(key, value, revision)
+	}
 
 	var b strings.Builder
 	if reflect.ValueOf(kv).Elem().FieldByName("useJSPfx").Bool() {
@@ -308,6 +325,9 @@ func (e *kve) Operation() nats.KeyValueOp { return e.op }
 
 // Get returns the latest value for the key.
 func KVGet(js nats.JetStreamContext, kv nats.KeyValue, key string) (nats.KeyValueEntry, error) {
+	if dkv, ok := kv.(DirectKeyValue); ok {
+		return dkv.Get(key)
+	}
 	e, err := kv_get(js, kv, key, kvLatestRevision)
 	if err != nil {
 		if errors.Is(err, nats.ErrKeyDeleted) {
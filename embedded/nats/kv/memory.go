@@ -0,0 +1,548 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+MemoryKeyValue is an in-process nats.KeyValue for running without a NATS server (see statefun.NewInMemoryRuntime).
+It keeps revisions, history, delete and purge markers and watchers with the semantics of a JetStream backed bucket.
+TTL and replicas of the config are ignored. KVPut, KVUpdate, KVGet and KVDelete of this package work with it through
+DirectKeyValue.
+
+nats.go options configure unexported structs, so they are recognized by comparing what they configure with what
+the supported public constructors configure. Supported are nats.LastRevision for Delete and Purge and nats.Context,
+nats.IgnoreDeletes, nats.IncludeHistory and nats.UpdatesOnly for watches, other options are rejected with an error.
+*/
+
+const memoryBackingStore = "Memory"
+
+var _ DirectKeyValue = (*MemoryKeyValue)(nil)
+
+type memoryEntry struct {
+	bucket   string
+	key      string
+	value    []byte
+	revision uint64
+	created  time.Time
+	op       nats.KeyValueOp
+}
+
+func (e *memoryEntry) Bucket() string             { return e.bucket }
+func (e *memoryEntry) Key() string                { return e.key }
+func (e *memoryEntry) Value() []byte              { return e.value }
+func (e *memoryEntry) Revision() uint64           { return e.revision }
+func (e *memoryEntry) Created() time.Time         { return e.created }
+func (e *memoryEntry) Delta() uint64              { return 0 }
+func (e *memoryEntry) Operation() nats.KeyValueOp { return e.op }
+
+type MemoryKeyValue struct {
+	mutex    sync.Mutex
+	bucket   string
+	history  int
+	ttl      time.Duration
+	revision uint64
+	entries  map[string][]*memoryEntry // Revisions of a key, the latest is the last
+	watchers map[*memoryWatcher]struct{}
+}
+
+func NewMemoryKeyValue(cfg *nats.KeyValueConfig) (*MemoryKeyValue, error) {
+	if cfg == nil {
+		return nil, nats.ErrKeyValueConfigRequired
+	}
+	if !validBucketRe.MatchString(cfg.Bucket) {
+		return nil, nats.ErrInvalidBucketName
+	}
+	history := 1
+	if cfg.History > 0 {
+		if cfg.History > nats.KeyValueMaxHistory {
+			return nil, nats.ErrHistoryToLarge
+		}
+		history = int(cfg.History)
+	}
+	return &MemoryKeyValue{
+		bucket:   cfg.Bucket,
+		history:  history,
+		ttl:      cfg.TTL,
+		entries:  map[string][]*memoryEntry{},
+		watchers: map[*memoryWatcher]struct{}{},
+	}, nil
+}
+
+func (kv *MemoryKeyValue) latest(key string) *memoryEntry {
+	revisions := kv.entries[key]
+	if len(revisions) == 0 {
+		return nil
+	}
+	return revisions[len(revisions)-1]
+}
+
+// append stores a new revision and notifies watchers, kv.mutex must be locked
+func (kv *MemoryKeyValue) append(key string, value []byte, op nats.KeyValueOp) uint64 {
+	kv.revision++
+	entry := &memoryEntry{
+		bucket:   kv.bucket,
+		key:      key,
+		value:    append([]byte{}, value...),
+		revision: kv.revision,
+		created:  time.Now(),
+		op:       op,
+	}
+	revisions := kv.entries[key]
+	if op == nats.KeyValuePurge {
+		revisions = nil
+	}
+	revisions = append(revisions, entry)
+	if len(revisions) > kv.history {
+		revisions = revisions[len(revisions)-kv.history:]
+	}
+	kv.entries[key] = revisions
+
+	for w := range kv.watchers {
+		if w.matches(entry) {
+			w.push(entry)
+		}
+	}
+	return entry.revision
+}
+
+func (kv *MemoryKeyValue) Get(key string) (nats.KeyValueEntry, error) {
+	if !KeyValid(key) {
+		return nil, nats.ErrInvalidKey
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	entry := kv.latest(key)
+	if entry == nil || entry.op != nats.KeyValuePut {
+		return nil, nats.ErrKeyNotFound
+	}
+	return entry, nil
+}
+
+func (kv *MemoryKeyValue) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	if !KeyValid(key) {
+		return nil, nats.ErrInvalidKey
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	for _, entry := range kv.entries[key] {
+		if entry.revision == revision {
+			if entry.op != nats.KeyValuePut {
+				return nil, nats.ErrKeyDeleted
+			}
+			return entry, nil
+		}
+	}
+	return nil, nats.ErrKeyNotFound
+}
+
+func (kv *MemoryKeyValue) Put(key string, value []byte) (uint64, error) {
+	if !KeyValid(key) {
+		return 0, nats.ErrInvalidKey
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	return kv.append(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *MemoryKeyValue) PutString(key string, value string) (uint64, error) {
+	return kv.Put(key, []byte(value))
+}
+
+func (kv *MemoryKeyValue) Create(key string, value []byte) (uint64, error) {
+	if !KeyValid(key) {
+		return 0, nats.ErrInvalidKey
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if entry := kv.latest(key); entry != nil && entry.op == nats.KeyValuePut {
+		return 0, nats.ErrKeyExists
+	}
+	return kv.append(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *MemoryKeyValue) Update(key string, value []byte, last uint64) (uint64, error) {
+	if !KeyValid(key) {
+		return 0, nats.ErrInvalidKey
+	}
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if err := kv.checkLastRevision(key, last); err != nil {
+		return 0, err
+	}
+	return kv.append(key, value, nats.KeyValuePut), nil
+}
+
+func (kv *MemoryKeyValue) checkLastRevision(key string, last uint64) error {
+	var current uint64
+	if entry := kv.latest(key); entry != nil {
+		current = entry.revision
+	}
+	if current != last {
+		return fmt.Errorf("%w: wrong last sequence: %d", nats.ErrKeyExists, current)
+	}
+	return nil
+}
+
+func (kv *MemoryKeyValue) Delete(key string, opts ...nats.DeleteOpt) error {
+	return kv.delete(key, nats.KeyValueDelete, opts)
+}
+
+func (kv *MemoryKeyValue) Purge(key string, opts ...nats.DeleteOpt) error {
+	return kv.delete(key, nats.KeyValuePurge, opts)
+}
+
+func (kv *MemoryKeyValue) delete(key string, op nats.KeyValueOp, opts []nats.DeleteOpt) error {
+	if !KeyValid(key) {
+		return nats.ErrInvalidKey
+	}
+	lastRevision, err := memoryDeleteOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if revision := lastRevision; revision > 0 {
+		if err := kv.checkLastRevision(key, revision); err != nil {
+			return err
+		}
+	}
+	kv.append(key, nil, op)
+	return nil
+}
+
+// DeleteLastRevision removes the latest revision of the key as if its message was deleted from the stream
+func (kv *MemoryKeyValue) DeleteLastRevision(key string) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	revisions := kv.entries[key]
+	if len(revisions) == 0 {
+		return nats.ErrMsgNotFound
+	}
+	if len(revisions) == 1 {
+		delete(kv.entries, key)
+	} else {
+		kv.entries[key] = revisions[:len(revisions)-1]
+	}
+	return nil
+}
+
+func (kv *MemoryKeyValue) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: %s", nats.ErrInvalidKey, "keys cannot be empty and must be a valid NATS subject")
+	}
+	o, err := memoryWatchOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newMemoryWatcher(o.ctx, keys, o.ignoreDeletes)
+
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	if !o.updatesOnly {
+		initial := []*memoryEntry{}
+		for _, revisions := range kv.entries {
+			if o.includeHistory {
+				initial = append(initial, revisions...)
+			} else if len(revisions) > 0 {
+				initial = append(initial, revisions[len(revisions)-1])
+			}
+		}
+		sort.Slice(initial, func(i, j int) bool { return initial[i].revision < initial[j].revision })
+		for _, entry := range initial {
+			if w.matches(entry) {
+				w.push(entry)
+			}
+		}
+		w.push(nil) // Initial values are done
+	}
+	kv.watchers[w] = struct{}{}
+	w.onStop = func() {
+		kv.mutex.Lock()
+		defer kv.mutex.Unlock()
+		delete(kv.watchers, w)
+	}
+	go w.run()
+	return w, nil
+}
+
+func (kv *MemoryKeyValue) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return kv.Watch(nats.AllKeys, opts...)
+}
+
+func (kv *MemoryKeyValue) keys() []string {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	keys := []string{}
+	for key := range kv.entries {
+		if entry := kv.latest(key); entry != nil && entry.op == nats.KeyValuePut {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (kv *MemoryKeyValue) Keys(opts ...nats.WatchOpt) ([]string, error) {
+	keys := kv.keys()
+	if len(keys) == 0 {
+		return nil, nats.ErrNoKeysFound
+	}
+	return keys, nil
+}
+
+func (kv *MemoryKeyValue) ListKeys(opts ...nats.WatchOpt) (nats.KeyLister, error) {
+	keys := kv.keys()
+	ch := make(chan string, len(keys))
+	for _, key := range keys {
+		ch <- key
+	}
+	close(ch)
+	return &memoryKeyLister{keys: ch}, nil
+}
+
+func (kv *MemoryKeyValue) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	revisions := kv.entries[key]
+	if len(revisions) == 0 {
+		return nil, nats.ErrKeyNotFound
+	}
+	history := make([]nats.KeyValueEntry, 0, len(revisions))
+	for _, entry := range revisions {
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+func (kv *MemoryKeyValue) Bucket() string {
+	return kv.bucket
+}
+
+func (kv *MemoryKeyValue) PurgeDeletes(opts ...nats.PurgeOpt) error {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	for key := range kv.entries {
+		if entry := kv.latest(key); entry != nil && entry.op != nats.KeyValuePut {
+			delete(kv.entries, key)
+		}
+	}
+	return nil
+}
+
+func (kv *MemoryKeyValue) Status() (nats.KeyValueStatus, error) {
+	kv.mutex.Lock()
+	defer kv.mutex.Unlock()
+	status := &memoryKeyValueStatus{bucket: kv.bucket, history: int64(kv.history), ttl: kv.ttl}
+	for _, revisions := range kv.entries {
+		for _, entry := range revisions {
+			status.values++
+			status.bytes += uint64(len(entry.key) + len(entry.value))
+		}
+	}
+	return status, nil
+}
+
+type memoryKeyValueStatus struct {
+	bucket  string
+	values  uint64
+	history int64
+	ttl     time.Duration
+	bytes   uint64
+}
+
+func (s *memoryKeyValueStatus) Bucket() string       { return s.bucket }
+func (s *memoryKeyValueStatus) Values() uint64       { return s.values }
+func (s *memoryKeyValueStatus) History() int64       { return s.history }
+func (s *memoryKeyValueStatus) TTL() time.Duration   { return s.ttl }
+func (s *memoryKeyValueStatus) BackingStore() string { return memoryBackingStore }
+func (s *memoryKeyValueStatus) Bytes() uint64        { return s.bytes }
+func (s *memoryKeyValueStatus) IsCompressed() bool   { return false }
+
+type memoryKeyLister struct {
+	keys chan string
+}
+
+func (l *memoryKeyLister) Keys() <-chan string { return l.keys }
+func (l *memoryKeyLister) Stop() error         { return nil }
+
+// memoryWatcher queues entries without a limit, so writers never block on slow watchers
+type memoryWatcher struct {
+	pattern       string
+	ignoreDeletes bool
+	ctx           context.Context
+	cancel        context.CancelFunc
+	updates       chan nats.KeyValueEntry
+	onStop        func()
+
+	mutex  sync.Mutex
+	queue  []nats.KeyValueEntry
+	notify chan struct{}
+}
+
+func newMemoryWatcher(ctx context.Context, pattern string, ignoreDeletes bool) *memoryWatcher {
+	w := &memoryWatcher{
+		pattern:       pattern,
+		ignoreDeletes: ignoreDeletes,
+		updates:       make(chan nats.KeyValueEntry),
+		notify:        make(chan struct{}, 1),
+	}
+	w.ctx, w.cancel = context.WithCancel(ctx)
+	return w
+}
+
+func (w *memoryWatcher) matches(entry *memoryEntry) bool {
+	if w.ignoreDeletes && entry.op != nats.KeyValuePut {
+		return false
+	}
+	return subjectMatches(w.pattern, entry.key)
+}
+
+func (w *memoryWatcher) push(entry *memoryEntry) {
+	w.mutex.Lock()
+	if entry == nil {
+		w.queue = append(w.queue, nil)
+	} else {
+		w.queue = append(w.queue, entry)
+	}
+	w.mutex.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (w *memoryWatcher) run() {
+	defer close(w.updates)
+	defer w.onStop()
+	for {
+		w.mutex.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mutex.Unlock()
+
+		for _, entry := range queue {
+			select {
+			case w.updates <- entry:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-w.notify:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *memoryWatcher) Context() context.Context           { return w.ctx }
+func (w *memoryWatcher) Updates() <-chan nats.KeyValueEntry { return w.updates }
+
+func (w *memoryWatcher) Stop() error {
+	w.cancel()
+	return nil
+}
+
+// subjectMatches matches "."-separated tokens of the key, "*" matches one token, ">" matches one or more tail tokens
+func subjectMatches(pattern string, key string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	keyTokens := strings.Split(key, ".")
+	for i, pt := range patternTokens {
+		if pt == ">" {
+			return len(keyTokens) > i
+		}
+		if i >= len(keyTokens) || (pt != "*" && pt != keyTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(keyTokens)
+}
+
+// applyNatsOption applies a nats.go option function to a new struct of the options it configures
+func applyNatsOption(opt any) (reflect.Value, error) {
+	fn := reflect.ValueOf(opt)
+	if fn.Kind() != reflect.Func || fn.Type().NumIn() != 1 || fn.Type().In(0).Kind() != reflect.Ptr {
+		return reflect.Value{}, fmt.Errorf("option %T is not supported by MemoryKeyValue", opt)
+	}
+	o := reflect.New(fn.Type().In(0).Elem())
+	if out := fn.Call([]reflect.Value{o}); len(out) == 1 && !out[0].IsNil() {
+		return reflect.Value{}, out[0].Interface().(error)
+	}
+	return o.Elem(), nil
+}
+
+// sameNatsOption tells whether the applied option configures the same as the known one
+func sameNatsOption(applied reflect.Value, known any) bool {
+	k, err := applyNatsOption(known)
+	return err == nil && k.Type() == applied.Type() && reflect.DeepEqual(k.Interface(), applied.Interface())
+}
+
+// memoryDeleteOptions returns the revision expected by nats.LastRevision, 0 - none
+func memoryDeleteOptions(opts []nats.DeleteOpt) (uint64, error) {
+	lastRevision := uint64(0)
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		o, err := applyNatsOption(opt)
+		if err != nil {
+			return 0, err
+		}
+		matched := false
+		for i := 0; i < o.NumField() && !matched; i++ {
+			if field := o.Field(i); field.Kind() == reflect.Uint64 && field.Uint() > 0 && sameNatsOption(o, nats.LastRevision(field.Uint())) {
+				lastRevision, matched = field.Uint(), true
+			}
+		}
+		if !matched {
+			return 0, fmt.Errorf("delete option %T is not supported by MemoryKeyValue", opt)
+		}
+	}
+	return lastRevision, nil
+}
+
+type memoryWatchOpts struct {
+	ctx            context.Context
+	ignoreDeletes  bool
+	includeHistory bool
+	updatesOnly    bool
+}
+
+func memoryWatchOptions(opts []nats.WatchOpt) (memoryWatchOpts, error) {
+	o := memoryWatchOpts{ctx: context.Background()}
+	for _, opt := range opts {
+		if opt == nil {
+			continue
+		}
+		if ctxOpt, ok := opt.(nats.ContextOpt); ok {
+			o.ctx = ctxOpt.Context
+			continue
+		}
+		applied, err := applyNatsOption(opt)
+		if err != nil {
+			return o, err
+		}
+		switch {
+		case sameNatsOption(applied, nats.IgnoreDeletes()):
+			o.ignoreDeletes = true
+		case sameNatsOption(applied, nats.IncludeHistory()):
+			o.includeHistory = true
+		case sameNatsOption(applied, nats.UpdatesOnly()):
+			o.updatesOnly = true
+		default:
+			return o, fmt.Errorf("watch option %T is not supported by MemoryKeyValue", opt)
+		}
+	}
+	return o, nil
+}
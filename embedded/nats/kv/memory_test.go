@@ -0,0 +1,51 @@
+package kv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryKeyValueOptions(t *testing.T) {
+	m, err := NewMemoryKeyValue(&nats.KeyValueConfig{Bucket: "test", History: 5})
+	require.NoError(t, err)
+
+	revision, err := m.Put("a.b", []byte("1"))
+	require.NoError(t, err)
+	require.ErrorIs(t, m.Delete("a.b", nats.LastRevision(revision+1)), nats.ErrKeyExists)
+	require.NoError(t, m.Delete("a.b", nats.LastRevision(revision)))
+	_, err = KVGet(nil, m, "a.b")
+	require.ErrorIs(t, err, nats.ErrKeyNotFound)
+
+	_, err = KVPut(nil, m, "a.c", []byte("2"))
+	require.NoError(t, err)
+	w, err := m.Watch("a.*", nats.IgnoreDeletes(), nats.IncludeHistory(), nats.Context(context.Background()))
+	require.NoError(t, err)
+	defer w.Stop()
+	seen := []string{}
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		seen = append(seen, entry.Key()+"="+string(entry.Value()))
+	}
+	require.Equal(t, []string{"a.b=1", "a.c=2"}, seen, "history without the delete marker")
+
+	updates, err := m.Watch("a.*", nats.UpdatesOnly())
+	require.NoError(t, err)
+	defer updates.Stop()
+	_, err = m.Put("a.d", []byte("3"))
+	require.NoError(t, err)
+	select {
+	case entry := <-updates.Updates():
+		require.Equal(t, "a.d", entry.Key())
+	case <-time.After(time.Second):
+		t.Fatal("no update")
+	}
+
+	_, err = m.Watch("a.*", nats.MetaOnly())
+	require.Error(t, err, "unsupported options are rejected, not ignored")
+}
@@ -0,0 +1,130 @@
+// Foliage state package.
+// Provides stateful functions for administration of versioned function states and of stored state history
+package state
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfMediators "github.com/foliagecp/sdk/statefun/mediator"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func RegisterAllFunctionTypes(runtime *statefun.Runtime) {
+	statefun.NewFunctionType(runtime, "functions.state.migrate_all", MigrateAll(runtime), *statefun.NewFunctionTypeConfig().SetAllowedRequestProviders(sfPlugins.AutoRequestSelect))
+	statefun.NewFunctionType(runtime, "functions.state.restore_at", RestoreAt, *statefun.NewFunctionTypeConfig().SetAllowedRequestProviders(sfPlugins.AutoRequestSelect))
+}
+
+/*
+Eagerly migrates stored contexts of function types registered in the runtime which handled the request to their
+current state versions (see FunctionTypeConfig.SetStateVersion). Every id with a stored context is signaled and is
+migrated by its worker, so migrations are done once the signals are handled.
+
+Request:
+
+	payload: json
+		typename: string - optional // All function types with a state version if omitted
+
+Reply:
+
+	payload: json
+		status: string
+		details: string
+		data: json
+			reports: json array // [{"typename": string, "version": int, "signaled": int, "failed": int}, ...]
+*/
+func MigrateAll(runtime *statefun.Runtime) statefun.FunctionLogicHandler {
+	return func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		om := sfMediators.NewOpMediator(ctx)
+
+		typenames := runtime.StateVersionedFunctionTypes()
+		if typename, ok := ctx.Payload.GetByPath("typename").AsString(); ok {
+			typenames = []string{typename}
+		}
+
+		reports := []statefun.StateMigrationReport{}
+		failed := false
+		for _, typename := range typenames {
+			report, err := runtime.MigrateAllStates(typename)
+			if err != nil {
+				om.AggregateOpMsg(sfMediators.OpMsgFailed(err.Error())).Reply()
+				return
+			}
+			failed = failed || report.Failed > 0
+			reports = append(reports, report)
+		}
+
+		bytes, err := json.Marshal(map[string]any{"reports": reports})
+		if err != nil {
+			om.AggregateOpMsg(sfMediators.OpMsgFailed(err.Error())).Reply()
+			return
+		}
+		data, _ := easyjson.JSONFromBytes(bytes)
+		if failed {
+			om.AggregateOpMsg(sfMediators.MakeOpMsg(sfMediators.SYNC_OP_STATUS_INCOMPLETE, "some ids failed to be signaled", "", data)).Reply()
+			return
+		}
+		om.AggregateOpMsg(sfMediators.OpMsgOk(data)).Reply()
+	}
+}
+
+/*
+Rolls cache keys back to their values at the given moment using the KV bucket history (see RuntimeConfig.SetKVHistory).
+For e.g. a vertex and all its links are restored with patterns ["hub/vertex_id", "hub/vertex_id.>"].
+
+Request:
+
+	payload: json
+		patterns: []string // Cache key patterns, "*" and ">" tokens are supported
+		time: int // Unix time in nanoseconds
+
+Reply:
+
+	payload: json
+		status: string
+		details: string
+		data: json
+			reports: json // {"<pattern>": {"restored": int, "deleted": int, "unknown": []string}, ...}
+*/
+func RestoreAt(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+	om := sfMediators.NewOpMediator(ctx)
+
+	patterns, ok := ctx.Payload.GetByPath("patterns").AsArrayString()
+	if !ok || len(patterns) == 0 {
+		om.AggregateOpMsg(sfMediators.OpMsgFailed("patterns are required")).Reply()
+		return
+	}
+	at, ok := ctx.Payload.GetByPath("time").AsNumeric()
+	if !ok {
+		om.AggregateOpMsg(sfMediators.OpMsgFailed("time is required")).Reply()
+		return
+	}
+
+	reports := map[string]cache.RestoreAtReport{}
+	unknown := false
+	for _, pattern := range patterns {
+		report, err := ctx.Domain.Cache().RestoreKeysAt(pattern, time.Unix(0, int64(at)))
+		if err != nil {
+			om.AggregateOpMsg(sfMediators.OpMsgFailed(err.Error())).Reply()
+			return
+		}
+		unknown = unknown || len(report.Unknown) > 0
+		reports[pattern] = report
+	}
+
+	bytes, err := json.Marshal(map[string]any{"reports": reports})
+	if err != nil {
+		om.AggregateOpMsg(sfMediators.OpMsgFailed(err.Error())).Reply()
+		return
+	}
+	data, _ := easyjson.JSONFromBytes(bytes)
+	if unknown {
+		om.AggregateOpMsg(sfMediators.MakeOpMsg(sfMediators.SYNC_OP_STATUS_INCOMPLETE, "history does not reach the time for some keys", "", data)).Reply()
+		return
+	}
+	om.AggregateOpMsg(sfMediators.OpMsgOk(data)).Reply()
+}
@@ -0,0 +1,463 @@
+package cache
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	customNatsKv "github.com/foliagecp/sdk/embedded/nats/kv"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Backup archive is a gzip compressed tar:
+
+	manifest.json  -> BackupManifest, always the first entry
+	kv/<key>       -> raw KV value of "<kv_store_prefix>.<key>" (8 bytes update time + append flag + value)
+
+Values are archived with their update time, so restored values are ordered correctly against values cached by
+running stores. Delete markers are not archived.
+
+A coordinated backup barrier engages every store of the bucket: each store announces itself under
+BackupBarrierMembersKeyPrefix, syncs all values written before the barrier timestamp to KV and acknowledges that
+under BackupBarrierAcksKeyPrefix. When all announced stores acknowledged, the coordinator locks the barrier, values
+newer than the barrier timestamp are held in the caches until the barrier is released. A store removes its keys when
+it stops, keys of stores which stopped without that are purged by the coordinator once they are not announced within
+BackupMemberAliveInterval.
+
+cmd/kvbackup backs up and restores buckets from the command line.
+*/
+
+const (
+	BackupFormatVersion       = 1
+	BackupManifestName        = "manifest.json"
+	BackupEntriesDir          = "kv/"
+	BackupBarrierTimeout      = 2 * time.Minute
+	BackupMemberAliveInterval = 3 * BackupBarrierCheckInterval
+
+	backupBarrierPollInterval = 250 * time.Millisecond
+)
+
+type BackupConflictPolicy int
+
+const (
+	// RestoreSkipExisting keeps values which already exist in the bucket
+	RestoreSkipExisting BackupConflictPolicy = iota
+	// RestoreOverwrite replaces existing values with archived ones
+	RestoreOverwrite
+	// RestoreKeepNewer replaces existing values only if the archived one was updated later
+	RestoreKeepNewer
+	// RestoreFailOnConflict stops the restore on the first existing value, values restored before it stay
+	RestoreFailOnConflict
+)
+
+type BackupManifest struct {
+	FormatVersion    int      `json:"format_version"`
+	Bucket           string   `json:"bucket"`
+	KVStorePrefix    string   `json:"kv_store_prefix"`
+	BarrierTimestamp int64    `json:"barrier_timestamp"`
+	CreatedAt        int64    `json:"created_at"`
+	Keys             int      `json:"keys"`
+	Members          []string `json:"members"`
+}
+
+type RestoreReport struct {
+	Restored int `json:"restored"`
+	Skipped  int `json:"skipped"`
+}
+
+type BackupConfig struct {
+	kvStorePrefix    string
+	barrierTimeout   time.Duration
+	compressionLevel int
+}
+
+func NewBackupConfig() *BackupConfig {
+	return &BackupConfig{
+		kvStorePrefix:    KVStorePrefix,
+		barrierTimeout:   BackupBarrierTimeout,
+		compressionLevel: gzip.DefaultCompression,
+	}
+}
+
+func (bc *BackupConfig) SetKVStorePrefix(kvStorePrefix string) *BackupConfig {
+	bc.kvStorePrefix = kvStorePrefix
+	return bc
+}
+
+// SetBarrierTimeout sets how long to wait for all stores to acknowledge the write barrier
+func (bc *BackupConfig) SetBarrierTimeout(barrierTimeout time.Duration) *BackupConfig {
+	bc.barrierTimeout = barrierTimeout
+	return bc
+}
+
+func (bc *BackupConfig) SetCompressionLevel(compressionLevel int) *BackupConfig {
+	bc.compressionLevel = compressionLevel
+	return bc
+}
+
+type RestoreConfig struct {
+	kvStorePrefix  string
+	conflictPolicy BackupConflictPolicy
+}
+
+// NewRestoreConfig returns a config which restores into the kv store prefix the archive was made from
+func NewRestoreConfig() *RestoreConfig {
+	return &RestoreConfig{
+		kvStorePrefix:  "",
+		conflictPolicy: RestoreSkipExisting,
+	}
+}
+
+func (rc *RestoreConfig) SetKVStorePrefix(kvStorePrefix string) *RestoreConfig {
+	rc.kvStorePrefix = kvStorePrefix
+	return rc
+}
+
+func (rc *RestoreConfig) SetConflictPolicy(conflictPolicy BackupConflictPolicy) *RestoreConfig {
+	rc.conflictPolicy = conflictPolicy
+	return rc
+}
+
+// Backup makes a backup of the store's bucket, see Backup
+func (cs *Store) Backup(ctx context.Context, w io.Writer, backupConfig *BackupConfig) (*BackupManifest, error) {
+	return Backup(ctx, cs.js, cs.kv, w, backupConfig.SetKVStorePrefix(cs.cacheConfig.kvStorePrefix))
+}
+
+// Backup engages the write barrier on all stores working with the bucket, writes every value under the kv store
+// prefix into w as a compressed archive and releases the barrier.
+func Backup(ctx context.Context, js nats.JetStreamContext, kv nats.KeyValue, w io.Writer, backupConfig *BackupConfig) (*BackupManifest, error) {
+	barrierTimestamp, members, err := EngageBackupBarrier(ctx, js, kv, backupConfig.barrierTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		system.MsgOnErrorReturn(ReleaseBackupBarrier(js, kv))
+	}()
+
+	keysCount := 0
+	if err := walkBackupValues(kv, backupConfig.kvStorePrefix, func(key string, value []byte) error {
+		keysCount++
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{
+		FormatVersion:    BackupFormatVersion,
+		Bucket:           kv.Bucket(),
+		KVStorePrefix:    backupConfig.kvStorePrefix,
+		BarrierTimestamp: barrierTimestamp,
+		CreatedAt:        system.GetCurrentTimeNs(),
+		Keys:             keysCount,
+		Members:          members,
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	gzw, err := gzip.NewWriterLevel(w, backupConfig.compressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(gzw)
+	if err := writeBackupEntry(tw, BackupManifestName, manifestBytes, time.Unix(0, manifest.CreatedAt)); err != nil {
+		return nil, err
+	}
+
+	written := 0
+	if err := walkBackupValues(kv, backupConfig.kvStorePrefix, func(key string, value []byte) error {
+		written++
+		return writeBackupEntry(tw, BackupEntriesDir+key, value, time.Unix(0, int64(binary.BigEndian.Uint64(value[:8]))))
+	}); err != nil {
+		return nil, err
+	}
+	if written != keysCount {
+		return nil, fmt.Errorf("bucket %s changed during backup: %d keys expected, %d written", kv.Bucket(), keysCount, written)
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+
+	lg.Logf(lg.InfoLevel, "Backup of %s is done: keys=%d, barrier_timestamp=%d, stores=%d", kv.Bucket(), keysCount, barrierTimestamp, len(members))
+	return manifest, nil
+}
+
+// Restore writes values from a backup archive into the bucket. The bucket may be empty or already contain values,
+// existing values are handled according to the conflict policy.
+func Restore(ctx context.Context, js nats.JetStreamContext, kv nats.KeyValue, r io.Reader, restoreConfig *RestoreConfig) (*BackupManifest, RestoreReport, error) {
+	report := RestoreReport{}
+
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, report, fmt.Errorf("backup archive is not gzip compressed: %w", err)
+	}
+	defer gzr.Close()
+	tr := tar.NewReader(gzr)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != BackupManifestName {
+		return nil, report, fmt.Errorf("backup archive must start with %s", BackupManifestName)
+	}
+	manifest := &BackupManifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, report, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+	if manifest.FormatVersion != BackupFormatVersion {
+		return manifest, report, fmt.Errorf("unsupported backup format version %d", manifest.FormatVersion)
+	}
+
+	kvStorePrefix := restoreConfig.kvStorePrefix
+	if len(kvStorePrefix) == 0 {
+		kvStorePrefix = manifest.KVStorePrefix
+	}
+
+	entries := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return manifest, report, err
+		}
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return manifest, report, err
+		}
+		if !strings.HasPrefix(header.Name, BackupEntriesDir) {
+			continue
+		}
+		entries++
+
+		value, err := io.ReadAll(tr)
+		if err != nil {
+			return manifest, report, err
+		}
+		if len(value) < 9 {
+			return manifest, report, fmt.Errorf("backup entry %s has no update time", header.Name)
+		}
+		storeKey := kvStorePrefix + "." + strings.TrimPrefix(header.Name, BackupEntriesDir)
+
+		restore, err := restoreNeeded(js, kv, storeKey, value, restoreConfig.conflictPolicy)
+		if err != nil {
+			return manifest, report, err
+		}
+		if !restore {
+			report.Skipped++
+			continue
+		}
+		if _, err := customNatsKv.KVPut(js, kv, storeKey, value); err != nil {
+			return manifest, report, fmt.Errorf("cannot restore %s: %w", storeKey, err)
+		}
+		report.Restored++
+	}
+
+	if entries != manifest.Keys {
+		return manifest, report, fmt.Errorf("backup archive is truncated: %d keys expected, %d found", manifest.Keys, entries)
+	}
+
+	lg.Logf(lg.InfoLevel, "Restore into %s is done: restored=%d, skipped=%d", kv.Bucket(), report.Restored, report.Skipped)
+	return manifest, report, nil
+}
+
+// EngageBackupBarrier locks writes newer than the returned barrier timestamp on every alive store of the bucket.
+// Returns ids of stores which acknowledged the barrier.
+func EngageBackupBarrier(ctx context.Context, js nats.JetStreamContext, kv nats.KeyValue, timeout time.Duration) (int64, []string, error) {
+	members, err := aliveBackupMembers(kv)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Stores read the barrier timestamp from JSON as float64, acknowledgements must match it exactly
+	barrierTimestamp := int64(float64(system.GetCurrentTimeNs()))
+	if err := putCoordinatedBackupBarrier(js, kv, BackupBarrierStatusLocking, barrierTimestamp); err != nil {
+		return 0, nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		pending := []string{}
+		for _, member := range members {
+			if !backupMemberAcked(js, kv, member, barrierTimestamp) {
+				pending = append(pending, member)
+			}
+		}
+		if len(pending) > 0 {
+			// Stores stopped since the barrier was engaged will never acknowledge it
+			alive, err := aliveBackupMembers(kv)
+			if err == nil {
+				pending = intersectStrings(pending, alive)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			system.MsgOnErrorReturn(ReleaseBackupBarrier(js, kv))
+			return 0, nil, fmt.Errorf("backup barrier was not acknowledged by stores %v within %s", pending, timeout)
+		}
+		select {
+		case <-ctx.Done():
+			system.MsgOnErrorReturn(ReleaseBackupBarrier(js, kv))
+			return 0, nil, ctx.Err()
+		case <-time.After(backupBarrierPollInterval):
+		}
+	}
+
+	if err := putCoordinatedBackupBarrier(js, kv, BackupBarrierStatusLocked, barrierTimestamp); err != nil {
+		system.MsgOnErrorReturn(ReleaseBackupBarrier(js, kv))
+		return 0, nil, err
+	}
+	return barrierTimestamp, members, nil
+}
+
+// ReleaseBackupBarrier unlocks writes on all stores of the bucket
+func ReleaseBackupBarrier(js nats.JetStreamContext, kv nats.KeyValue) error {
+	barrier := easyjson.NewJSONObject()
+	barrier.SetByPath("status", easyjson.NewJSON(BackupBarrierStatusUnlocked))
+	barrier.SetByPath("barrier_timestamp", easyjson.NewJSON(0))
+	_, err := customNatsKv.KVPut(js, kv, BackupBarrierLockKey, barrier.ToBytes())
+	return err
+}
+
+func putCoordinatedBackupBarrier(js nats.JetStreamContext, kv nats.KeyValue, status int, barrierTimestamp int64) error {
+	barrier := easyjson.NewJSONObject()
+	barrier.SetByPath("status", easyjson.NewJSON(status))
+	barrier.SetByPath("barrier_timestamp", easyjson.NewJSON(barrierTimestamp))
+	barrier.SetByPath("set_by", easyjson.NewJSON("backup"))
+	barrier.SetByPath("coordinated", easyjson.NewJSON(true))
+	_, err := customNatsKv.KVPut(js, kv, BackupBarrierLockKey, barrier.ToBytes())
+	return err
+}
+
+func backupMemberAcked(js nats.JetStreamContext, kv nats.KeyValue, member string, barrierTimestamp int64) bool {
+	entry, err := customNatsKv.KVGet(js, kv, BackupBarrierAcksKeyPrefix+"."+member)
+	if err != nil {
+		return false
+	}
+	ack, ok := easyjson.JSONFromBytes(entry.Value())
+	return ok && int64(ack.GetByPath("barrier_timestamp").AsNumericDefault(0)) == barrierTimestamp
+}
+
+// aliveBackupMembers returns ids of stores which announced themselves recently, keys of stale stores are purged
+func aliveBackupMembers(kv nats.KeyValue) ([]string, error) {
+	members := []string{}
+	stale := []string{}
+	aliveSince := system.GetCurrentTimeNs() - BackupMemberAliveInterval.Nanoseconds()
+	err := walkKVValues(kv, BackupBarrierMembersKeyPrefix+".*", func(key string, value []byte) error {
+		memberID := strings.TrimPrefix(key, BackupBarrierMembersKeyPrefix+".")
+		if member, ok := easyjson.JSONFromBytes(value); ok && int64(member.GetByPath("announced_at").AsNumericDefault(0)) >= aliveSince {
+			members = append(members, memberID)
+		} else {
+			stale = append(stale, memberID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, memberID := range stale {
+		system.MsgOnErrorReturn(kv.Purge(BackupBarrierMembersKeyPrefix + "." + memberID))
+		system.MsgOnErrorReturn(kv.Purge(BackupBarrierAcksKeyPrefix + "." + memberID))
+	}
+	return members, nil
+}
+
+// walkBackupValues calls f for every value under the kv store prefix except delete markers, key is without the prefix
+func walkBackupValues(kv nats.KeyValue, kvStorePrefix string, f func(key string, value []byte) error) error {
+	return walkKVValues(kv, kvStorePrefix+".>", func(key string, value []byte) error {
+		if len(value) < 9 || value[8] == 0 {
+			return nil
+		}
+		return f(strings.TrimPrefix(key, kvStorePrefix+"."), value)
+	})
+}
+
+func walkKVValues(kv nats.KeyValue, keysFilter string, f func(key string, value []byte) error) error {
+	w, err := kv.Watch(keysFilter, nats.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		system.MsgOnErrorReturn(w.Stop())
+	}()
+	for entry := range w.Updates() {
+		if entry == nil { // All current values are received
+			return nil
+		}
+		if err := f(entry.Key(), entry.Value()); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("watcher of %s was stopped", keysFilter)
+}
+
+func writeBackupEntry(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func restoreNeeded(js nats.JetStreamContext, kv nats.KeyValue, storeKey string, value []byte, conflictPolicy BackupConflictPolicy) (bool, error) {
+	entry, err := customNatsKv.KVGet(js, kv, storeKey)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return true, nil
+		}
+		return false, err
+	}
+	existing := entry.Value()
+	if len(existing) < 9 || existing[8] == 0 {
+		return true, nil // Only a delete marker exists
+	}
+
+	switch conflictPolicy {
+	case RestoreOverwrite:
+		return true, nil
+	case RestoreKeepNewer:
+		return binary.BigEndian.Uint64(value[:8]) > binary.BigEndian.Uint64(existing[:8]), nil
+	case RestoreFailOnConflict:
+		return false, fmt.Errorf("key %s already exists in bucket %s", storeKey, kv.Bucket())
+	default:
+		return false, nil
+	}
+}
+
+func intersectStrings(a []string, b []string) []string {
+	in := map[string]struct{}{}
+	for _, s := range b {
+		in[s] = struct{}{}
+	}
+	res := []string{}
+	for _, s := range a {
+		if _, ok := in[s]; ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupMemberKeysAreRemoved(t *testing.T) {
+	cs, memoryKV := startMemoryTestStore(t, NewCacheConfig("test"), 1)
+	memberKey := BackupBarrierMembersKeyPrefix + "." + cs.backupMemberID
+	ackKey := BackupBarrierAcksKeyPrefix + "." + cs.backupMemberID
+	exists := func(key string) bool {
+		_, err := memoryKV.Get(key)
+		return !errors.Is(err, nats.ErrKeyNotFound)
+	}
+	require.Eventually(t, func() bool { return exists(memberKey) }, 5*time.Second, time.Millisecond)
+	cs.ackCoordinatedBackupBarrier(1)
+	require.True(t, exists(ackKey))
+
+	// Store which stopped without removing its keys
+	stale := easyjson.NewJSONObjectWithKeyValue("announced_at", easyjson.NewJSON(time.Now().Add(-2*BackupMemberAliveInterval).UnixNano()))
+	_, err := memoryKV.Put(BackupBarrierMembersKeyPrefix+".stale", stale.ToBytes())
+	require.NoError(t, err)
+	_, err = memoryKV.Put(BackupBarrierAcksKeyPrefix+".stale", []byte(`{"barrier_timestamp":1}`))
+	require.NoError(t, err)
+
+	members, err := aliveBackupMembers(memoryKV)
+	require.NoError(t, err)
+	require.Equal(t, []string{cs.backupMemberID}, members)
+	require.False(t, exists(BackupBarrierMembersKeyPrefix+".stale"))
+	require.False(t, exists(BackupBarrierAcksKeyPrefix+".stale"))
+
+	cs.Destroy()
+	require.Eventually(t, func() bool { return !exists(memberKey) && !exists(ackKey) }, 5*time.Second, time.Millisecond)
+}
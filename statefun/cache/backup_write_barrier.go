@@ -19,6 +19,10 @@ const (
 	BackupBarrierStatusLocked   = 2
 
 	BackupBarrierCheckInterval = 5 * time.Second
+
+	// Every store announces itself and acknowledges a coordinated barrier under these keys (see backup.go)
+	BackupBarrierMembersKeyPrefix = "__backup_members_"
+	BackupBarrierAcksKeyPrefix    = "__backup_acks_"
 )
 
 func (cs *Store) getBackupBarrierInfo() (*easyjson.JSON, error) {
@@ -74,6 +78,7 @@ func (cs *Store) refreshBackupBarrierFromKV() {
 	barrierTs := int64(barrier.GetByPath("barrier_timestamp").AsNumericDefault(0))
 	status := int32(barrier.GetByPath("status").AsNumericDefault(BackupBarrierStatusUnlocked))
 
+	cs.backupBarrierCoordinated.Store(barrier.GetByPath("coordinated").AsBoolDefault(false))
 	cs.updateBackupBarrier(status, barrierTs)
 }
 
@@ -97,6 +102,11 @@ func (cs *Store) updateBackupBarrier(status int32, timestamp int64) {
 
 func (cs *Store) markCacheReadyForBackup() {
 	backupBarrierTimestamp := atomic.LoadInt64(&cs.backupBarrierTimestamp)
+	if cs.backupBarrierCoordinated.Load() {
+		// Coordinator locks the barrier by itself when every store of the domain is ready
+		cs.ackCoordinatedBackupBarrier(backupBarrierTimestamp)
+		return
+	}
 	cs.updateBackupBarrier(BackupBarrierStatusLocked, backupBarrierTimestamp)
 
 	barrier := easyjson.NewJSONObject()
@@ -120,3 +130,36 @@ func (cs *Store) updateBackupBarrierWithTimestamp(timestamp int64) error {
 
 	return nil
 }
+
+func (cs *Store) ackCoordinatedBackupBarrier(timestamp int64) {
+	if atomic.LoadInt64(&cs.backupBarrierAckedTimestamp) == timestamp {
+		return
+	}
+	ack := easyjson.NewJSONObject()
+	ack.SetByPath("barrier_timestamp", easyjson.NewJSON(timestamp))
+	if _, err := customNatsKv.KVPut(cs.js, cs.kv, BackupBarrierAcksKeyPrefix+"."+cs.backupMemberID, ack.ToBytes()); err != nil {
+		system.MsgOnErrorReturn(err)
+		return
+	}
+	atomic.StoreInt64(&cs.backupBarrierAckedTimestamp, timestamp)
+}
+
+// announceBackupMember lets a backup coordinator know that this store is alive and must acknowledge the barrier
+func (cs *Store) announceBackupMember() {
+	now := system.GetCurrentTimeNs()
+	if now-atomic.LoadInt64(&cs.backupMemberLastAnnounced) < BackupBarrierCheckInterval.Nanoseconds() {
+		return
+	}
+	member := easyjson.NewJSONObject()
+	member.SetByPath("announced_at", easyjson.NewJSON(now))
+	if _, err := customNatsKv.KVPut(cs.js, cs.kv, BackupBarrierMembersKeyPrefix+"."+cs.backupMemberID, member.ToBytes()); err == nil {
+		atomic.StoreInt64(&cs.backupMemberLastAnnounced, now)
+	}
+}
+
+// leaveBackupBarrier removes the member and the acknowledgement keys of the store when it stops
+func (cs *Store) leaveBackupBarrier() {
+	for _, key := range []string{BackupBarrierMembersKeyPrefix + "." + cs.backupMemberID, BackupBarrierAcksKeyPrefix + "." + cs.backupMemberID} {
+		system.MsgOnErrorReturn(cs.kv.Purge(key))
+	}
+}
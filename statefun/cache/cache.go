@@ -271,11 +271,17 @@ type Store struct {
 	transactions                sync.Map
 	transactionsMutex           *sync.Mutex
 	getKeysByPatternFromKVMutex *sync.Mutex
+	kvHistory                   int
 
 	//write barrier state
 	backupBarrierTimestamp   int64
 	backupBarrierStatus      int32 // 0=unlocked, 1=locking, 2=locked
 	backupBarrierLastChecked int64
+
+	backupBarrierCoordinated    atomic.Bool
+	backupBarrierAckedTimestamp int64
+	backupMemberID              string
+	backupMemberLastAnnounced   int64
 }
 
 func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamContext, kv nats.KeyValue) *Store {
@@ -305,10 +311,16 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 		backupBarrierTimestamp:   0,
 		backupBarrierStatus:      BackupBarrierStatusUnlocked,
 		backupBarrierLastChecked: 0,
+		backupMemberID:           system.GetUniqueStrID(),
 	}
 
 	cs.ctx, cs.cancel = context.WithCancel(ctx)
 
+	cs.kvHistory = 1
+	if status, err := kv.Status(); err == nil {
+		cs.kvHistory = int(status.History())
+	}
+
 	system.MsgOnErrorReturn(cs.clearBackupBarrier())
 
 	storeUpdatesHandler := func(cs *Store) {
@@ -325,19 +337,20 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 						key := cs.fromStoreKey(entry.Key())
 						valueBytes := entry.Value()
 						if len(valueBytes) >= 9 { // Update or delete signal from KV store
-							appendFlag := valueBytes[8]
-							kvRecordTime := int64(binary.BigEndian.Uint64(valueBytes[:8]))
+							kvRecordTime, appendFlag, value, decodeErr := cs.decodeKVValue(key, valueBytes)
 
 							cacheRecordTime := cs.GetValueUpdateTime(key)
 							if kvRecordTime > cacheRecordTime {
-								if appendFlag == 1 {
+								if decodeErr != nil {
+									lg.Logf(lg.ErrorLevel, "storeUpdatesHandler: %s", decodeErr)
+								} else if appendFlag == 1 {
 									//lg.Logf("---CACHE_KV TF UPDATE: %s, %d, %d", key, kvRecordTime, appendFlag)
-									cs.SetValue(key, valueBytes[9:], false, kvRecordTime, "")
+									cs.SetValue(key, value, false, kvRecordTime, "")
 								} else { // Someone else (other module) deleted a key from the cache
 									//lg.Logf("---CACHE_KV TF DELETE: %s, %d, %d", key, kvRecordTime, appendFlag)
 
 									//system.MsgOnErrorReturn(kv.Delete(entry.Key()))
-									system.MsgOnErrorReturn(customNatsKv.KVDelete(cs.js, cs.kv, entry.Key()))
+									system.MsgOnErrorReturn(cs.deleteFromKV(entry.Key()))
 
 									//cs.rootValue.purgeReady
 									//if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
@@ -347,7 +360,7 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 							} else if kvRecordTime == cacheRecordTime { // KV confirmes update
 								if appendFlag == 0 {
 									//system.MsgOnErrorReturn(kv.Delete(entry.Key()))
-									system.MsgOnErrorReturn(customNatsKv.KVDelete(cs.js, cs.kv, entry.Key()))
+									system.MsgOnErrorReturn(cs.deleteFromKV(entry.Key()))
 								}
 								if csv := cs.getLastKeyCacheStoreValue(key); csv != nil {
 									csv.Lock("storeUpdatesHandler")
@@ -389,7 +402,10 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 		for {
 			select {
 			case <-cs.ctx.Done():
+				cs.leaveBackupBarrier()
+				return
 			default:
+				cs.announceBackupMember()
 				backupBarrierTimestamp, backupBarrierStatus := cs.getBackupBarrierState()
 				if backupBarrierStatus == BackupBarrierStatusLocking {
 					if backupBarrierTimestamp == 0 {
@@ -446,21 +462,21 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 						}
 
 						var valueUpdateTime int64 = 0
+						var encodeErr error = nil
 						csvChild.Lock("kvLazyWriter")
 						if csvChild.syncNeeded {
 							valueUpdateTime = csvChild.valueUpdateTime
-							timeBytes := make([]byte, 8)
-							binary.BigEndian.PutUint64(timeBytes, uint64(csvChild.valueUpdateTime))
 							if csvChild.valueExists {
-								header := append(timeBytes, 1) // Add append flag "1"
-								finalBytes = append(header, csvChild.value.([]byte)...)
+								finalBytes, encodeErr = cs.encodeKVValue(newSuffix, csvChild.valueUpdateTime, csvChild.value.([]byte))
 							} else {
+								timeBytes := make([]byte, 8)
+								binary.BigEndian.PutUint64(timeBytes, uint64(csvChild.valueUpdateTime))
 								finalBytes = append(timeBytes, 0) // Add delete flag "0"
 							}
 						} else {
 							if csvChild.valueUpdateTime > 0 && csvChild.valueUpdateTime <= cs.lruTresholdTime && csvChild.purgeState == 0 { // Older than or equal to specific time
 								// currentStoreValue locked by range no locking/unlocking needed
-								currentStoreValue.ConsistencyLoss(system.GetCurrentTimeNs())
+								currentStoreValue.ConsistencyLoss(cs.now())
 								//lg.Logf("Consistency lost for key=\"%s\" store", currentStoreValue.GetFullKeyString())
 								//lg.Logln("Purging: " + newSuffix)
 								csvChild.TryPurgeReady(false)
@@ -474,12 +490,16 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 							keyStr := key.(string)
 							///_, putErr := kv.Put(cs.toStoreKey(newSuffix), finalBytes)
 
+							if encodeErr != nil {
+								lg.Logf(lg.ErrorLevel, "Store kvLazyWriter cannot encode key=%s: %s", keyStr, encodeErr)
+								return true
+							}
 							if err := cs.checkBackupBarrierInfoBeforeWrite(valueUpdateTime); err != nil {
 								lg.Logf(lg.TraceLevel, "==============skipping write for key=%s due to barrier: %v", keyStr, err)
 								return true
 							}
 
-							_, putErr := customNatsKv.KVPut(cs.js, kv, cs.toStoreKey(newSuffix), finalBytes)
+							_, putErr := cs.kvPut(kv, cs.toStoreKey(newSuffix), finalBytes)
 							if putErr == nil {
 								csvChild.Lock("kvLazyWriter")
 								if valueUpdateTime == csvChild.valueUpdateTime {
@@ -538,6 +558,9 @@ func NewCacheStore(ctx context.Context, cacheConfig *Config, js nats.JetStreamCo
 	}
 	go storeUpdatesHandler(&cs)
 	go kvLazyWriter(&cs)
+	if cacheConfig.encryption != nil && cacheConfig.encryption.reencryptionInterval > 0 {
+		go cs.runReencryption()
+	}
 	<-initChan
 	return &cs
 }
@@ -609,12 +632,13 @@ func (cs *Store) GetValue(key string) ([]byte, error) {
 		if entry, err := customNatsKv.KVGet(cs.js, cs.kv, cs.toStoreKey(key)); err == nil {
 			key := cs.fromStoreKey(entry.Key())
 			valueBytes := entry.Value()
-			result = valueBytes[9:]
 
 			if len(valueBytes) >= 9 { // Updated or deleted value exists in KV store
-				appendFlag := valueBytes[8]
-				kvRecordTime := int64(binary.BigEndian.Uint64(valueBytes[:8]))
-				if appendFlag == 1 { // Valid value exists in KV store
+				kvRecordTime, appendFlag, value, err := cs.decodeKVValue(key, valueBytes)
+				result = value
+				if err != nil {
+					resultError = err
+				} else if appendFlag == 1 { // Valid value exists in KV store
 					cs.SetValue(key, result, false, kvRecordTime, "")
 					resultError = nil
 				}
@@ -702,7 +726,7 @@ func (cs *Store) SetValueIfDoesNotExist(key string, newValue []byte, updateInKV
 	}
 
 	if customSetTime < 0 {
-		customSetTime = system.GetCurrentTimeNs()
+		customSetTime = cs.now()
 	}
 	if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, true); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
 		parentCacheStoreValue.Lock("SetValueIfEquals parent")
@@ -729,7 +753,7 @@ func (cs *Store) SetValue(key string, value []byte, updateInKV bool, customSetTi
 	}
 
 	if customSetTime < 0 {
-		customSetTime = system.GetCurrentTimeNs()
+		customSetTime = cs.now()
 	}
 	if len(transactionID) == 0 {
 		//lg.Logln(">>1 " + key)
@@ -766,7 +790,7 @@ func (cs *Store) Destroy() {
 
 func (cs *Store) DeleteValue(key string, updateInKV bool, customDeleteTime int64, transactionID string) {
 	if customDeleteTime < 0 {
-		customDeleteTime = system.GetCurrentTimeNs()
+		customDeleteTime = cs.now()
 	}
 	if len(transactionID) == 0 {
 		if keyLastToken, parentCacheStoreValue := cs.getLastKeyTokenAndItsParentCacheStoreValue(key, false); len(keyLastToken) > 0 && parentCacheStoreValue != nil {
@@ -964,7 +988,7 @@ func (cs *Store) getLastKeyTokenAndItsParentCacheStoreValue(key string, createIf
 					purgeState:                     0,
 					syncNeeded:                     false,
 					syncedWithKV:                   true,
-					valueUpdateTime:                system.GetCurrentTimeNs(),
+					valueUpdateTime:                cs.now(),
 				}
 				currentStoreLevel.StoreChild(tokens[currentTokenID], &csv, true)
 				currentStoreLevel = &csv
@@ -1009,6 +1033,36 @@ func (cs *Store) getLastKeyCacheStoreValue(key string) *StoreValue {
 	return currentStoreLevel
 }
 
+// deleteFromKV removes a confirmed delete record of the key, a bucket with history keeps a delete marker instead
+// so the deletion stays in the key's history
+func (cs *Store) deleteFromKV(storeKey string) error {
+	if cs.kvHistory > 1 {
+		return cs.kv.Delete(storeKey)
+	}
+	return customNatsKv.KVDelete(cs.js, cs.kv, storeKey)
+}
+
+func (cs *Store) kvPut(kv nats.KeyValue, storeKey string, value []byte) (uint64, error) {
+	if cs.cacheConfig.kvWriteFault != nil {
+		if err := cs.cacheConfig.kvWriteFault(storeKey); err != nil {
+			return 0, err
+		}
+	}
+	return customNatsKv.KVPut(cs.js, kv, storeKey, value)
+}
+
+func (cs *Store) clock() system.Clock {
+	if cs.cacheConfig.clock == nil {
+		return system.RealClock
+	}
+	return cs.cacheConfig.clock
+}
+
+// now returns the current time of the cache clock in nanoseconds
+func (cs *Store) now() int64 {
+	return cs.clock().Now().UnixNano()
+}
+
 func (cs *Store) toStoreKey(key string) string {
 	return cs.cacheConfig.kvStorePrefix + "." + key
 }
@@ -1,5 +1,7 @@
 package cache
 
+import "github.com/foliagecp/sdk/statefun/system"
+
 const (
 	KVStorePrefix                               = "store"
 	LRUSize                                     = 1000000
@@ -15,6 +17,9 @@ type Config struct {
 	levelSubscriptionNotificationsBufferMaxSize int
 	lazyWriterValueProcessDelayMkS              int
 	lazyWriterRepeatDelayMkS                    int
+	encryption                                  *EncryptionConfig
+	clock                                       system.Clock
+	kvWriteFault                                func(key string) error
 }
 
 func NewCacheConfig(id string) *Config {
@@ -32,11 +37,31 @@ func (cc *Config) GetId() string {
 	return cc.id
 }
 
+func (cc *Config) GetKVStorePrefix() string {
+	return cc.kvStorePrefix
+}
+
 func (cc *Config) SetKVStorePrefix(kvStorePrefix string) *Config {
 	cc.kvStorePrefix = kvStorePrefix
 	return cc
 }
 
+func (cc *Config) GetLRUSize() int {
+	return cc.lruSize
+}
+
+func (cc *Config) GetLevelSubscriptionNotificationsBufferMaxSize() int {
+	return cc.levelSubscriptionNotificationsBufferMaxSize
+}
+
+func (cc *Config) GetLazyWriterValueProcessDelayMkS() int {
+	return cc.lazyWriterValueProcessDelayMkS
+}
+
+func (cc *Config) GetLazyWriterRepeatDelayMkS() int {
+	return cc.lazyWriterRepeatDelayMkS
+}
+
 func (cc *Config) SetLRUSize(lruSize int) *Config {
 	cc.lruSize = lruSize
 	return cc
@@ -56,3 +81,30 @@ func (cc *Config) SetLazyWriterRepeatDelayMkS(lazyWriterRepeatDelayMkS int) *Con
 	cc.lazyWriterRepeatDelayMkS = lazyWriterRepeatDelayMkS
 	return cc
 }
+
+// SetEncryption makes values be stored in KV encrypted, nil - values are stored plain
+func (cc *Config) SetEncryption(encryption *EncryptionConfig) *Config {
+	cc.encryption = encryption
+	return cc
+}
+
+// SetClock sets the time source of value timestamps and re-encryption, nil - the clock of the runtime
+func (cc *Config) SetClock(clock system.Clock) *Config {
+	cc.clock = clock
+	return cc
+}
+
+func (cc *Config) GetClock() system.Clock {
+	return cc.clock
+}
+
+// SetKVWriteFault sets a function called before the lazy writer puts a value into KV, an error returned by it fails
+// the write like a KV error does, so the value is written again on the next pass. Meant for fault injection.
+func (cc *Config) SetKVWriteFault(kvWriteFault func(key string) error) *Config {
+	cc.kvWriteFault = kvWriteFault
+	return cc
+}
+
+func (cc *Config) GetKVWriteFault() func(key string) error {
+	return cc.kvWriteFault
+}
@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/embedded/nats/kv"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// startMemoryTestStore starts a cache store over an in-memory KV bucket keeping history revisions of every key
+func startMemoryTestStore(t *testing.T, config *Config, history int) (*Store, *kv.MemoryKeyValue) {
+	t.Helper()
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	memoryKV, err := kv.NewMemoryKeyValue(&nats.KeyValueConfig{Bucket: "cache_test_bucket", History: uint8(history)})
+	require.NoError(t, err)
+	cs := NewCacheStore(context.Background(), config, nil, memoryKV)
+	t.Cleanup(cs.Destroy)
+	return cs, memoryKV
+}
+
+// putRevision writes a KV revision of the key as the cache writes it
+func putRevision(t *testing.T, cs *Store, memoryKV *kv.MemoryKeyValue, key string, updateTime int64, value []byte) {
+	t.Helper()
+	encoded, err := cs.encodeKVValue(key, updateTime, value)
+	require.NoError(t, err)
+	_, err = memoryKV.Put(cs.toStoreKey(key), encoded)
+	require.NoError(t, err)
+}
@@ -0,0 +1,272 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	customNatsKv "github.com/foliagecp/sdk/embedded/nats/kv"
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Values in KV are stored as:
+
+	[8 bytes update time][1 byte flag][data]
+
+flag: 0 - deleted, 1 - plain value, 2 - encrypted value. Data of an encrypted value is:
+
+	[1 byte key id length][key id][12 bytes nonce][AES-GCM ciphertext]
+
+The update time, flag and cache key (without the KV store prefix) are authenticated together with the value, so an
+encrypted value cannot be moved to another key. Keys stay plain, so key patterns work as before.
+
+Keys are rotated by adding a new key and making it active: new writes use it, the re-encryption job rewrites values
+encrypted with other keys (and plain ones) with the active key. A key can be removed after the job has passed.
+The job rewrites only the latest revision of a key, so point in time reads of older revisions still need the key
+(see GetValueAt).
+*/
+
+const (
+	kvValueFlagDeleted   byte = 0
+	kvValueFlagPlain     byte = 1
+	kvValueFlagEncrypted byte = 2
+
+	kvValueHeaderSize = 9
+
+	ReencryptionInterval = 1 * time.Hour
+)
+
+var (
+	ErrNoActiveEncryptionKey = errors.New("no active encryption key")
+	ErrUnknownEncryptionKey  = errors.New("value is encrypted with an unknown key")
+)
+
+type EncryptionConfig struct {
+	mutex                sync.RWMutex
+	keys                 map[string]cipher.AEAD
+	activeKeyID          string
+	reencryptionInterval time.Duration
+}
+
+func NewEncryptionConfig() *EncryptionConfig {
+	return &EncryptionConfig{
+		keys:                 map[string]cipher.AEAD{},
+		reencryptionInterval: ReencryptionInterval,
+	}
+}
+
+// AddKey adds an AES-128/192/256 key (16, 24 or 32 bytes), the first added key becomes active
+func (ec *EncryptionConfig) AddKey(keyID string, key []byte) (*EncryptionConfig, error) {
+	if len(keyID) == 0 || len(keyID) > 255 {
+		return ec, fmt.Errorf("encryption key id must be 1..255 bytes long")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return ec, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return ec, err
+	}
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	ec.keys[keyID] = aead
+	if len(ec.activeKeyID) == 0 {
+		ec.activeKeyID = keyID
+	}
+	return ec, nil
+}
+
+// SetActiveKey makes new values be encrypted with the key
+func (ec *EncryptionConfig) SetActiveKey(keyID string) (*EncryptionConfig, error) {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	if _, ok := ec.keys[keyID]; !ok {
+		return ec, fmt.Errorf("encryption key %s is not added", keyID)
+	}
+	ec.activeKeyID = keyID
+	return ec, nil
+}
+
+// RemoveKey removes a key which is not active, values still encrypted with it cannot be read anymore, including
+// older KV revisions read by GetValueAt and RestoreKeysAt
+func (ec *EncryptionConfig) RemoveKey(keyID string) *EncryptionConfig {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+	if keyID != ec.activeKeyID {
+		delete(ec.keys, keyID)
+	}
+	return ec
+}
+
+// SetReencryptionInterval sets how often values not encrypted with the active key are looked for, 0 - never
+func (ec *EncryptionConfig) SetReencryptionInterval(reencryptionInterval time.Duration) *EncryptionConfig {
+	ec.reencryptionInterval = reencryptionInterval
+	return ec
+}
+
+func (ec *EncryptionConfig) activeKey() (string, cipher.AEAD) {
+	ec.mutex.RLock()
+	defer ec.mutex.RUnlock()
+	return ec.activeKeyID, ec.keys[ec.activeKeyID]
+}
+
+func (ec *EncryptionConfig) key(keyID string) cipher.AEAD {
+	ec.mutex.RLock()
+	defer ec.mutex.RUnlock()
+	return ec.keys[keyID]
+}
+
+// encodeKVValue builds KV bytes of an existing value, encrypted if encryption is on
+func (cs *Store) encodeKVValue(key string, updateTime int64, value []byte) ([]byte, error) {
+	header := make([]byte, kvValueHeaderSize, kvValueHeaderSize+len(value))
+	binary.BigEndian.PutUint64(header, uint64(updateTime))
+	encryption := cs.cacheConfig.encryption
+	if encryption == nil {
+		header[8] = kvValueFlagPlain
+		return append(header, value...), nil
+	}
+
+	keyID, aead := encryption.activeKey()
+	if aead == nil {
+		return nil, ErrNoActiveEncryptionKey
+	}
+	header[8] = kvValueFlagEncrypted
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	result := append(header, byte(len(keyID)))
+	result = append(result, keyID...)
+	result = append(result, nonce...)
+	return aead.Seal(result, nonce, value, encryptionAdditionalData(key, header)), nil
+}
+
+// decodeKVValue returns update time, flag (kvValueFlagDeleted or kvValueFlagPlain) and the decrypted value
+func (cs *Store) decodeKVValue(key string, valueBytes []byte) (updateTime int64, flag byte, value []byte, err error) {
+	if len(valueBytes) < kvValueHeaderSize {
+		return 0, 0, nil, fmt.Errorf("value of key %s has no update time and flag", key)
+	}
+	updateTime = int64(binary.BigEndian.Uint64(valueBytes[:8]))
+	flag = valueBytes[8]
+	if flag != kvValueFlagEncrypted {
+		return updateTime, flag, valueBytes[kvValueHeaderSize:], nil
+	}
+
+	data := valueBytes[kvValueHeaderSize:]
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return updateTime, flag, nil, fmt.Errorf("encrypted value of key %s is malformed", key)
+	}
+	keyID := string(data[1 : 1+data[0]])
+	data = data[1+data[0]:]
+	aead := cs.cacheConfig.encryption.keyOrNil(keyID)
+	if aead == nil {
+		return updateTime, flag, nil, fmt.Errorf("%w %s, key %s", ErrUnknownEncryptionKey, keyID, key)
+	}
+	if len(data) < aead.NonceSize() {
+		return updateTime, flag, nil, fmt.Errorf("encrypted value of key %s is malformed", key)
+	}
+	value, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], encryptionAdditionalData(key, valueBytes[:kvValueHeaderSize]))
+	if err != nil {
+		return updateTime, flag, nil, fmt.Errorf("value of key %s cannot be decrypted: %w", key, err)
+	}
+	return updateTime, kvValueFlagPlain, value, nil
+}
+
+func (ec *EncryptionConfig) keyOrNil(keyID string) cipher.AEAD {
+	if ec == nil {
+		return nil
+	}
+	return ec.key(keyID)
+}
+
+func encryptionAdditionalData(key string, header []byte) []byte {
+	return append(append([]byte{}, header...), key...)
+}
+
+// kvValueEncryptedWithActiveKey tells if KV bytes do not need to be re-encrypted
+func (cs *Store) kvValueEncryptedWithActiveKey(valueBytes []byte) bool {
+	if len(valueBytes) < kvValueHeaderSize || valueBytes[8] == kvValueFlagDeleted {
+		return true
+	}
+	if valueBytes[8] != kvValueFlagEncrypted {
+		return false
+	}
+	data := valueBytes[kvValueHeaderSize:]
+	activeKeyID, _ := cs.cacheConfig.encryption.activeKey()
+	return len(data) >= 1+int(data[0]) && string(data[1:1+data[0]]) == activeKeyID
+}
+
+// ReencryptValues rewrites values in KV which are plain or encrypted with a non active key, values changed
+// concurrently are skipped since they are written with the active key anyway
+func (cs *Store) ReencryptValues() (reencrypted int, err error) {
+	if cs.cacheConfig.encryption == nil {
+		return 0, nil
+	}
+	if _, status := cs.getBackupBarrierState(); status != BackupBarrierStatusUnlocked {
+		return 0, fmt.Errorf("backup barrier is engaged")
+	}
+
+	w, err := cs.kv.Watch(cs.toStoreKey(">"))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+		if cs.kvValueEncryptedWithActiveKey(entry.Value()) {
+			continue
+		}
+		key := cs.fromStoreKey(entry.Key())
+		updateTime, flag, value, err := cs.decodeKVValue(key, entry.Value())
+		if err != nil {
+			lg.Logf(lg.ErrorLevel, "Re-encryption skips key %s: %s", key, err)
+			continue
+		}
+		if flag == kvValueFlagDeleted {
+			continue
+		}
+		encoded, err := cs.encodeKVValue(key, updateTime, value)
+		if err != nil {
+			return reencrypted, err
+		}
+		if _, err := customNatsKv.KVUpdate(cs.js, cs.kv, entry.Key(), encoded, entry.Revision()); err != nil {
+			lg.Logf(lg.DebugLevel, "Re-encryption skips key %s changed concurrently: %s", key, err)
+			continue
+		}
+		reencrypted++
+	}
+	return reencrypted, nil
+}
+
+func (cs *Store) runReencryption() {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("cache.reencryption")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("cache.reencryption")
+
+	ticker := cs.clock().NewTicker(cs.cacheConfig.encryption.reencryptionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cs.ctx.Done():
+			return
+		case <-ticker.C():
+			reencrypted, err := cs.ReencryptValues()
+			if err != nil {
+				lg.Logf(lg.WarnLevel, "Re-encryption of cache values failed: %s", err)
+			} else if reencrypted > 0 {
+				lg.Logf(lg.InfoLevel, "Re-encrypted %d cache values", reencrypted)
+			}
+		}
+	}
+}
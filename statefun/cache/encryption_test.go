@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testEncryptionConfig(t *testing.T, keyIDs ...string) *EncryptionConfig {
+	t.Helper()
+	ec := NewEncryptionConfig().SetReencryptionInterval(0)
+	for _, keyID := range keyIDs {
+		_, err := ec.AddKey(keyID, bytes.Repeat([]byte(keyID[:1]), 32))
+		require.NoError(t, err)
+	}
+	return ec
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	cs := &Store{cacheConfig: NewCacheConfig("test").SetEncryption(testEncryptionConfig(t, "k1"))}
+
+	encoded, err := cs.encodeKVValue("a.b", 42, []byte("secret"))
+	require.NoError(t, err)
+	require.Equal(t, kvValueFlagEncrypted, encoded[8])
+	require.False(t, bytes.Contains(encoded, []byte("secret")))
+
+	updateTime, flag, value, err := cs.decodeKVValue("a.b", encoded)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), updateTime)
+	require.Equal(t, kvValueFlagPlain, flag)
+	require.Equal(t, []byte("secret"), value)
+}
+
+func TestEncryptionBindsValueToKey(t *testing.T) {
+	cs := &Store{cacheConfig: NewCacheConfig("test").SetEncryption(testEncryptionConfig(t, "k1"))}
+
+	encoded, err := cs.encodeKVValue("a.b", 42, []byte("secret"))
+	require.NoError(t, err)
+
+	_, _, _, err = cs.decodeKVValue("a.c", encoded)
+	require.Error(t, err, "value moved to another key")
+
+	tampered := append([]byte{}, encoded...)
+	tampered[7]++ // Update time
+	_, _, _, err = cs.decodeKVValue("a.b", tampered)
+	require.Error(t, err, "update time changed")
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	ec := testEncryptionConfig(t, "k1", "k2")
+	cs := &Store{cacheConfig: NewCacheConfig("test").SetEncryption(ec)}
+
+	old, err := cs.encodeKVValue("a", 1, []byte("old"))
+	require.NoError(t, err)
+	require.True(t, cs.kvValueEncryptedWithActiveKey(old))
+
+	_, err = ec.SetActiveKey("k2")
+	require.NoError(t, err)
+	require.False(t, cs.kvValueEncryptedWithActiveKey(old))
+	_, _, value, err := cs.decodeKVValue("a", old)
+	require.NoError(t, err, "values of a non active key are still readable")
+	require.Equal(t, []byte("old"), value)
+
+	plain := (&Store{cacheConfig: NewCacheConfig("test")})
+	plainValue, err := plain.encodeKVValue("a", 1, []byte("plain"))
+	require.NoError(t, err)
+	require.False(t, cs.kvValueEncryptedWithActiveKey(plainValue), "plain values are re-encrypted too")
+
+	ec.RemoveKey("k2")
+	_, active := ec.activeKey()
+	require.NotNil(t, active, "the active key is not removed")
+
+	ec.RemoveKey("k1")
+	_, _, _, err = cs.decodeKVValue("a", old)
+	require.ErrorIs(t, err, ErrUnknownEncryptionKey)
+
+	_, err = ec.SetActiveKey("k1")
+	require.Error(t, err)
+}
+
+func TestEncryptionRemovedKeyHistory(t *testing.T) {
+	ec := testEncryptionConfig(t, "k1", "k2")
+	cs, memoryKV := startMemoryTestStore(t, NewCacheConfig("test").SetEncryption(ec), 5)
+
+	putRevision(t, cs, memoryKV, "a", 100, []byte("v1"))
+	_, err := ec.SetActiveKey("k2")
+	require.NoError(t, err)
+	putRevision(t, cs, memoryKV, "a", 200, []byte("v2"))
+
+	value, err := cs.GetValueAt("a", time.Unix(0, 150))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), value)
+
+	ec.RemoveKey("k1")
+	_, err = cs.GetValueAt("a", time.Unix(0, 150))
+	require.ErrorIs(t, err, ErrValueUnreadable)
+
+	report, err := cs.RestoreKeysAt("a", time.Unix(0, 150))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, report.Unknown)
+	require.Zero(t, report.Deleted)
+	require.Zero(t, report.Restored)
+
+	value, err = cs.GetValue("a")
+	require.NoError(t, err, "the live key is kept")
+	require.Equal(t, []byte("v2"), value)
+}
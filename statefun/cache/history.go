@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Point in time reads use the revisions kept by the KV bucket (see RuntimeConfig.SetKVHistory), every revision carries
+the cache update time of its value. A key which has no revision older than the requested moment is considered absent
+at that moment unless all the bucket's history slots of the key are taken, then older revisions may have been
+dropped and the value at that moment is unknown.
+
+Re-encryption rewrites only the latest revision of a key, older revisions stay encrypted with the keys they were
+written with. A revision which cannot be decrypted (e.g. its key was removed with EncryptionConfig.RemoveKey) makes
+the value at that moment unreadable, so keep removed keys' history expired (RuntimeConfig.SetKVHistory, KV TTL)
+before removing a key if point in time reads must keep working.
+*/
+
+var (
+	ErrValueNotExisted = errors.New("value did not exist at the requested time")
+	ErrHistoryTooShort = errors.New("KV history does not reach the requested time")
+	ErrValueUnreadable = errors.New("value at the requested time cannot be read")
+)
+
+type RestoreAtReport struct {
+	Restored int      `json:"restored"`
+	Deleted  int      `json:"deleted"`
+	Unknown  []string `json:"unknown"`
+}
+
+type valueRevision struct {
+	updateTime int64
+	value      []byte // nil for deleted
+	err        error  // Value cannot be decoded, e.g. its encryption key was removed
+}
+
+// GetValueAt returns the value the key had at moment t
+func (cs *Store) GetValueAt(key string, t time.Time) ([]byte, error) {
+	at := t.UnixNano()
+	if updateTime := cs.GetValueUpdateTime(key); updateTime > 0 && updateTime <= at {
+		// The cached value may be not synced with KV yet
+		if value, err := cs.GetValue(key); err == nil {
+			return value, nil
+		}
+		return nil, ErrValueNotExisted
+	}
+
+	entries, err := cs.kv.History(cs.toStoreKey(key))
+	if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, err
+	}
+	revisions := []valueRevision{}
+	for _, entry := range entries {
+		revisions = append(revisions, cs.toValueRevision(entry))
+	}
+
+	revision, err := revisionAt(revisions, at, cs.kvHistory)
+	if err != nil {
+		return nil, err
+	}
+	return revision.value, nil
+}
+
+// RestoreKeysAt rolls back all keys matching the pattern to their values at moment t: keys which did not exist at t
+// are deleted, changed and deleted ones get their values back. Keys with unknown or unreadable values at t are left
+// untouched.
+func (cs *Store) RestoreKeysAt(pattern string, t time.Time) (RestoreAtReport, error) {
+	report := RestoreAtReport{Unknown: []string{}}
+	at := t.UnixNano()
+
+	keyRevisions := map[string][]valueRevision{}
+	w, err := cs.kv.Watch(cs.toStoreKey(pattern), nats.IncludeHistory())
+	if err != nil {
+		return report, err
+	}
+	for entry := range w.Updates() {
+		if entry == nil { // All revisions are received
+			break
+		}
+		key := cs.fromStoreKey(entry.Key())
+		keyRevisions[key] = append(keyRevisions[key], cs.toValueRevision(entry))
+	}
+	system.MsgOnErrorReturn(w.Stop())
+
+	for _, key := range cs.GetKeysByPattern(pattern) {
+		if _, ok := keyRevisions[key]; !ok {
+			keyRevisions[key] = []valueRevision{} // Not synced with KV yet, did not exist at t if it is newer
+		}
+	}
+
+	for key, revisions := range keyRevisions {
+		current, currentErr := cs.GetValue(key)
+		if updateTime := cs.GetValueUpdateTime(key); currentErr == nil && updateTime > 0 && updateTime <= at {
+			continue // Not changed since t
+		}
+
+		revision, err := revisionAt(revisions, at, cs.kvHistory)
+		if err != nil {
+			if errors.Is(err, ErrHistoryTooShort) || errors.Is(err, ErrValueUnreadable) {
+				report.Unknown = append(report.Unknown, key)
+				continue
+			}
+			if currentErr == nil {
+				cs.DeleteValue(key, true, -1, "")
+				report.Deleted++
+			}
+			continue
+		}
+		if currentErr == nil && string(current) == string(revision.value) {
+			continue
+		}
+		cs.SetValue(key, revision.value, true, -1, "")
+		report.Restored++
+	}
+
+	lg.Logf(lg.InfoLevel, "Keys %s are restored at %s: restored=%d, deleted=%d, unknown=%d", pattern, t.Format(time.RFC3339Nano), report.Restored, report.Deleted, len(report.Unknown))
+	return report, nil
+}
+
+func (cs *Store) toValueRevision(entry nats.KeyValueEntry) valueRevision {
+	if entry.Operation() != nats.KeyValuePut || len(entry.Value()) < 9 {
+		return valueRevision{updateTime: entry.Created().UnixNano()}
+	}
+	updateTime, flag, value, err := cs.decodeKVValue(cs.fromStoreKey(entry.Key()), entry.Value())
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Revision %d: %s", entry.Revision(), err)
+		return valueRevision{updateTime: updateTime, err: fmt.Errorf("%w: %s", ErrValueUnreadable, err)}
+	}
+	revision := valueRevision{updateTime: updateTime}
+	if flag == kvValueFlagPlain {
+		revision.value = value
+	}
+	return revision
+}
+
+// revisionAt returns the latest revision made not later than at, revisions are in KV order
+func revisionAt(revisions []valueRevision, at int64, history int) (valueRevision, error) {
+	found := false
+	latest := valueRevision{}
+	for _, revision := range revisions {
+		if revision.updateTime <= at && (!found || revision.updateTime >= latest.updateTime) {
+			latest = revision
+			found = true
+		}
+	}
+	if !found {
+		if len(revisions) >= history {
+			return latest, ErrHistoryTooShort
+		}
+		return latest, ErrValueNotExisted
+	}
+	if latest.err != nil {
+		return latest, latest.err
+	}
+	if latest.value == nil {
+		return latest, ErrValueNotExisted
+	}
+	return latest, nil
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/embedded/nats/kv"
+)
+
+// putDeletedRevision writes a KV revision of the key deleted at updateTime as the cache writes it and waits for the
+// cache to confirm it with a delete marker
+func putDeletedRevision(t *testing.T, cs *Store, memoryKV *kv.MemoryKeyValue, key string, updateTime int64) {
+	t.Helper()
+	header := make([]byte, kvValueHeaderSize)
+	binary.BigEndian.PutUint64(header, uint64(updateTime))
+	header[8] = kvValueFlagDeleted
+	_, err := memoryKV.Put(cs.toStoreKey(key), header)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := memoryKV.Get(cs.toStoreKey(key))
+		return errors.Is(err, nats.ErrKeyNotFound)
+	}, 5*time.Second, time.Millisecond)
+}
+
+// waitSynced waits for the cache to get the latest KV revision of the key
+func waitSynced(t *testing.T, cs *Store, key string, updateTime int64) {
+	t.Helper()
+	require.Eventually(t, func() bool { return cs.GetValueUpdateTime(key) == updateTime }, 5*time.Second, time.Millisecond)
+}
+
+func TestGetValueAt(t *testing.T) {
+	cs, memoryKV := startMemoryTestStore(t, NewCacheConfig("test"), 10)
+	putRevision(t, cs, memoryKV, "a", 100, []byte("v1"))
+	putRevision(t, cs, memoryKV, "a", 200, []byte("v2"))
+	putDeletedRevision(t, cs, memoryKV, "a", 300)
+	putRevision(t, cs, memoryKV, "a", 400, []byte("v3"))
+	waitSynced(t, cs, "a", 400)
+
+	for _, tc := range []struct {
+		at    int64
+		value string
+		err   error
+	}{
+		{at: 50, err: ErrValueNotExisted},
+		{at: 100, value: "v1"},
+		{at: 250, value: "v2"},
+		{at: 350, err: ErrValueNotExisted},
+		{at: 450, value: "v3"},
+	} {
+		value, err := cs.GetValueAt("a", time.Unix(0, tc.at))
+		if tc.err != nil {
+			require.ErrorIs(t, err, tc.err, tc.at)
+			continue
+		}
+		require.NoError(t, err, tc.at)
+		require.Equal(t, tc.value, string(value), tc.at)
+	}
+
+	// Not synced with KV yet
+	cs.SetValue("b", []byte("v1"), false, 500, "")
+	value, err := cs.GetValueAt("b", time.Unix(0, 600))
+	require.NoError(t, err)
+	require.Equal(t, "v1", string(value))
+	_, err = cs.GetValueAt("b", time.Unix(0, 450))
+	require.ErrorIs(t, err, ErrValueNotExisted)
+}
+
+func TestGetValueAtBeyondHistory(t *testing.T) {
+	cs, memoryKV := startMemoryTestStore(t, NewCacheConfig("test"), 2)
+	putRevision(t, cs, memoryKV, "a", 100, []byte("v1"))
+	putRevision(t, cs, memoryKV, "a", 200, []byte("v2"))
+	putRevision(t, cs, memoryKV, "a", 300, []byte("v3"))
+	waitSynced(t, cs, "a", 300)
+
+	value, err := cs.GetValueAt("a", time.Unix(0, 250))
+	require.NoError(t, err)
+	require.Equal(t, "v2", string(value))
+	_, err = cs.GetValueAt("a", time.Unix(0, 150))
+	require.ErrorIs(t, err, ErrHistoryTooShort, "revision of 100 is dropped")
+
+	report, err := cs.RestoreKeysAt("a", time.Unix(0, 150))
+	require.NoError(t, err)
+	require.Equal(t, RestoreAtReport{Unknown: []string{"a"}}, report)
+	value, err = cs.GetValue("a")
+	require.NoError(t, err, "the live key is kept")
+	require.Equal(t, "v3", string(value))
+}
+
+func TestRestoreKeysAt(t *testing.T) {
+	cs, memoryKV := startMemoryTestStore(t, NewCacheConfig("test"), 10)
+	// Changed after t
+	putRevision(t, cs, memoryKV, "p.a", 100, []byte("v1"))
+	putRevision(t, cs, memoryKV, "p.a", 300, []byte("v2"))
+	// Not changed since t
+	putRevision(t, cs, memoryKV, "p.b", 100, []byte("v1"))
+	// Created after t
+	putRevision(t, cs, memoryKV, "p.c", 300, []byte("v1"))
+	// Deleted at t, created again after it
+	putRevision(t, cs, memoryKV, "p.d", 100, []byte("v1"))
+	putDeletedRevision(t, cs, memoryKV, "p.d", 150)
+	putRevision(t, cs, memoryKV, "p.d", 300, []byte("v2"))
+	// Out of the pattern
+	putRevision(t, cs, memoryKV, "q.a", 100, []byte("v1"))
+	putRevision(t, cs, memoryKV, "q.a", 300, []byte("v2"))
+	for _, key := range []string{"p.a", "p.c", "p.d", "q.a"} {
+		waitSynced(t, cs, key, 300)
+	}
+	waitSynced(t, cs, "p.b", 100)
+	// Created after t, not synced with KV yet
+	cs.SetValue("p.e", []byte("v1"), false, 300, "")
+
+	report, err := cs.RestoreKeysAt("p.*", time.Unix(0, 200))
+	require.NoError(t, err)
+	require.Equal(t, RestoreAtReport{Restored: 1, Deleted: 3, Unknown: []string{}}, report)
+
+	value := func(key string) string {
+		v, err := cs.GetValue(key)
+		if err != nil {
+			return ""
+		}
+		return string(v)
+	}
+	require.Equal(t, "v1", value("p.a"))
+	require.Equal(t, "v1", value("p.b"))
+	require.Equal(t, "", value("p.c"))
+	require.Equal(t, "", value("p.d"))
+	require.Equal(t, "", value("p.e"))
+	require.Equal(t, "v2", value("q.a"))
+}
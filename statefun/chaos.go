@@ -0,0 +1,260 @@
+package statefun
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+)
+
+/*
+Chaos mode (RuntimeConfig.SetChaos) injects faults to test how an application behaves under redelivery, duplicates,
+latency and lost replies. Rules are set per typename, ChaosAllTypenames applies to function types without own rules.
+Each message passing to a function type (from NATS or from a local golang signal) draws its faults:
+
+  - drop: the message is neither handled nor answered, a JetStream signal is redelivered after its ack wait,
+    a request times out on the caller side;
+  - duplicate: the message is handled twice, only the first handling acks it or replies to it;
+  - reorder: the message is held until the next message for the same function type passes or the hold time ends;
+  - delay: the message is handled after the delay.
+
+Also cache values may fail to be written into KV (the cache writes them again later) and a mutex lease held
+by someone else may be considered expired before its lifetime ends, so the lock is taken over.
+
+Every kind of fault draws its decisions from its own random sequence derived from the seed, so a run with the same
+seed and the same order of messages gets the same message faults no matter when the cache writes or locks are
+attempted, and vice versa. The in-memory runtime applies only the KV and mutex faults.
+*/
+
+const ChaosAllTypenames = "*"
+
+type ChaosRules struct {
+	dropProbability      float64
+	duplicateProbability float64
+	reorderProbability   float64
+	reorderMaxHold       time.Duration
+	delayProbability     float64
+	delay                time.Duration
+}
+
+func NewChaosRules() *ChaosRules {
+	return &ChaosRules{}
+}
+
+func (cr *ChaosRules) SetDrop(probability float64) *ChaosRules {
+	cr.dropProbability = probability
+	return cr
+}
+
+func (cr *ChaosRules) SetDuplicate(probability float64) *ChaosRules {
+	cr.duplicateProbability = probability
+	return cr
+}
+
+// SetReorder holds a message for at most maxHold waiting for the next one to overtake it
+func (cr *ChaosRules) SetReorder(probability float64, maxHold time.Duration) *ChaosRules {
+	cr.reorderProbability = probability
+	cr.reorderMaxHold = maxHold
+	return cr
+}
+
+func (cr *ChaosRules) SetDelay(probability float64, delay time.Duration) *ChaosRules {
+	cr.delayProbability = probability
+	cr.delay = delay
+	return cr
+}
+
+type ChaosConfig struct {
+	seed                        int64
+	rules                       map[string]*ChaosRules
+	kvWriteFailureProbability   float64
+	mutexLeaseExpiryProbability float64
+}
+
+func NewChaosConfig(seed int64) *ChaosConfig {
+	return &ChaosConfig{seed: seed, rules: map[string]*ChaosRules{}}
+}
+
+// SetRules sets message faults of the typename, ChaosAllTypenames - of function types without own rules
+func (cc *ChaosConfig) SetRules(typename string, rules *ChaosRules) *ChaosConfig {
+	cc.rules[typename] = rules
+	return cc
+}
+
+func (cc *ChaosConfig) SetKVWriteFailure(probability float64) *ChaosConfig {
+	cc.kvWriteFailureProbability = probability
+	return cc
+}
+
+func (cc *ChaosConfig) SetMutexLeaseExpiry(probability float64) *ChaosConfig {
+	cc.mutexLeaseExpiryProbability = probability
+	return cc
+}
+
+type chaosFault int
+
+const (
+	chaosDrop chaosFault = iota
+	chaosDuplicate
+	chaosReorder
+	chaosDelay
+	chaosKVWriteFailure
+	chaosMutexLeaseExpiry
+	chaosFaultKinds
+)
+
+type chaosHeldMsg struct {
+	id  string
+	msg FunctionTypeMsg
+}
+
+type chaos struct {
+	config *ChaosConfig
+	mutex  sync.Mutex
+	random [chaosFaultKinds]*rand.Rand
+	held   map[string]*chaosHeldMsg // Reordered message per typename
+}
+
+func newChaos(config *ChaosConfig) *chaos {
+	if config == nil {
+		return nil
+	}
+	c := &chaos{config: config, held: map[string]*chaosHeldMsg{}}
+	for fault := range c.random {
+		c.random[fault] = rand.New(rand.NewSource(config.seed + int64(fault)))
+	}
+	return c
+}
+
+// happens draws the next decision of the fault even if the probability is 0
+func (c *chaos) happens(fault chaosFault, probability float64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.random[fault].Float64() < probability
+}
+
+func (c *chaos) rulesFor(typename string) *ChaosRules {
+	if rules, ok := c.config.rules[typename]; ok {
+		return rules
+	}
+	return c.config.rules[ChaosAllTypenames]
+}
+
+// sendMsg passes the message to the function type applying faults of its rules
+func (c *chaos) sendMsg(ft *FunctionType, id string, msg FunctionTypeMsg) {
+	rules := c.rulesFor(ft.name)
+	if rules == nil {
+		ft.enqueueMsg(id, msg)
+		return
+	}
+
+	// Always draw all decisions, so the sequence of faults depends only on the seed and the order of messages
+	drop := c.happens(chaosDrop, rules.dropProbability)
+	duplicate := c.happens(chaosDuplicate, rules.duplicateProbability)
+	reorder := c.happens(chaosReorder, rules.reorderProbability)
+	delay := c.happens(chaosDelay, rules.delayProbability)
+
+	if drop {
+		lg.Logf(lg.DebugLevel, "Chaos: dropped message for %s:%s", ft.name, id)
+		c.releaseHeld(ft)
+		return
+	}
+	if reorder && c.hold(ft, id, msg, rules.reorderMaxHold) {
+		lg.Logf(lg.DebugLevel, "Chaos: holding message for %s:%s", ft.name, id)
+		return
+	}
+
+	deliver := func() {
+		ft.enqueueMsg(id, msg)
+		if duplicate {
+			lg.Logf(lg.DebugLevel, "Chaos: duplicated message for %s:%s", ft.name, id)
+			ft.enqueueMsg(id, chaosDuplicateMsg(msg))
+		}
+		c.releaseHeld(ft)
+	}
+	if delay && rules.delay > 0 {
+		lg.Logf(lg.DebugLevel, "Chaos: delaying message for %s:%s by %s", ft.name, id, rules.delay)
+		go func() {
+			<-ft.runtime.clock().After(rules.delay)
+			deliver()
+		}()
+		return
+	}
+	deliver()
+}
+
+// hold returns false if a message for the function type is already held
+func (c *chaos) hold(ft *FunctionType, id string, msg FunctionTypeMsg, maxHold time.Duration) bool {
+	c.mutex.Lock()
+	if _, ok := c.held[ft.name]; ok {
+		c.mutex.Unlock()
+		return false
+	}
+	held := &chaosHeldMsg{id: id, msg: msg}
+	c.held[ft.name] = held
+	c.mutex.Unlock()
+
+	go func() {
+		<-ft.runtime.clock().After(maxHold)
+		c.mutex.Lock()
+		if c.held[ft.name] != held {
+			c.mutex.Unlock()
+			return
+		}
+		delete(c.held, ft.name)
+		c.mutex.Unlock()
+		ft.enqueueMsg(held.id, held.msg)
+	}()
+	return true
+}
+
+func (c *chaos) releaseHeld(ft *FunctionType) {
+	c.mutex.Lock()
+	held, ok := c.held[ft.name]
+	delete(c.held, ft.name)
+	c.mutex.Unlock()
+	if ok {
+		ft.enqueueMsg(held.id, held.msg)
+	}
+}
+
+// chaosDuplicateMsg copies the message, the copy does not ack, refuse or reply
+func chaosDuplicateMsg(msg FunctionTypeMsg) FunctionTypeMsg {
+	duplicate := FunctionTypeMsg{
+		Caller:          msg.Caller,
+		RefusalCallback: func(bool) {},
+	}
+	if msg.Payload != nil {
+		duplicate.Payload = msg.Payload.Clone().GetPtr()
+	}
+	if msg.Options != nil {
+		duplicate.Options = msg.Options.Clone().GetPtr()
+	}
+	if msg.RequestCallback != nil {
+		duplicate.RequestCallback = func(*easyjson.JSON) {}
+	}
+	if msg.AckCallback != nil {
+		duplicate.AckCallback = func(bool) {}
+	}
+	return duplicate
+}
+
+func (c *chaos) kvWriteFault(key string) error {
+	if c.config.kvWriteFailureProbability > 0 && c.happens(chaosKVWriteFailure, c.config.kvWriteFailureProbability) {
+		return fmt.Errorf("chaos: write of key=%s failed", key)
+	}
+	return nil
+}
+
+// mutexLeaseExpired tells whether a lease held by someone else must be considered expired early
+func (c *chaos) mutexLeaseExpired(key string) bool {
+	if c == nil || c.config.mutexLeaseExpiryProbability <= 0 || !c.happens(chaosMutexLeaseExpiry, c.config.mutexLeaseExpiryProbability) {
+		return false
+	}
+	lg.Logf(lg.DebugLevel, "Chaos: expired mutex lease for key=%s", key)
+	return true
+}
@@ -0,0 +1,207 @@
+package statefun
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+func TestChaosSeed(t *testing.T) {
+	draw := func(seed int64) []bool {
+		c := newChaos(NewChaosConfig(seed).SetKVWriteFailure(0.5))
+		decisions := make([]bool, 64)
+		for i := range decisions {
+			decisions[i] = c.happens(chaosDrop, 0.5)
+			if i%3 == 0 {
+				_ = c.kvWriteFault("key") // Other kinds of faults do not shift message faults
+			}
+		}
+		return decisions
+	}
+	require.Equal(t, draw(1), draw(1))
+	require.NotEqual(t, draw(1), draw(2))
+
+	c1, c2 := newChaos(NewChaosConfig(1)), newChaos(NewChaosConfig(1))
+	for i := 0; i < 16; i++ {
+		c2.happens(chaosKVWriteFailure, 0.5)
+	}
+	for i := 0; i < 64; i++ {
+		require.Equal(t, c1.happens(chaosDrop, 0.5), c2.happens(chaosDrop, 0.5))
+	}
+
+	c := newChaos(NewChaosConfig(1).SetKVWriteFailure(1))
+	require.Error(t, c.kvWriteFault("key"))
+	require.NoError(t, newChaos(NewChaosConfig(1)).kvWriteFault("key"))
+	require.False(t, (*chaos)(nil).mutexLeaseExpired("key"))
+}
+
+func TestChaosDuplicateMsg(t *testing.T) {
+	calls := 0
+	payload := easyjson.NewJSONObjectWithKeyValue("a", easyjson.NewJSON(1))
+	msg := FunctionTypeMsg{
+		Caller:          &sfPlugins.StatefunAddress{Typename: "ingress", ID: "signal"},
+		Payload:         &payload,
+		RefusalCallback: func(bool) { calls++ },
+		RequestCallback: func(*easyjson.JSON) { calls++ },
+		AckCallback:     func(bool) { calls++ },
+	}
+
+	duplicate := chaosDuplicateMsg(msg)
+	duplicate.RefusalCallback(false)
+	duplicate.RequestCallback(nil)
+	duplicate.AckCallback(true)
+	require.Zero(t, calls)
+
+	duplicate.Payload.SetByPath("a", easyjson.NewJSON(2))
+	require.Equal(t, 1.0, payload.GetByPath("a").AsNumericDefault(0))
+	require.Nil(t, chaosDuplicateMsg(FunctionTypeMsg{}).RequestCallback, "a signal stays a signal")
+}
+
+func TestChaosMutexLeaseExpiry(t *testing.T) {
+	lockTwice := func(config *RuntimeConfig) error {
+		r, stop := startInMemoryTestRuntime(t, config, nil)
+		defer stop()
+
+		_, err := KeyMutexLock(context.Background(), r, "key", true)
+		require.NoError(t, err)
+		_, err = KeyMutexLock(context.Background(), r, "key", true)
+		return err
+	}
+
+	require.ErrorIs(t, lockTwice(NewRuntimeConfigSimple("", "test_app")), ErrMutexLocked)
+	require.NoError(t, lockTwice(NewRuntimeConfigSimple("", "test_app").SetChaos(NewChaosConfig(1).SetMutexLeaseExpiry(1))))
+}
+
+const chaosTypename = "functions.test.chaos"
+
+// chaosSeed finds a seed whose first decisions of the fault with probability 0.5 are the given ones
+func chaosSeed(t *testing.T, fault chaosFault, decisions ...bool) int64 {
+	for seed := int64(0); seed < 1000; seed++ {
+		random := rand.New(rand.NewSource(seed + int64(fault)))
+		matches := true
+		for _, decision := range decisions {
+			matches = matches && (random.Float64() < 0.5) == decision
+		}
+		if matches {
+			return seed
+		}
+	}
+	t.Fatal("no seed found")
+	return 0
+}
+
+// startChaosTestRuntime starts a runtime against an embedded NATS server with chaos rules for chaosTypename, which
+// records the "n" of payloads it handles
+func startChaosTestRuntime(t *testing.T, seed int64, rules *ChaosRules) (*Runtime, *nats.Conn, func() []float64) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsservertest.RunServer(&opts)
+	t.Cleanup(srv.Shutdown)
+
+	r, err := NewRuntime(*NewRuntimeConfigSimple(srv.ClientURL(), "test_app").SetChaos(NewChaosConfig(seed).SetRules(chaosTypename, rules)))
+	require.NoError(t, err)
+	var mutex sync.Mutex
+	handled := []float64{}
+	NewFunctionType(r, chaosTypename, func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		mutex.Lock()
+		handled = append(handled, ctx.Payload.GetByPath("n").AsNumericDefault(0))
+		mutex.Unlock()
+	}, *NewFunctionTypeConfig().SetMsgAckWaitMs(500))
+
+	started := make(chan struct{})
+	r.RegisterOnAfterStartFunction(func(ctx context.Context, runtime *Runtime) error {
+		close(started)
+		return nil
+	}, false)
+	stopped := make(chan error, 1)
+	go func() { stopped <- r.Start(context.Background(), cache.NewCacheConfig("test_cache")) }()
+	select {
+	case <-started:
+	case err := <-stopped:
+		t.Fatalf("runtime stopped: %v", err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("runtime did not start")
+	}
+	t.Cleanup(func() {
+		r.Shutdown()
+		<-stopped
+	})
+
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+	return r, nc, func() []float64 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]float64{}, handled...)
+	}
+}
+
+func chaosSignal(t *testing.T, r *Runtime, n int) {
+	payload := easyjson.NewJSONObjectWithKeyValue("n", easyjson.NewJSON(n))
+	require.NoError(t, r.Signal(sfPlugins.JetstreamGlobalSignal, chaosTypename, "a", &payload, nil))
+}
+
+// chaosConsumerInfo returns the state of the JetStream consumer of chaosTypename
+func chaosConsumerInfo(t *testing.T, r *Runtime, nc *nats.Conn) *nats.ConsumerInfo {
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	ft, _ := r.functionType(chaosTypename)
+	info, err := js.ConsumerInfo(ft.getStreamName(), r.Domain.name+"-functionstestchaos")
+	require.NoError(t, err)
+	return info
+}
+
+func TestChaosDroppedSignalIsRedelivered(t *testing.T) {
+	r, nc, handled := startChaosTestRuntime(t, chaosSeed(t, chaosDrop, true, false), NewChaosRules().SetDrop(0.5))
+
+	chaosSignal(t, r, 1)
+	require.Eventually(t, func() bool { return len(handled()) == 1 }, 10*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		info := chaosConsumerInfo(t, r, nc)
+		return info.NumAckPending == 0 && info.AckFloor.Stream == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(2), chaosConsumerInfo(t, r, nc).Delivered.Consumer, "delivered again after the ack wait")
+	require.Equal(t, []float64{1}, handled())
+}
+
+func TestChaosDuplicatedSignalIsAckedOnce(t *testing.T) {
+	r, nc, handled := startChaosTestRuntime(t, 1, NewChaosRules().SetDuplicate(1))
+
+	chaosSignal(t, r, 1)
+	require.Eventually(t, func() bool { return len(handled()) == 2 }, 10*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		info := chaosConsumerInfo(t, r, nc)
+		return info.NumAckPending == 0 && info.AckFloor.Stream == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(time.Second) // Longer than the ack wait
+	require.Equal(t, uint64(1), chaosConsumerInfo(t, r, nc).Delivered.Consumer, "acked, not redelivered")
+	require.Equal(t, []float64{1, 1}, handled())
+}
+
+func TestChaosReorderedSignalIsOvertaken(t *testing.T) {
+	r, _, handled := startChaosTestRuntime(t, chaosSeed(t, chaosReorder, true, false), NewChaosRules().SetReorder(0.5, time.Minute))
+
+	chaosSignal(t, r, 1)
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, handled(), "held")
+	chaosSignal(t, r, 2)
+	require.Eventually(t, func() bool { return len(handled()) == 2 }, 10*time.Second, 10*time.Millisecond)
+	require.Equal(t, []float64{2, 1}, handled())
+}
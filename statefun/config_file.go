@@ -0,0 +1,941 @@
+package statefun
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"gopkg.in/yaml.v3"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+A config file describes RuntimeConfig, cache.Config and FunctionTypeConfigs keyed by typename:
+
+	runtime:
+	  nats_url: nats://nats:4222
+	  hub_domain_name: hub
+	  request_timeout_sec: 30
+	  streams:
+	    function: {max_msgs: 10000, max_age: 24h}
+	  nats_connection:
+	    credentials_file: /etc/nats/app.creds
+	    ca_files: [/etc/nats/ca.pem]
+	    reconnect_wait: 1s
+	    reconnect_backoff_max: 30s
+	cache:
+	  id: main_cache
+	  lru_size: 100000
+	function_types:
+	  functions.app.handler:
+	    msg_ack_wait_ms: 20000
+	    worker_pool: {load_type: high}
+	    allowed_signal_providers: [jetstream]
+	    allowed_request_providers: [nats_core, golang_local]
+	    options: {any: json}
+
+YAML (.yaml, .yml) and JSON (.json) are supported, unknown fields are errors. Absent fields keep builder defaults,
+durations are strings like "1m30s".
+
+Every field can be overridden by an environment variable named by its path upper cased with non alphanumeric
+characters replaced by "_" and prefixed with envPrefix: FOLIAGE_RUNTIME_NATS_URL, FOLIAGE_RUNTIME_STREAMS_KV_MAX_AGE,
+FOLIAGE_FUNCTION_TYPES_FUNCTIONS_APP_HANDLER_WORKER_POOL_LOAD_TYPE. Lists are comma-separated, options are JSON.
+Function types can be overridden only if they are in the file.
+
+LoadedConfig.PrintEffective prints the configuration the runtime is built with, including defaults, secrets are masked.
+*/
+
+const (
+	ConfigFileCacheID = "main_cache"
+
+	configFileSecretMask = "***"
+)
+
+var (
+	ErrInvalidConfigFile = errors.New("invalid config file")
+
+	configFileEnvNameRegexp = regexp.MustCompile(`[^A-Z0-9]+`)
+
+	wpLoadTypeNames = map[string]WPLoadType{
+		"default":    WPLoadDefault,
+		"very_light": WPLoadVeryLight,
+		"light":      WPLoadLight,
+		"normal":     WPLoadNormal,
+		"high":       WPLoadHigh,
+		"very_high":  WPLoadVeryHigh,
+	}
+	signalProviderNames = map[string]sfPlugins.SignalProvider{
+		"auto":         sfPlugins.AutoSignalSelect,
+		"jetstream":    sfPlugins.JetstreamGlobalSignal,
+		"golang_local": sfPlugins.GolangLocalSignal,
+	}
+	requestProviderNames = map[string]sfPlugins.RequestProvider{
+		"auto":         sfPlugins.AutoRequestSelect,
+		"nats_core":    sfPlugins.NatsCoreGlobalRequest,
+		"golang_local": sfPlugins.GolangLocalRequest,
+	}
+)
+
+// ConfigDuration is a time.Duration written as a string in config files
+type ConfigDuration time.Duration
+
+func (d ConfigDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *ConfigDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"1m30s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = ConfigDuration(parsed)
+	return nil
+}
+
+type ConfigFile struct {
+	Runtime       *RuntimeConfigFile                 `json:"runtime,omitempty"`
+	Cache         *CacheConfigFile                   `json:"cache,omitempty"`
+	FunctionTypes map[string]*FunctionTypeConfigFile `json:"function_types,omitempty"`
+}
+
+type RuntimeConfigFile struct {
+	NatsURL                          *string                   `json:"nats_url,omitempty"`
+	HubDomainName                    *string                   `json:"hub_domain_name,omitempty"` // "" - JetStream domain name
+	HandlesDomainRouters             *bool                     `json:"handles_domain_routers,omitempty"`
+	TLS                              *bool                     `json:"tls,omitempty"`
+	NatsClusterMode                  *bool                     `json:"nats_cluster_mode,omitempty"`
+	NatsReplicas                     *int                      `json:"nats_replicas,omitempty"`
+	KVMutexLifeTimeSec               *int                      `json:"kv_mutex_lifetime_sec,omitempty"`
+	KVMutexIsOldPollingIntervalSec   *int                      `json:"kv_mutex_is_old_polling_interval_sec,omitempty"`
+	KVMutexIntrospection             *bool                     `json:"kv_mutex_introspection,omitempty"`
+	FunctionTypeIDLifetimeMs         *int                      `json:"function_type_id_lifetime_ms,omitempty"`
+	RequestTimeoutSec                *int                      `json:"request_timeout_sec,omitempty"`
+	GCIntervalSec                    *int                      `json:"gc_interval_sec,omitempty"`
+	ActivePassiveMode                *bool                     `json:"active_passive_mode,omitempty"`
+	PassiveInstanceIsReady           *bool                     `json:"passive_instance_is_ready,omitempty"`
+	WorkerPoolStuckTimeoutSec        *int                      `json:"worker_pool_stuck_timeout_sec,omitempty"`
+	LockDeadlockDetectionIntervalSec *int                      `json:"lock_deadlock_detection_interval_sec,omitempty"`
+	KVHistory                        *int                      `json:"kv_history,omitempty"`
+	Tenant                           *string                   `json:"tenant,omitempty"`
+	Principal                        *string                   `json:"principal,omitempty"`
+	Streams                          *StreamsConfigFile        `json:"streams,omitempty"`
+	NatsConnection                   *NatsConnectionConfigFile `json:"nats_connection,omitempty"`
+}
+
+type StreamsConfigFile struct {
+	Function *StreamConfigFile `json:"function,omitempty"`
+	System   *StreamConfigFile `json:"system,omitempty"`
+	KV       *StreamConfigFile `json:"kv,omitempty"`
+}
+
+type StreamConfigFile struct {
+	MaxMsgs  *int64          `json:"max_msgs,omitempty"`
+	MaxBytes *int64          `json:"max_bytes,omitempty"`
+	MaxAge   *ConfigDuration `json:"max_age,omitempty"`
+}
+
+type NatsConnectionConfigFile struct {
+	Name                 *string         `json:"name,omitempty"`
+	CredentialsFile      *string         `json:"credentials_file,omitempty"`
+	NKeySeedFile         *string         `json:"nkey_seed_file,omitempty"`
+	Token                *string         `json:"token,omitempty"`
+	User                 *string         `json:"user,omitempty"`
+	Password             *string         `json:"password,omitempty"`
+	TLS                  *bool           `json:"tls,omitempty"`
+	ClientCertFile       *string         `json:"client_cert_file,omitempty"`
+	ClientKeyFile        *string         `json:"client_key_file,omitempty"`
+	CAFiles              []string        `json:"ca_files,omitempty"`
+	TLSServerName        *string         `json:"tls_server_name,omitempty"`
+	InsecureSkipVerify   *bool           `json:"insecure_skip_verify,omitempty"`
+	MaxReconnects        *int            `json:"max_reconnects,omitempty"`
+	ReconnectWait        *ConfigDuration `json:"reconnect_wait,omitempty"`
+	ReconnectBackoffMax  *ConfigDuration `json:"reconnect_backoff_max,omitempty"`
+	ReconnectJitter      *ConfigDuration `json:"reconnect_jitter,omitempty"`
+	ReconnectBufSize     *int            `json:"reconnect_buf_size,omitempty"`
+	RetryOnFailedConnect *bool           `json:"retry_on_failed_connect,omitempty"`
+	ConnectTimeout       *ConfigDuration `json:"connect_timeout,omitempty"`
+	PingInterval         *ConfigDuration `json:"ping_interval,omitempty"`
+	MaxPingsOutstanding  *int            `json:"max_pings_outstanding,omitempty"`
+}
+
+type CacheConfigFile struct {
+	ID                                          *string `json:"id,omitempty"`
+	KVStorePrefix                               *string `json:"kv_store_prefix,omitempty"`
+	LRUSize                                     *int    `json:"lru_size,omitempty"`
+	LevelSubscriptionNotificationsBufferMaxSize *int    `json:"level_subscription_notifications_buffer_max_size,omitempty"`
+	LazyWriterValueProcessDelayMkS              *int    `json:"lazy_writer_value_process_delay_mks,omitempty"`
+	LazyWriterRepeatDelayMkS                    *int    `json:"lazy_writer_repeat_delay_mks,omitempty"`
+}
+
+type FunctionTypeConfigFile struct {
+	MsgAckWaitMs             *int                    `json:"msg_ack_wait_ms,omitempty"`
+	MsgMaxDeliver            *int                    `json:"msg_max_deliver,omitempty"`
+	IdChannelSize            *int                    `json:"id_channel_size,omitempty"`
+	BalanceNeeded            *bool                   `json:"balance_needed,omitempty"`
+	MutexLifeTimeSec         *int                    `json:"mutex_lifetime_sec,omitempty"`
+	MultipleInstancesAllowed *bool                   `json:"multiple_instances_allowed,omitempty"`
+	AllowedSignalProviders   []string                `json:"allowed_signal_providers,omitempty"`
+	AllowedRequestProviders  []string                `json:"allowed_request_providers,omitempty"`
+	WorkerPool               *WorkerPoolConfigFile   `json:"worker_pool,omitempty"`
+	ContextTTL               *ConfigDuration         `json:"context_ttl,omitempty"`
+	ContextExpireSignal      *bool                   `json:"context_expire_signal,omitempty"`
+	AllowedCallerTypenames   []string                `json:"allowed_caller_typenames,omitempty"`
+	AllowedCallerDomains     []string                `json:"allowed_caller_domains,omitempty"`
+	AllowedCallerPrincipals  []string                `json:"allowed_caller_principals,omitempty"`
+	Options                  *map[string]interface{} `json:"options,omitempty"`
+}
+
+// WorkerPoolConfigFile sets the pool by load type, explicit sizes override the ones of the load type
+type WorkerPoolConfigFile struct {
+	LoadType     *string         `json:"load_type,omitempty"`
+	MinWorkers   *int            `json:"min_workers,omitempty"`
+	MaxWorkers   *int            `json:"max_workers,omitempty"`
+	IdleTimeout  *ConfigDuration `json:"idle_timeout,omitempty"`
+	TaskQueueLen *int            `json:"task_queue_len,omitempty"`
+}
+
+// LoadedConfig holds configs built from a config file
+type LoadedConfig struct {
+	Runtime       *RuntimeConfig
+	Cache         *cache.Config
+	FunctionTypes map[string]*FunctionTypeConfig
+}
+
+// LoadConfigFile reads, overrides from the environment (envPrefix "" - no overrides) and validates a config file
+func LoadConfigFile(path string, envPrefix string) (*LoadedConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var format string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		format = "yaml"
+	case ".json":
+		format = "json"
+	default:
+		return nil, fmt.Errorf("%w: unknown format of %s, expected .yaml, .yml or .json", ErrInvalidConfigFile, path)
+	}
+	return LoadConfig(data, format, envPrefix)
+}
+
+// LoadConfig is LoadConfigFile for data in the format "yaml" or "json"
+func LoadConfig(data []byte, format string, envPrefix string) (*LoadedConfig, error) {
+	cf, err := parseConfigFile(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if len(envPrefix) > 0 {
+		if err := cf.applyEnv(envPrefix, os.LookupEnv); err != nil {
+			return nil, err
+		}
+	}
+	if err := cf.validate(); err != nil {
+		return nil, err
+	}
+	return cf.build(), nil
+}
+
+func parseConfigFile(data []byte, format string) (*ConfigFile, error) {
+	switch format {
+	case "json":
+	case "yaml":
+		var parsed interface{}
+		if err := yaml.Unmarshal(data, &parsed); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidConfigFile, err)
+		}
+		if parsed == nil {
+			parsed = map[string]interface{}{}
+		}
+		var err error
+		if data, err = json.Marshal(parsed); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidConfigFile, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown format %s", ErrInvalidConfigFile, format)
+	}
+
+	cf := &ConfigFile{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cf); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidConfigFile, err)
+	}
+	return cf, nil
+}
+
+// applyEnv overrides fields of the config file with environment variables named by their paths
+func (cf *ConfigFile) applyEnv(envPrefix string, lookupEnv func(string) (string, bool)) error {
+	if _, err := applyEnvToStruct(reflect.ValueOf(cf).Elem(), envPrefix, lookupEnv); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidConfigFile, err)
+	}
+	for typename, ftcf := range cf.FunctionTypes {
+		if ftcf == nil {
+			ftcf = &FunctionTypeConfigFile{}
+			cf.FunctionTypes[typename] = ftcf
+		}
+		if _, err := applyEnvToStruct(reflect.ValueOf(ftcf).Elem(), configFileEnvName(envPrefix, "function_types", typename), lookupEnv); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidConfigFile, err)
+		}
+	}
+	return nil
+}
+
+func configFileEnvName(tokens ...string) string {
+	return strings.Trim(configFileEnvNameRegexp.ReplaceAllString(strings.ToUpper(strings.Join(tokens, "_")), "_"), "_")
+}
+
+func applyEnvToStruct(v reflect.Value, envName string, lookupEnv func(string) (string, bool)) (bool, error) {
+	anySet := false
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		jsonName := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if len(jsonName) == 0 || field.Kind() == reflect.Map && field.Type().Elem().Kind() == reflect.Ptr {
+			continue // Function types are keyed by typename
+		}
+		fieldEnvName := configFileEnvName(envName, jsonName)
+
+		if field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Struct {
+			nested := reflect.New(field.Type().Elem())
+			if !field.IsNil() {
+				nested = field
+			}
+			set, err := applyEnvToStruct(nested.Elem(), fieldEnvName, lookupEnv)
+			if err != nil {
+				return false, err
+			}
+			if set {
+				field.Set(nested)
+				anySet = true
+			}
+			continue
+		}
+
+		value, ok := lookupEnv(fieldEnvName)
+		if !ok {
+			continue
+		}
+		if err := setFieldFromEnv(field, value); err != nil {
+			return false, fmt.Errorf("%s: %w", fieldEnvName, err)
+		}
+		anySet = true
+	}
+	return anySet, nil
+}
+
+func setFieldFromEnv(field reflect.Value, value string) error {
+	if field.Kind() == reflect.Slice {
+		list := []string{}
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); len(s) > 0 {
+				list = append(list, s)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+		return nil
+	}
+
+	target := reflect.New(field.Type().Elem())
+	switch target.Interface().(type) {
+	case *string:
+		target.Elem().SetString(value)
+	case *bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		target.Elem().SetBool(b)
+	case *int, *int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		target.Elem().SetInt(n)
+	case *ConfigDuration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		target.Elem().SetInt(int64(d))
+	case *map[string]interface{}:
+		if err := json.Unmarshal([]byte(value), target.Interface()); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported type %s", field.Type())
+	}
+	field.Set(target)
+	return nil
+}
+
+func (cf *ConfigFile) validate() error {
+	errs := []error{}
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, a...))
+		}
+	}
+	positive := func(v *int, name string) {
+		check(v == nil || *v > 0, "%s must be positive", name)
+	}
+	notNegative := func(v *int, name string) {
+		check(v == nil || *v >= 0, "%s must not be negative", name)
+	}
+
+	if rcf := cf.Runtime; rcf != nil {
+		check(rcf.NatsURL == nil || len(*rcf.NatsURL) > 0, "runtime.nats_url must not be empty")
+		positive(rcf.NatsReplicas, "runtime.nats_replicas")
+		positive(rcf.KVMutexLifeTimeSec, "runtime.kv_mutex_lifetime_sec")
+		positive(rcf.KVMutexIsOldPollingIntervalSec, "runtime.kv_mutex_is_old_polling_interval_sec")
+		positive(rcf.FunctionTypeIDLifetimeMs, "runtime.function_type_id_lifetime_ms")
+		positive(rcf.RequestTimeoutSec, "runtime.request_timeout_sec")
+		positive(rcf.GCIntervalSec, "runtime.gc_interval_sec")
+		notNegative(rcf.WorkerPoolStuckTimeoutSec, "runtime.worker_pool_stuck_timeout_sec")
+		notNegative(rcf.LockDeadlockDetectionIntervalSec, "runtime.lock_deadlock_detection_interval_sec")
+		check(rcf.KVHistory == nil || (*rcf.KVHistory >= 1 && *rcf.KVHistory <= 64), "runtime.kv_history must be 1..64")
+		if rcf.Tenant != nil {
+			if err := validateTenant(*rcf.Tenant); err != nil {
+				errs = append(errs, fmt.Errorf("runtime.tenant: %w", err))
+			}
+		}
+		if ncf := rcf.NatsConnection; ncf != nil {
+			check(ncf.CredentialsFile == nil || ncf.NKeySeedFile == nil, "runtime.nats_connection: credentials_file and nkey_seed_file cannot be used together")
+			check((ncf.ClientCertFile == nil) == (ncf.ClientKeyFile == nil), "runtime.nats_connection: client_cert_file and client_key_file must be set together")
+			check(ncf.ReconnectBackoffMax == nil || *ncf.ReconnectBackoffMax >= 0, "runtime.nats_connection.reconnect_backoff_max must not be negative")
+		}
+	}
+
+	if ccf := cf.Cache; ccf != nil {
+		check(ccf.ID == nil || len(*ccf.ID) > 0, "cache.id must not be empty")
+		check(ccf.KVStorePrefix == nil || len(*ccf.KVStorePrefix) > 0, "cache.kv_store_prefix must not be empty")
+		positive(ccf.LRUSize, "cache.lru_size")
+		positive(ccf.LevelSubscriptionNotificationsBufferMaxSize, "cache.level_subscription_notifications_buffer_max_size")
+		notNegative(ccf.LazyWriterValueProcessDelayMkS, "cache.lazy_writer_value_process_delay_mks")
+		notNegative(ccf.LazyWriterRepeatDelayMkS, "cache.lazy_writer_repeat_delay_mks")
+	}
+
+	for _, typename := range cf.functionTypenames() {
+		ftcf := cf.FunctionTypes[typename]
+		prefix := "function_types." + typename
+		check(len(typename) > 0 && !strings.ContainsAny(typename, " \t*>"), "%s: invalid typename", prefix)
+		if ftcf == nil {
+			continue
+		}
+		positive(ftcf.MsgAckWaitMs, prefix+".msg_ack_wait_ms")
+		check(ftcf.MsgMaxDeliver == nil || *ftcf.MsgMaxDeliver > 0 || *ftcf.MsgMaxDeliver == -1, "%s.msg_max_deliver must be positive or -1", prefix)
+		positive(ftcf.IdChannelSize, prefix+".id_channel_size")
+		positive(ftcf.MutexLifeTimeSec, prefix+".mutex_lifetime_sec")
+		check(ftcf.ContextTTL == nil || *ftcf.ContextTTL >= 0, "%s.context_ttl must not be negative", prefix)
+		for _, name := range ftcf.AllowedSignalProviders {
+			_, ok := signalProviderNames[name]
+			check(ok, "%s.allowed_signal_providers: unknown provider %q, expected one of %s", prefix, name, configFileNames(signalProviderNames))
+		}
+		for _, name := range ftcf.AllowedRequestProviders {
+			_, ok := requestProviderNames[name]
+			check(ok, "%s.allowed_request_providers: unknown provider %q, expected one of %s", prefix, name, configFileNames(requestProviderNames))
+		}
+		if wpcf := ftcf.WorkerPool; wpcf != nil {
+			if wpcf.LoadType != nil {
+				_, ok := wpLoadTypeNames[*wpcf.LoadType]
+				check(ok, "%s.worker_pool.load_type: unknown load type %q, expected one of %s", prefix, *wpcf.LoadType, configFileNames(wpLoadTypeNames))
+			}
+			notNegative(wpcf.MinWorkers, prefix+".worker_pool.min_workers")
+			positive(wpcf.MaxWorkers, prefix+".worker_pool.max_workers")
+			positive(wpcf.TaskQueueLen, prefix+".worker_pool.task_queue_len")
+			check(wpcf.MinWorkers == nil || wpcf.MaxWorkers == nil || *wpcf.MinWorkers <= *wpcf.MaxWorkers, "%s.worker_pool.min_workers must not exceed max_workers", prefix)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%w:\n%w", ErrInvalidConfigFile, errors.Join(errs...))
+	}
+	return nil
+}
+
+func configFileNames[T any](names map[string]T) string {
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+func (cf *ConfigFile) functionTypenames() []string {
+	typenames := make([]string, 0, len(cf.FunctionTypes))
+	for typename := range cf.FunctionTypes {
+		typenames = append(typenames, typename)
+	}
+	sort.Strings(typenames)
+	return typenames
+}
+
+func (cf *ConfigFile) build() *LoadedConfig {
+	lc := &LoadedConfig{
+		Runtime:       NewRuntimeConfig(),
+		Cache:         cache.NewCacheConfig(ConfigFileCacheID),
+		FunctionTypes: map[string]*FunctionTypeConfig{},
+	}
+	if cf.Runtime != nil {
+		cf.Runtime.apply(lc.Runtime)
+	}
+	if cf.Cache != nil {
+		if cf.Cache.ID != nil {
+			lc.Cache = cache.NewCacheConfig(*cf.Cache.ID)
+		}
+		cf.Cache.apply(lc.Cache)
+	}
+	for typename, ftcf := range cf.FunctionTypes {
+		ftc := NewFunctionTypeConfig()
+		if ftcf != nil {
+			ftcf.apply(ftc)
+		}
+		lc.FunctionTypes[typename] = ftc
+	}
+	return lc
+}
+
+func (rcf *RuntimeConfigFile) apply(ro *RuntimeConfig) {
+	if rcf.NatsURL != nil {
+		ro.SetNatsURL(*rcf.NatsURL)
+	}
+	if rcf.HubDomainName != nil {
+		ro.SetHubDomainName(*rcf.HubDomainName)
+	}
+	if rcf.HandlesDomainRouters != nil {
+		ro.SetDomainRoutersHandling(*rcf.HandlesDomainRouters)
+	}
+	if rcf.TLS != nil {
+		ro.SetTLS(*rcf.TLS)
+	}
+	if rcf.NatsClusterMode != nil {
+		ro.EnableNatsCluster(*rcf.NatsClusterMode)
+	}
+	if rcf.NatsReplicas != nil {
+		ro.SetNatsReplicas(*rcf.NatsReplicas)
+	}
+	if rcf.KVMutexLifeTimeSec != nil {
+		ro.SetKVMutexLifeTimeSec(*rcf.KVMutexLifeTimeSec)
+	}
+	if rcf.KVMutexIsOldPollingIntervalSec != nil {
+		ro.SetKVMutexIsOldPollingIntervalSec(*rcf.KVMutexIsOldPollingIntervalSec)
+	}
+	if rcf.KVMutexIntrospection != nil {
+		ro.SetKVMutexIntrospection(*rcf.KVMutexIntrospection)
+	}
+	if rcf.FunctionTypeIDLifetimeMs != nil {
+		ro.SetFunctionTypeIDLifetimeMs(*rcf.FunctionTypeIDLifetimeMs)
+	}
+	if rcf.RequestTimeoutSec != nil {
+		ro.SetRequestTimeoutSec(*rcf.RequestTimeoutSec)
+	}
+	if rcf.GCIntervalSec != nil {
+		ro.SetGCIntervalSec(*rcf.GCIntervalSec)
+	}
+	if rcf.ActivePassiveMode != nil {
+		ro.SetActivePassiveMode(*rcf.ActivePassiveMode)
+	}
+	if rcf.PassiveInstanceIsReady != nil {
+		ro.SetPassiveInstanceIsReady(*rcf.PassiveInstanceIsReady)
+	}
+	if rcf.WorkerPoolStuckTimeoutSec != nil {
+		ro.SetWorkerPoolStuckTimeoutSec(*rcf.WorkerPoolStuckTimeoutSec)
+	}
+	if rcf.LockDeadlockDetectionIntervalSec != nil {
+		ro.SetLockDeadlockDetectionIntervalSec(*rcf.LockDeadlockDetectionIntervalSec)
+	}
+	if rcf.KVHistory != nil {
+		ro.SetKVHistory(uint8(*rcf.KVHistory))
+	}
+	if rcf.Tenant != nil {
+		ro.SetTenant(*rcf.Tenant)
+	}
+	if rcf.Principal != nil {
+		ro.SetPrincipal(*rcf.Principal)
+	}
+	if rcf.Streams != nil {
+		rcf.Streams.Function.apply(ro, StreamTypeFunction)
+		rcf.Streams.System.apply(ro, StreamTypeSystem)
+		rcf.Streams.KV.apply(ro, StreamTypeKV)
+	}
+	if rcf.NatsConnection != nil {
+		ro.SetNatsConnection(rcf.NatsConnection.build())
+	}
+}
+
+func (scf *StreamConfigFile) apply(ro *RuntimeConfig, streamType StreamType) {
+	if scf == nil {
+		return
+	}
+	if scf.MaxMsgs != nil {
+		ro.SetStreamMaxMessages(streamType, *scf.MaxMsgs)
+	}
+	if scf.MaxBytes != nil {
+		ro.SetStreamMaxBytes(streamType, *scf.MaxBytes)
+	}
+	if scf.MaxAge != nil {
+		ro.SetStreamMaxAge(streamType, time.Duration(*scf.MaxAge))
+	}
+}
+
+func (ncf *NatsConnectionConfigFile) build() *NatsConnectionConfig {
+	nc := NewNatsConnectionConfig()
+	if ncf.Name != nil {
+		nc.SetName(*ncf.Name)
+	}
+	if ncf.CredentialsFile != nil {
+		nc.SetCredentialsFile(*ncf.CredentialsFile)
+	}
+	if ncf.NKeySeedFile != nil {
+		nc.SetNKeySeedFile(*ncf.NKeySeedFile)
+	}
+	if ncf.Token != nil {
+		nc.SetToken(*ncf.Token)
+	}
+	if ncf.User != nil {
+		nc.SetUserInfo(*ncf.User, valueOrZero(ncf.Password))
+	}
+	if ncf.TLS != nil {
+		nc.SetTLS(*ncf.TLS)
+	}
+	if ncf.ClientCertFile != nil && ncf.ClientKeyFile != nil {
+		nc.SetClientCertificate(*ncf.ClientCertFile, *ncf.ClientKeyFile)
+	}
+	for _, caFile := range ncf.CAFiles {
+		nc.AddCAFile(caFile)
+	}
+	if ncf.TLSServerName != nil {
+		nc.SetTLSServerName(*ncf.TLSServerName)
+	}
+	if ncf.InsecureSkipVerify != nil {
+		nc.SetInsecureSkipVerify(*ncf.InsecureSkipVerify)
+	}
+	if ncf.MaxReconnects != nil {
+		nc.SetMaxReconnects(*ncf.MaxReconnects)
+	}
+	if ncf.ReconnectBackoffMax != nil {
+		nc.SetReconnectBackoff(time.Duration(valueOrZero(ncf.ReconnectWait)), time.Duration(*ncf.ReconnectBackoffMax))
+	} else if ncf.ReconnectWait != nil {
+		nc.SetReconnectWait(time.Duration(*ncf.ReconnectWait))
+	}
+	if ncf.ReconnectJitter != nil {
+		nc.SetReconnectJitter(time.Duration(*ncf.ReconnectJitter))
+	}
+	if ncf.ReconnectBufSize != nil {
+		nc.SetReconnectBufSize(*ncf.ReconnectBufSize)
+	}
+	if ncf.RetryOnFailedConnect != nil {
+		nc.SetRetryOnFailedConnect(*ncf.RetryOnFailedConnect)
+	}
+	if ncf.ConnectTimeout != nil {
+		nc.SetConnectTimeout(time.Duration(*ncf.ConnectTimeout))
+	}
+	if ncf.PingInterval != nil || ncf.MaxPingsOutstanding != nil {
+		nc.SetPingInterval(time.Duration(valueOrZero(ncf.PingInterval)), valueOrZero(ncf.MaxPingsOutstanding))
+	}
+	return nc
+}
+
+func (ccf *CacheConfigFile) apply(cc *cache.Config) {
+	if ccf.KVStorePrefix != nil {
+		cc.SetKVStorePrefix(*ccf.KVStorePrefix)
+	}
+	if ccf.LRUSize != nil {
+		cc.SetLRUSize(*ccf.LRUSize)
+	}
+	if ccf.LevelSubscriptionNotificationsBufferMaxSize != nil {
+		cc.SetLevelSubscriptionNotificationsBufferMaxSize(*ccf.LevelSubscriptionNotificationsBufferMaxSize)
+	}
+	if ccf.LazyWriterValueProcessDelayMkS != nil {
+		cc.SetLazyWriterValueProcessDelayMkS(*ccf.LazyWriterValueProcessDelayMkS)
+	}
+	if ccf.LazyWriterRepeatDelayMkS != nil {
+		cc.SetLazyWriterRepeatDelayMkS(*ccf.LazyWriterRepeatDelayMkS)
+	}
+}
+
+func (ftcf *FunctionTypeConfigFile) apply(ftc *FunctionTypeConfig) {
+	if ftcf.MsgAckWaitMs != nil {
+		ftc.SetMsgAckWaitMs(*ftcf.MsgAckWaitMs)
+	}
+	if ftcf.MsgMaxDeliver != nil {
+		ftc.SetMsgMaxDeliver(*ftcf.MsgMaxDeliver)
+	}
+	if ftcf.IdChannelSize != nil {
+		ftc.SetIdChannelSize(*ftcf.IdChannelSize)
+	}
+	if ftcf.BalanceNeeded != nil {
+		ftc.SetBalanceNeeded(*ftcf.BalanceNeeded)
+	}
+	if ftcf.MutexLifeTimeSec != nil {
+		ftc.SetMutexLifeTimeSec(*ftcf.MutexLifeTimeSec)
+	}
+	if ftcf.MultipleInstancesAllowed != nil {
+		ftc.SetMultipleInstancesAllowance(*ftcf.MultipleInstancesAllowed)
+	}
+	if ftcf.AllowedSignalProviders != nil {
+		providers := []sfPlugins.SignalProvider{}
+		for _, name := range ftcf.AllowedSignalProviders {
+			providers = append(providers, signalProviderNames[name])
+		}
+		ftc.SetAllowedSignalProviders(providers...)
+	}
+	if ftcf.AllowedRequestProviders != nil {
+		providers := []sfPlugins.RequestProvider{}
+		for _, name := range ftcf.AllowedRequestProviders {
+			providers = append(providers, requestProviderNames[name])
+		}
+		ftc.SetAllowedRequestProviders(providers...)
+	}
+	if wpcf := ftcf.WorkerPool; wpcf != nil {
+		wpc := ftc.functionWorkerPoolConfig
+		if wpcf.LoadType != nil {
+			wpc = NewSFWorkerPoolConfig(wpLoadTypeNames[*wpcf.LoadType])
+		}
+		if wpcf.MinWorkers != nil {
+			wpc.MinWorkers = *wpcf.MinWorkers
+		}
+		if wpcf.MaxWorkers != nil {
+			wpc.MaxWorkers = *wpcf.MaxWorkers
+		}
+		if wpcf.IdleTimeout != nil {
+			wpc.IdleTimeout = time.Duration(*wpcf.IdleTimeout)
+		}
+		if wpcf.TaskQueueLen != nil {
+			wpc.TaskQueueLen = *wpcf.TaskQueueLen
+		}
+		ftc.SetWorkerPoolConfig(wpc)
+	}
+	if ftcf.ContextTTL != nil {
+		ftc.SetContextTTL(time.Duration(*ftcf.ContextTTL))
+	}
+	if ftcf.ContextExpireSignal != nil {
+		ftc.SetContextExpireSignal(*ftcf.ContextExpireSignal)
+	}
+	if ftcf.AllowedCallerTypenames != nil {
+		ftc.SetAllowedCallerTypenames(ftcf.AllowedCallerTypenames...)
+	}
+	if ftcf.AllowedCallerDomains != nil {
+		ftc.SetAllowedCallerDomains(ftcf.AllowedCallerDomains...)
+	}
+	if ftcf.AllowedCallerPrincipals != nil {
+		ftc.SetAllowedCallerPrincipals(ftcf.AllowedCallerPrincipals...)
+	}
+	if ftcf.Options != nil {
+		options := easyjson.NewJSON(*ftcf.Options)
+		ftc.SetOptions(&options)
+	}
+}
+
+// FunctionType returns the config of the typename from the file or a default one if the file has no such typename
+func (lc *LoadedConfig) FunctionType(typename string) *FunctionTypeConfig {
+	if ftc, ok := lc.FunctionTypes[typename]; ok {
+		return ftc
+	}
+	return NewFunctionTypeConfig()
+}
+
+// Effective describes the loaded configs with all their values including defaults, secrets are masked
+func (lc *LoadedConfig) Effective() *ConfigFile {
+	cf := &ConfigFile{
+		Runtime:       effectiveRuntimeConfigFile(lc.Runtime),
+		Cache:         effectiveCacheConfigFile(lc.Cache),
+		FunctionTypes: map[string]*FunctionTypeConfigFile{},
+	}
+	for typename, ftc := range lc.FunctionTypes {
+		cf.FunctionTypes[typename] = effectiveFunctionTypeConfigFile(ftc)
+	}
+	return cf
+}
+
+// PrintEffective writes the effective configuration in the format "yaml" or "json"
+func (lc *LoadedConfig) PrintEffective(w io.Writer, format string) error {
+	data, err := json.MarshalIndent(lc.Effective(), "", "  ")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "json":
+		_, err = w.Write(append(data, '\n'))
+		return err
+	case "yaml":
+		var generic interface{}
+		if err := json.Unmarshal(data, &generic); err != nil {
+			return err
+		}
+		encoder := yaml.NewEncoder(w)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(generic); err != nil {
+			return err
+		}
+		return encoder.Close()
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+}
+
+func effectiveRuntimeConfigFile(ro *RuntimeConfig) *RuntimeConfigFile {
+	rcf := &RuntimeConfigFile{
+		NatsURL:                          ptr(maskURLPassword(ro.natsURL)),
+		HubDomainName:                    ptr(ro.desiredHUBDomainName),
+		HandlesDomainRouters:             ptr(ro.handlesDomainRouters),
+		TLS:                              ptr(ro.enableTLS),
+		NatsClusterMode:                  ptr(ro.enableNatsClusterMode),
+		NatsReplicas:                     ptr(ro.natsReplicasCount),
+		KVMutexLifeTimeSec:               ptr(ro.kvMutexLifeTimeSec),
+		KVMutexIsOldPollingIntervalSec:   ptr(ro.kvMutexIsOldPollingIntervalSec),
+		KVMutexIntrospection:             ptr(ro.kvMutexIntrospection),
+		FunctionTypeIDLifetimeMs:         ptr(ro.functionTypeIDLifetimeMs),
+		RequestTimeoutSec:                ptr(ro.requestTimeoutSec),
+		GCIntervalSec:                    ptr(ro.gcIntervalSec),
+		ActivePassiveMode:                ptr(ro.activePassiveMode),
+		PassiveInstanceIsReady:           ptr(ro.passiveInstanceIsReady),
+		WorkerPoolStuckTimeoutSec:        ptr(ro.workerPoolStuckTimeoutSec),
+		LockDeadlockDetectionIntervalSec: ptr(ro.lockDeadlockDetectionIntervalSec),
+		KVHistory:                        ptr(int(ro.kvHistory)),
+		Tenant:                           ptr(ro.tenant),
+		Principal:                        ptr(ro.principal),
+		Streams: &StreamsConfigFile{
+			Function: &StreamConfigFile{MaxMsgs: ptr(ro.ftStreamMaxMsgs), MaxBytes: ptr(ro.ftStreamMaxBytes), MaxAge: ptr(ConfigDuration(ro.ftStreamMaxAge))},
+			System:   &StreamConfigFile{MaxMsgs: ptr(ro.sysStreamMaxMsgs), MaxBytes: ptr(ro.sysStreamMaxBytes), MaxAge: ptr(ConfigDuration(ro.sysStreamMaxAge))},
+			KV:       &StreamConfigFile{MaxMsgs: ptr(ro.kvStreamMaxMsgs), MaxBytes: ptr(ro.kvStreamMaxBytes), MaxAge: ptr(ConfigDuration(ro.kvStreamMaxAge))},
+		},
+	}
+	if nc := ro.natsConnection; nc != nil {
+		ncf := &NatsConnectionConfigFile{
+			Name:                 ptrIfSet(nc.name),
+			CredentialsFile:      ptrIfSet(nc.credentialsFile),
+			NKeySeedFile:         ptrIfSet(nc.nkeySeedFile),
+			User:                 ptrIfSet(nc.user),
+			TLS:                  ptr(nc.tls),
+			ClientCertFile:       ptrIfSet(nc.clientCertFile),
+			ClientKeyFile:        ptrIfSet(nc.clientKeyFile),
+			CAFiles:              nc.caFiles,
+			TLSServerName:        ptrIfSet(nc.tlsServerName),
+			InsecureSkipVerify:   ptr(nc.insecureSkipVerify),
+			MaxReconnects:        nc.maxReconnects,
+			ReconnectWait:        ptrIfSet(ConfigDuration(nc.reconnectWait)),
+			ReconnectBackoffMax:  ptrIfSet(ConfigDuration(nc.reconnectBackoffMax)),
+			ReconnectJitter:      ptrIfSet(ConfigDuration(nc.reconnectJitter)),
+			ReconnectBufSize:     ptrIfSet(nc.reconnectBufSize),
+			RetryOnFailedConnect: ptr(nc.retryOnFailedConnect),
+			ConnectTimeout:       ptrIfSet(ConfigDuration(nc.connectTimeout)),
+			PingInterval:         ptrIfSet(ConfigDuration(nc.pingInterval)),
+			MaxPingsOutstanding:  ptrIfSet(nc.maxPingsOutstanding),
+		}
+		if len(nc.token) > 0 {
+			ncf.Token = ptr(configFileSecretMask)
+		}
+		if len(nc.password) > 0 {
+			ncf.Password = ptr(configFileSecretMask)
+		}
+		rcf.NatsConnection = ncf
+	}
+	return rcf
+}
+
+func effectiveCacheConfigFile(cc *cache.Config) *CacheConfigFile {
+	return &CacheConfigFile{
+		ID:            ptr(cc.GetId()),
+		KVStorePrefix: ptr(cc.GetKVStorePrefix()),
+		LRUSize:       ptr(cc.GetLRUSize()),
+		LevelSubscriptionNotificationsBufferMaxSize: ptr(cc.GetLevelSubscriptionNotificationsBufferMaxSize()),
+		LazyWriterValueProcessDelayMkS:              ptr(cc.GetLazyWriterValueProcessDelayMkS()),
+		LazyWriterRepeatDelayMkS:                    ptr(cc.GetLazyWriterRepeatDelayMkS()),
+	}
+}
+
+func effectiveFunctionTypeConfigFile(ftc *FunctionTypeConfig) *FunctionTypeConfigFile {
+	ftcf := &FunctionTypeConfigFile{
+		MsgAckWaitMs:             ptr(ftc.msgAckWaitMs),
+		MsgMaxDeliver:            ptr(ftc.msgMaxDeliver),
+		IdChannelSize:            ptr(ftc.idChannelSize),
+		BalanceNeeded:            ptr(ftc.balanceNeeded),
+		MutexLifeTimeSec:         ptr(ftc.mutexLifeTimeSec),
+		MultipleInstancesAllowed: ptr(ftc.multipleInstancesAllowed),
+		AllowedSignalProviders:   []string{},
+		AllowedRequestProviders:  []string{},
+		WorkerPool: &WorkerPoolConfigFile{
+			MinWorkers:   ptr(ftc.functionWorkerPoolConfig.MinWorkers),
+			MaxWorkers:   ptr(ftc.functionWorkerPoolConfig.MaxWorkers),
+			IdleTimeout:  ptr(ConfigDuration(ftc.functionWorkerPoolConfig.IdleTimeout)),
+			TaskQueueLen: ptr(ftc.functionWorkerPoolConfig.TaskQueueLen),
+		},
+		ContextTTL:              ptr(ConfigDuration(ftc.contextTTL)),
+		ContextExpireSignal:     ptr(ftc.contextExpireSignal),
+		AllowedCallerTypenames:  ftc.allowedCallerTypenames,
+		AllowedCallerDomains:    ftc.allowedCallerDomains,
+		AllowedCallerPrincipals: ftc.allowedCallerPrincipals,
+	}
+	for name, provider := range signalProviderNames {
+		if _, ok := ftc.allowedSignalProviders[provider]; ok {
+			ftcf.AllowedSignalProviders = append(ftcf.AllowedSignalProviders, name)
+		}
+	}
+	sort.Strings(ftcf.AllowedSignalProviders)
+	for name, provider := range requestProviderNames {
+		if _, ok := ftc.allowedRequestProviders[provider]; ok {
+			ftcf.AllowedRequestProviders = append(ftcf.AllowedRequestProviders, name)
+		}
+	}
+	sort.Strings(ftcf.AllowedRequestProviders)
+	if ftc.options != nil {
+		if options, ok := ftc.options.Value.(map[string]interface{}); ok {
+			ftcf.Options = &options
+		}
+	}
+	return ftcf
+}
+
+func maskURLPassword(natsURLs string) string {
+	masked := []string{}
+	for _, natsURL := range strings.Split(natsURLs, ",") {
+		if u, err := url.Parse(natsURL); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), configFileSecretMask)
+				natsURL = strings.Replace(u.String(), url.QueryEscape(configFileSecretMask), configFileSecretMask, 1)
+			}
+		}
+		masked = append(masked, natsURL)
+	}
+	return strings.Join(masked, ",")
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+// ptrIfSet leaves zero values, which mean nats.go defaults, out of the effective configuration
+func ptrIfSet[T comparable](v T) *T {
+	var zero T
+	if v == zero {
+		return nil
+	}
+	return &v
+}
+
+func valueOrZero[T any](v *T) T {
+	var zero T
+	if v == nil {
+		return zero
+	}
+	return *v
+}
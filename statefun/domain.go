@@ -6,6 +6,7 @@ import (
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/nats.go"
@@ -33,7 +34,7 @@ const (
 
 	streamPrefix = "$JS.%s.API"
 
-	hubEventStreamName        = "hub_events"
+	hubEventStreamName        = "hub_events" // Shared by all tenants, see tenant.go
 	domainIngressStreamName   = "domain_ingress"
 	domainEgressStreamName    = "domain_egress"
 	deadLetterQueueStreamName = "domain_dlq"
@@ -44,7 +45,9 @@ const (
 )
 
 type Domain struct {
+	tenant                  string
 	hubDomainName           string
+	hubJSDomainName         string // JetStream domain of the hub, not namespaced with the tenant
 	name                    string
 	weakClusterDomains      map[string]struct{}
 	weakClusterDomainsMutex sync.Mutex
@@ -55,7 +58,9 @@ type Domain struct {
 	kvSC                    streamConfig
 
 	kv    nats.KeyValue
-	cache *cache.Store
+	cache atomic.Pointer[cache.Store] // Set once the initial sync with KV is finished, read by health checks
+
+	routersReady atomic.Bool
 }
 
 type streamConfig struct {
@@ -63,9 +68,10 @@ type streamConfig struct {
 	maxMsgs       int64
 	maxBytes      int64
 	maxAge        time.Duration
+	history       uint8
 }
 
-func NewDomain(nc *nats.Conn, js nats.JetStreamContext, desiredHubDomainName string, ftSC, sysSC, kvSC streamConfig) (dm *Domain, e error) {
+func NewDomain(nc *nats.Conn, js nats.JetStreamContext, tenant string, desiredHubDomainName string, ftSC, sysSC, kvSC streamConfig) (dm *Domain, e error) {
 	accInfo, err := js.AccountInfo()
 	if err != nil {
 		return nil, err
@@ -86,8 +92,14 @@ func NewDomain(nc *nats.Conn, js nats.JetStreamContext, desiredHubDomainName str
 		}
 	}
 
+	hubJSDomainName := hubDomainName
+	hubDomainName = tenantName(tenant, hubDomainName)
+	thisDomainName = tenantName(tenant, thisDomainName)
+
 	domain := &Domain{
+		tenant:             tenant,
 		hubDomainName:      hubDomainName,
+		hubJSDomainName:    hubJSDomainName,
 		name:               thisDomainName,
 		weakClusterDomains: map[string]struct{}{thisDomainName: {}},
 		nc:                 nc,
@@ -109,7 +121,7 @@ func (dm *Domain) Name() string {
 }
 
 func (dm *Domain) Cache() *cache.Store {
-	return dm.cache
+	return dm.cache.Load()
 }
 
 // Get all domains in weak cluster including this one
@@ -131,7 +143,7 @@ func (dm *Domain) SetWeakClusterDomains(weakClusterDomains []string) {
 
 	dm.weakClusterDomains = map[string]struct{}{dm.name: {}}
 	for _, dmn := range weakClusterDomains {
-		dm.weakClusterDomains[dmn] = struct{}{}
+		dm.weakClusterDomains[dm.tenantName(dmn)] = struct{}{}
 	}
 }
 
@@ -262,6 +274,7 @@ func (dm *Domain) start(cacheConfig *cache.Config, createDomainRouters bool) err
 	if kv, err := dm.js.KeyValue(bucketName); err == nil {
 		dm.kv = kv
 		kvExists = true
+		system.MsgOnErrorReturn(dm.increaseKVHistory(bucketName))
 	}
 	if !kvExists {
 		var err error
@@ -270,6 +283,7 @@ func (dm *Domain) start(cacheConfig *cache.Config, createDomainRouters bool) err
 			Replicas: dm.kvSC.replicasCount,
 			MaxBytes: dm.kvSC.maxBytes,
 			TTL:      dm.kvSC.maxAge,
+			History:  dm.kvSC.history,
 		})
 		if err != nil {
 			return err
@@ -303,9 +317,10 @@ func (dm *Domain) start(cacheConfig *cache.Config, createDomainRouters bool) err
 			return err
 		}
 	}
+	dm.routersReady.Store(true)
 
 	lg.Logln(lg.TraceLevel, "Initializing the cache store...")
-	dm.cache = cache.NewCacheStore(context.Background(), cacheConfig, dm.js, dm.kv)
+	dm.cache.Store(cache.NewCacheStore(context.Background(), cacheConfig, dm.js, dm.kv))
 	lg.Logln(lg.TraceLevel, "Cache store inited!")
 
 	return nil
@@ -315,7 +330,7 @@ func (dm *Domain) createIngressRouter() error {
 	targetSubjectCalculator := func(msg *nats.Msg) (string, error) {
 		return fmt.Sprintf(DomainIngressSubjectsTmpl, dm.name, msg.Subject), nil
 	}
-	return dm.createRouter(domainIngressStreamName, fmt.Sprintf(FromGlobalSignalTmpl, dm.name, ">"), targetSubjectCalculator)
+	return dm.createRouter(dm.streamName(domainIngressStreamName), fmt.Sprintf(FromGlobalSignalTmpl, dm.name, ">"), targetSubjectCalculator)
 }
 
 func (dm *Domain) createEgressRouter() error {
@@ -333,7 +348,7 @@ func (dm *Domain) createEgressRouter() error {
 		}
 		return targetSubject, nil
 	}
-	return dm.createRouter(domainEgressStreamName, fmt.Sprintf(DomainEgressSubjectsTmpl, dm.name, ">"), targetSubjectCalculator)
+	return dm.createRouter(dm.streamName(domainEgressStreamName), fmt.Sprintf(DomainEgressSubjectsTmpl, dm.name, ">"), targetSubjectCalculator)
 }
 
 func (dm *Domain) createHubSignalStream() error {
@@ -355,7 +370,7 @@ func (dm *Domain) createIngresSignalStream() error {
 		}
 	} else {
 		ext := &nats.ExternalStream{
-			APIPrefix: fmt.Sprintf(streamPrefix, dm.hubDomainName),
+			APIPrefix: fmt.Sprintf(streamPrefix, dm.hubJSDomainName),
 		}
 		ss = &nats.StreamSource{
 			Name:          hubEventStreamName,
@@ -364,7 +379,7 @@ func (dm *Domain) createIngresSignalStream() error {
 		}
 	}
 	sc := &nats.StreamConfig{
-		Name:      domainIngressStreamName,
+		Name:      dm.streamName(domainIngressStreamName),
 		Sources:   []*nats.StreamSource{ss},
 		Retention: nats.InterestPolicy,
 		Replicas:  dm.sysSC.replicasCount,
@@ -377,7 +392,7 @@ func (dm *Domain) createIngresSignalStream() error {
 
 func (dm *Domain) createEgressSignalStream() error {
 	sc := &nats.StreamConfig{
-		Name:      domainEgressStreamName,
+		Name:      dm.streamName(domainEgressStreamName),
 		Subjects:  []string{fmt.Sprintf(DomainEgressSubjectsTmpl, dm.name, ">")},
 		Retention: nats.InterestPolicy,
 		Replicas:  dm.sysSC.replicasCount,
@@ -390,7 +405,7 @@ func (dm *Domain) createEgressSignalStream() error {
 
 func (dm *Domain) createDLQStream() error {
 	sc := &nats.StreamConfig{
-		Name:      deadLetterQueueStreamName,
+		Name:      dm.streamName(deadLetterQueueStreamName),
 		Retention: nats.LimitsPolicy,
 	}
 	return dm.createStreamIfNotExists(sc)
@@ -455,12 +470,12 @@ func (dm *Domain) createRouter(sourceStreamName string, subject string, tsc targ
 					system.MsgOnErrorReturn(msg.Ack())
 					return
 				} else {
-					dlqMsg := dlqMsgBuilder(msg.Subject, sourceStreamName, dm.name, err.Error(), msg.Data)
+					dlqMsg := dm.dlqMsgBuilder(msg.Subject, sourceStreamName, err.Error(), msg.Data)
 					_, err := dm.js.PublishMsg(dlqMsg)
 					switch sourceStreamName {
-					case domainEgressStreamName:
+					case dm.streamName(domainEgressStreamName):
 						// Default logic - infinite republishing
-					case domainIngressStreamName:
+					case dm.streamName(domainIngressStreamName):
 						// Send message to DLQ without retryAdd commentMore actions
 						if err == nil {
 							lg.Logf(lg.DebugLevel, "Domain (domain=%s) router with sourceStreamName=%s republished message to DLQ", dm.name, sourceStreamName)
@@ -490,8 +505,9 @@ func (dm *Domain) createRouter(sourceStreamName string, subject string, tsc targ
 	return nil
 }
 
-func dlqMsgBuilder(subject, stream, domain, errorMsg string, data []byte) *nats.Msg {
-	dlqMsg := nats.NewMsg(deadLetterQueueStreamName)
+func (dm *Domain) dlqMsgBuilder(subject, stream, errorMsg string, data []byte) *nats.Msg {
+	domain := dm.name
+	dlqMsg := nats.NewMsg(dm.streamName(deadLetterQueueStreamName))
 	dlqMsg.Data = data
 	dlqMsg.Header.Set("Original-Subject", subject)
 	dlqMsg.Header.Set("Original-Stream", stream)
@@ -501,3 +517,16 @@ func dlqMsgBuilder(subject, stream, domain, errorMsg string, data []byte) *nats.
 
 	return dlqMsg
 }
+
+func (dm *Domain) increaseKVHistory(bucketName string) error {
+	streamInfo, err := dm.js.StreamInfo("KV_" + bucketName)
+	if err != nil {
+		return err
+	}
+	if streamInfo.Config.MaxMsgsPerSubject >= int64(dm.kvSC.history) {
+		return nil
+	}
+	streamInfo.Config.MaxMsgsPerSubject = int64(dm.kvSC.history)
+	_, err = dm.js.UpdateStream(&streamInfo.Config)
+	return err
+}
@@ -0,0 +1,369 @@
+package statefun
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+HTTPWebhookEgress delivers egress payloads as HTTP POST requests. Every egress is first persisted in the domain's
+webhook outbox stream, so it survives restarts, and then is delivered by the outbox dispatcher:
+
+	$WH.<domain>.<typename>.<id> -> webhook_egress_outbox -> POST <URL from the typename's template>
+
+Failed deliveries are retried with exponential backoff. Deliveries which ran out of retries or were refused with a
+non retryable status are moved to the DLQ.
+*/
+
+const (
+	WebhookOutboxSubjectsPrefix = "$WH"
+	WebhookOutboxSubjectsTmpl   = WebhookOutboxSubjectsPrefix + ".%s.%s"
+	webhookOutboxStreamName     = "webhook_egress_outbox"
+
+	WebhookEgressTimeoutSec      = 10
+	WebhookEgressMaxRetries      = 10
+	WebhookEgressRetryBackoffMin = 1 * time.Second
+	WebhookEgressRetryBackoffMax = 5 * time.Minute
+	WebhookEgressWorkers         = 4
+
+	webhookHeaderTypename = "Foliage-Egress-Typename"
+	webhookHeaderID       = "Foliage-Egress-Id"
+	webhookHeaderSeq      = "Foliage-Egress-Seq"
+)
+
+// WebhookURLTemplateData is available in URL templates, e.g. "https://example.com/hooks/{{.Typename}}?id={{.ID}}"
+type WebhookURLTemplateData struct {
+	Domain   string
+	Typename string
+	ID       string
+}
+
+type WebhookEgressConfig struct {
+	urlTemplates       map[string]*template.Template
+	defaultURLTemplate *template.Template
+	headers            map[string]string
+	authorization      string
+	timeoutSec         int
+	maxRetries         int
+	retryBackoffMin    time.Duration
+	retryBackoffMax    time.Duration
+	workers            int
+	templateErr        error
+}
+
+func NewWebhookEgressConfig() *WebhookEgressConfig {
+	return &WebhookEgressConfig{
+		urlTemplates:    map[string]*template.Template{},
+		headers:         map[string]string{},
+		timeoutSec:      WebhookEgressTimeoutSec,
+		maxRetries:      WebhookEgressMaxRetries,
+		retryBackoffMin: WebhookEgressRetryBackoffMin,
+		retryBackoffMax: WebhookEgressRetryBackoffMax,
+		workers:         WebhookEgressWorkers,
+	}
+}
+
+func (wc *WebhookEgressConfig) parseURLTemplate(name string, urlTemplate string) *template.Template {
+	t, err := template.New(name).Option("missingkey=error").Parse(urlTemplate)
+	if err != nil {
+		wc.templateErr = errors.Join(wc.templateErr, fmt.Errorf("invalid webhook url template for %s: %w", name, err))
+		return nil
+	}
+	return t
+}
+
+// SetURLTemplate sets the URL template for egress of the function type typename
+func (wc *WebhookEgressConfig) SetURLTemplate(typename string, urlTemplate string) *WebhookEgressConfig {
+	if t := wc.parseURLTemplate(typename, urlTemplate); t != nil {
+		wc.urlTemplates[typename] = t
+	}
+	return wc
+}
+
+// SetDefaultURLTemplate sets the URL template for function types without their own template
+func (wc *WebhookEgressConfig) SetDefaultURLTemplate(urlTemplate string) *WebhookEgressConfig {
+	wc.defaultURLTemplate = wc.parseURLTemplate("default", urlTemplate)
+	return wc
+}
+
+func (wc *WebhookEgressConfig) SetHeader(name string, value string) *WebhookEgressConfig {
+	wc.headers[name] = value
+	return wc
+}
+
+func (wc *WebhookEgressConfig) SetBearerToken(token string) *WebhookEgressConfig {
+	wc.authorization = "Bearer " + token
+	return wc
+}
+
+func (wc *WebhookEgressConfig) SetBasicAuth(username string, password string) *WebhookEgressConfig {
+	req := http.Request{Header: http.Header{}}
+	req.SetBasicAuth(username, password)
+	wc.authorization = req.Header.Get("Authorization")
+	return wc
+}
+
+func (wc *WebhookEgressConfig) SetTimeoutSec(timeoutSec int) *WebhookEgressConfig {
+	wc.timeoutSec = timeoutSec
+	return wc
+}
+
+// SetMaxRetries sets how many times a failed delivery is retried before it is moved to the DLQ
+func (wc *WebhookEgressConfig) SetMaxRetries(maxRetries int) *WebhookEgressConfig {
+	wc.maxRetries = maxRetries
+	return wc
+}
+
+// SetRetryBackoff sets the delay before the first retry, every next retry doubles it up to backoffMax
+func (wc *WebhookEgressConfig) SetRetryBackoff(backoffMin time.Duration, backoffMax time.Duration) *WebhookEgressConfig {
+	wc.retryBackoffMin = backoffMin
+	wc.retryBackoffMax = backoffMax
+	return wc
+}
+
+// SetWorkers sets the number of concurrent deliveries of a single runtime
+func (wc *WebhookEgressConfig) SetWorkers(workers int) *WebhookEgressConfig {
+	wc.workers = workers
+	return wc
+}
+
+func (wc *WebhookEgressConfig) urlTemplate(typename string) *template.Template {
+	if t, ok := wc.urlTemplates[typename]; ok {
+		return t
+	}
+	return wc.defaultURLTemplate
+}
+
+func (wc *WebhookEgressConfig) url(domain string, typename string, id string) (string, error) {
+	t := wc.urlTemplate(typename)
+	if t == nil {
+		return "", fmt.Errorf("no webhook url template for %s", typename)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, WebhookURLTemplateData{Domain: domain, Typename: typename, ID: id}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (wc *WebhookEgressConfig) retryBackoff(attempt uint64) time.Duration {
+	backoff := wc.retryBackoffMin
+	for i := uint64(1); i < attempt && backoff < wc.retryBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > wc.retryBackoffMax {
+		backoff = wc.retryBackoffMax
+	}
+	return backoff
+}
+
+func (r *Runtime) webhookEgress(callerTypename string, callerID string, payload *easyjson.JSON) error {
+	wc := r.config.webhookEgress
+	if wc == nil {
+		return fmt.Errorf("http webhook egress is not configured")
+	}
+	if wc.urlTemplate(callerTypename) == nil {
+		return fmt.Errorf("no webhook url template for %s", callerTypename)
+	}
+
+	msg := nats.NewMsg(fmt.Sprintf(WebhookOutboxSubjectsTmpl, r.Domain.name, fmt.Sprintf("%s.%s", callerTypename, callerID)))
+	msg.Header.Set(webhookHeaderTypename, callerTypename)
+	msg.Header.Set(webhookHeaderID, callerID)
+	if payload != nil {
+		msg.Data = payload.ToBytes()
+	}
+	_, err := r.js.PublishMsg(msg)
+	return err
+}
+
+func (r *Runtime) createWebhookOutboxStream() error {
+	if r.config.webhookEgress == nil {
+		return nil
+	}
+	if r.config.webhookEgress.templateErr != nil {
+		return r.config.webhookEgress.templateErr
+	}
+	return r.Domain.createStreamIfNotExists(&nats.StreamConfig{
+		Name:      r.Domain.streamName(webhookOutboxStreamName),
+		Subjects:  []string{fmt.Sprintf(WebhookOutboxSubjectsTmpl, r.Domain.name, ">")},
+		Retention: nats.WorkQueuePolicy,
+		Replicas:  r.Domain.sysSC.replicasCount,
+		MaxBytes:  r.Domain.sysSC.maxBytes,
+		MaxMsgs:   r.Domain.sysSC.maxMsgs,
+		MaxAge:    r.Domain.sysSC.maxAge,
+	})
+}
+
+// runWebhookEgressDispatcher delivers messages of the webhook outbox until the runtime shuts down
+func (r *Runtime) runWebhookEgressDispatcher(ctx context.Context) error {
+	wc := r.config.webhookEgress
+	streamName := r.Domain.streamName(webhookOutboxStreamName)
+	consumerName := streamName + "-" + r.Domain.name + "-consumer"
+	subject := fmt.Sprintf(WebhookOutboxSubjectsTmpl, r.Domain.name, ">")
+
+	if _, err := r.js.ConsumerInfo(streamName, consumerName); err != nil {
+		if !errors.Is(err, nats.ErrConsumerNotFound) {
+			return err
+		}
+		if _, err := r.js.AddConsumer(streamName, &nats.ConsumerConfig{
+			Name:          consumerName,
+			Durable:       consumerName,
+			FilterSubject: subject,
+			AckPolicy:     nats.AckExplicitPolicy,
+			AckWait:       time.Duration(wc.timeoutSec+5) * time.Second,
+			MaxAckPending: maxPendingMessages,
+		}); err != nil {
+			return err
+		}
+	}
+
+	sub, err := r.js.PullSubscribe(subject, consumerName, nats.Bind(streamName, consumerName))
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: time.Duration(wc.timeoutSec) * time.Second}
+	workers := wc.workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		system.GlobalPrometrics.GetRoutinesCounter().Started("webhook_egress_dispatcher")
+		defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("webhook_egress_dispatcher")
+
+		var workersWg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			workersWg.Add(1)
+			go func() {
+				defer workersWg.Done()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-r.shutdown:
+						return
+					default:
+					}
+					msgs, err := sub.Fetch(1, nats.MaxWait(time.Second))
+					if err != nil {
+						if !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.DeadlineExceeded) && !r.nc.IsClosed() {
+							lg.Logf(lg.ErrorLevel, "Webhook egress dispatcher cannot fetch messages: %s", err)
+							time.Sleep(time.Second)
+						}
+						continue
+					}
+					for _, msg := range msgs {
+						r.deliverWebhookEgress(client, msg)
+					}
+				}
+			}()
+		}
+		workersWg.Wait()
+		system.MsgOnErrorReturn(sub.Unsubscribe())
+	}()
+	return nil
+}
+
+func webhookStatusIsRetryable(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
+}
+
+func (r *Runtime) deliverWebhookEgress(client *http.Client, msg *nats.Msg) {
+	wc := r.config.webhookEgress
+	typename := msg.Header.Get(webhookHeaderTypename)
+	id := msg.Header.Get(webhookHeaderID)
+
+	var attempt uint64 = 1
+	var seq uint64
+	if meta, err := msg.Metadata(); err == nil {
+		attempt = meta.NumDelivered
+		seq = meta.Sequence.Stream
+	}
+
+	toDLQ := func(errorMsg string) {
+		lg.Logf(lg.ErrorLevel, "Webhook egress for %s:%s is moved to DLQ: %s", typename, id, errorMsg)
+		if _, err := r.js.PublishMsg(r.Domain.dlqMsgBuilder(msg.Subject, r.Domain.streamName(webhookOutboxStreamName), errorMsg, msg.Data)); err != nil {
+			system.MsgOnErrorReturn(err)
+			system.MsgOnErrorReturn(msg.NakWithDelay(wc.retryBackoff(attempt)))
+			return
+		}
+		system.MsgOnErrorReturn(msg.Term())
+	}
+
+	url, err := wc.url(r.Domain.name, typename, id)
+	if err != nil {
+		toDLQ(err.Error())
+		return
+	}
+
+	status := "error"
+	started := time.Now()
+	err = func() error {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(msg.Data))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for name, value := range wc.headers {
+			req.Header.Set(name, value)
+		}
+		if len(wc.authorization) > 0 {
+			req.Header.Set("Authorization", wc.authorization)
+		}
+		req.Header.Set(webhookHeaderTypename, typename)
+		req.Header.Set(webhookHeaderID, id)
+		req.Header.Set(webhookHeaderSeq, strconv.FormatUint(seq, 10)) // Lets the receiver deduplicate redeliveries
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		status = strconv.Itoa(resp.StatusCode)
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+		}
+		return nil
+	}()
+	r.prometricsMeasureWebhookEgress(typename, status, time.Since(started))
+
+	if err == nil {
+		system.MsgOnErrorReturn(msg.Ack())
+		return
+	}
+	if code, convErr := strconv.Atoi(status); convErr == nil && !webhookStatusIsRetryable(code) {
+		toDLQ(err.Error())
+		return
+	}
+	if attempt > uint64(wc.maxRetries) {
+		toDLQ(fmt.Sprintf("retries exhausted: %s", err))
+		return
+	}
+	lg.Logf(lg.WarnLevel, "Webhook egress for %s:%s failed (attempt %d), retrying: %s", typename, id, attempt, err)
+	system.MsgOnErrorReturn(msg.NakWithDelay(wc.retryBackoff(attempt)))
+}
+
+func (r *Runtime) prometricsMeasureWebhookEgress(typename string, status string, duration time.Duration) {
+	histogram, err := system.GlobalPrometrics.EnsureHistogramVecSimple("webhook_egress_response", "Webhook egress responses by status, \"error\" if no response was received", nil, []string{"typename", "status"})
+	if err != nil {
+		return
+	}
+	histogram.WithLabelValues(typename, status).Observe(duration.Seconds())
+}
@@ -0,0 +1,102 @@
+package statefun_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+func TestHTTPWebhookEgress(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+
+	opts := natsservertest.DefaultTestOptions
+	opts.JetStream = true
+	opts.Port = -1
+	opts.StoreDir = t.TempDir()
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+
+	type delivery struct {
+		path          string
+		testHeader    string
+		authorization string
+		body          string
+	}
+	var attempts atomic.Int32
+	received := make(chan delivery, 4)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if attempts.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable) // First delivery fails and must be retried
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		received <- delivery{
+			path:          req.URL.Path,
+			testHeader:    req.Header.Get("X-Test"),
+			authorization: req.Header.Get("Authorization"),
+			body:          string(body),
+		}
+	}))
+	defer webhook.Close()
+
+	webhookCfg := statefun.NewWebhookEgressConfig().
+		SetURLTemplate("functions.tests.webhook", webhook.URL+"/hooks/{{.Typename}}/{{.ID}}").
+		SetHeader("X-Test", "yes").
+		SetBearerToken("secret").
+		SetRetryBackoff(100*time.Millisecond, time.Second)
+	runtimeCfg := statefun.NewRuntimeConfigSimple(srv.ClientURL(), "test_app").SetWebhookEgress(webhookCfg)
+	runtime, err := statefun.NewRuntime(*runtimeCfg)
+	require.NoError(t, err)
+
+	egressErrors := make(chan error, 4)
+	statefun.NewFunctionType(runtime, "functions.tests.webhook", func(executor sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		egressErrors <- ctx.Egress(sfPlugins.HTTPWebhookEgress, ctx.Payload, "obj")
+	}, *statefun.NewFunctionTypeConfig())
+
+	runtime.RegisterOnAfterStartFunction(func(ctx context.Context, runtime *statefun.Runtime) error {
+		payload := easyjson.NewJSONObjectWithKeyValue("hello", easyjson.NewJSON("world"))
+		return runtime.Signal(sfPlugins.JetstreamGlobalSignal, "functions.tests.webhook", "caller", &payload, nil)
+	}, true)
+
+	stopped := make(chan error, 1)
+	go func() { stopped <- runtime.Start(context.Background(), cache.NewCacheConfig("test_cache")) }()
+	defer func() {
+		runtime.Shutdown()
+		require.NoError(t, <-stopped)
+	}()
+
+	select {
+	case err := <-egressErrors:
+		require.NoError(t, err)
+	case err := <-stopped:
+		stopped <- err
+		t.Fatalf("runtime stopped: %v", err)
+	case <-time.After(15 * time.Second):
+		t.Fatal("function was not called")
+	}
+	select {
+	case d := <-received:
+		require.Equal(t, "/hooks/functions.tests.webhook/obj", d.path)
+		require.Equal(t, "yes", d.testHeader)
+		require.Equal(t, "Bearer secret", d.authorization)
+		require.JSONEq(t, `{"hello":"world"}`, d.body)
+		require.Equal(t, int32(2), attempts.Load())
+	case <-time.After(15 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+}
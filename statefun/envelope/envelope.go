@@ -0,0 +1,265 @@
+package envelope
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+)
+
+/*
+Envelope signing authenticates the callers of functions. A signed envelope carries:
+
+	{
+		"caller_typename": string,
+		"caller_id": string,
+		...
+		"payload": json,
+		"options": json,
+		"signature": {
+			"alg": "hmac-sha256" | "ed25519",
+			"key_id": string,
+			"ts": int,       // Unix time in ms
+			"nonce": string,
+			"target": string, // <target_typename>.<target_id>
+			"sig": string     // base64
+		}
+	}
+
+"sig" signs the JSON of the whole envelope without "signature.sig", so caller, payload, options, timestamp and target
+are all covered. Envelopes are serialized with sorted keys and are normalized before signing, so the receiver gets the
+same bytes back by parsing the envelope and removing "signature.sig".
+
+Keys are rotated through Config: a new key is added to every runtime and client with the moment it becomes the
+signing key (notBefore), old keys stay verifiable until removed.
+*/
+
+const (
+	SignaturePath = "signature"
+
+	AlgHMACSHA256 = "hmac-sha256"
+	AlgEd25519    = "ed25519"
+
+	MaxMessageAge        = 2 * time.Minute
+	MaxDurableMessageAge = 24 * time.Hour // Max age of function streams, see statefun.FtStreamMaxAge
+
+	nonceBytes = 16
+)
+
+var (
+	ErrUnsigned          = errors.New("envelope is not signed")
+	ErrUnknownKey        = errors.New("envelope is signed with an unknown key")
+	ErrInvalidSignature  = errors.New("envelope signature is invalid")
+	ErrTargetMismatch    = errors.New("envelope is signed for another target")
+	ErrStale             = errors.New("envelope is too old or from the future")
+	ErrReplayed          = errors.New("envelope is replayed")
+	ErrNoSigningKey      = errors.New("no signing key is active")
+	ErrMalformedEnvelope = errors.New("envelope is malformed")
+)
+
+type key struct {
+	id         string
+	alg        string
+	notBefore  time.Time
+	secret     []byte
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+func (k *key) canSign() bool {
+	return len(k.secret) > 0 || len(k.privateKey) > 0
+}
+
+type Config struct {
+	mutex                sync.RWMutex
+	keys                 map[string]*key
+	maxMessageAge        time.Duration
+	maxDurableMessageAge time.Duration
+	acceptUnsigned       bool
+}
+
+func NewConfig() *Config {
+	return &Config{
+		keys:                 map[string]*key{},
+		maxMessageAge:        MaxMessageAge,
+		maxDurableMessageAge: MaxDurableMessageAge,
+	}
+}
+
+// AddHMACKey adds a shared secret key, it signs envelopes since notBefore if it is the newest signing key
+func (c *Config) AddHMACKey(keyID string, secret []byte, notBefore time.Time) *Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.keys[keyID] = &key{id: keyID, alg: AlgHMACSHA256, notBefore: notBefore, secret: secret}
+	return c
+}
+
+// AddEd25519Key adds a private key, it signs envelopes since notBefore if it is the newest signing key
+func (c *Config) AddEd25519Key(keyID string, privateKey ed25519.PrivateKey, notBefore time.Time) *Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.keys[keyID] = &key{
+		id:         keyID,
+		alg:        AlgEd25519,
+		notBefore:  notBefore,
+		privateKey: privateKey,
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+	}
+	return c
+}
+
+// AddEd25519PublicKey adds a key envelopes of other runtimes and clients are verified with
+func (c *Config) AddEd25519PublicKey(keyID string, publicKey ed25519.PublicKey) *Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.keys[keyID] = &key{id: keyID, alg: AlgEd25519, publicKey: publicKey}
+	return c
+}
+
+// RemoveKey retires a key, envelopes signed with it are not accepted anymore
+func (c *Config) RemoveKey(keyID string) *Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.keys, keyID)
+	return c
+}
+
+// SetMaxMessageAge limits the difference between an envelope's timestamp and the moment it is received over core NATS
+func (c *Config) SetMaxMessageAge(maxMessageAge time.Duration) *Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.maxMessageAge = maxMessageAge
+	return c
+}
+
+func (c *Config) GetMaxMessageAge() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.maxMessageAge
+}
+
+// SetMaxDurableMessageAge limits the difference between an envelope's timestamp and the moment it is stored into the
+// JetStream stream it is consumed from. Durable signals may wait in egress and ingress streams for routing, so it
+// must cover the max age of those streams. Nonces of durable signals are remembered for this long.
+func (c *Config) SetMaxDurableMessageAge(maxDurableMessageAge time.Duration) *Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.maxDurableMessageAge = maxDurableMessageAge
+	return c
+}
+
+func (c *Config) GetMaxDurableMessageAge() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.maxDurableMessageAge
+}
+
+// SetAcceptUnsigned makes verification accept unsigned envelopes, for rolling out signing on a running system
+func (c *Config) SetAcceptUnsigned(acceptUnsigned bool) *Config {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.acceptUnsigned = acceptUnsigned
+	return c
+}
+
+func (c *Config) AcceptsUnsigned() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.acceptUnsigned
+}
+
+// signingKey returns the newest key which can sign and is active at the moment
+func (c *Config) signingKey(now time.Time) *key {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	var signing *key
+	for _, k := range c.keys {
+		if !k.canSign() || k.notBefore.After(now) {
+			continue
+		}
+		if signing == nil || k.notBefore.After(signing.notBefore) || (k.notBefore.Equal(signing.notBefore) && k.id > signing.id) {
+			signing = k
+		}
+	}
+	return signing
+}
+
+func (c *Config) verificationKey(keyID string) *key {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.keys[keyID]
+}
+
+// Sign signs the envelope for the target (<target_typename>.<target_id>) and returns its bytes to be published
+func (c *Config) Sign(envelope *easyjson.JSON, target string) ([]byte, error) {
+	now := time.Now()
+	k := c.signingKey(now)
+	if k == nil {
+		return nil, ErrNoSigningKey
+	}
+	nonce := make([]byte, nonceBytes)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	signature := easyjson.NewJSONObject()
+	signature.SetByPath("alg", easyjson.NewJSON(k.alg))
+	signature.SetByPath("key_id", easyjson.NewJSON(k.id))
+	signature.SetByPath("ts", easyjson.NewJSON(now.UnixMilli()))
+	signature.SetByPath("nonce", easyjson.NewJSON(hex.EncodeToString(nonce)))
+	signature.SetByPath("target", easyjson.NewJSON(target))
+
+	// Normalization makes the signed bytes reproducible by the receiver
+	signed, ok := easyjson.JSONFromBytes(envelope.ToBytes())
+	if !ok {
+		return nil, ErrMalformedEnvelope
+	}
+	signed.SetByPath(SignaturePath, signature)
+	signedBytes := signed.ToBytes()
+
+	sig, err := k.sign(signedBytes)
+	if err != nil {
+		return nil, err
+	}
+	signed.SetByPath(SignaturePath+".sig", easyjson.NewJSON(base64.StdEncoding.EncodeToString(sig)))
+	return signed.ToBytes(), nil
+}
+
+func (k *key) sign(data []byte) ([]byte, error) {
+	switch k.alg {
+	case AlgHMACSHA256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	case AlgEd25519:
+		return ed25519.Sign(k.privateKey, data), nil
+	default:
+		return nil, fmt.Errorf("unknown signing algorithm %s", k.alg)
+	}
+}
+
+func (k *key) verify(data []byte, sig []byte) bool {
+	switch k.alg {
+	case AlgHMACSHA256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(data)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case AlgEd25519:
+		return ed25519.Verify(k.publicKey, data, sig)
+	default:
+		return false
+	}
+}
+
+// IsSigned tells if the envelope carries a signature
+func IsSigned(envelope *easyjson.JSON) bool {
+	return envelope.GetByPath(SignaturePath).IsObject()
+}
@@ -0,0 +1,137 @@
+package envelope
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/stretchr/testify/require"
+)
+
+const testTarget = "functions.test.hub/x"
+
+func testEnvelope() *easyjson.JSON {
+	envelope := easyjson.NewJSONObject()
+	envelope.SetByPath("caller_typename", easyjson.NewJSON("functions.caller"))
+	envelope.SetByPath("caller_id", easyjson.NewJSON("hub/y"))
+	envelope.SetByPath("payload", easyjson.NewJSONObjectWithKeyValue("big", easyjson.NewJSON(int64(1)<<60)))
+	return &envelope
+}
+
+func signAndParse(t *testing.T, config *Config, envelope *easyjson.JSON, target string) *easyjson.JSON {
+	signed, err := config.Sign(envelope, target)
+	require.NoError(t, err)
+	received, ok := easyjson.JSONFromBytes(signed)
+	require.True(t, ok)
+	return &received
+}
+
+func TestSignVerify(t *testing.T) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	for name, config := range map[string]*Config{
+		"hmac":    NewConfig().AddHMACKey("k1", []byte("secret"), time.Time{}),
+		"ed25519": NewConfig().AddEd25519Key("k1", privateKey, time.Time{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			received := signAndParse(t, config, testEnvelope(), testTarget)
+			require.NoError(t, NewVerifier(config).Verify(received, testTarget, time.Now(), 0))
+
+			tampered := received.Clone()
+			tampered.SetByPath("caller_typename", easyjson.NewJSON("functions.other"))
+			require.ErrorIs(t, NewVerifier(config).Verify(&tampered, testTarget, time.Now(), 0), ErrInvalidSignature)
+
+			require.ErrorIs(t, NewVerifier(config).Verify(received, "functions.test.hub/z", time.Now(), 0), ErrTargetMismatch)
+			require.ErrorIs(t, NewVerifier(config).Verify(received, testTarget, time.Now().Add(MaxMessageAge+time.Second), 0), ErrStale)
+		})
+	}
+}
+
+func TestVerifyEd25519PublicKeyOnly(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	received := signAndParse(t, NewConfig().AddEd25519Key("client", privateKey, time.Time{}), testEnvelope(), testTarget)
+	verifier := NewVerifier(NewConfig().AddEd25519PublicKey("client", publicKey))
+	require.NoError(t, verifier.Verify(received, testTarget, time.Now(), 0))
+
+	_, err = verifier.Config().Sign(testEnvelope(), testTarget)
+	require.ErrorIs(t, err, ErrNoSigningKey)
+}
+
+func TestReplay(t *testing.T) {
+	config := NewConfig().AddHMACKey("k1", []byte("secret"), time.Time{})
+	verifier := NewVerifier(config)
+	received := signAndParse(t, config, testEnvelope(), testTarget)
+
+	// Core NATS
+	require.NoError(t, verifier.Verify(received, testTarget, time.Now(), 0))
+	require.ErrorIs(t, verifier.Verify(received, testTarget, time.Now(), 0), ErrReplayed)
+
+	// JetStream, redelivery of the same stream message is not a replay
+	received = signAndParse(t, config, testEnvelope(), testTarget)
+	require.NoError(t, verifier.Verify(received, testTarget, time.Now(), 7))
+	require.NoError(t, verifier.Verify(received, testTarget, time.Now(), 7))
+	require.ErrorIs(t, verifier.Verify(received, testTarget, time.Now(), 8), ErrReplayed)
+}
+
+func TestDurableSignalAge(t *testing.T) {
+	config := NewConfig().AddHMACKey("k1", []byte("secret"), time.Time{})
+	verifier := NewVerifier(config)
+	received := signAndParse(t, config, testEnvelope(), testTarget)
+
+	// A durable signal consumed from the ingress stream long after it was sent is not stale
+	receivedAt := time.Now().Add(10 * MaxMessageAge)
+	require.NoError(t, verifier.Verify(received, testTarget, receivedAt, 3))
+	require.ErrorIs(t, verifier.Verify(received, testTarget, receivedAt, 4), ErrReplayed)
+	require.ErrorIs(t, NewVerifier(config).Verify(received, testTarget, receivedAt, 0), ErrStale)
+}
+
+func TestDurableSignalReplay(t *testing.T) {
+	config := NewConfig().AddHMACKey("k1", []byte("secret"), time.Time{}).
+		SetMaxMessageAge(10 * time.Millisecond).
+		SetMaxDurableMessageAge(200 * time.Millisecond)
+	verifier := NewVerifier(config)
+	received := signAndParse(t, config, testEnvelope(), testTarget)
+	require.NoError(t, verifier.Verify(received, testTarget, time.Now(), 3))
+
+	// Re-published into the stream long after the core NATS max message age, the nonce is still remembered
+	time.Sleep(50 * time.Millisecond)
+	require.ErrorIs(t, verifier.Verify(received, testTarget, time.Now(), 9), ErrReplayed)
+
+	// Re-published after the nonce is forgotten, the envelope is too old
+	time.Sleep(200 * time.Millisecond)
+	require.ErrorIs(t, verifier.Verify(received, testTarget, time.Now(), 10), ErrStale)
+	require.ErrorIs(t, NewVerifier(config).Verify(received, testTarget, time.Now(), 10), ErrStale)
+}
+
+func TestUnsigned(t *testing.T) {
+	config := NewConfig().AddHMACKey("k1", []byte("secret"), time.Time{})
+	require.ErrorIs(t, NewVerifier(config).Verify(testEnvelope(), testTarget, time.Now(), 0), ErrUnsigned)
+	require.NoError(t, NewVerifier(config.SetAcceptUnsigned(true)).Verify(testEnvelope(), testTarget, time.Now(), 0))
+}
+
+func TestKeyRotation(t *testing.T) {
+	now := time.Now()
+	config := NewConfig().
+		AddHMACKey("k1", []byte("secret1"), now.Add(-time.Hour)).
+		AddHMACKey("k2", []byte("secret2"), now.Add(time.Hour))
+	verifier := NewVerifier(config)
+
+	// k2 is not active yet
+	received := signAndParse(t, config, testEnvelope(), testTarget)
+	require.Equal(t, "k1", received.GetByPath("signature.key_id").AsStringDefault(""))
+
+	config.AddHMACKey("k2", []byte("secret2"), now.Add(-time.Minute))
+	rotated := signAndParse(t, config, testEnvelope(), testTarget)
+	require.Equal(t, "k2", rotated.GetByPath("signature.key_id").AsStringDefault(""))
+
+	// Envelopes signed with the old key are accepted until it is removed
+	require.NoError(t, verifier.Verify(received, testTarget, time.Now(), 0))
+	config.RemoveKey("k1")
+	require.ErrorIs(t, verifier.Verify(signAndParse(t, NewConfig().AddHMACKey("k1", []byte("secret1"), time.Time{}), testEnvelope(), testTarget), testTarget, time.Now(), 0), ErrUnknownKey)
+	require.NoError(t, verifier.Verify(rotated, testTarget, time.Now(), 0))
+}
@@ -0,0 +1,118 @@
+package envelope
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+)
+
+type seenNonce struct {
+	sequence  uint64
+	expiresAt time.Time
+}
+
+// Verifier verifies envelopes and remembers their nonces for as long as they can pass the age check, so an envelope
+// is accepted once. Redeliveries of the same JetStream message (same stream sequence) are not replays.
+//
+// Nonces are remembered by this process only: instances of a queue group do not share them, so an envelope captured
+// on core NATS can be replayed to another instance of the group within the max message age. Deployments which need
+// stronger replay protection must restrict who can publish to the request subjects.
+type Verifier struct {
+	config *Config
+
+	mutex     sync.Mutex
+	nonces    map[string]seenNonce
+	lastSweep time.Time
+}
+
+func NewVerifier(config *Config) *Verifier {
+	return &Verifier{
+		config:    config,
+		nonces:    map[string]seenNonce{},
+		lastSweep: time.Now(),
+	}
+}
+
+func (v *Verifier) Config() *Config {
+	return v.config
+}
+
+// Verify checks the envelope signed for the target. receivedAt is the moment the envelope was received (or published
+// into the stream it is consumed from), sequence is its stream sequence (0 for core NATS).
+//
+// Envelopes received over core NATS are checked against the max message age. Durable signals pass egress and ingress
+// streams and may wait there for routing much longer, so they are checked against the max durable message age.
+// A replay is refused by its nonce while it is young enough to pass the age check and by its age after that.
+func (v *Verifier) Verify(envelope *easyjson.JSON, target string, receivedAt time.Time, sequence uint64) error {
+	if !IsSigned(envelope) {
+		if v.config.AcceptsUnsigned() {
+			return nil
+		}
+		return ErrUnsigned
+	}
+
+	signature := envelope.GetByPath(SignaturePath)
+	keyID, _ := signature.GetByPath("key_id").AsString()
+	alg, _ := signature.GetByPath("alg").AsString()
+	nonce, _ := signature.GetByPath("nonce").AsString()
+	signedTarget, _ := signature.GetByPath("target").AsString()
+	sigStr, _ := signature.GetByPath("sig").AsString()
+	ts, tsOk := signature.GetByPath("ts").AsNumeric()
+	sig, err := base64.StdEncoding.DecodeString(sigStr)
+	if len(nonce) == 0 || !tsOk || err != nil || len(sig) == 0 {
+		return ErrMalformedEnvelope
+	}
+
+	k := v.config.verificationKey(keyID)
+	if k == nil || k.alg != alg {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+	signed := envelope.Clone()
+	signed.RemoveByPath(SignaturePath + ".sig")
+	if !k.verify(signed.ToBytes(), sig) {
+		return ErrInvalidSignature
+	}
+	if signedTarget != target {
+		return fmt.Errorf("%w: %s != %s", ErrTargetMismatch, signedTarget, target)
+	}
+
+	maxMessageAge := v.config.GetMaxMessageAge()
+	maxAge := maxMessageAge
+	if sequence != 0 {
+		maxAge = v.config.GetMaxDurableMessageAge()
+	}
+	signedAt := time.UnixMilli(int64(ts))
+	if age := receivedAt.Sub(signedAt); age > maxAge || age < -maxMessageAge {
+		return fmt.Errorf("%w: signed at %s, received at %s", ErrStale, signedAt.Format(time.RFC3339Nano), receivedAt.Format(time.RFC3339Nano))
+	}
+	// The envelope is stale after signedAt+maxAge, the nonce is not needed after that (plus clock skew)
+	return v.rememberNonce(keyID+"."+nonce, sequence, signedAt.Add(maxAge+maxMessageAge), maxMessageAge)
+}
+
+func (v *Verifier) rememberNonce(nonceKey string, sequence uint64, expiresAt time.Time, maxMessageAge time.Duration) error {
+	now := time.Now()
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if now.Sub(v.lastSweep) > maxMessageAge {
+		for n, seen := range v.nonces {
+			if now.After(seen.expiresAt) {
+				delete(v.nonces, n)
+			}
+		}
+		v.lastSweep = now
+	}
+
+	if seen, ok := v.nonces[nonceKey]; ok && now.Before(seen.expiresAt) {
+		if sequence == 0 || seen.sequence != sequence {
+			return ErrReplayed
+		}
+		return nil // Redelivery
+	}
+	v.nonces[nonceKey] = seenNonce{sequence: sequence, expiresAt: expiresAt}
+	return nil
+}
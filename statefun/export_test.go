@@ -0,0 +1,37 @@
+package statefun
+
+import (
+	"fmt"
+	"time"
+)
+
+// Internals for the tests of package statefun_test, which can use the virtual clock of statefun/test
+
+const (
+	RWMutexKeySuffix   = rwMutexKeySuffix
+	SemaphoreKeySuffix = semaphoreKeySuffix
+)
+
+// PutLeaderElectionLease writes the lease of le into the KV as if it was renewed, e.g. by a leader which died later
+func PutLeaderElectionLease(le *LeaderElection, expiresAt time.Time) (uint64, error) {
+	return le.runtime.Domain.kv.Put(le.key, le.leaseValue(expiresAt.UnixNano()))
+}
+
+// LeaderElectionRevision returns the KV revision of the last acquisition or renewal of the lease by le
+func LeaderElectionRevision(le *LeaderElection) uint64 {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.revision
+}
+
+// SharedLockExpiresAt returns the lease expiration time of the only holder of the shared lock
+func SharedLockExpiresAt(r *Runtime, stateKey string) (time.Time, error) {
+	state, err := sharedLockGetState(r, stateKey)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(state.Holders) != 1 {
+		return time.Time{}, fmt.Errorf("%d holders of %s", len(state.Holders), stateKey)
+	}
+	return time.Unix(0, state.Holders[0].ExpiresAt), nil
+}
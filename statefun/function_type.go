@@ -36,6 +36,9 @@ type FunctionType struct {
 
 	sfWorkerPool *SFWorkerPool
 	tokens       system.TokenBucket
+
+	expiryIndexReady atomic.Bool
+	refusals         atomic.Uint64
 }
 
 const (
@@ -54,7 +57,9 @@ func NewFunctionType(runtime *Runtime, name string, logicHandler FunctionLogicHa
 		tokens:       *system.NewTokenBucket(config.functionWorkerPoolConfig.MaxWorkers + config.functionWorkerPoolConfig.TaskQueueLen),
 	}
 	ft.sfWorkerPool = NewSFWorkerPool(ft, config.functionWorkerPoolConfig)
+	runtime.functionTypesMutex.Lock()
 	runtime.registeredFunctionTypes[ft.name] = ft
+	runtime.functionTypesMutex.Unlock()
 	return ft
 }
 
@@ -92,6 +97,7 @@ func (ft *FunctionType) prometricsMeasureMsgDeliver(deliveryType MeasureMsgDeliv
 	histogram, err := system.GlobalPrometrics.EnsureHistogramVecSimple("ft_msg_delivery", "messages receive", buckets, labelNames)
 	if err != nil {
 		lg.Logf(lg.ErrorLevel, "Failed to create histogram: %s", err.Error())
+		return
 	}
 
 	histogram.WithLabelValues(ft.name, string(deliveryType)).Observe(1.0)
@@ -127,10 +133,28 @@ func (ft *FunctionType) TokenCapacity() int {
 	return ft.tokens.Capacity
 }
 
+func (ft *FunctionType) WorkerPool() *SFWorkerPool {
+	return ft.sfWorkerPool
+}
+
+// Refusals returns the number of messages the function type refused because it was overloaded
+func (ft *FunctionType) Refusals() uint64 {
+	return ft.refusals.Load()
+}
+
 func (ft *FunctionType) sendMsg(originId string, msg FunctionTypeMsg) {
+	if ft.runtime.chaos != nil {
+		ft.runtime.chaos.sendMsg(ft, originId, msg)
+		return
+	}
+	ft.enqueueMsg(originId, msg)
+}
+
+func (ft *FunctionType) enqueueMsg(originId string, msg FunctionTypeMsg) {
 	id := ft.runtime.Domain.CreateObjectIDWithThisDomain(originId, false)
 
 	if !ft.TokenTryAcquire() {
+		ft.refusals.Add(1)
 		msg.RefusalCallback(true) // No redelivering cause system have no more scaling resources!
 		logger.Logf(logger.ErrorLevel, sendMsgFuncErrorMsg, ft.name, id, "no tokens left")
 		return
@@ -151,10 +175,11 @@ func (ft *FunctionType) sendMsg(originId string, msg FunctionTypeMsg) {
 
 	select {
 	case msgChannel <- msg:
-		ft.idHandlersLastMsgTime.Store(id, time.Now().UnixNano())
+		ft.idHandlersLastMsgTime.Store(id, ft.runtime.clock().Now().UnixNano())
 		ft.sfWorkerPool.Notify()
 	default:
 		ft.TokenRelease()
+		ft.refusals.Add(1)
 		msg.RefusalCallback(false) // Can try to rediliver cause free tokens still exists, system have scaling resources
 		logger.Logf(logger.WarnLevel, sendMsgFuncErrorMsg, ft.name, id, "queue for current id is full")
 	}
@@ -170,6 +195,17 @@ func (ft *FunctionType) workerTaskExecutor(id string, msg FunctionTypeMsg) {
 		ft.idKeyMutex.Unlock(id)
 	}()
 
+	if ft.config.stateVersion > 0 && msg.Payload != nil && msg.Payload.PathExists(StateMigrationPayloadKey) {
+		ft.migrateStoredContexts(id)
+		if msg.AckCallback != nil {
+			msg.AckCallback(true)
+		}
+		if msg.RequestCallback != nil {
+			msg.RequestCallback(easyjson.NewJSONObjectWithKeyValue("status", easyjson.NewJSON("ok")).GetPtr())
+		}
+		return
+	}
+
 	if ft.executor != nil {
 		ft.executor.AddForID(id)
 	}
@@ -180,12 +216,13 @@ func (ft *FunctionType) workerTaskExecutor(id string, msg FunctionTypeMsg) {
 		typenameIDContextProcessor = v.(*sfPlugins.StatefunContextProcessor)
 	} else {
 		v := sfPlugins.StatefunContextProcessor{
-			GetFunctionContext:        func() *easyjson.JSON { return ft.getContext(ft.name + "." + id) },
-			SetFunctionContext:        func(context *easyjson.JSON) { ft.setContext(ft.name+"."+id, context) },
+			GetFunctionContext:        func() *easyjson.JSON { return ft.loadContext(FunctionState, ft.name+"."+id) },
+			SetFunctionContext:        func(context *easyjson.JSON) { ft.storeFunctionContext(ft.name+"."+id, context) },
 			SetContextExpirationAfter: func(after time.Duration) { ft.setContextExpirationAfter(ft.name+"."+id, after) },
-			GetObjectContext:          func() *easyjson.JSON { return ft.getContext(id) },
-			SetObjectContext:          func(context *easyjson.JSON) { ft.setContext(id, context) },
+			GetObjectContext:          func() *easyjson.JSON { return ft.loadContext(ObjectState, id) },
+			SetObjectContext:          func(context *easyjson.JSON) { ft.storeObjectContext(id, context) },
 			Domain:                    ft.runtime.Domain,
+			Clock:                     ft.runtime.clock(),
 			Self:                      sfPlugins.StatefunAddress{Typename: ft.name, ID: id},
 			Signal: func(signalProvider sfPlugins.SignalProvider, targetTypename string, targetID string, j *easyjson.JSON, o *easyjson.JSON) error {
 				return ft.runtime.signal(signalProvider, ft.name, id, targetTypename, targetID, j, o)
@@ -214,6 +251,8 @@ func (ft *FunctionType) workerTaskExecutor(id string, msg FunctionTypeMsg) {
 }
 
 func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameIDContextProcessor *sfPlugins.StatefunContextProcessor) {
+	record := ft.runtime.recorder.begin(ft.name, id, msg, ft.runtime.clock().Now())
+
 	msgRequestCallback := msg.RequestCallback
 	replyDataChannel := make(chan *easyjson.JSON, 1)
 	typenameIDContextProcessor.Reply = nil
@@ -261,7 +300,8 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 
 	typenameIDContextProcessor.ObjectMutexLock = func(objectId string, errorOnLocked bool) error {
 		lockId := fmt.Sprintf("%s-lock", objectId)
-		revId, err := KeyMutexLock(context.TODO(), ft.runtime, lockId, errorOnLocked)
+		lockCtx := WithLockOwner(context.TODO(), LockOwner{Typename: ft.name, Id: id})
+		revId, err := KeyMutexLock(lockCtx, ft.runtime, lockId, errorOnLocked)
 		if err == nil {
 			objCtx := ft.getContext(lockId)
 			objCtx.SetByPath("__lock_rev_id", easyjson.NewJSON(revId))
@@ -284,10 +324,48 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 		if err != nil {
 			return err
 		}
-		ft.runtime.Domain.cache.DeleteValue(lockId, true, -1, "")
+		ft.runtime.Domain.Cache().DeleteValue(lockId, true, -1, "")
 		return nil
 	}
 
+	// Shared locks are held on behalf of the typename instance, so unlock does not need any stored state.
+	// Their leases are prolonged while the handler runs.
+	sharedLockHolderId := ft.name + ":" + id
+	sharedLocks := newSharedLockLeases(ft.runtime, sharedLockHolderId)
+	defer sharedLocks.stop()
+	typenameIDContextProcessor.ObjectRWMutexLock = func(objectId string, exclusive bool, errorOnLocked bool) error {
+		lockKey := fmt.Sprintf("%s-lock", objectId)
+		if err := KeyRWMutexLock(context.TODO(), ft.runtime, lockKey, sharedLockHolderId, exclusive, errorOnLocked); err != nil {
+			return err
+		}
+		sharedLocks.add(lockKey + rwMutexKeySuffix)
+		return nil
+	}
+	typenameIDContextProcessor.ObjectRWMutexLockUpdate = func(objectId string) error {
+		return KeyRWMutexLockUpdate(context.TODO(), ft.runtime, fmt.Sprintf("%s-lock", objectId), sharedLockHolderId)
+	}
+	typenameIDContextProcessor.ObjectRWMutexUnlock = func(objectId string) error {
+		lockKey := fmt.Sprintf("%s-lock", objectId)
+		sharedLocks.remove(lockKey + rwMutexKeySuffix)
+		return KeyRWMutexUnlock(context.TODO(), ft.runtime, lockKey, sharedLockHolderId)
+	}
+	typenameIDContextProcessor.ObjectSemaphoreAcquire = func(objectId string, permits int, maxPermits int, errorOnLocked bool) error {
+		lockKey := fmt.Sprintf("%s-lock", objectId)
+		if err := KeySemaphoreAcquire(context.TODO(), ft.runtime, lockKey, sharedLockHolderId, permits, maxPermits, errorOnLocked); err != nil {
+			return err
+		}
+		sharedLocks.add(lockKey + semaphoreKeySuffix)
+		return nil
+	}
+	typenameIDContextProcessor.ObjectSemaphoreUpdate = func(objectId string) error {
+		return KeySemaphoreUpdate(context.TODO(), ft.runtime, fmt.Sprintf("%s-lock", objectId), sharedLockHolderId)
+	}
+	typenameIDContextProcessor.ObjectSemaphoreRelease = func(objectId string) error {
+		lockKey := fmt.Sprintf("%s-lock", objectId)
+		sharedLocks.remove(lockKey + semaphoreKeySuffix)
+		return KeySemaphoreRelease(context.TODO(), ft.runtime, lockKey, sharedLockHolderId)
+	}
+
 	start := time.Now()
 
 	// Calling typename handler function --------------------
@@ -298,6 +376,10 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 	}
 	// -------------------------------------------------------
 
+	if ft.config.contextExpireSignal && msg.Payload != nil && msg.Payload.PathExists(ContextExpiredPayloadKey) {
+		ft.deleteContextIfExpired(ft.name + "." + id)
+	}
+
 	if gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple("ft_execution_time", "", []string{"typename"}); err == nil {
 		gaugeVec.With(prometheus.Labels{"typename": ft.name}).Set(float64(time.Since(start).Microseconds()))
 	}
@@ -309,27 +391,27 @@ func (ft *FunctionType) handleMsgForID(id string, msg FunctionTypeMsg, typenameI
 		var replyData *easyjson.JSON = nil
 		select {
 		case replyData = <-replyDataChannel:
-		case <-time.After(time.Duration(ft.runtime.config.requestTimeoutSec) * time.Second):
+		case <-ft.runtime.clock().After(time.Duration(ft.runtime.config.requestTimeoutSec) * time.Second):
 			replyData.SetByPath("status", easyjson.NewJSON("timeout"))
 		}
+		if record != nil && replyData != nil {
+			record.Reply = replyData.Clone().GetPtr()
+		}
 		msgRequestCallback(replyData)
 	}
+	if record != nil {
+		record.Duration = ft.runtime.clock().Now().Sub(record.ReceivedAt)
+		ft.runtime.recorder.write(record)
+	}
 
-	atomic.StoreInt64(&ft.runtime.glce, time.Now().UnixNano())
+	atomic.StoreInt64(&ft.runtime.glce, ft.runtime.clock().Now().UnixNano())
 }
 
 func (ft *FunctionType) gc(typenameIDLifetimeMs int) (garbageCollected int, handlersRunning int) {
-	now := time.Now().UnixNano()
+	now := ft.runtime.clock().Now().UnixNano()
 
 	// Deleting function contexts which are expired ---------
-	for _, funcCtxKey := range ft.runtime.Domain.Cache().GetKeysByPattern(ft.name + ".>") {
-		expirationTime := int64(ft.getContext(funcCtxKey).GetByPath(contextExpirationKey).AsNumericDefault(-1))
-		if expirationTime > 0 {
-			if expirationTime < now {
-				ft.runtime.Domain.Cache().DeleteValue(funcCtxKey, true, -1, "")
-			}
-		}
-	}
+	ft.collectExpiredContexts(now)
 	// ------------------------------------------------------
 
 	ft.idHandlersLastMsgTime.Range(func(key, value interface{}) bool {
@@ -373,7 +455,7 @@ func (ft *FunctionType) gc(typenameIDLifetimeMs int) (garbageCollected int, hand
 }
 
 func (ft *FunctionType) getContext(keyValueID string) *easyjson.JSON {
-	if j, err := ft.runtime.Domain.cache.GetValueAsJSON(keyValueID); err == nil {
+	if j, err := ft.runtime.Domain.Cache().GetValueAsJSON(keyValueID); err == nil {
 		return j
 	}
 	j := easyjson.NewJSONObject()
@@ -382,24 +464,12 @@ func (ft *FunctionType) getContext(keyValueID string) *easyjson.JSON {
 
 func (ft *FunctionType) setContext(keyValueID string, context *easyjson.JSON) {
 	if context == nil {
-		ft.runtime.Domain.cache.DeleteValue(keyValueID, true, -1, "")
+		ft.runtime.Domain.Cache().DeleteValue(keyValueID, true, -1, "")
 	} else {
-		ft.runtime.Domain.cache.SetValue(keyValueID, context.ToBytes(), true, -1, "")
-	}
-}
-
-// Negative duration removes expiration
-func (ft *FunctionType) setContextExpirationAfter(keyValueID string, after time.Duration) {
-	if j, err := ft.runtime.Domain.cache.GetValueAsJSON(keyValueID); err == nil {
-		if after < 0 {
-			j.RemoveByPath(contextExpirationKey)
-		} else {
-			j.SetByPath(contextExpirationKey, easyjson.NewJSON(time.Now().Add(after).UnixNano()))
-		}
-		ft.runtime.Domain.cache.SetValue(keyValueID, j.ToBytes(), true, -1, "")
+		ft.runtime.Domain.Cache().SetValue(keyValueID, context.ToBytes(), true, -1, "")
 	}
 }
 
 func (ft *FunctionType) getStreamName() string {
-	return fmt.Sprintf("%s_stream", system.GetHashStr(ft.subject))
+	return ft.runtime.Domain.streamName(fmt.Sprintf("%s_stream", system.GetHashStr(ft.subject)))
 }
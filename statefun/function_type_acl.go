@@ -0,0 +1,154 @@
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Caller ACL of a function type is set with FunctionTypeConfig.SetAllowedCallerTypenames, SetAllowedCallerDomains and
+SetAllowedCallerPrincipals, a call must match every list which is set. It is checked for calls coming from NATS and
+for Golang local calls.
+
+A denied request is replied with:
+
+	{
+		"status": "failed",
+		"details": "access denied: ...",
+		"data": {
+			"refusal": {
+				"reason": "acl" | "signature",
+				"function": string,
+				"caller_typename": string,
+				"caller_id": string,
+				"caller_domain": string,
+				"caller_principal": string
+			}
+		}
+	}
+
+a denied signal is acked and dropped, a Golang local signal returns ErrCallerDenied. Each denial is logged as an audit
+entry with "audit"="acl".
+
+Caller domain and principal are taken from the message which is published by the caller's runtime or client (see NatsConnectionConfig.SetCaller), so they are
+trustworthy as long as publishing on the bus is restricted to trusted runtimes or envelopes are signed (see
+RuntimeConfig.SetEnvelopeSigning), envelopes failing verification are refused with "reason"="signature".
+
+Calls made by the runtime itself (the context expire and state migration signals with ContextExpiryCallerTypename) are
+not checked against the ACL only when they never left the process (Golang local calls). Envelopes coming from NATS are
+self-asserted by their publishers, so internal signals sent over NATS are checked as any other call: a function type
+with a caller ACL must allow ContextExpiryCallerTypename of its own domain to get them.
+*/
+
+const (
+	CallerDomainNatsDataPath    = "caller_domain"
+	CallerPrincipalNatsDataPath = "caller_principal"
+
+	callRefusalReasonACL       = "acl"
+	callRefusalReasonSignature = "signature"
+)
+
+var ErrCallerDenied = errors.New("access denied")
+
+type callerInfo struct {
+	address   sfPlugins.StatefunAddress
+	domain    string
+	principal string
+	local     bool // The call never left the process
+}
+
+func (ftc *FunctionTypeConfig) hasCallerACL() bool {
+	return len(ftc.allowedCallerTypenames) > 0 || len(ftc.allowedCallerDomains) > 0 || len(ftc.allowedCallerPrincipals) > 0
+}
+
+// checkCaller returns nil if the caller is allowed to call the function
+func (ftc *FunctionTypeConfig) checkCaller(caller callerInfo) error {
+	if len(ftc.allowedCallerTypenames) > 0 && !matchesAnyACLPattern(ftc.allowedCallerTypenames, caller.address.Typename) {
+		return fmt.Errorf("%w: caller typename %q is not allowed", ErrCallerDenied, caller.address.Typename)
+	}
+	if len(ftc.allowedCallerDomains) > 0 && !matchesAnyACLPattern(ftc.allowedCallerDomains, caller.domain) {
+		return fmt.Errorf("%w: caller domain %q is not allowed", ErrCallerDenied, caller.domain)
+	}
+	if len(ftc.allowedCallerPrincipals) > 0 && !matchesAnyACLPattern(ftc.allowedCallerPrincipals, caller.principal) {
+		return fmt.Errorf("%w: caller principal %q is not allowed", ErrCallerDenied, caller.principal)
+	}
+	return nil
+}
+
+// checkCaller checks the caller against the function type's ACL and writes an audit entry on denial
+func (ft *FunctionType) checkCaller(id string, caller callerInfo, path string) error {
+	if !ft.config.hasCallerACL() {
+		return nil
+	}
+	if caller.local && isInternalCaller(caller.address.Typename) {
+		return nil
+	}
+	err := ft.config.checkCaller(caller)
+	if err != nil {
+		ft.auditDeniedCall(callRefusalReasonACL, id, caller, path, err)
+	}
+	return err
+}
+
+func (ft *FunctionType) auditDeniedCall(reason string, id string, caller callerInfo, path string, err error) {
+	lg.GetLogger().Warn(context.TODO(), "Function call is denied",
+		"audit", reason,
+		"function", ft.name,
+		"id", id,
+		"path", path,
+		"caller_typename", caller.address.Typename,
+		"caller_id", caller.address.ID,
+		"caller_domain", caller.domain,
+		"caller_principal", caller.principal,
+		"reason", err.Error(),
+	)
+}
+
+func (ft *FunctionType) callerRefusalReply(reason string, caller callerInfo, err error) *easyjson.JSON {
+	refusal := easyjson.NewJSONObject()
+	refusal.SetByPath("reason", easyjson.NewJSON(reason))
+	refusal.SetByPath("function", easyjson.NewJSON(ft.name))
+	refusal.SetByPath("caller_typename", easyjson.NewJSON(caller.address.Typename))
+	refusal.SetByPath("caller_id", easyjson.NewJSON(caller.address.ID))
+	refusal.SetByPath("caller_domain", easyjson.NewJSON(caller.domain))
+	refusal.SetByPath("caller_principal", easyjson.NewJSON(caller.principal))
+
+	reply := easyjson.NewJSONObjectWithKeyValue("status", easyjson.NewJSON("failed"))
+	reply.SetByPath("details", easyjson.NewJSON(err.Error()))
+	reply.SetByPath("data", easyjson.NewJSONObjectWithKeyValue("refusal", refusal))
+	return &reply
+}
+
+func matchesAnyACLPattern(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matchACLPattern(pattern, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchACLPattern matches "."-separated tokens of the value, "*" matches one token, ">" matches one or more tail tokens
+func matchACLPattern(pattern string, value string) bool {
+	if pattern == value {
+		return true
+	}
+	patternTokens := strings.Split(pattern, ".")
+	valueTokens := strings.Split(value, ".")
+	for i, pt := range patternTokens {
+		if pt == ">" {
+			return i == len(patternTokens)-1 && len(valueTokens) > i
+		}
+		if i >= len(valueTokens) || (pt != "*" && pt != valueTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(valueTokens)
+}
@@ -0,0 +1,124 @@
+package statefun
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestMatchACLPattern(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		value   string
+		matches bool
+	}{
+		{"functions.cmdb.api.create", "functions.cmdb.api.create", true},
+		{"functions.cmdb.api.create", "functions.cmdb.api.delete", false},
+		{"functions.cmdb.api.create", "functions.cmdb.api", false},
+		{"functions.cmdb.api.*", "functions.cmdb.api.create", true},
+		{"functions.cmdb.api.*", "functions.cmdb.api", false},
+		{"functions.cmdb.api.*", "functions.cmdb.api.create.vertex", false},
+		{"functions.*.api.create", "functions.graph.api.create", true},
+		{"functions.>", "functions.cmdb.api.create", true},
+		{"functions.>", "functions", false},
+		{"functions.>", "other.cmdb", false},
+		{">", "hub", true},
+		{"*", "hub", true},
+		{"*", "hub.leaf", false},
+		{"functions.>.create", "functions.cmdb.create", false},
+	} {
+		require.Equal(t, tc.matches, matchACLPattern(tc.pattern, tc.value), "%s ~ %s", tc.pattern, tc.value)
+	}
+}
+
+func TestInternalCallerACL(t *testing.T) {
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app"), func(r *Runtime) {
+		NewFunctionType(r, "functions.test.guarded", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {},
+			*NewFunctionTypeConfig().SetAllowedCallerTypenames("functions.test.*"))
+	})
+	defer stop()
+	ft := r.registeredFunctionTypes["functions.test.guarded"]
+
+	gc := r.localCallerInfo(ContextExpiryCallerTypename, contextExpiryCallerID)
+	require.NoError(t, ft.checkCaller("hub/a", gc, "golang_signal"), "GC of the own domain is not checked")
+
+	gc.local = false
+	require.ErrorIs(t, ft.checkCaller("hub/a", gc, "nats_signal"), ErrCallerDenied, "GC typename from NATS is checked")
+
+	require.ErrorIs(t, ft.checkCaller("hub/a", r.localCallerInfo("ingress", "signal"), "golang_signal"), ErrCallerDenied)
+	require.NoError(t, ft.checkCaller("hub/a", r.localCallerInfo("functions.test.caller", "hub/b"), "golang_signal"))
+}
+
+func TestDeniedNatsCalls(t *testing.T) {
+	var handled atomic.Int32
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app"), func(r *Runtime) {
+		NewFunctionType(r, "functions.test.guarded", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {
+			handled.Add(1)
+		}, *NewFunctionTypeConfig().SetAllowedCallerTypenames("functions.test.*"))
+	})
+	defer stop()
+	ft := r.registeredFunctionTypes["functions.test.guarded"]
+
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	data := easyjson.NewJSONObject()
+	data.SetByPath("caller_typename", easyjson.NewJSON("ingress"))
+	data.SetByPath("caller_id", easyjson.NewJSON("cli"))
+	data.SetByPath(CallerDomainNatsDataPath, easyjson.NewJSON("hub"))
+
+	// Request is replied with the refusal
+	sub, err := nc.SubscribeSync("request.hub.functions.test.guarded.a")
+	require.NoError(t, err)
+	replies := make(chan *nats.Msg, 1)
+	go func() {
+		reply, err := nc.Request("request.hub.functions.test.guarded.a", data.ToBytes(), 5*time.Second)
+		assert.NoError(t, err)
+		replies <- reply
+	}()
+	msg, err := sub.NextMsg(5 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, handleNatsMsg(ft, msg, true))
+	reply, ok := easyjson.JSONFromBytes((<-replies).Data)
+	require.True(t, ok)
+	require.Equal(t, "failed", reply.GetByPath("status").AsStringDefault(""))
+	require.Equal(t, callRefusalReasonACL, reply.GetByPath("data.refusal.reason").AsStringDefault(""))
+	require.Equal(t, "ingress", reply.GetByPath("data.refusal.caller_typename").AsStringDefault(""))
+	require.Equal(t, "hub", reply.GetByPath("data.refusal.caller_domain").AsStringDefault(""))
+
+	// Signal is acked and dropped
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "acl", Subjects: []string{"signal.>"}})
+	require.NoError(t, err)
+	_, err = js.AddConsumer("acl", &nats.ConsumerConfig{Durable: "guarded", AckPolicy: nats.AckExplicitPolicy})
+	require.NoError(t, err)
+	_, err = js.Publish("signal.hub.functions.test.guarded.a", data.ToBytes())
+	require.NoError(t, err)
+	pull, err := js.PullSubscribe("signal.>", "guarded", nats.Bind("acl", "guarded"))
+	require.NoError(t, err)
+	msgs, err := pull.Fetch(1, nats.MaxWait(5*time.Second))
+	require.NoError(t, err)
+	require.NoError(t, handleNatsMsg(ft, msgs[0], false))
+	require.Eventually(t, func() bool {
+		info, err := js.ConsumerInfo("acl", "guarded")
+		return err == nil && info.AckFloor.Stream == 1 && info.NumAckPending == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Zero(t, handled.Load())
+}
@@ -1,6 +1,8 @@
 package statefun
 
 import (
+	"time"
+
 	"github.com/foliagecp/easyjson"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 	"github.com/foliagecp/sdk/statefun/system"
@@ -14,6 +16,8 @@ const (
 	MutexLifetimeSec         = 120
 	MultipleInstancesAllowed = false
 	MaxIdHandlers            = 20
+	ContextTTL               = 0 // no default expiration
+	ContextExpireSignal      = false
 )
 
 type FunctionTypeConfig struct {
@@ -27,6 +31,13 @@ type FunctionTypeConfig struct {
 	allowedSignalProviders   map[sfPlugins.SignalProvider]struct{}
 	allowedRequestProviders  map[sfPlugins.RequestProvider]struct{}
 	functionWorkerPoolConfig SFWorkerPoolConfig
+	contextTTL               time.Duration
+	contextExpireSignal      bool
+	stateVersion             int
+	stateMigrations          []StateMigration
+	allowedCallerTypenames   []string
+	allowedCallerDomains     []string
+	allowedCallerPrincipals  []string
 }
 
 func NewFunctionTypeConfig() *FunctionTypeConfig {
@@ -41,6 +52,8 @@ func NewFunctionTypeConfig() *FunctionTypeConfig {
 		allowedSignalProviders:   map[sfPlugins.SignalProvider]struct{}{},
 		allowedRequestProviders:  map[sfPlugins.RequestProvider]struct{}{},
 		functionWorkerPoolConfig: NewSFWorkerPoolConfig(WPLoadDefault),
+		contextTTL:               ContextTTL,
+		contextExpireSignal:      ContextExpireSignal,
 	}
 	ft.allowedSignalProviders[sfPlugins.AutoSignalSelect] = struct{}{}
 	return ft
@@ -141,3 +154,48 @@ func (ftc *FunctionTypeConfig) SetWorkerPoolLoadType(wpLoadType WPLoadType) *Fun
 	ftc.functionWorkerPoolConfig = NewSFWorkerPoolConfig(wpLoadType)
 	return ftc
 }
+
+// SetContextTTL makes function contexts expire after ttl since their last SetFunctionContext, 0 disables default expiration.
+// SetContextExpirationAfter overrides the expiration until the next SetFunctionContext.
+func (ftc *FunctionTypeConfig) SetContextTTL(ttl time.Duration) *FunctionTypeConfig {
+	ftc.contextTTL = ttl
+	return ftc
+}
+
+// SetContextExpireSignal makes GC signal the function with ContextExpiredPayloadKey in the payload before its expired context is deleted,
+// so the function can flush or archive the state. Prolonging the expiration while handling the signal (including
+// SetFunctionContext with a default TTL) keeps the context.
+func (ftc *FunctionTypeConfig) SetContextExpireSignal(enabled bool) *FunctionTypeConfig {
+	ftc.contextExpireSignal = enabled
+	return ftc
+}
+
+// SetStateVersion sets the version of the shape of the function's function and object contexts. Contexts stored with an
+// older version are migrated on first load: migrations[i] migrates state of version i to version i+1, unversioned state
+// has version 0. A missing or nil migration means the state shape did not change between these versions.
+func (ftc *FunctionTypeConfig) SetStateVersion(version int, migrations ...StateMigration) *FunctionTypeConfig {
+	ftc.stateVersion = version
+	ftc.stateMigrations = migrations
+	return ftc
+}
+
+// SetAllowedCallerTypenames restricts typenames allowed to signal and request the function, patterns may contain
+// NATS-like wildcards: "functions.cmdb.api.*", "functions.graph.>". No typenames - any typename is allowed.
+func (ftc *FunctionTypeConfig) SetAllowedCallerTypenames(typenames ...string) *FunctionTypeConfig {
+	ftc.allowedCallerTypenames = typenames
+	return ftc
+}
+
+// SetAllowedCallerDomains restricts domains of callers allowed to signal and request the function. No domains - any
+// domain is allowed.
+func (ftc *FunctionTypeConfig) SetAllowedCallerDomains(domains ...string) *FunctionTypeConfig {
+	ftc.allowedCallerDomains = domains
+	return ftc
+}
+
+// SetAllowedCallerPrincipals restricts principals (see RuntimeConfig.SetPrincipal) allowed to signal and request the
+// function. No principals - any principal, including none, is allowed.
+func (ftc *FunctionTypeConfig) SetAllowedCallerPrincipals(principals ...string) *FunctionTypeConfig {
+	ftc.allowedCallerPrincipals = principals
+	return ftc
+}
@@ -0,0 +1,184 @@
+package statefun
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Function context expiration is indexed by time buckets in the cache, so GC visits only contexts which are due:
+
+	____ctx_expiry.<typename_hash>.<bucket>                         -> bucket marker
+	____ctx_expiry.<typename_hash>.<bucket>.<function_context_hash> -> function context key
+
+bucket is the expiration unix time divided by GC interval. An index entry is only a hint, the expiration time stored
+in the function context itself is always checked before the context is deleted.
+
+With the expire signal enabled GC signals the function with ContextExpiredPayloadKey in the payload instead of
+deleting its context. The context is deleted right after the function handles the signal unless the function
+prolonged it. If the signal is not handled within contextExpireSignalGraceSec the context is deleted without it.
+*/
+
+const (
+	ContextExpiredPayloadKey    = sfPlugins.ContextExpiredPayloadKey
+	ContextExpiryCallerTypename = "gc" // Caller typename of the expire signal
+
+	contextExpiryCallerID = "context_expiry"
+
+	contextExpiryIndexPrefix     = "____ctx_expiry"
+	contextExpireSignaledKey     = "____ctx_expire_signaled"
+	contextExpireSignalGraceSec  = 60
+	contextExpiryIndexBucketTmpl = contextExpiryIndexPrefix + ".%s.%d"
+)
+
+// isInternalCaller tells if the call is made by the runtime itself rather than by a function or an ingress
+func isInternalCaller(callerTypename string) bool {
+	return callerTypename == ContextExpiryCallerTypename
+}
+
+func (ft *FunctionType) contextExpiryBucketSec() int64 {
+	if ft.runtime.config.gcIntervalSec > 0 {
+		return int64(ft.runtime.config.gcIntervalSec)
+	}
+	return 1
+}
+
+func (ft *FunctionType) contextExpiryBucket(expirationTime int64) int64 {
+	return expirationTime / (ft.contextExpiryBucketSec() * int64(time.Second))
+}
+
+func (ft *FunctionType) contextExpiryBucketKey(bucket int64) string {
+	return fmt.Sprintf(contextExpiryIndexBucketTmpl, system.GetHashStr(ft.name), bucket)
+}
+
+func (ft *FunctionType) indexContextExpiration(funcCtxKey string, expirationTime int64) {
+	cache := ft.runtime.Domain.Cache()
+	bucketKey := ft.contextExpiryBucketKey(ft.contextExpiryBucket(expirationTime))
+	cache.SetValueIfDoesNotExist(bucketKey, []byte{1}, true, -1)
+	cache.SetValue(bucketKey+"."+system.GetHashStr(funcCtxKey), []byte(funcCtxKey), true, -1, "")
+}
+
+// setFunctionContext writes the function context applying the function type's default TTL
+func (ft *FunctionType) setFunctionContext(funcCtxKey string, context *easyjson.JSON) {
+	if context == nil || ft.config.contextTTL <= 0 {
+		ft.setContext(funcCtxKey, context)
+		return
+	}
+	prevExpirationTime := int64(context.GetByPath(contextExpirationKey).AsNumericDefault(-1))
+	expirationTime := ft.runtime.clock().Now().Add(ft.config.contextTTL).UnixNano()
+	context.SetByPath(contextExpirationKey, easyjson.NewJSON(expirationTime))
+	context.RemoveByPath(contextExpireSignaledKey)
+	ft.setContext(funcCtxKey, context)
+	if prevExpirationTime <= 0 || ft.contextExpiryBucket(prevExpirationTime) != ft.contextExpiryBucket(expirationTime) {
+		ft.indexContextExpiration(funcCtxKey, expirationTime)
+	}
+}
+
+// Negative duration removes expiration
+func (ft *FunctionType) setContextExpirationAfter(funcCtxKey string, after time.Duration) {
+	if j, err := ft.runtime.Domain.Cache().GetValueAsJSON(funcCtxKey); err == nil {
+		j.RemoveByPath(contextExpireSignaledKey)
+		if after < 0 {
+			j.RemoveByPath(contextExpirationKey)
+			ft.runtime.Domain.Cache().SetValue(funcCtxKey, j.ToBytes(), true, -1, "")
+			return
+		}
+		expirationTime := ft.runtime.clock().Now().Add(after).UnixNano()
+		j.SetByPath(contextExpirationKey, easyjson.NewJSON(expirationTime))
+		ft.runtime.Domain.Cache().SetValue(funcCtxKey, j.ToBytes(), true, -1, "")
+		ft.indexContextExpiration(funcCtxKey, expirationTime)
+	}
+}
+
+// indexLegacyContextExpirations indexes contexts which got their expiration before the index existed. Runs once.
+func (ft *FunctionType) indexLegacyContextExpirations() {
+	for _, funcCtxKey := range ft.runtime.Domain.Cache().GetKeysByPattern(ft.name + ".>") {
+		if expirationTime := int64(ft.getContext(funcCtxKey).GetByPath(contextExpirationKey).AsNumericDefault(-1)); expirationTime > 0 {
+			ft.indexContextExpiration(funcCtxKey, expirationTime)
+		}
+	}
+}
+
+// collectExpiredContexts deletes (or signals) function contexts from all index buckets which are due
+func (ft *FunctionType) collectExpiredContexts(now int64) {
+	if ft.expiryIndexReady.CompareAndSwap(false, true) {
+		ft.indexLegacyContextExpirations()
+	}
+
+	cache := ft.runtime.Domain.Cache()
+	nowBucket := ft.contextExpiryBucket(now)
+	indexPrefix := contextExpiryIndexPrefix + "." + system.GetHashStr(ft.name) + "."
+	for _, bucketKey := range cache.GetKeysByPattern(indexPrefix + "*") {
+		bucket, err := strconv.ParseInt(strings.TrimPrefix(bucketKey, indexPrefix), 10, 64)
+		if err != nil || bucket > nowBucket {
+			continue
+		}
+		pending := 0
+		for _, entryKey := range cache.GetKeysByPattern(bucketKey + ".*") {
+			value, err := cache.GetValue(entryKey)
+			if err == nil && !ft.collectExpiredContext(string(value), now) {
+				pending++
+				continue
+			}
+			cache.DeleteValue(entryKey, true, -1, "")
+		}
+		if pending == 0 {
+			cache.DeleteValue(bucketKey, true, -1, "")
+		}
+	}
+}
+
+// collectExpiredContext returns false if the index entry must be kept because the context is not due yet
+func (ft *FunctionType) collectExpiredContext(funcCtxKey string, now int64) bool {
+	funcCtx, err := ft.runtime.Domain.Cache().GetValueAsJSON(funcCtxKey)
+	if err != nil {
+		return true // Context is already deleted
+	}
+	expirationTime := int64(funcCtx.GetByPath(contextExpirationKey).AsNumericDefault(-1))
+	if expirationTime <= 0 {
+		return true // Expiration was removed
+	}
+	if ft.contextExpiryBucket(expirationTime) > ft.contextExpiryBucket(now) {
+		return true // Prolonged, indexed in a later bucket
+	}
+	if expirationTime >= now {
+		return false
+	}
+
+	if ft.config.contextExpireSignal && !funcCtx.GetByPath(contextExpireSignaledKey).AsBoolDefault(false) {
+		funcCtx.SetByPath(contextExpireSignaledKey, easyjson.NewJSON(true))
+		ft.runtime.Domain.Cache().SetValue(funcCtxKey, funcCtx.ToBytes(), true, -1, "")
+		ft.indexContextExpiration(funcCtxKey, now+int64(contextExpireSignalGraceSec)*int64(time.Second))
+
+		id := strings.TrimPrefix(funcCtxKey, ft.name+".")
+		payload := easyjson.NewJSONObject()
+		payload.SetByPath(ContextExpiredPayloadKey+".expired_at", easyjson.NewJSON(expirationTime))
+		if err := ft.runtime.signal(sfPlugins.AutoSignalSelect, ContextExpiryCallerTypename, contextExpiryCallerID, ft.name, id, &payload, nil); err != nil {
+			lg.Logf(lg.ErrorLevel, "Cannot send context expire signal to %s:%s: %s", ft.name, id, err)
+		}
+		return true
+	}
+
+	ft.runtime.Domain.Cache().DeleteValue(funcCtxKey, true, -1, "")
+	return true
+}
+
+// deleteContextIfExpired is called after the function handled its context expire signal
+func (ft *FunctionType) deleteContextIfExpired(funcCtxKey string) {
+	funcCtx, err := ft.runtime.Domain.Cache().GetValueAsJSON(funcCtxKey)
+	if err != nil {
+		return
+	}
+	expirationTime := int64(funcCtx.GetByPath(contextExpirationKey).AsNumericDefault(-1))
+	if expirationTime > 0 && expirationTime < ft.runtime.clock().Now().UnixNano() {
+		ft.runtime.Domain.Cache().DeleteValue(funcCtxKey, true, -1, "")
+	}
+}
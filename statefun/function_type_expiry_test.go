@@ -0,0 +1,139 @@
+package statefun
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/stretchr/testify/require"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const expiringTypename = "functions.test.expiring"
+
+// registerExpiringFunction registers a function which stores its payload as the function context and records the
+// ids it got the context expire signal for, a context with "keep" is prolonged by an hour on the signal
+func registerExpiringFunction(r *Runtime, expireSignal bool, mutex *sync.Mutex, signaled *[]string) {
+	NewFunctionType(r, expiringTypename, func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		if ctx.Payload.PathExists(ContextExpiredPayloadKey) {
+			mutex.Lock()
+			*signaled = append(*signaled, ctx.Self.ID)
+			mutex.Unlock()
+			if ctx.GetFunctionContext().PathExists("keep") {
+				ctx.SetContextExpirationAfter(time.Hour)
+			}
+			return
+		}
+		ctx.SetFunctionContext(ctx.Payload)
+	}, *NewFunctionTypeConfig().SetContextExpireSignal(expireSignal))
+}
+
+func contextExpiryIndex(r *Runtime) []string {
+	keys := r.Domain.Cache().GetKeysByPattern(contextExpiryIndexPrefix + ".>")
+	sort.Strings(keys)
+	return keys
+}
+
+func TestContextExpiryIndexGC(t *testing.T) {
+	var mutex sync.Mutex
+	var signaled []string
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app").SetGCIntervalSec(60), func(r *Runtime) {
+		registerExpiringFunction(r, false, &mutex, &signaled)
+	})
+	defer stop()
+
+	ft := r.registeredFunctionTypes[expiringTypename]
+	cache := r.Domain.Cache()
+	for _, id := range []string{"a", "b", "c"} {
+		payload := easyjson.NewJSONObjectWithKeyValue("v", easyjson.NewJSON(id))
+		require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, expiringTypename, id, &payload, nil))
+	}
+	key := func(id string) string { return expiringTypename + ".hub/" + id }
+	exists := func(id string) bool {
+		_, err := cache.GetValue(key(id))
+		return err == nil
+	}
+
+	now := r.clock().Now()
+	ft.setContextExpirationAfter(key("a"), time.Minute)
+	// Prolonged, the entry in the earlier bucket is left behind
+	ft.setContextExpirationAfter(key("b"), time.Minute)
+	ft.setContextExpirationAfter(key("b"), time.Hour)
+	// Expiration removed, the entry is left behind
+	ft.setContextExpirationAfter(key("c"), time.Minute)
+	ft.setContextExpirationAfter(key("c"), -1)
+	// Got its expiration before the index existed
+	legacy := easyjson.NewJSONObjectWithKeyValue(contextExpirationKey, easyjson.NewJSON(now.Add(time.Minute).UnixNano()))
+	cache.SetValue(key("d"), legacy.ToBytes(), true, -1, "")
+
+	ft.collectExpiredContexts(now.UnixNano())
+	for _, id := range []string{"a", "b", "c", "d"} {
+		require.True(t, exists(id), id)
+	}
+	require.Len(t, contextExpiryIndex(r), 7, "2 bucket markers, entries of a, b, c, d and of prolonged b")
+
+	ft.collectExpiredContexts(now.Add(2 * time.Minute).UnixNano())
+	require.False(t, exists("a"))
+	require.True(t, exists("b"))
+	require.True(t, exists("c"))
+	require.False(t, exists("d"))
+	bExpiration := int64(ft.getContext(key("b")).GetByPath(contextExpirationKey).AsNumericDefault(0))
+	bBucketKey := ft.contextExpiryBucketKey(ft.contextExpiryBucket(bExpiration))
+	require.Equal(t, []string{bBucketKey, bBucketKey + "." + system.GetHashStr(key("b"))}, contextExpiryIndex(r), "due bucket is removed")
+
+	ft.collectExpiredContexts(now.Add(2 * time.Hour).UnixNano())
+	require.False(t, exists("b"))
+	require.True(t, exists("c"))
+	require.Empty(t, contextExpiryIndex(r))
+	require.Empty(t, signaled)
+}
+
+func TestContextExpireSignal(t *testing.T) {
+	var mutex sync.Mutex
+	var signaled []string
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app").SetGCIntervalSec(3600), func(r *Runtime) {
+		registerExpiringFunction(r, true, &mutex, &signaled)
+	})
+	defer stop()
+
+	ft := r.registeredFunctionTypes[expiringTypename]
+	cache := r.Domain.Cache()
+	key := func(id string) string { return expiringTypename + ".hub/" + id }
+	exists := func(id string) bool {
+		_, err := cache.GetValue(key(id))
+		return err == nil
+	}
+
+	require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, expiringTypename, "a", easyjson.NewJSONObject().GetPtr(), nil))
+	keep := easyjson.NewJSONObjectWithKeyValue("keep", easyjson.NewJSON(true))
+	require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, expiringTypename, "b", &keep, nil))
+	ft.setContextExpirationAfter(key("a"), time.Millisecond)
+	ft.setContextExpirationAfter(key("b"), time.Millisecond)
+	// Was signaled, but did not handle the signal within the grace period
+	abandoned := easyjson.NewJSONObjectWithKeyValue(contextExpirationKey, easyjson.NewJSON(r.clock().Now().UnixNano()))
+	abandoned.SetByPath(contextExpireSignaledKey, easyjson.NewJSON(true))
+	cache.SetValue(key("c"), abandoned.ToBytes(), true, -1, "")
+	ft.indexContextExpiration(key("c"), r.clock().Now().UnixNano())
+	time.Sleep(10 * time.Millisecond)
+
+	ft.collectExpiredContexts(r.clock().Now().UnixNano())
+	require.False(t, exists("c"))
+	require.Eventually(t, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(signaled) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	mutex.Lock()
+	sort.Strings(signaled)
+	require.Equal(t, []string{"hub/a", "hub/b"}, signaled)
+	mutex.Unlock()
+
+	// Deleted right after the signal unless the function prolonged it
+	require.Eventually(t, func() bool { return !exists("a") }, 5*time.Second, 10*time.Millisecond)
+	require.True(t, exists("b"))
+	require.False(t, ft.getContext(key("b")).PathExists(contextExpireSignaledKey))
+}
@@ -0,0 +1,263 @@
+package statefun
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Every context written by a function type with a state version is stamped with that version:
+
+	function context: ____state_version: int
+	object context:   ____state_versions.<typename_hash>.<object_id_hash> -> {"id": string, "version": int}
+
+Object contexts are shared between function types and belong to the application, so their versions are kept in
+separate keys of the cache rather than in the contexts. A version key is written with the object context by
+SetObjectContext and is deleted with it, an object context deleted and written again by another function type keeps
+the stale version key until this function type writes or migrates the object.
+
+A context with an older stamp (no stamp means version 0) is migrated on its first load by the function type and is
+written back immediately. An object context without a version key of the function type may belong to another function
+type (e.g. a graph vertex body), it is migrated for the handler only and is written back with the version key when the
+handler sets it. migrations[i] migrates state of version i to version i+1.
+
+Eager migration signals every id with a stored context with StateMigrationPayloadKey in the payload. The signal is
+handled by the runtime in the id's worker instead of the function, so the migration does not race with the function
+handling the same id.
+*/
+
+const (
+	StateMigrationPayloadKey = "__state_migration"
+
+	functionStateVersionKey   = "____state_version"
+	objectStateVersionsKey    = "____state_versions"
+	objectStateVersionKeyTmpl = objectStateVersionsKey + ".%s.%s"
+	stateMigrationCallerID    = "state_migration"
+)
+
+type StateKind int
+
+const (
+	FunctionState StateKind = iota
+	ObjectState
+)
+
+// StateMigration converts a context of one version into the next one. Returned nil means the context must be deleted.
+type StateMigration func(kind StateKind, state *easyjson.JSON) (*easyjson.JSON, error)
+
+type StateMigrationReport struct {
+	Typename string `json:"typename"`
+	Version  int    `json:"version"`
+	Signaled int    `json:"signaled"` // Ids whose contexts are migrated by their workers
+	Failed   int    `json:"failed"`   // Ids which could not be signaled
+}
+
+func (ft *FunctionType) objectStateVersionKey(id string) string {
+	return fmt.Sprintf(objectStateVersionKeyTmpl, system.GetHashStr(ft.name), system.GetHashStr(id))
+}
+
+// storedStateVersion returns the version the context was stamped with, 0 if it was not
+func (ft *FunctionType) storedStateVersion(kind StateKind, keyValueID string, state *easyjson.JSON) int {
+	if kind == ObjectState {
+		record, err := ft.runtime.Domain.Cache().GetValueAsJSON(ft.objectStateVersionKey(keyValueID))
+		if err != nil {
+			return 0
+		}
+		return int(record.GetByPath("version").AsNumericDefault(0))
+	}
+	return int(state.GetByPath(functionStateVersionKey).AsNumericDefault(0))
+}
+
+// ownsStoredState tells if the context belongs to the function type: function contexts always do, object contexts do
+// if the function type wrote its version key
+func (ft *FunctionType) ownsStoredState(kind StateKind, keyValueID string) bool {
+	if kind == FunctionState {
+		return true
+	}
+	_, err := ft.runtime.Domain.Cache().GetValue(ft.objectStateVersionKey(keyValueID))
+	return err == nil
+}
+
+func (ft *FunctionType) stampFunctionStateVersion(state *easyjson.JSON) {
+	if ft.config.stateVersion > 0 && state != nil && state.IsObject() {
+		state.SetByPath(functionStateVersionKey, easyjson.NewJSON(ft.config.stateVersion))
+	}
+}
+
+// stampObjectStateVersion writes the version key of the object context, deletes it if the context is deleted
+func (ft *FunctionType) stampObjectStateVersion(id string, state *easyjson.JSON) {
+	if ft.config.stateVersion <= 0 {
+		return
+	}
+	versionKey := ft.objectStateVersionKey(id)
+	if state == nil {
+		ft.runtime.Domain.Cache().DeleteValue(versionKey, true, -1, "")
+		return
+	}
+	record := easyjson.NewJSONObject()
+	record.SetByPath("id", easyjson.NewJSON(id))
+	record.SetByPath("version", easyjson.NewJSON(ft.config.stateVersion))
+	ft.runtime.Domain.Cache().SetValue(versionKey, record.ToBytes(), true, -1, "")
+}
+
+// migrateState returns the state migrated to the current version and whether anything was changed
+func (ft *FunctionType) migrateState(kind StateKind, keyValueID string, state *easyjson.JSON) (*easyjson.JSON, bool, error) {
+	version := ft.storedStateVersion(kind, keyValueID, state)
+	if version >= ft.config.stateVersion {
+		return state, false, nil
+	}
+	for v := version; v < ft.config.stateVersion; v++ {
+		if v >= len(ft.config.stateMigrations) || ft.config.stateMigrations[v] == nil {
+			continue // No changes in the state shape between these versions
+		}
+		migrated, err := ft.config.stateMigrations[v](kind, state)
+		if err != nil {
+			return state, false, fmt.Errorf("state migration of %s from version %d failed: %w", ft.name, v, err)
+		}
+		if migrated == nil {
+			return nil, true, nil
+		}
+		state = migrated
+	}
+	if kind == FunctionState {
+		ft.stampFunctionStateVersion(state)
+	}
+	return state, true, nil
+}
+
+// storeMigratedContext writes back the migrated context and its version
+func (ft *FunctionType) storeMigratedContext(kind StateKind, keyValueID string, state *easyjson.JSON) {
+	ft.setContext(keyValueID, state)
+	if kind == ObjectState {
+		ft.stampObjectStateVersion(keyValueID, state)
+	}
+}
+
+// loadContext returns the context migrated to the current state version, a missing context is returned as an empty object.
+// The migrated context is written back only if the function type owns it.
+func (ft *FunctionType) loadContext(kind StateKind, keyValueID string) *easyjson.JSON {
+	if ft.config.stateVersion <= 0 {
+		return ft.getContext(keyValueID)
+	}
+	state, err := ft.runtime.Domain.Cache().GetValueAsJSON(keyValueID)
+	if err != nil {
+		j := easyjson.NewJSONObject()
+		return &j
+	}
+	migrated, changed, err := ft.migrateState(kind, keyValueID, state)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Context %s stays unmigrated: %s", keyValueID, err)
+		return state
+	}
+	if !changed {
+		return migrated
+	}
+	if ft.ownsStoredState(kind, keyValueID) {
+		ft.storeMigratedContext(kind, keyValueID, migrated)
+	}
+	if migrated == nil {
+		j := easyjson.NewJSONObject()
+		return &j
+	}
+	return migrated
+}
+
+func (ft *FunctionType) storeFunctionContext(funcCtxKey string, context *easyjson.JSON) {
+	ft.stampFunctionStateVersion(context)
+	ft.setFunctionContext(funcCtxKey, context)
+}
+
+func (ft *FunctionType) storeObjectContext(id string, context *easyjson.JSON) {
+	ft.setContext(id, context)
+	ft.stampObjectStateVersion(id, context)
+}
+
+func (ft *FunctionType) migrateStoredContext(kind StateKind, keyValueID string) {
+	state, err := ft.runtime.Domain.Cache().GetValueAsJSON(keyValueID)
+	if err != nil {
+		if kind == ObjectState {
+			ft.stampObjectStateVersion(keyValueID, nil) // The object was deleted by someone else
+		}
+		return
+	}
+	migrated, changed, err := ft.migrateState(kind, keyValueID, state)
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Context %s stays unmigrated: %s", keyValueID, err)
+		return
+	}
+	if changed {
+		ft.storeMigratedContext(kind, keyValueID, migrated)
+	}
+}
+
+// migrateStoredContexts handles the state migration signal of the id, must be called by the id's worker
+func (ft *FunctionType) migrateStoredContexts(id string) {
+	ft.migrateStoredContext(FunctionState, ft.name+"."+id)
+	if ft.ownsStoredState(ObjectState, id) {
+		ft.migrateStoredContext(ObjectState, id)
+	}
+}
+
+/*
+MigrateAllStates eagerly migrates all stored contexts of the function type to its current state version:
+all function contexts and object contexts which have a version key of this function type with an older version.
+Unstamped object contexts are not touched since they may not belong to the function type.
+
+Every id is signaled and is migrated by its worker, so migrations are done when the signals are handled.
+A function type with a caller ACL must allow ContextExpiryCallerTypename to get the signals over NATS.
+*/
+func (r *Runtime) MigrateAllStates(typename string) (StateMigrationReport, error) {
+	ft, ok := r.functionType(typename)
+	if !ok {
+		return StateMigrationReport{}, fmt.Errorf("function type %s is not registered", typename)
+	}
+	report := StateMigrationReport{Typename: typename, Version: ft.config.stateVersion}
+	if ft.config.stateVersion <= 0 {
+		return report, nil
+	}
+
+	cache := r.Domain.Cache()
+	ids := map[string]struct{}{}
+	for _, funcCtxKey := range cache.GetKeysByPattern(typename + ".>") {
+		ids[strings.TrimPrefix(funcCtxKey, typename+".")] = struct{}{}
+	}
+	for _, versionKey := range cache.GetKeysByPattern(fmt.Sprintf(objectStateVersionKeyTmpl, system.GetHashStr(typename), ">")) {
+		record, err := cache.GetValueAsJSON(versionKey)
+		if err != nil {
+			continue
+		}
+		if id, ok := record.GetByPath("id").AsString(); ok {
+			ids[id] = struct{}{}
+		}
+	}
+
+	payload := easyjson.NewJSONObjectWithKeyValue(StateMigrationPayloadKey, easyjson.NewJSON(ft.config.stateVersion))
+	for id := range ids {
+		if err := r.signal(sfPlugins.AutoSignalSelect, ContextExpiryCallerTypename, stateMigrationCallerID, typename, id, &payload, nil); err != nil {
+			lg.Logf(lg.ErrorLevel, "Cannot send state migration signal to %s:%s: %s", typename, id, err)
+			report.Failed++
+			continue
+		}
+		report.Signaled++
+	}
+
+	lg.Logf(lg.InfoLevel, "State migration of %s to version %d: signaled=%d failed=%d", typename, report.Version, report.Signaled, report.Failed)
+	return report, nil
+}
+
+// StateVersionedFunctionTypes returns names of all registered function types which have a state version
+func (r *Runtime) StateVersionedFunctionTypes() []string {
+	typenames := []string{}
+	for _, typename := range r.RegisteredFunctionTypes() {
+		if ft, ok := r.functionType(typename); ok && ft.config.stateVersion > 0 {
+			typenames = append(typenames, typename)
+		}
+	}
+	return typenames
+}
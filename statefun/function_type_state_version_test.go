@@ -0,0 +1,119 @@
+package statefun
+
+import (
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/stretchr/testify/require"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+const versionedTypename = "functions.test.versioned"
+
+// registerVersionedFunction registers a function type with state version 2: version 1 renames "old" to "mid",
+// version 2 renames "mid" to "new", contexts with "drop" are deleted by the first migration. The function sets the object
+// context it got if the payload has "write".
+func registerVersionedFunction(r *Runtime, seen *[]string) {
+	rename := func(from string, to string) StateMigration {
+		return func(_ StateKind, state *easyjson.JSON) (*easyjson.JSON, error) {
+			if state.PathExists("drop") {
+				return nil, nil
+			}
+			if state.PathExists(from) {
+				state.SetByPath(to, state.GetByPath(from))
+				state.RemoveByPath(from)
+			}
+			return state, nil
+		}
+	}
+	NewFunctionType(r, versionedTypename, func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		*seen = append(*seen, ctx.GetFunctionContext().ToString(), ctx.GetObjectContext().ToString())
+		if ctx.Payload.PathExists("write") {
+			ctx.SetObjectContext(ctx.GetObjectContext())
+		}
+	}, *NewFunctionTypeConfig().SetStateVersion(2, rename("old", "mid"), rename("mid", "new")))
+}
+
+func TestStateMigrationOnLoad(t *testing.T) {
+	var seen []string
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app"), func(r *Runtime) {
+		registerVersionedFunction(r, &seen)
+	})
+	defer stop()
+
+	cache := r.Domain.Cache()
+	cache.SetValue(versionedTypename+".hub/a", []byte(`{"old":1}`), true, -1, "")
+	cache.SetValue("hub/a", []byte(`{"old":2}`), true, -1, "")
+	ft := r.registeredFunctionTypes[versionedTypename]
+
+	// The object context may belong to someone else, it is migrated for the function only
+	require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, versionedTypename, "a", nil, nil))
+	require.Equal(t, []string{`{"____state_version":2,"new":1}`, `{"new":2}`}, seen)
+	require.Equal(t, `{"old":2}`, r.ObjectContext("a").ToString())
+	_, err := cache.GetValue(ft.objectStateVersionKey("hub/a"))
+	require.Error(t, err)
+
+	write := easyjson.NewJSONObjectWithKeyValue("write", easyjson.NewJSON(true))
+	seen = nil
+	require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, versionedTypename, "a", &write, nil))
+	require.Equal(t, []string{`{"____state_version":2,"new":1}`, `{"new":2}`}, seen)
+
+	// The object context is not stamped, its version is kept in a separate key
+	require.Equal(t, `{"new":2}`, r.ObjectContext("a").ToString())
+	record, err := cache.GetValueAsJSON(ft.objectStateVersionKey("hub/a"))
+	require.NoError(t, err)
+	require.Equal(t, "hub/a", record.GetByPath("id").AsStringDefault(""))
+	require.Equal(t, float64(2), record.GetByPath("version").AsNumericDefault(0))
+
+	// Migrated contexts are not migrated again
+	seen = nil
+	require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, versionedTypename, "a", nil, nil))
+	require.Equal(t, []string{`{"____state_version":2,"new":1}`, `{"new":2}`}, seen)
+}
+
+func TestMigrateAllStates(t *testing.T) {
+	var seen []string
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app"), func(r *Runtime) {
+		registerVersionedFunction(r, &seen)
+	})
+	defer stop()
+
+	cache := r.Domain.Cache()
+	ft := r.registeredFunctionTypes[versionedTypename]
+	cache.SetValue(versionedTypename+".hub/a", []byte(`{"old":1}`), true, -1, "")
+	cache.SetValue(versionedTypename+".hub/b", []byte(`{"mid":2,"____state_version":1}`), true, -1, "")
+	cache.SetValue(versionedTypename+".hub/c", []byte(`{"drop":true}`), true, -1, "")
+	// Object of version 1 with a version key, and an unversioned object which may belong to someone else
+	cache.SetValue("hub/d", []byte(`{"mid":3}`), true, -1, "")
+	cache.SetValue(ft.objectStateVersionKey("hub/d"), []byte(`{"id":"hub/d","version":1}`), true, -1, "")
+	cache.SetValue("hub/e", []byte(`{"old":4}`), true, -1, "")
+
+	report, err := r.MigrateAllStates(versionedTypename)
+	require.NoError(t, err)
+	require.Equal(t, StateMigrationReport{Typename: versionedTypename, Version: 2, Signaled: 4}, report)
+	require.Empty(t, seen, "migration signals are handled by the runtime")
+
+	context := func(key string) string {
+		value, err := cache.GetValue(key)
+		if err != nil {
+			return ""
+		}
+		return string(value)
+	}
+	require.Equal(t, `{"____state_version":2,"new":1}`, context(versionedTypename+".hub/a"))
+	require.Equal(t, `{"____state_version":2,"new":2}`, context(versionedTypename+".hub/b"))
+	require.Equal(t, "", context(versionedTypename+".hub/c"))
+	require.Equal(t, `{"new":3}`, context("hub/d"))
+	require.Equal(t, `{"old":4}`, context("hub/e"))
+
+	report, err = r.MigrateAllStates(versionedTypename)
+	require.NoError(t, err)
+	require.Equal(t, 3, report.Signaled)
+	require.Equal(t, `{"____state_version":2,"new":1}`, context(versionedTypename+".hub/a"))
+	require.Equal(t, `{"new":3}`, context("hub/d"))
+	require.Empty(t, seen)
+
+	_, err = r.MigrateAllStates("functions.test.unknown")
+	require.Error(t, err)
+}
@@ -3,6 +3,7 @@ package statefun
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/foliagecp/sdk/statefun/logger"
@@ -103,6 +104,7 @@ type SFWorkerPool struct {
 	stopped  bool
 
 	prometricsUpdatedTime time.Time
+	lastTaskDoneTime      int64
 
 	wg sync.WaitGroup
 }
@@ -117,6 +119,7 @@ func NewSFWorkerPool(ft *FunctionType, conf SFWorkerPoolConfig) *SFWorkerPool {
 		notifyCh:    make(chan struct{}, 1),
 		stopCh:      make(chan struct{}),
 	}
+	atomic.StoreInt64(&wp.lastTaskDoneTime, wp.ft.runtime.clock().Now().UnixNano())
 	go wp.manager()
 	return wp
 }
@@ -252,6 +255,7 @@ func (wp *SFWorkerPool) worker() {
 
 				ft.workerTaskExecutor(id, task.Msg.Data)
 			}
+			atomic.StoreInt64(&wp.lastTaskDoneTime, wp.ft.runtime.clock().Now().UnixNano())
 
 			if !timer.Stop() {
 				<-timer.C
@@ -305,3 +309,16 @@ func (wp *SFWorkerPool) GetWorkerPercentage() (loadedWorkers float64, idleWorker
 
 	return
 }
+
+// IsStuck reports a possible deadlock: all workers are busy, tasks are waiting in the queue
+// and not a single task was completed during the stuckTimeout
+func (wp *SFWorkerPool) IsStuck(stuckTimeout time.Duration) bool {
+	wp.mu.Lock()
+	allBusy := wp.workers > 0 && wp.idleWorkers == 0
+	wp.mu.Unlock()
+
+	if !allBusy || len(wp.taskQueue) == 0 {
+		return false
+	}
+	return wp.ft.runtime.clock().Now().Sub(time.Unix(0, atomic.LoadInt64(&wp.lastTaskDoneTime))) > stuckTimeout
+}
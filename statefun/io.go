@@ -16,23 +16,46 @@ const (
 	ShadowObjectCallParamOptionPath string = "shadow_object.can_receive"
 )
 
-func buildNatsData(callerDomain string, callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON) []byte {
+// buildNatsData builds the envelope of a call to the target (<target_typename>.<target_id>), signed if signing is on.
+// A call is never sent unsigned when signing is on, receivers would refuse it anyway.
+func (r *Runtime) buildNatsData(target string, callerTypename string, callerID string, payload *easyjson.JSON, options *easyjson.JSON) ([]byte, error) {
 	data := easyjson.NewJSONObject()
 	data.SetByPath("caller_typename", easyjson.NewJSON(callerTypename))
 	data.SetByPath("caller_id", easyjson.NewJSON(callerID))
+	data.SetByPath(CallerDomainNatsDataPath, easyjson.NewJSON(r.Domain.name))
+	if len(r.config.principal) > 0 {
+		data.SetByPath(CallerPrincipalNatsDataPath, easyjson.NewJSON(r.config.principal))
+	}
 	if payload != nil {
 		data.SetByPath("payload", *payload)
 	}
 	if options != nil {
 		data.SetByPath("options", *options)
 	}
-	return data.ToBytes()
+	if r.config.envelopeSigning != nil {
+		signed, err := r.config.envelopeSigning.Sign(&data, target)
+		if err != nil {
+			return nil, fmt.Errorf("envelope for %s cannot be signed: %w", target, err)
+		}
+		return signed, nil
+	}
+	return data.ToBytes(), nil
+}
+
+func (r *Runtime) localCallerInfo(callerTypename string, callerID string) callerInfo {
+	return callerInfo{
+		address:   sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID},
+		domain:    r.Domain.name,
+		principal: r.config.principal,
+		local:     true,
+	}
 }
 
-func (r *Runtime) signalShadowObject(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) error {
+// shadowObjectSignalMsg returns the subject and the data of a signal to the shadow object
+func (r *Runtime) shadowObjectSignalMsg(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (string, []byte, error) {
 	tDomainName, tObjectIdWithoutDomain, err := r.Domain.GetShadowObjectDomainAndID(targetID)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 	objectIdInRemoteDomain := fmt.Sprintf("%s%s%s", tDomainName, ObjectIDDomainSeparator, tObjectIdWithoutDomain)
 
@@ -44,12 +67,11 @@ func (r *Runtime) signalShadowObject(callerTypename string, callerID string, tar
 		ObjectIDWeakClusteringDomainSeparator,
 		r.Domain.GetObjectIDWithoutDomain(callerID),
 	)
-	system.MsgOnErrorReturn(r.nc.Publish(
-		fmt.Sprintf(DomainIngressSubjectsTmpl, tDomainName, fmt.Sprintf("%s.%s.%s.%s", SignalPrefix, tDomainName, targetTypename, objectIdInRemoteDomain)),
-		buildNatsData(r.Domain.name, callerTypename, shadowCallerID, payload, options),
-	))
-
-	return nil
+	data, err := r.buildNatsData(targetTypename+"."+objectIdInRemoteDomain, callerTypename, shadowCallerID, payload, options)
+	if err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf(DomainIngressSubjectsTmpl, tDomainName, fmt.Sprintf("%s.%s.%s.%s", SignalPrefix, tDomainName, targetTypename, objectIdInRemoteDomain)), data, nil
 }
 
 func (r *Runtime) requestShadowObject(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) (*nats.Msg, error) {
@@ -67,9 +89,13 @@ func (r *Runtime) requestShadowObject(callerTypename string, callerID string, ta
 		ObjectIDWeakClusteringDomainSeparator,
 		r.Domain.GetObjectIDWithoutDomain(callerID),
 	)
+	data, err := r.buildNatsData(targetTypename+"."+objectIdInRemoteDomain, callerTypename, shadowCallerID, payload, options)
+	if err != nil {
+		return nil, err
+	}
 	resp, err := r.nc.Request(
 		fmt.Sprintf("%s.%s.%s.%s", RequestPrefix, tDomainName, targetTypename, objectIdInRemoteDomain),
-		buildNatsData(r.Domain.name, callerTypename, shadowCallerID, payload, options),
+		data,
 		time.Duration(r.config.requestTimeoutSec)*time.Second,
 	)
 
@@ -77,13 +103,16 @@ func (r *Runtime) requestShadowObject(callerTypename string, callerID string, ta
 }
 
 func (r *Runtime) egress(egressProvider sfPlugins.EgressProvider, callerTypename string, callerID string, payload *easyjson.JSON) error {
+	if r.memory != nil {
+		return r.memory.recordEgress(egressProvider, callerTypename, callerID, payload)
+	}
 	natsCoreEgress := func() error {
 		go func() {
 			system.GlobalPrometrics.GetRoutinesCounter().Started("ingress-jetstreamGlobalSignal-gofunc")
 			defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("ingress-jetstreamGlobalSignal-gofunc")
 
 			system.MsgOnErrorReturn(r.nc.Publish(
-				fmt.Sprintf("%s.%s.%s", "egress", callerTypename, callerID),
+				fmt.Sprintf("%s.%s.%s", r.Domain.egressSubjectsPrefix(), callerTypename, callerID),
 				payload.ToBytes(),
 			))
 		}()
@@ -93,6 +122,8 @@ func (r *Runtime) egress(egressProvider sfPlugins.EgressProvider, callerTypename
 	switch egressProvider {
 	case sfPlugins.NatsCoreEgress:
 		return natsCoreEgress()
+	case sfPlugins.HTTPWebhookEgress:
+		return r.webhookEgress(callerTypename, callerID, payload)
 	default:
 		return fmt.Errorf("unknown egress provider: %d", egressProvider)
 	}
@@ -107,7 +138,7 @@ func (r *Runtime) egress(egressProvider sfPlugins.EgressProvider, callerTypename
 func (r *Runtime) functionTypeIsReadyForGoLangCommunication(targetFunctionTypeName string, isRequest bool, targetID string) int {
 	var targetFT *FunctionType
 	if r.Domain.GetDomainFromObjectID(targetID) == r.Domain.name {
-		if ft, ok := r.registeredFunctionTypes[targetFunctionTypeName]; ok {
+		if ft, ok := r.functionType(targetFunctionTypeName); ok {
 			targetFT = ft
 		} else {
 			return 2
@@ -136,27 +167,39 @@ func (r *Runtime) signal(signalProvider sfPlugins.SignalProvider, callerTypename
 	if options != nil {
 		shadowObjectCanBeReceiver = options.GetByPath(ShadowObjectCallParamOptionPath).AsBoolDefault(false)
 	}
+	if err := r.checkTenantCall(callerTypename, targetID); err != nil {
+		return err
+	}
+	if r.memory != nil {
+		return r.memorySignal(callerTypename, callerID, targetTypename, targetID, payload, options)
+	}
 	jetstreamGlobalSignal := func() error {
+		var (
+			subject string
+			data    []byte
+			err     error
+		)
+		if !shadowObjectCanBeReceiver && r.Domain.IsShadowObject(targetID) {
+			subject, data, err = r.shadowObjectSignalMsg(callerTypename, callerID, targetTypename, targetID, payload, options)
+		} else {
+			// If publishing signal to the same domain
+			if r.Domain.name == r.Domain.GetDomainFromObjectID(targetID) {
+				// Publish directly into function's topic bypassing egress router
+				subject = fmt.Sprintf(DomainIngressSubjectsTmpl, r.Domain.name, fmt.Sprintf("%s.%s.%s.%s", SignalPrefix, r.Domain.name, targetTypename, targetID))
+			} else { // Publish into egress router
+				subject = fmt.Sprintf(DomainEgressSubjectsTmpl, r.Domain.name, fmt.Sprintf("%s.%s.%s.%s", SignalPrefix, r.Domain.GetDomainFromObjectID(targetID), targetTypename, targetID))
+			}
+			data, err = r.buildNatsData(targetTypename+"."+targetID, callerTypename, callerID, payload, options)
+		}
+		if err != nil {
+			return err
+		}
+
 		go func() {
 			system.GlobalPrometrics.GetRoutinesCounter().Started("ingress-jetstreamGlobalSignal-gofunc")
 			defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("ingress-jetstreamGlobalSignal-gofunc")
 
-			if !shadowObjectCanBeReceiver && r.Domain.IsShadowObject(targetID) {
-				system.MsgOnErrorReturn(r.signalShadowObject(callerTypename, callerID, targetTypename, targetID, payload, options))
-			} else {
-				// If publishing signal to the same domain
-				if r.Domain.name == r.Domain.GetDomainFromObjectID(targetID) {
-					system.MsgOnErrorReturn(r.nc.Publish( // Publish directly into function's topic bypassing egress router
-						fmt.Sprintf(DomainIngressSubjectsTmpl, r.Domain.name, fmt.Sprintf("%s.%s.%s.%s", SignalPrefix, r.Domain.name, targetTypename, targetID)),
-						buildNatsData(r.Domain.name, callerTypename, callerID, payload, options),
-					))
-				} else { // Publish into egress router
-					system.MsgOnErrorReturn(r.nc.Publish(
-						fmt.Sprintf(DomainEgressSubjectsTmpl, r.Domain.name, fmt.Sprintf("%s.%s.%s.%s", SignalPrefix, r.Domain.GetDomainFromObjectID(targetID), targetTypename, targetID)),
-						buildNatsData(r.Domain.name, callerTypename, callerID, payload, options),
-					))
-				}
-			}
+			system.MsgOnErrorReturn(r.nc.Publish(subject, data))
 		}()
 		return nil
 	}
@@ -164,9 +207,11 @@ func (r *Runtime) signal(signalProvider sfPlugins.SignalProvider, callerTypename
 	goLangLocalSignal := func() error {
 		switch r.functionTypeIsReadyForGoLangCommunication(targetTypename, false, targetID) {
 		case 0:
+			targetFT, _ := r.functionType(targetTypename)
+			if err := targetFT.checkCaller(targetID, r.localCallerInfo(callerTypename, callerID), "golang_signal"); err != nil {
+				return err
+			}
 			func() {
-				targetFT := r.registeredFunctionTypes[targetTypename]
-
 				// Do not send original data, prevents same data concurrent access from different functions
 				var payloadCopy *easyjson.JSON = nil
 				var optionsCopy *easyjson.JSON = nil
@@ -212,7 +257,7 @@ func (r *Runtime) signal(signalProvider sfPlugins.SignalProvider, callerTypename
 						logger.Logln(logger.ErrorLevel, "goLangLocalSignal: nackChannel was unexpectedly closed")
 					}
 					// if ok - whether signal is redirected to NATS Jetstream due to nack command
-				case <-time.After(time.Duration(targetFT.config.msgAckWaitMs) * time.Millisecond):
+				case <-r.clock().After(time.Duration(targetFT.config.msgAckWaitMs) * time.Millisecond):
 					logger.Logf(logger.WarnLevel, "goLangLocalSignal: receiver typename=%s called on id=%s did not ack msg in time, for safety reasons msg is being redirected to NATS Jetstream", targetTypename, targetID)
 					system.MsgOnErrorReturn(r.signal(sfPlugins.JetstreamGlobalSignal, callerTypename, callerID, targetTypename, targetID, payload, options))
 				}
@@ -250,15 +295,88 @@ func (r *Runtime) signal(signalProvider sfPlugins.SignalProvider, callerTypename
 	}
 }
 
+// localRequest hands the request to the target function type in this goroutine and waits for the reply
+func (r *Runtime) localRequest(targetFT *FunctionType, callerTypename string, callerID string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, timeout time.Duration) (*easyjson.JSON, error) {
+	caller := r.localCallerInfo(callerTypename, callerID)
+	if err := targetFT.checkCaller(targetID, caller, "golang_request"); err != nil {
+		return targetFT.callerRefusalReply(callRefusalReasonACL, caller, err), nil
+	}
+	resultJSONChannel := make(chan *easyjson.JSON, 1)
+
+	// Do not send original data, prevents same data concurrent access from different functions
+	var payloadCopy *easyjson.JSON = nil
+	var optionsCopy *easyjson.JSON = nil
+	if payload != nil {
+		payloadCopy = payload.Clone().GetPtr()
+	}
+	if options != nil {
+		optionsCopy = options.Clone().GetPtr()
+	}
+	// ----------------------------------------------------------------------------------------
+	functionMsg := FunctionTypeMsg{
+		Caller:  &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID},
+		Payload: payloadCopy,
+		Options: optionsCopy,
+	}
+
+	/*functionMsg.RequestCallback = func(data *easyjson.JSON) {
+		go func() {
+			resultJSONChannel <- data.Clone().GetPtr() // Clone().GetPtr() prevents data to contain custom Golang types
+		}()
+	}
+	functionMsg.RefusalCallback = func(_ bool) {
+		go func() {
+			close(resultJSONChannel)
+		}()
+	}
+
+	targetFT.prometricsMeasureMsgDeliver(GolangReq)
+	targetFT.sendMsg(targetID, functionMsg)*/
+
+	functionMsg.RequestCallback = func(data *easyjson.JSON) {
+		select {
+		case resultJSONChannel <- data.Clone().GetPtr():
+		default: // channel is ether closed or already has a value
+		}
+	}
+	functionMsg.RefusalCallback = func(_ bool) {
+		defer func() {
+			if r := recover(); r != nil { // in case channel is already closed
+				logger.Logf(logger.ErrorLevel, "panic in request functionMsg.RefusalCallback close(resultJSONChannel) caller:%s:%s target:%s:%s: %v", callerTypename, callerID, targetFT.name, targetID, r)
+			}
+		}()
+		close(resultJSONChannel)
+	}
+
+	targetFT.prometricsMeasureMsgDeliver(GolangReq)
+	targetFT.workerTaskExecutor(targetID, functionMsg)
+
+	select {
+	case resultJSON, ok := <-resultJSONChannel:
+		if ok {
+			return resultJSON, nil
+		}
+		return nil, fmt.Errorf("goLangLocalRequest: target function with typename \"%s\" with id \"%s\" resufes to handle request", targetFT.name, targetID)
+	case <-r.clock().After(timeout):
+		return nil, fmt.Errorf("goLangLocalRequest: timeout occured while requesting function typename \"%s\" with id \"%s\"", targetFT.name, targetID)
+	}
+}
+
 func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, timeout ...time.Duration) (*easyjson.JSON, error) {
 	shadowObjectCanBeReceiver := false
 	if options != nil {
 		shadowObjectCanBeReceiver = options.GetByPath(ShadowObjectCallParamOptionPath).AsBoolDefault(false)
 	}
+	if err := r.checkTenantCall(callerTypename, targetID); err != nil {
+		return nil, err
+	}
 	requestTimeoutDuration := time.Duration(r.config.requestTimeoutSec) * time.Second
 	if len(timeout) > 0 {
 		requestTimeoutDuration = timeout[0]
 	}
+	if r.memory != nil {
+		return r.memoryRequest(callerTypename, callerID, targetTypename, targetID, payload, options, requestTimeoutDuration)
+	}
 	natsCoreGlobalRequest := func() (*easyjson.JSON, error) {
 		var (
 			resp *nats.Msg
@@ -268,9 +386,13 @@ func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypen
 		if !shadowObjectCanBeReceiver && r.Domain.IsShadowObject(targetID) {
 			resp, err = r.requestShadowObject(callerTypename, callerID, targetTypename, targetID, payload, options)
 		} else {
+			var data []byte
+			if data, err = r.buildNatsData(targetTypename+"."+targetID, callerTypename, callerID, payload, options); err != nil {
+				return nil, err
+			}
 			resp, err = r.nc.Request(
 				fmt.Sprintf("%s.%s.%s.%s", RequestPrefix, r.Domain.GetDomainFromObjectID(targetID), targetTypename, targetID),
-				buildNatsData(r.Domain.name, callerTypename, callerID, payload, options),
+				data,
 				requestTimeoutDuration,
 			)
 		}
@@ -286,66 +408,8 @@ func (r *Runtime) request(requestProvider sfPlugins.RequestProvider, callerTypen
 	goLangLocalRequest := func() (*easyjson.JSON, error) {
 		switch r.functionTypeIsReadyForGoLangCommunication(targetTypename, true, targetID) {
 		case 0:
-			targetFT := r.registeredFunctionTypes[targetTypename]
-			resultJSONChannel := make(chan *easyjson.JSON, 1)
-
-			// Do not send original data, prevents same data concurrent access from different functions
-			var payloadCopy *easyjson.JSON = nil
-			var optionsCopy *easyjson.JSON = nil
-			if payload != nil {
-				payloadCopy = payload.Clone().GetPtr()
-			}
-			if options != nil {
-				optionsCopy = options.Clone().GetPtr()
-			}
-			// ----------------------------------------------------------------------------------------
-			functionMsg := FunctionTypeMsg{
-				Caller:  &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID},
-				Payload: payloadCopy,
-				Options: optionsCopy,
-			}
-
-			/*functionMsg.RequestCallback = func(data *easyjson.JSON) {
-				go func() {
-					resultJSONChannel <- data.Clone().GetPtr() // Clone().GetPtr() prevents data to contain custom Golang types
-				}()
-			}
-			functionMsg.RefusalCallback = func(_ bool) {
-				go func() {
-					close(resultJSONChannel)
-				}()
-			}
-
-			targetFT.prometricsMeasureMsgDeliver(GolangReq)
-			targetFT.sendMsg(targetID, functionMsg)*/
-
-			functionMsg.RequestCallback = func(data *easyjson.JSON) {
-				select {
-				case resultJSONChannel <- data.Clone().GetPtr():
-				default: // channel is ether closed or already has a value
-				}
-			}
-			functionMsg.RefusalCallback = func(_ bool) {
-				defer func() {
-					if r := recover(); r != nil { // in case channel is already closed
-						logger.Logf(logger.ErrorLevel, "panic in request functionMsg.RefusalCallback close(resultJSONChannel) caller:%s:%s target:%s:%s: %v", callerTypename, callerID, targetTypename, targetID, r)
-					}
-				}()
-				close(resultJSONChannel)
-			}
-
-			targetFT.prometricsMeasureMsgDeliver(GolangReq)
-			targetFT.workerTaskExecutor(targetID, functionMsg)
-
-			select {
-			case resultJSON, ok := <-resultJSONChannel:
-				if ok {
-					return resultJSON, nil
-				}
-				return nil, fmt.Errorf("goLangLocalRequest: target function with typename \"%s\" with id \"%s\" resufes to handle request", targetTypename, targetID)
-			case <-time.After(requestTimeoutDuration):
-				return nil, fmt.Errorf("goLangLocalRequest: timeout occured while requesting function typename \"%s\" with id \"%s\"", targetTypename, targetID)
-			}
+			targetFT, _ := r.functionType(targetTypename)
+			return r.localRequest(targetFT, callerTypename, callerID, targetID, payload, options, requestTimeoutDuration)
 		case 1:
 			return nil, fmt.Errorf("goLangLocalRequest: cannot request function with the typename %s via golang, domain differs: %s(runtime) != %s(id)", callerTypename, r.Domain.name, r.Domain.GetDomainFromObjectID(targetID))
 		case 2:
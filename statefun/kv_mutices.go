@@ -54,8 +54,9 @@ func KeyMutexLock(ctx context.Context, runtime *Runtime, key string, errorOnLock
 		system.MsgOnErrorReturn(w.Stop())
 		kwWatchMutex.Unlock()
 	}
-	mutexWaitForUnlock := func(keyMutex string) {
+	mutexWaitForUnlock := func(keyMutex string, waiting func()) {
 		for {
+			waiting()
 			if w, err := getKeyWatch(keyMutex); err == nil {
 				entry := <-w.Updates()
 				if entry != nil {
@@ -64,7 +65,7 @@ func KeyMutexLock(ctx context.Context, runtime *Runtime, key string, errorOnLock
 						releaseKeyWatch(w)
 						return
 					}
-					if lockTime+int64(runtime.config.kvMutexLifeTimeSec)*int64(time.Second) < system.GetCurrentTimeNs() {
+					if lockTime+int64(runtime.config.kvMutexLifeTimeSec)*int64(time.Second) < runtime.clock().Now().UnixNano() || runtime.chaos.mutexLeaseExpired(key) {
 						le.Tracef(ctx, "======================= WAITING FOR UNLOCK DONE (MUTEX IS DEAD)")
 						releaseKeyWatch(w)
 						return
@@ -82,8 +83,26 @@ func KeyMutexLock(ctx context.Context, runtime *Runtime, key string, errorOnLock
 	keyMutex := key + ".mutex"
 	mutexResetLockNeeded := false
 	le.Tracef(ctx, "============== Locking %s", keyMutex)
+
+	owner := lockOwnerFromContext(ctx, runtime)
+	waiterKey := ""
+	var waitingSince, waiterRenewedAt int64
+	renewWaiter := func() {
+		if now := runtime.clock().Now().UnixNano(); len(waiterKey) == 0 || waiterRenewedAt+int64(runtime.config.kvMutexLifeTimeSec)*int64(time.Second)/2 < now {
+			waiterKey = keyMutexRecordWaiter(runtime, waiterKey, key, owner, waitingSince)
+			waiterRenewedAt = now
+		}
+	}
+	defer func() { keyMutexForgetWaiter(runtime, waiterKey) }()
+	locked := func(revId uint64, err error, now int64) (uint64, error) {
+		if err == nil && revId != 0 {
+			keyMutexRecordOwner(runtime, key, owner, now)
+		}
+		return revId, err
+	}
+
 	for {
-		now := system.GetCurrentTimeNs()
+		now := runtime.clock().Now().UnixNano()
 
 		//keyValueMutexOperationMutex.Lock()
 
@@ -98,7 +117,8 @@ func KeyMutexLock(ctx context.Context, runtime *Runtime, key string, errorOnLock
 		}
 		if mutexResetLockNeeded {
 			//defer keyValueMutexOperationMutex.Unlock()
-			return mutexResetLock(keyMutex, now)
+			revId, err := mutexResetLock(keyMutex, now)
+			return locked(revId, err, now)
 		}
 
 		lockTime := system.BytesToInt64(entry.Value())
@@ -108,8 +128,8 @@ func KeyMutexLock(ctx context.Context, runtime *Runtime, key string, errorOnLock
 			if revId == 0 && err == nil { // Did not succeed in locking, other lock was faster
 				continue
 			}
-			return revId, err
-		} else if lockTime+int64(runtime.config.kvMutexLifeTimeSec)*int64(time.Second) < now { // Mutex was locked by someone else and its lock is too old
+			return locked(revId, err, now)
+		} else if lockTime+int64(runtime.config.kvMutexLifeTimeSec)*int64(time.Second) < now || runtime.chaos.mutexLeaseExpired(key) { // Mutex was locked by someone else and its lock is too old
 			le.Warnf(ctx, "Context mutex for key=%s is too old, will be unlocked!", key)
 			mutexResetLockNeeded = true
 			//keyValueMutexOperationMutex.Unlock()
@@ -121,7 +141,10 @@ func KeyMutexLock(ctx context.Context, runtime *Runtime, key string, errorOnLock
 		if errorOnLocked {
 			return 0, ErrMutexLocked
 		}
-		mutexWaitForUnlock(keyMutex)
+		if waitingSince == 0 {
+			waitingSince = now
+		}
+		mutexWaitForUnlock(keyMutex, renewWaiter)
 	}
 }
 
@@ -139,7 +162,7 @@ func KeyMutexLockUpdate(ctx context.Context, runtime *Runtime, key string, lockR
 	}
 	lockTime := system.BytesToInt64(entry.Value())
 	if lockTime != 0 {
-		revId, err := kv.Update(keyMutex, system.Int64ToBytes(system.GetCurrentTimeNs()), entry.Revision())
+		revId, err := kv.Update(keyMutex, system.Int64ToBytes(runtime.clock().Now().UnixNano()), entry.Revision())
 		if err != nil {
 			return 0, err
 		}
@@ -174,6 +197,7 @@ func KeyMutexUnlock(ctx context.Context, runtime *Runtime, key string, lockRevis
 	} else {
 		le.Warnf(ctx, "Context mutex for key=%s was already unlocked!", key)
 	}
+	keyMutexForgetOwner(runtime, key)
 	le.Tracef(ctx, "============== Unlocked %s", keyMutex)
 	return nil // Successfully unlocked
 }
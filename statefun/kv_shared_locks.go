@@ -0,0 +1,491 @@
+package statefun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Shared locks (read/write mutexes and counting semaphores) are stored in the domain's NATS KV as a single JSON value
+per lock key:
+
+	{
+		"max_permits": int, // 0 - unlimited
+		"holders": [{"id": string, "permits": int, "exclusive": bool, "expires_at": int64}, ...],
+		"queue":   [{"id": string, "permits": int, "exclusive": bool, "expires_at": int64}, ...]
+	}
+
+Every change is made with a KV revision check, waiters are served in FIFO order and wait for KV updates via watch.
+Holders and waiters are leases: if not prolonged during kvMutexLifeTimeSec they are considered dead and removed.
+Locks taken through StatefunContextProcessor are prolonged automatically while the handler which took them runs,
+a lock kept after the handler returns must be prolonged with ObjectRWMutexLockUpdate or ObjectSemaphoreUpdate.
+
+Acquisition is reentrant for the same holder only as far as it already holds what it asks for: a write lock covers
+a read, permits cover fewer permits. A read lock is upgraded to a write lock only if the holder is the lock's only
+holder, more permits are taken only if they are available, otherwise ErrSharedLockUpgrade is returned instead of
+waiting, since two holders waiting for each other to upgrade would never be served. The max permits of a semaphore
+are fixed while it has holders or waiters.
+*/
+
+const (
+	rwMutexKeySuffix   = ".rwmutex"
+	semaphoreKeySuffix = ".semaphore"
+)
+
+var (
+	ErrSharedLockNotHeld          = errors.New("shared lock is not held by the holder")
+	ErrSharedLockUpgrade          = errors.New("shared lock held by the holder cannot be upgraded")
+	ErrSemaphoreMaxPermitsChanged = errors.New("semaphore is in use with other max permits")
+)
+
+type sharedLockEntry struct {
+	Id        string `json:"id"`
+	Permits   int    `json:"permits"`
+	Exclusive bool   `json:"exclusive"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+type sharedLockState struct {
+	MaxPermits int               `json:"max_permits"`
+	Holders    []sharedLockEntry `json:"holders"`
+	Queue      []sharedLockEntry `json:"queue"`
+
+	revision uint64 // 0 - does not exist in KV yet
+}
+
+func sharedLockGetState(runtime *Runtime, stateKey string) (*sharedLockState, error) {
+	entry, err := runtime.Domain.kv.Get(stateKey)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return &sharedLockState{}, nil
+		}
+		return nil, err
+	}
+	state := &sharedLockState{}
+	if err := json.Unmarshal(entry.Value(), state); err != nil {
+		lg.Logf(lg.WarnLevel, "Shared lock %s has invalid state and will be reset: %s", stateKey, err)
+		state = &sharedLockState{}
+	}
+	state.revision = entry.Revision()
+	return state, nil
+}
+
+// sharedLockPutState returns false without an error if the state was changed concurrently
+func sharedLockPutState(runtime *Runtime, stateKey string, state *sharedLockState) (bool, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return false, err
+	}
+	if state.revision == 0 {
+		_, err = runtime.Domain.kv.Create(stateKey, data)
+	} else {
+		_, err = runtime.Domain.kv.Update(stateKey, data, state.revision)
+	}
+	if err != nil {
+		if isKVRevisionConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func isKVRevisionConflict(err error) bool {
+	if errors.Is(err, nats.ErrKeyExists) {
+		return true
+	}
+	var apiErr *nats.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == nats.JSErrCodeStreamWrongLastSequence
+}
+
+// prune removes expired holders and waiters
+func (s *sharedLockState) prune(now int64) {
+	holders := s.Holders[:0]
+	for _, h := range s.Holders {
+		if h.ExpiresAt < now {
+			lg.Logf(lg.WarnLevel, "Shared lock holder %s is too old and will be removed", h.Id)
+			continue
+		}
+		holders = append(holders, h)
+	}
+	s.Holders = holders
+
+	queue := s.Queue[:0]
+	for _, w := range s.Queue {
+		if w.ExpiresAt >= now {
+			queue = append(queue, w)
+		}
+	}
+	s.Queue = queue
+}
+
+func (s *sharedLockState) holderIndex(holderId string) int {
+	for i, h := range s.Holders {
+		if h.Id == holderId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *sharedLockState) queueIndex(holderId string) int {
+	for i, w := range s.Queue {
+		if w.Id == holderId {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *sharedLockState) removeFromQueue(holderId string) {
+	if i := s.queueIndex(holderId); i >= 0 {
+		s.Queue = append(s.Queue[:i], s.Queue[i+1:]...)
+	}
+}
+
+// canAcquire checks whether a request standing at queuePos (len(queue) if not queued) can take the lock right now
+func (s *sharedLockState) canAcquire(req sharedLockEntry, queuePos int) bool {
+	usedPermits := 0
+	for _, h := range s.Holders {
+		if h.Exclusive {
+			return false
+		}
+		usedPermits += h.Permits
+	}
+
+	if req.Exclusive {
+		return len(s.Holders) == 0 && queuePos == 0
+	}
+
+	aheadPermits := 0
+	for i := 0; i < queuePos && i < len(s.Queue); i++ {
+		if s.Queue[i].Exclusive {
+			return false
+		}
+		aheadPermits += s.Queue[i].Permits
+	}
+	return s.MaxPermits <= 0 || usedPermits+aheadPermits+req.Permits <= s.MaxPermits
+}
+
+// canUpgrade checks whether the holder at holderIndex can take what req asks for in addition to what it holds
+func (s *sharedLockState) canUpgrade(holderIndex int, req sharedLockEntry) bool {
+	if req.Exclusive {
+		return len(s.Holders) == 1
+	}
+	usedPermits := 0
+	for i, h := range s.Holders {
+		if i != holderIndex {
+			usedPermits += h.Permits
+		}
+	}
+	return s.MaxPermits <= 0 || usedPermits+req.Permits <= s.MaxPermits
+}
+
+// sharedLockTryStep makes one atomic attempt to take the lock. If the lock cannot be taken and enqueue is set,
+// the request is placed into the waiters queue, or its waiter lease is prolonged when refresh is set.
+func sharedLockTryStep(runtime *Runtime, stateKey string, req sharedLockEntry, maxPermits int, enqueue bool, refresh bool) (bool, error) {
+	lifetime := time.Duration(runtime.config.kvMutexLifeTimeSec) * time.Second
+	for {
+		state, err := sharedLockGetState(runtime, stateKey)
+		if err != nil {
+			return false, err
+		}
+		now := runtime.clock().Now().UnixNano()
+		state.prune(now)
+		if maxPermits > 0 && state.MaxPermits != maxPermits {
+			if len(state.Holders) > 0 || len(state.Queue) > 0 {
+				return false, fmt.Errorf("%w: %d != %d", ErrSemaphoreMaxPermitsChanged, maxPermits, state.MaxPermits)
+			}
+			state.MaxPermits = maxPermits
+		}
+
+		req.ExpiresAt = now + lifetime.Nanoseconds()
+		if i := state.holderIndex(req.Id); i >= 0 { // Reentrant acquisition by the same holder
+			held := state.Holders[i]
+			if (held.Exclusive || !req.Exclusive) && held.Permits >= req.Permits {
+				return true, nil
+			}
+			if !state.canUpgrade(i, req) {
+				return false, ErrSharedLockUpgrade
+			}
+			state.Holders[i].Exclusive = held.Exclusive || req.Exclusive
+			state.Holders[i].Permits = req.Permits
+			state.Holders[i].ExpiresAt = req.ExpiresAt
+			ok, err := sharedLockPutState(runtime, stateKey, state)
+			if err != nil || ok {
+				return ok, err
+			}
+			continue // State was changed concurrently, retrying
+		}
+
+		acquired := false
+		pos := state.queueIndex(req.Id)
+		queuePos := pos
+		if queuePos < 0 {
+			queuePos = len(state.Queue)
+		}
+
+		if state.canAcquire(req, queuePos) {
+			state.removeFromQueue(req.Id)
+			state.Holders = append(state.Holders, req)
+			acquired = true
+		} else if !enqueue {
+			return false, nil
+		} else if pos < 0 {
+			state.Queue = append(state.Queue, req)
+		} else if refresh {
+			state.Queue[pos].ExpiresAt = req.ExpiresAt
+		} else {
+			return false, nil
+		}
+
+		ok, err := sharedLockPutState(runtime, stateKey, state)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return acquired, nil
+		}
+		// State was changed concurrently, retrying
+	}
+}
+
+func sharedLockLeaveQueue(runtime *Runtime, stateKey string, holderId string) {
+	for {
+		state, err := sharedLockGetState(runtime, stateKey)
+		if err != nil || state.queueIndex(holderId) < 0 {
+			system.MsgOnErrorReturn(err)
+			return
+		}
+		state.removeFromQueue(holderId)
+		ok, err := sharedLockPutState(runtime, stateKey, state)
+		if err != nil {
+			system.MsgOnErrorReturn(err)
+			return
+		}
+		if ok {
+			return
+		}
+	}
+}
+
+func sharedLockAcquire(ctx context.Context, runtime *Runtime, stateKey string, req sharedLockEntry, maxPermits int, errorOnLocked bool) error {
+	if len(req.Id) == 0 {
+		return fmt.Errorf("shared lock holder id must not be empty")
+	}
+	if req.Permits <= 0 {
+		req.Permits = 1
+	}
+
+	if errorOnLocked {
+		acquired, err := sharedLockTryStep(runtime, stateKey, req, maxPermits, false, false)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			return ErrMutexLocked
+		}
+		return nil
+	}
+
+	// Watch is created before the first attempt so that no update between the attempt and the wait is missed
+	w, err := runtime.Domain.kv.Watch(stateKey, nats.IgnoreDeletes(), nats.Context(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+
+	acquired, err := sharedLockTryStep(runtime, stateKey, req, maxPermits, true, false)
+	if err != nil || acquired {
+		return err
+	}
+
+	lifetime := time.Duration(runtime.config.kvMutexLifeTimeSec) * time.Second
+	refreshTicker := runtime.clock().NewTicker(lifetime / 3)
+	defer refreshTicker.Stop()
+
+	for {
+		refresh := false
+		select {
+		case <-ctx.Done():
+			sharedLockLeaveQueue(runtime, stateKey, req.Id)
+			return ctx.Err()
+		case <-runtime.shutdown:
+			sharedLockLeaveQueue(runtime, stateKey, req.Id)
+			return fmt.Errorf("runtime is shutting down")
+		case _, ok := <-w.Updates():
+			if !ok {
+				sharedLockLeaveQueue(runtime, stateKey, req.Id)
+				return fmt.Errorf("shared lock %s watch was closed", stateKey)
+			}
+		case <-refreshTicker.C():
+			refresh = true // Keeps waiter's lease alive and evicts dead holders
+		}
+		acquired, err := sharedLockTryStep(runtime, stateKey, req, maxPermits, true, refresh)
+		if err != nil {
+			sharedLockLeaveQueue(runtime, stateKey, req.Id)
+			return err
+		}
+		if acquired {
+			return nil
+		}
+	}
+}
+
+func sharedLockRelease(runtime *Runtime, stateKey string, holderId string) error {
+	for {
+		state, err := sharedLockGetState(runtime, stateKey)
+		if err != nil {
+			return err
+		}
+		i := state.holderIndex(holderId)
+		if i < 0 {
+			return ErrSharedLockNotHeld
+		}
+		state.Holders = append(state.Holders[:i], state.Holders[i+1:]...)
+		ok, err := sharedLockPutState(runtime, stateKey, state)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+}
+
+func sharedLockUpdate(runtime *Runtime, stateKey string, holderId string) error {
+	lifetime := time.Duration(runtime.config.kvMutexLifeTimeSec) * time.Second
+	for {
+		state, err := sharedLockGetState(runtime, stateKey)
+		if err != nil {
+			return err
+		}
+		i := state.holderIndex(holderId)
+		if i < 0 {
+			return ErrSharedLockNotHeld
+		}
+		state.Holders[i].ExpiresAt = runtime.clock().Now().UnixNano() + lifetime.Nanoseconds()
+		ok, err := sharedLockPutState(runtime, stateKey, state)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+}
+
+// KeyRWMutexLock acquires a distributed read (shared) or write (exclusive) lock for the key on behalf of holderId.
+// Lock is reentrant for the same holderId, a read lock is upgraded to a write lock if holderId is its only holder.
+// errorOnLocked - if lock cannot be acquired immediately, exit with ErrMutexLocked instead of waiting in the queue
+func KeyRWMutexLock(ctx context.Context, runtime *Runtime, key string, holderId string, exclusive bool, errorOnLocked bool) error {
+	return sharedLockAcquire(ctx, runtime, key+rwMutexKeySuffix, sharedLockEntry{Id: holderId, Permits: 1, Exclusive: exclusive}, 0, errorOnLocked)
+}
+
+// KeyRWMutexLockUpdate prolongs the lease of a lock held by holderId
+func KeyRWMutexLockUpdate(ctx context.Context, runtime *Runtime, key string, holderId string) error {
+	return sharedLockUpdate(runtime, key+rwMutexKeySuffix, holderId)
+}
+
+func KeyRWMutexUnlock(ctx context.Context, runtime *Runtime, key string, holderId string) error {
+	return sharedLockRelease(runtime, key+rwMutexKeySuffix, holderId)
+}
+
+// KeySemaphoreAcquire takes permits out of maxPermits for the key on behalf of holderId. A holder asking again holds
+// the greater number of permits, if they are available.
+// errorOnLocked - if permits are not available immediately, exit with ErrMutexLocked instead of waiting in the queue
+func KeySemaphoreAcquire(ctx context.Context, runtime *Runtime, key string, holderId string, permits int, maxPermits int, errorOnLocked bool) error {
+	if maxPermits <= 0 {
+		return fmt.Errorf("semaphore max permits must be positive")
+	}
+	if permits > maxPermits {
+		return fmt.Errorf("cannot acquire %d permits out of %d", permits, maxPermits)
+	}
+	return sharedLockAcquire(ctx, runtime, key+semaphoreKeySuffix, sharedLockEntry{Id: holderId, Permits: permits}, maxPermits, errorOnLocked)
+}
+
+// KeySemaphoreUpdate prolongs the lease of permits held by holderId
+func KeySemaphoreUpdate(ctx context.Context, runtime *Runtime, key string, holderId string) error {
+	return sharedLockUpdate(runtime, key+semaphoreKeySuffix, holderId)
+}
+
+func KeySemaphoreRelease(ctx context.Context, runtime *Runtime, key string, holderId string) error {
+	return sharedLockRelease(runtime, key+semaphoreKeySuffix, holderId)
+}
+
+// sharedLockLeases prolongs leases of shared locks taken by a handler while it runs
+type sharedLockLeases struct {
+	runtime  *Runtime
+	holderId string
+
+	mutex     sync.Mutex
+	stateKeys map[string]struct{}
+	done      chan struct{} // nil - renewal is not started
+}
+
+func newSharedLockLeases(runtime *Runtime, holderId string) *sharedLockLeases {
+	return &sharedLockLeases{runtime: runtime, holderId: holderId, stateKeys: map[string]struct{}{}}
+}
+
+func (l *sharedLockLeases) add(stateKey string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stateKeys[stateKey] = struct{}{}
+	if l.done == nil {
+		l.done = make(chan struct{})
+		go l.renew(l.done)
+	}
+}
+
+func (l *sharedLockLeases) remove(stateKey string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.stateKeys, stateKey)
+}
+
+// stop ends the renewal, the leases of locks which are still held expire kvMutexLifeTimeSec after the last renewal
+func (l *sharedLockLeases) stop() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.done != nil {
+		close(l.done)
+	}
+	l.stateKeys = map[string]struct{}{}
+}
+
+func (l *sharedLockLeases) renew(done chan struct{}) {
+	system.GlobalPrometrics.GetRoutinesCounter().Started("sharedLockLeases-renew")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("sharedLockLeases-renew")
+
+	ticker := l.runtime.clock().NewTicker(time.Duration(l.runtime.config.kvMutexLifeTimeSec) * time.Second / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-l.runtime.shutdown:
+			return
+		case <-ticker.C():
+			l.mutex.Lock()
+			stateKeys := make([]string, 0, len(l.stateKeys))
+			for stateKey := range l.stateKeys {
+				stateKeys = append(stateKeys, stateKey)
+			}
+			l.mutex.Unlock()
+			for _, stateKey := range stateKeys {
+				if err := sharedLockUpdate(l.runtime, stateKey, l.holderId); err != nil {
+					lg.Logf(lg.WarnLevel, "Shared lock %s lease of %s cannot be prolonged: %s", stateKey, l.holderId, err)
+				}
+			}
+		}
+	}
+}
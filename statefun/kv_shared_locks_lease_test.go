@@ -0,0 +1,103 @@
+package statefun_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+	sfTest "github.com/foliagecp/sdk/statefun/test"
+)
+
+const (
+	sharedLockerTypename = "functions.test.locker"
+	sharedLockLifetime   = time.Second
+)
+
+type sharedLockLeaseSuite struct {
+	sfTest.StatefunMemoryTestSuite
+	entered chan struct{}
+	release chan struct{}
+}
+
+// SetupTest registers a function which takes the write lock and a semaphore permit of hub/res, waits for release to
+// be closed and returns keeping both, or prolongs them when the payload has "update"
+func (s *sharedLockLeaseSuite) SetupTest() {
+	s.StatefunMemoryTestSuite.SetupTest()
+	s.entered = make(chan struct{})
+	s.release = make(chan struct{})
+	s.RuntimeConfig().SetKVMutexLifeTimeSec(int(sharedLockLifetime / time.Second))
+	s.RegisterFunction(sharedLockerTypename, func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		if ctx.Payload != nil && ctx.Payload.PathExists("update") {
+			s.Assert().NoError(ctx.ObjectRWMutexLockUpdate("hub/res"))
+			s.Assert().NoError(ctx.ObjectSemaphoreUpdate("hub/res"))
+			return
+		}
+		s.Assert().NoError(ctx.ObjectRWMutexLock("hub/res", true, false))
+		s.Assert().NoError(ctx.ObjectSemaphoreAcquire("hub/res", 1, 1, false))
+		close(s.entered)
+		<-s.release
+	}, *statefun.NewFunctionTypeConfig())
+	s.Require().NoError(s.StartRuntime())
+}
+
+func (s *sharedLockLeaseSuite) expiresAt(stateKey string) time.Time {
+	expiresAt, err := statefun.SharedLockExpiresAt(s.Runtime(), stateKey)
+	s.Require().NoError(err)
+	return expiresAt
+}
+
+func (s *sharedLockLeaseSuite) TestRenewedWhileHandlerRuns() {
+	rwKey, semaphoreKey := "hub/res-lock"+statefun.RWMutexKeySuffix, "hub/res-lock"+statefun.SemaphoreKeySuffix
+	handled := make(chan error, 1)
+	go func() { handled <- s.Signal(sharedLockerTypename, "a", nil, nil) }()
+	<-s.entered
+
+	// The handler holds the locks twice as long as their lifetime
+	for until := s.Clock().Now().Add(2 * sharedLockLifetime); s.Clock().Now().Before(until); {
+		rwExpiresAt, semaphoreExpiresAt := s.expiresAt(rwKey), s.expiresAt(semaphoreKey)
+		advanceUntil(&s.StatefunMemoryTestSuite, sharedLockLifetime/30, func() bool {
+			return s.expiresAt(rwKey).After(rwExpiresAt) && s.expiresAt(semaphoreKey).After(semaphoreExpiresAt)
+		})
+	}
+	s.Require().ErrorIs(statefun.KeyRWMutexLock(context.TODO(), s.Runtime(), "hub/res-lock", "other", true, true), statefun.ErrMutexLocked)
+	s.Require().ErrorIs(statefun.KeySemaphoreAcquire(context.TODO(), s.Runtime(), "hub/res-lock", "other", 1, 1, true), statefun.ErrMutexLocked)
+
+	close(s.release)
+	s.Require().NoError(<-handled)
+
+	// Locks kept after the handler returned are not renewed anymore
+	lastExpiresAt := s.expiresAt(rwKey)
+	advanceUntil(&s.StatefunMemoryTestSuite, sharedLockLifetime/30, func() bool {
+		return statefun.KeyRWMutexLock(context.TODO(), s.Runtime(), "hub/res-lock", "other", true, true) == nil
+	})
+	s.Require().Less(s.Clock().Now().Sub(lastExpiresAt), sharedLockLifetime/3, "taken over soon after the last lease expired")
+}
+
+func (s *sharedLockLeaseSuite) TestUpdate() {
+	rwKey, semaphoreKey := "hub/res-lock"+statefun.RWMutexKeySuffix, "hub/res-lock"+statefun.SemaphoreKeySuffix
+	close(s.release)
+	s.Require().NoError(s.Signal(sharedLockerTypename, "a", nil, nil))
+	rwExpiresAt, semaphoreExpiresAt := s.expiresAt(rwKey), s.expiresAt(semaphoreKey)
+
+	s.Advance(sharedLockLifetime / 2)
+	payload := easyjson.NewJSONObjectWithKeyValue("update", easyjson.NewJSON(true))
+	s.Require().NoError(s.Signal(sharedLockerTypename, "a", &payload, nil))
+	s.Require().Equal(rwExpiresAt.Add(sharedLockLifetime/2), s.expiresAt(rwKey))
+	s.Require().Equal(semaphoreExpiresAt.Add(sharedLockLifetime/2), s.expiresAt(semaphoreKey))
+
+	// Another instance does not hold the locks and cannot prolong them
+	s.Require().ErrorIs(statefun.KeyRWMutexLockUpdate(context.TODO(), s.Runtime(), "hub/res-lock", sharedLockerTypename+":hub/b"), statefun.ErrSharedLockNotHeld)
+}
+
+func TestSharedLockLeaseSuite(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	suite.Run(t, new(sharedLockLeaseSuite))
+}
@@ -0,0 +1,56 @@
+package statefun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedLockUpgrade(t *testing.T) {
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app"), nil)
+	defer stop()
+	ctx := context.TODO()
+
+	require.NoError(t, KeyRWMutexLock(ctx, r, "res", "a", false, true))
+	require.NoError(t, KeyRWMutexLock(ctx, r, "res", "b", false, true))
+	// A reader does not become a writer while another reader holds the lock
+	require.ErrorIs(t, KeyRWMutexLock(ctx, r, "res", "a", true, true), ErrSharedLockUpgrade)
+	require.ErrorIs(t, KeyRWMutexLock(ctx, r, "res", "a", true, false), ErrSharedLockUpgrade, "does not wait for a deadlock")
+
+	require.NoError(t, KeyRWMutexUnlock(ctx, r, "res", "b"))
+	require.NoError(t, KeyRWMutexLock(ctx, r, "res", "a", true, true))
+	require.ErrorIs(t, KeyRWMutexLock(ctx, r, "res", "b", false, true), ErrMutexLocked)
+	// A write lock covers reads
+	require.NoError(t, KeyRWMutexLock(ctx, r, "res", "a", false, true))
+	state, err := sharedLockGetState(r, "res"+rwMutexKeySuffix)
+	require.NoError(t, err)
+	require.Len(t, state.Holders, 1)
+	require.True(t, state.Holders[0].Exclusive)
+}
+
+func TestSemaphoreExtraPermits(t *testing.T) {
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app"), nil)
+	defer stop()
+	ctx := context.TODO()
+	heldPermits := func(holderId string) int {
+		state, err := sharedLockGetState(r, "res"+semaphoreKeySuffix)
+		require.NoError(t, err)
+		return state.Holders[state.holderIndex(holderId)].Permits
+	}
+
+	require.NoError(t, KeySemaphoreAcquire(ctx, r, "res", "a", 1, 3, true))
+	require.NoError(t, KeySemaphoreAcquire(ctx, r, "res", "b", 1, 3, true))
+	require.NoError(t, KeySemaphoreAcquire(ctx, r, "res", "a", 2, 3, true))
+	require.Equal(t, 2, heldPermits("a"))
+	require.ErrorIs(t, KeySemaphoreAcquire(ctx, r, "res", "a", 3, 3, true), ErrSharedLockUpgrade, "b holds a permit")
+	require.NoError(t, KeySemaphoreAcquire(ctx, r, "res", "a", 1, 3, true))
+	require.Equal(t, 2, heldPermits("a"), "fewer permits are covered by the held ones")
+	require.ErrorIs(t, KeySemaphoreAcquire(ctx, r, "res", "c", 1, 3, true), ErrMutexLocked)
+
+	// Max permits are fixed while the semaphore is in use
+	require.ErrorIs(t, KeySemaphoreAcquire(ctx, r, "res", "c", 1, 5, true), ErrSemaphoreMaxPermitsChanged)
+	require.NoError(t, KeySemaphoreRelease(ctx, r, "res", "a"))
+	require.NoError(t, KeySemaphoreRelease(ctx, r, "res", "b"))
+	require.NoError(t, KeySemaphoreAcquire(ctx, r, "res", "c", 4, 5, true))
+}
@@ -0,0 +1,270 @@
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const (
+	leaderElectionKeyTmpl = "%s.leader"
+)
+
+type OnElectedFunction func(ctx context.Context, fencingToken uint64)
+type OnRevokedFunction func()
+
+// LeaderElection elects exactly one leader among all the runtimes which run an election with the same name.
+// Leadership is a lease stored in the domain's NATS KV and renewed automatically every ttl/3.
+// Fencing token is a KV revision the leadership was acquired with, it grows monotonically with every new leader.
+type LeaderElection struct {
+	runtime *Runtime
+	name    string
+	key     string
+	owner   string
+	ttl     time.Duration
+
+	onElected OnElectedFunction
+	onRevoked OnRevokedFunction
+
+	mutex        sync.Mutex
+	started      bool
+	isLeader     bool
+	fencingToken uint64
+	revision     uint64
+	leaderCancel context.CancelFunc
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewLeaderElection(runtime *Runtime, name string, ttl time.Duration) *LeaderElection {
+	return &LeaderElection{
+		runtime: runtime,
+		name:    name,
+		key:     fmt.Sprintf(leaderElectionKeyTmpl, system.GetHashStr(name)),
+		owner:   runtime.config.name + "-" + system.GetUniqueStrID(),
+		ttl:     ttl,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// OnElected sets a callback which is called in a separate goroutine when this instance becomes a leader.
+// The callback's context is canceled when leadership is lost.
+func (le *LeaderElection) OnElected(f OnElectedFunction) *LeaderElection {
+	le.onElected = f
+	return le
+}
+
+// OnRevoked sets a callback which is called when this instance stops being a leader
+func (le *LeaderElection) OnRevoked(f OnRevokedFunction) *LeaderElection {
+	le.onRevoked = f
+	return le
+}
+
+func (le *LeaderElection) IsLeader() bool {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	return le.isLeader
+}
+
+// FencingToken returns the token of the current leadership or 0 if this instance is not a leader
+func (le *LeaderElection) FencingToken() uint64 {
+	le.mutex.Lock()
+	defer le.mutex.Unlock()
+	if !le.isLeader {
+		return 0
+	}
+	return le.fencingToken
+}
+
+// Start runs the election in background until ctx is done, Stop is called or the runtime shuts down
+func (le *LeaderElection) Start(ctx context.Context) {
+	le.mutex.Lock()
+	if le.started {
+		le.mutex.Unlock()
+		return
+	}
+	le.started = true
+	le.mutex.Unlock()
+
+	le.runtime.wg.Add(1)
+	go le.run(ctx)
+}
+
+// Stop steps down promptly if this instance is a leader and stops the election
+func (le *LeaderElection) Stop() {
+	le.mutex.Lock()
+	started := le.started
+	le.mutex.Unlock()
+	if !started {
+		return
+	}
+
+	select {
+	case <-le.stop:
+	default:
+		close(le.stop)
+	}
+	<-le.done
+}
+
+func (le *LeaderElection) run(ctx context.Context) {
+	defer le.runtime.wg.Done()
+	defer close(le.done)
+	system.GlobalPrometrics.GetRoutinesCounter().Started("leader_election")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("leader_election")
+
+	renewInterval := le.ttl / 3
+	if renewInterval <= 0 {
+		renewInterval = time.Second
+	}
+	ticker := le.runtime.clock().NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	le.tick()
+	for {
+		select {
+		case <-ctx.Done():
+			le.stepDown()
+			return
+		case <-le.stop:
+			le.stepDown()
+			return
+		case <-le.runtime.shutdown:
+			le.stepDown()
+			return
+		case <-ticker.C():
+			le.tick()
+		}
+	}
+}
+
+func (le *LeaderElection) tick() {
+	if le.IsLeader() {
+		if err := le.renew(); err != nil {
+			lg.Logf(lg.WarnLevel, "LeaderElection %s: lease renewal failed, stepping down: %s", le.name, err)
+			le.revoke()
+		}
+		return
+	}
+	revision, err := le.tryAcquire()
+	if err != nil {
+		if !errors.Is(err, ErrMutexLocked) {
+			lg.Logf(lg.ErrorLevel, "LeaderElection %s: %s", le.name, err)
+		}
+		return
+	}
+	le.elect(revision)
+}
+
+func (le *LeaderElection) leaseValue(expiresAt int64) []byte {
+	v := easyjson.NewJSONObject()
+	v.SetByPath("owner", easyjson.NewJSON(le.owner))
+	v.SetByPath("expires_at", easyjson.NewJSON(expiresAt))
+	return v.ToBytes()
+}
+
+func (le *LeaderElection) tryAcquire() (uint64, error) {
+	kv := le.runtime.Domain.kv
+	expiresAt := le.runtime.clock().Now().Add(le.ttl).UnixNano()
+
+	entry, err := kv.Get(le.key)
+	if err != nil {
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			revision, err := kv.Create(le.key, le.leaseValue(expiresAt))
+			if err != nil {
+				return 0, ErrMutexLocked // Someone else was faster
+			}
+			return revision, nil
+		}
+		return 0, err
+	}
+
+	if lease, ok := easyjson.JSONFromBytes(entry.Value()); ok {
+		leaseExpiresAt := int64(lease.GetByPath("expires_at").AsNumericDefault(0))
+		if leaseExpiresAt > le.runtime.clock().Now().UnixNano() {
+			return 0, ErrMutexLocked
+		}
+	}
+
+	revision, err := kv.Update(le.key, le.leaseValue(expiresAt), entry.Revision())
+	if err != nil {
+		return 0, ErrMutexLocked // Someone else was faster
+	}
+	return revision, nil
+}
+
+func (le *LeaderElection) renew() error {
+	le.mutex.Lock()
+	revision := le.revision
+	le.mutex.Unlock()
+
+	newRevision, err := le.runtime.Domain.kv.Update(le.key, le.leaseValue(le.runtime.clock().Now().Add(le.ttl).UnixNano()), revision)
+	if err != nil {
+		return err
+	}
+
+	le.mutex.Lock()
+	le.revision = newRevision
+	le.mutex.Unlock()
+	return nil
+}
+
+func (le *LeaderElection) elect(revision uint64) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	le.mutex.Lock()
+	le.isLeader = true
+	le.fencingToken = revision
+	le.revision = revision
+	le.leaderCancel = cancel
+	le.mutex.Unlock()
+
+	lg.Logf(lg.DebugLevel, "LeaderElection %s: elected with fencing token %d", le.name, revision)
+	if le.onElected != nil {
+		go le.onElected(ctx, revision)
+	}
+}
+
+func (le *LeaderElection) revoke() {
+	le.mutex.Lock()
+	if !le.isLeader {
+		le.mutex.Unlock()
+		return
+	}
+	le.isLeader = false
+	if le.leaderCancel != nil {
+		le.leaderCancel()
+		le.leaderCancel = nil
+	}
+	le.mutex.Unlock()
+
+	lg.Logf(lg.DebugLevel, "LeaderElection %s: revoked", le.name)
+	if le.onRevoked != nil {
+		le.onRevoked()
+	}
+}
+
+// stepDown releases the lease so that another instance can be elected without waiting for ttl
+func (le *LeaderElection) stepDown() {
+	if !le.IsLeader() {
+		return
+	}
+	le.mutex.Lock()
+	revision := le.revision
+	le.mutex.Unlock()
+
+	if _, err := le.runtime.Domain.kv.Update(le.key, le.leaseValue(0), revision); err != nil {
+		lg.Logf(lg.WarnLevel, "LeaderElection %s: cannot release lease: %s", le.name, err)
+	}
+	le.revoke()
+}
@@ -0,0 +1,121 @@
+package statefun_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/system"
+	sfTest "github.com/foliagecp/sdk/statefun/test"
+)
+
+const leaderElectionTestTTL = 3 * time.Second
+
+type leaderElectionSuite struct {
+	sfTest.StatefunMemoryTestSuite
+}
+
+func (s *leaderElectionSuite) SetupTest() {
+	s.StatefunMemoryTestSuite.SetupTest()
+	s.Require().NoError(s.StartRuntime())
+}
+
+func (s *leaderElectionSuite) TestTakeover() {
+	elected := make(chan context.Context, 1)
+	revoked := make(chan struct{}, 1)
+	first := statefun.NewLeaderElection(s.Runtime(), "test", leaderElectionTestTTL).
+		OnElected(func(ctx context.Context, _ uint64) { elected <- ctx }).
+		OnRevoked(func() { revoked <- struct{}{} })
+	first.Start(context.Background())
+	leaderCtx := <-elected
+	s.Require().True(first.IsLeader())
+	firstToken := first.FencingToken()
+	s.Require().NotZero(firstToken)
+
+	second := statefun.NewLeaderElection(s.Runtime(), "test", leaderElectionTestTTL)
+	second.Start(context.Background())
+	defer second.Stop()
+
+	// The lease is renewed, so the second instance stays a follower for several ttls
+	for until := s.Clock().Now().Add(3 * leaderElectionTestTTL); s.Clock().Now().Before(until); {
+		revision := statefun.LeaderElectionRevision(first)
+		advanceUntil(&s.StatefunMemoryTestSuite, leaderElectionTestTTL/30, func() bool {
+			return statefun.LeaderElectionRevision(first) > revision
+		})
+		s.Require().False(second.IsLeader())
+	}
+	s.Require().True(first.IsLeader())
+	s.Require().Zero(second.FencingToken())
+
+	// Stepping down lets the follower take over without waiting for the ttl
+	first.Stop()
+	<-revoked
+	s.Require().Error(leaderCtx.Err(), "leader context is canceled on revocation")
+	s.Require().False(first.IsLeader())
+	steppedDownAt := s.Clock().Now()
+	advanceUntil(&s.StatefunMemoryTestSuite, leaderElectionTestTTL/30, second.IsLeader)
+	s.Require().Less(s.Clock().Now().Sub(steppedDownAt), leaderElectionTestTTL)
+	s.Require().Greater(second.FencingToken(), firstToken)
+}
+
+func (s *leaderElectionSuite) TestLeaseExpiry() {
+	// A leader which died without stepping down
+	dead := statefun.NewLeaderElection(s.Runtime(), "test", leaderElectionTestTTL)
+	deadExpiresAt := s.Clock().Now().Add(leaderElectionTestTTL)
+	deadRevision, err := statefun.PutLeaderElectionLease(dead, deadExpiresAt)
+	s.Require().NoError(err)
+
+	election := statefun.NewLeaderElection(s.Runtime(), "test", leaderElectionTestTTL)
+	election.Start(context.Background())
+	defer election.Stop()
+
+	advanceUntil(&s.StatefunMemoryTestSuite, leaderElectionTestTTL/30, election.IsLeader)
+	s.Require().False(s.Clock().Now().Before(deadExpiresAt), "elected after the lease expired")
+	s.Require().Greater(election.FencingToken(), deadRevision)
+}
+
+func (s *leaderElectionSuite) TestStepsDownWhenLeaseIsLost() {
+	revoked := make(chan struct{})
+	election := statefun.NewLeaderElection(s.Runtime(), "test", leaderElectionTestTTL).OnRevoked(func() { close(revoked) })
+	election.Start(context.Background())
+	defer election.Stop()
+	s.Require().Eventually(election.IsLeader, time.Second, time.Millisecond)
+
+	// Someone else took the lease over, e.g. after a long pause of this instance
+	other := statefun.NewLeaderElection(s.Runtime(), "test", leaderElectionTestTTL)
+	_, err := statefun.PutLeaderElectionLease(other, s.Clock().Now().Add(time.Hour))
+	s.Require().NoError(err)
+
+	advanceUntil(&s.StatefunMemoryTestSuite, leaderElectionTestTTL/30, func() bool {
+		select {
+		case <-revoked:
+			return true
+		default:
+			return false
+		}
+	})
+	s.Require().False(election.IsLeader())
+	s.Require().Zero(election.FencingToken())
+}
+
+// advanceUntil moves the virtual clock forward by step until condition holds. Background loops react to the clock
+// asynchronously, so the time moves on only while they have not caught up yet.
+func advanceUntil(s *sfTest.StatefunMemoryTestSuite, step time.Duration, condition func() bool) {
+	s.Require().Eventually(func() bool {
+		if condition() {
+			return true
+		}
+		s.Advance(step)
+		return false
+	}, 10*time.Second, time.Millisecond)
+}
+
+func TestLeaderElectionSuite(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	suite.Run(t, new(leaderElectionSuite))
+}
@@ -0,0 +1,382 @@
+package statefun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+Every KeyMutexLock records who holds the mutex and who waits for it in the domain's NATS KV:
+
+	__locks.owner.<key>    -> {"owner": LockOwner, "acquired_at": int64}
+	__locks.waiter.<uid>   -> {"key": string, "owner": LockOwner, "since": int64, "renewed_at": int64}
+
+Records are written only with RuntimeConfig.SetKVMutexIntrospection. A waiter renews its record while it waits, so
+records of owners whose mutex is expired and of waiters not renewed during kvMutexLifeTimeSec are left by crashed
+runtimes, ListKeyMutexLocks ignores and deletes them.
+
+In-process locks (e.g. graph CRUD key locks) are exposed through registered LockInfoSource functions.
+*/
+
+const (
+	lockOwnerKeyPrefix  = "__locks.owner."
+	lockWaiterKeyPrefix = "__locks.waiter."
+
+	LockSourceKVMutex = "kv_mutex"
+)
+
+type lockOwnerCtxKey struct{}
+
+// LockOwner identifies who holds or waits for a lock
+type LockOwner struct {
+	Runtime  string `json:"runtime"`
+	Typename string `json:"typename,omitempty"`
+	Id       string `json:"id,omitempty"`
+}
+
+func (lo LockOwner) String() string {
+	if len(lo.Typename) == 0 && len(lo.Id) == 0 {
+		return lo.Runtime
+	}
+	return fmt.Sprintf("%s/%s:%s", lo.Runtime, lo.Typename, lo.Id)
+}
+
+type LockHolder struct {
+	Owner      LockOwner `json:"owner"`
+	Exclusive  bool      `json:"exclusive"`
+	AcquiredAt int64     `json:"acquired_at"`
+}
+
+type LockWaiter struct {
+	Owner     LockOwner `json:"owner"`
+	Exclusive bool      `json:"exclusive"`
+	Since     int64     `json:"since"`
+}
+
+type keyMutexWaiterRecord struct {
+	Key string `json:"key"`
+	LockWaiter
+	RenewedAt int64 `json:"renewed_at"`
+}
+
+type LockInfo struct {
+	Key     string       `json:"key"`
+	Source  string       `json:"source"`
+	Holders []LockHolder `json:"holders"`
+	Waiters []LockWaiter `json:"waiters"`
+}
+
+// LockInfoSource returns the current state of locks which are not visible in KV
+type LockInfoSource func() []LockInfo
+
+type lockInfoSources struct {
+	mutex   sync.Mutex
+	sources map[string]LockInfoSource
+}
+
+// WithLockOwner returns a context which makes KeyMutexLock record owner as the holder of the mutex
+func WithLockOwner(ctx context.Context, owner LockOwner) context.Context {
+	return context.WithValue(ctx, lockOwnerCtxKey{}, owner)
+}
+
+func lockOwnerFromContext(ctx context.Context, runtime *Runtime) LockOwner {
+	if ctx != nil {
+		if owner, ok := ctx.Value(lockOwnerCtxKey{}).(LockOwner); ok {
+			if len(owner.Runtime) == 0 {
+				owner.Runtime = runtime.instanceID
+			}
+			return owner
+		}
+	}
+	return LockOwner{Runtime: runtime.instanceID}
+}
+
+func keyMutexRecordOwner(runtime *Runtime, key string, owner LockOwner, acquiredAt int64) {
+	if !runtime.config.kvMutexIntrospection {
+		return
+	}
+	data, _ := json.Marshal(LockHolder{Owner: owner, Exclusive: true, AcquiredAt: acquiredAt})
+	_, err := runtime.Domain.kv.Put(lockOwnerKeyPrefix+key, data)
+	system.MsgOnErrorReturn(err)
+}
+
+func keyMutexForgetOwner(runtime *Runtime, key string) {
+	if !runtime.config.kvMutexIntrospection {
+		return
+	}
+	system.MsgOnErrorReturn(runtime.Domain.kv.Delete(lockOwnerKeyPrefix + key))
+}
+
+// keyMutexRecordWaiter records or renews (if waiterKey is not empty) the waiter record, returns its KV key or empty
+// string if nothing was recorded
+func keyMutexRecordWaiter(runtime *Runtime, waiterKey string, key string, owner LockOwner, since int64) string {
+	if !runtime.config.kvMutexIntrospection {
+		return ""
+	}
+	if len(waiterKey) == 0 {
+		waiterKey = lockWaiterKeyPrefix + system.GetUniqueStrID()
+	}
+	data, _ := json.Marshal(keyMutexWaiterRecord{key, LockWaiter{Owner: owner, Exclusive: true, Since: since}, runtime.clock().Now().UnixNano()})
+	if _, err := runtime.Domain.kv.Put(waiterKey, data); err != nil {
+		system.MsgOnErrorReturn(err)
+		return ""
+	}
+	return waiterKey
+}
+
+func keyMutexForgetWaiter(runtime *Runtime, waiterKey string) {
+	if len(waiterKey) == 0 {
+		return
+	}
+	system.MsgOnErrorReturn(runtime.Domain.kv.Delete(waiterKey))
+}
+
+// ListKeyMutexLocks returns all currently held KeyMutexLock mutexes in the domain with their holders and waiters,
+// stale records are deleted
+func ListKeyMutexLocks(runtime *Runtime) ([]LockInfo, error) {
+	kv := runtime.Domain.kv
+	w, err := kv.Watch("__locks.>", nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer func() { system.MsgOnErrorReturn(w.Stop()) }()
+
+	lifetime := int64(runtime.config.kvMutexLifeTimeSec) * int64(time.Second)
+	now := runtime.clock().Now().UnixNano()
+	deleteStale := func(entry nats.KeyValueEntry) {
+		// A newer record written meanwhile is kept
+		if err := kv.Delete(entry.Key(), nats.LastRevision(entry.Revision())); err != nil {
+			lg.Logf(lg.DebugLevel, "Stale lock record %s is not deleted: %s", entry.Key(), err)
+		}
+	}
+
+	locks := map[string]*LockInfo{}
+	ownerEntries := map[string]nats.KeyValueEntry{}
+	waiters := map[string][]LockWaiter{}
+	for entry := range w.Updates() {
+		if entry == nil { // All initial values were received
+			break
+		}
+		switch {
+		case strings.HasPrefix(entry.Key(), lockOwnerKeyPrefix):
+			key := strings.TrimPrefix(entry.Key(), lockOwnerKeyPrefix)
+			holder := LockHolder{}
+			if json.Unmarshal(entry.Value(), &holder) != nil {
+				continue
+			}
+			locks[key] = &LockInfo{Key: key, Source: LockSourceKVMutex, Holders: []LockHolder{holder}, Waiters: []LockWaiter{}}
+			ownerEntries[key] = entry
+		case strings.HasPrefix(entry.Key(), lockWaiterKeyPrefix):
+			waiter := keyMutexWaiterRecord{}
+			if json.Unmarshal(entry.Value(), &waiter) != nil {
+				continue
+			}
+			if waiter.RenewedAt+lifetime < now {
+				deleteStale(entry)
+				continue
+			}
+			waiters[waiter.Key] = append(waiters[waiter.Key], waiter.LockWaiter)
+		}
+	}
+
+	result := []LockInfo{}
+	for key, li := range locks {
+		// Owner record is informational only, the mutex itself tells if the lock is still held
+		entry, err := kv.Get(key + ".mutex")
+		if err != nil {
+			if errors.Is(err, nats.ErrKeyNotFound) {
+				deleteStale(ownerEntries[key])
+			}
+			continue
+		}
+		lockTime := system.BytesToInt64(entry.Value())
+		if lockTime == 0 || lockTime+lifetime < now {
+			deleteStale(ownerEntries[key])
+			continue
+		}
+		li.Waiters = append(li.Waiters, waiters[key]...)
+		result = append(result, *li)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+// KeyMutexForceUnlock unlocks the mutex regardless of its holder. Must be used only to resolve hung locks.
+func KeyMutexForceUnlock(ctx context.Context, runtime *Runtime, key string) error {
+	lg.Logf(lg.WarnLevel, "Context mutex for key=%s is being force unlocked", key)
+	if _, err := runtime.Domain.kv.Put(key+".mutex", system.Int64ToBytes(0)); err != nil {
+		return err
+	}
+	keyMutexForgetOwner(runtime, key)
+	return nil
+}
+
+// RegisterLockInfoSource plugs in-process locks into ListLocks and deadlock detection
+func (r *Runtime) RegisterLockInfoSource(name string, source LockInfoSource) {
+	r.lockInfoSources.mutex.Lock()
+	defer r.lockInfoSources.mutex.Unlock()
+	if r.lockInfoSources.sources == nil {
+		r.lockInfoSources.sources = map[string]LockInfoSource{}
+	}
+	r.lockInfoSources.sources[name] = source
+}
+
+// ListLocks returns KV mutexes of the domain together with locks of all registered lock info sources
+func (r *Runtime) ListLocks() ([]LockInfo, error) {
+	locks, err := ListKeyMutexLocks(r)
+	if err != nil {
+		return nil, err
+	}
+
+	r.lockInfoSources.mutex.Lock()
+	names := make([]string, 0, len(r.lockInfoSources.sources))
+	for name := range r.lockInfoSources.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sources := make([]LockInfoSource, 0, len(names))
+	for _, name := range names {
+		sources = append(sources, r.lockInfoSources.sources[name])
+	}
+	r.lockInfoSources.mutex.Unlock()
+
+	for _, source := range sources {
+		locks = append(locks, source()...)
+	}
+	return locks, nil
+}
+
+// FindLockWaitCycles builds a wait-for graph (waiter -> holder) and returns all found cycles
+func FindLockWaitCycles(locks []LockInfo) [][]LockOwner {
+	owners := map[string]LockOwner{}
+	edges := map[string]map[string]struct{}{}
+	for _, li := range locks {
+		for _, w := range li.Waiters {
+			for _, h := range li.Holders {
+				from, to := w.Owner.String(), h.Owner.String()
+				if from == to {
+					continue
+				}
+				owners[from] = w.Owner
+				owners[to] = h.Owner
+				if edges[from] == nil {
+					edges[from] = map[string]struct{}{}
+				}
+				edges[from][to] = struct{}{}
+			}
+		}
+	}
+
+	nodes := make([]string, 0, len(owners))
+	for n := range owners {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+
+	const (
+		white = iota
+		grey
+		black
+	)
+	color := map[string]int{}
+	stack := []string{}
+	reported := map[string]struct{}{}
+	cycles := [][]LockOwner{}
+
+	var visit func(n string)
+	visit = func(n string) {
+		color[n] = grey
+		stack = append(stack, n)
+
+		next := make([]string, 0, len(edges[n]))
+		for m := range edges[n] {
+			next = append(next, m)
+		}
+		sort.Strings(next)
+		for _, m := range next {
+			switch color[m] {
+			case white:
+				visit(m)
+			case grey:
+				start := len(stack) - 1
+				for stack[start] != m {
+					start--
+				}
+				cycleNodes := append([]string{}, stack[start:]...)
+				sorted := append([]string{}, cycleNodes...)
+				sort.Strings(sorted)
+				id := strings.Join(sorted, "|")
+				if _, ok := reported[id]; !ok {
+					reported[id] = struct{}{}
+					cycle := make([]LockOwner, 0, len(cycleNodes))
+					for _, cn := range cycleNodes {
+						cycle = append(cycle, owners[cn])
+					}
+					cycles = append(cycles, cycle)
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		color[n] = black
+	}
+	for _, n := range nodes {
+		if color[n] == white {
+			visit(n)
+		}
+	}
+	return cycles
+}
+
+// runLockDeadlockDetector periodically looks for wait-for cycles among all known locks and reports them
+func (r *Runtime) runLockDeadlockDetector(ctx context.Context) {
+	defer r.wg.Done()
+	system.GlobalPrometrics.GetRoutinesCounter().Started("lock_deadlock_detector")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("lock_deadlock_detector")
+
+	gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple("lock_wait_cycles", "Number of lock wait-for cycles found by the deadlock detector", []string{})
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Error ensuring GaugeVec: %v", err)
+	}
+
+	ticker := r.clock().NewTicker(time.Duration(r.config.lockDeadlockDetectionIntervalSec) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.shutdown:
+			return
+		case <-ticker.C():
+			locks, err := r.ListLocks()
+			if err != nil {
+				lg.Logf(lg.ErrorLevel, "Lock deadlock detector cannot list locks: %s", err)
+				continue
+			}
+			cycles := FindLockWaitCycles(locks)
+			if gaugeVec != nil {
+				gaugeVec.With(prometheus.Labels{}).Set(float64(len(cycles)))
+			}
+			for _, cycle := range cycles {
+				members := make([]string, 0, len(cycle))
+				for _, owner := range cycle {
+					members = append(members, owner.String())
+				}
+				lg.Logf(lg.ErrorLevel, "Lock deadlock detected: %s -> %s", strings.Join(members, " -> "), members[0])
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package statefun
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+func TestKeyMutexIntrospection(t *testing.T) {
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app").SetKVMutexIntrospection(true), nil)
+	defer stop()
+	kv := r.Domain.kv
+	lifetime := time.Duration(r.config.kvMutexLifeTimeSec) * time.Second
+	now := time.Now()
+
+	ctx := WithLockOwner(context.Background(), LockOwner{Typename: "functions.test.holder", Id: "a"})
+	_, err := KeyMutexLock(ctx, r, "live", false)
+	require.NoError(t, err)
+
+	putWaiter := func(waiterKey string, key string, renewedAt time.Time) {
+		data, _ := json.Marshal(keyMutexWaiterRecord{key, LockWaiter{Owner: LockOwner{Runtime: "other"}, Exclusive: true, Since: renewedAt.UnixNano()}, renewedAt.UnixNano()})
+		_, err := kv.Put(lockWaiterKeyPrefix+waiterKey, data)
+		require.NoError(t, err)
+	}
+	putWaiter("fresh", "live", now)
+	putWaiter("stale", "live", now.Add(-2*lifetime))
+
+	// Owner of a crashed runtime whose lease is expired
+	_, err = kv.Put("dead.mutex", system.Int64ToBytes(now.Add(-2*lifetime).UnixNano()))
+	require.NoError(t, err)
+	data, _ := json.Marshal(LockHolder{Owner: LockOwner{Runtime: "crashed"}, Exclusive: true, AcquiredAt: now.Add(-2 * lifetime).UnixNano()})
+	_, err = kv.Put(lockOwnerKeyPrefix+"dead", data)
+	require.NoError(t, err)
+
+	locks, err := ListKeyMutexLocks(r)
+	require.NoError(t, err)
+	require.Len(t, locks, 1)
+	require.Equal(t, "live", locks[0].Key)
+	require.Equal(t, "functions.test.holder", locks[0].Holders[0].Owner.Typename)
+	require.Len(t, locks[0].Waiters, 1)
+	require.Equal(t, "other", locks[0].Waiters[0].Owner.Runtime)
+
+	for _, staleKey := range []string{lockWaiterKeyPrefix + "stale", lockOwnerKeyPrefix + "dead"} {
+		_, err := kv.Get(staleKey)
+		require.ErrorIs(t, err, nats.ErrKeyNotFound, staleKey)
+	}
+	_, err = kv.Get(lockWaiterKeyPrefix + "fresh")
+	require.NoError(t, err)
+}
+
+func TestKeyMutexIntrospectionIsOffByDefault(t *testing.T) {
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app"), nil)
+	defer stop()
+
+	_, err := KeyMutexLock(context.Background(), r, "k", false)
+	require.NoError(t, err)
+	_, err = r.Domain.kv.Get(lockOwnerKeyPrefix + "k")
+	require.ErrorIs(t, err, nats.ErrKeyNotFound)
+}
+
+func TestFindLockWaitCycles(t *testing.T) {
+	a, b, c := LockOwner{Runtime: "a"}, LockOwner{Runtime: "b"}, LockOwner{Runtime: "c"}
+	lock := func(key string, holder LockOwner, waiters ...LockOwner) LockInfo {
+		li := LockInfo{Key: key, Holders: []LockHolder{{Owner: holder}}}
+		for _, w := range waiters {
+			li.Waiters = append(li.Waiters, LockWaiter{Owner: w})
+		}
+		return li
+	}
+
+	require.Empty(t, FindLockWaitCycles([]LockInfo{lock("k1", a, b), lock("k2", b, c)}))
+
+	cycles := FindLockWaitCycles([]LockInfo{lock("k1", a, b), lock("k2", b, c), lock("k3", c, a)})
+	require.Len(t, cycles, 1)
+	require.ElementsMatch(t, []LockOwner{a, b, c}, cycles[0])
+}
@@ -2,6 +2,7 @@ package mediator
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -19,11 +20,16 @@ const (
 	WorkerIsTaskedByAggregatorOp
 	AggregatorRepliedByWorkerOp
 	AggregatedWorkersOp
+	DiscardedOp // Late reply or deadline of an already finished aggregation, must be ignored by the handler
 )
 
 const (
 	aggrPack                       = "__mAggrPack"
+	aggrDeadlinePayloadPath        = "__mAggregationDeadline"
 	aggrPackTempl                  = aggrPack + ".%s"
+	aggrFinished                   = "__mAggrFinished"
+	aggrFinishedTempl              = aggrFinished + ".%s" // Time the aggregation with a deadline finished at, late replies are discarded
+	aggrFinishedLifetimeSec        = replyStoreRecordExpirationSecs
 	gcIntervalSec                  = 60
 	replyStoreRecordExpirationSecs = 120
 )
@@ -32,6 +38,9 @@ var (
 	replyStore           map[string]SyncReplyPack = map[string]SyncReplyPack{}
 	replyStoreMutex      sync.Mutex
 	replyStoreLastGCTime time.Time
+
+	deadlineWakeUps      = map[string]chan struct{}{} // Cancels wake ups of aggregations finished before their deadlines
+	deadlineWakeUpsMutex sync.Mutex
 )
 
 type OpMediator struct {
@@ -77,6 +86,10 @@ func NewOpMediatorWithUniquenessControl(ctx *sfPlugins.StatefunContextProcessor,
 			// Update the aggregation pack --------------------------
 			aggrPackPath := fmt.Sprintf(aggrPackTempl, mediatorId)
 			aggregationPack := funcContext.GetByPath(aggrPackPath)
+			if !aggregationPack.PathExists("callbacks") && funcContext.PathExists(fmt.Sprintf(aggrFinishedTempl, mediatorId)) {
+				om = &OpMediator{ctx, opMsgs, mediatorId, DiscardedOp, meta1}
+				return
+			}
 			if !aggregationPack.IsNonEmptyObject() {
 				aggregationPack = easyjson.NewJSONObject()
 			}
@@ -97,10 +110,11 @@ func NewOpMediatorWithUniquenessControl(ctx *sfPlugins.StatefunContextProcessor,
 			registeredResults.SetByPath(fmt.Sprintf("%s:%s", strings.ReplaceAll(ctx.Caller.Typename, ".", "_"), ctx.Caller.ID), *ctx.Payload)
 			aggregationPack.SetByPath("results", registeredResults)
 
-			for _, key := range registeredResults.ObjectKeys() {
-				opMsg := OpMsgFromJson(registeredResults.GetByPath(key).GetPtr())
-				opMsg.Meta = key
-				opMsgs = append(opMsgs, opMsg)
+			if opType != AggregatedWorkersOp && aggregationDeadlinePassed(&aggregationPack, ctxClock(ctx).Now()) {
+				opType = AggregatedWorkersOp
+				opMsgs = aggregationDeadlineOpMsgs(&aggregationPack)
+			} else {
+				opMsgs = aggregationResultsOpMsgs(&registeredResults)
 			}
 			// ------------------------------------------------------
 			funcContext.SetByPath(aggrPackPath, aggregationPack)
@@ -108,11 +122,88 @@ func NewOpMediatorWithUniquenessControl(ctx *sfPlugins.StatefunContextProcessor,
 
 			ctx.SetContextExpirationAfter(time.Duration(gcIntervalSec) * time.Second)
 		}
+		if s, ok := ctx.Payload.GetByPath(aggrDeadlinePayloadPath).AsString(); ok {
+			mediatorId = s
+			opType = DiscardedOp
+
+			funcContext := ctx.GetFunctionContext()
+			aggrPackPath := fmt.Sprintf(aggrPackTempl, mediatorId)
+			aggregationPack := funcContext.GetByPath(aggrPackPath)
+			if aggregationPack.PathExists("callbacks") && aggregationPack.GetByPath("callbacks").AsNumericDefault(0) > 0 {
+				opType = AggregatedWorkersOp
+				opMsgs = aggregationDeadlineOpMsgs(&aggregationPack)
+			}
+		}
+		if ctx.Payload.PathExists(sfPlugins.ContextExpiredPayloadKey) {
+			// The deadline wake up is lost if the runtime restarted, GC signals the expiring context instead
+			funcContext := ctx.GetFunctionContext()
+			if overdueId, aggregationPack, ok := overdueAggregation(funcContext, ctxClock(ctx).Now()); ok {
+				mediatorId = overdueId
+				opType = AggregatedWorkersOp
+				opMsgs = aggregationDeadlineOpMsgs(&aggregationPack)
+			}
+		}
 	}
 	om = &OpMediator{ctx, opMsgs, mediatorId, opType, meta1}
 	return
 }
 
+func ctxClock(ctx *sfPlugins.StatefunContextProcessor) system.Clock {
+	if ctx.Clock == nil {
+		return system.RealClock
+	}
+	return ctx.Clock
+}
+
+// overdueAggregation returns the first unfinished aggregation whose deadline has passed
+func overdueAggregation(funcContext *easyjson.JSON, now time.Time) (string, easyjson.JSON, bool) {
+	packs := funcContext.GetByPath(aggrPack)
+	mediatorIds := packs.ObjectKeys()
+	sort.Strings(mediatorIds)
+	for _, mediatorId := range mediatorIds {
+		aggregationPack := packs.GetByPath(mediatorId)
+		if aggregationPack.GetByPath("callbacks").AsNumericDefault(0) > 0 && aggregationDeadlinePassed(&aggregationPack, now) {
+			return mediatorId, aggregationPack, true
+		}
+	}
+	return "", easyjson.JSON{}, false
+}
+
+func aggregationResultsOpMsgs(registeredResults *easyjson.JSON) []OpMsg {
+	opMsgs := []OpMsg{}
+	for _, key := range registeredResults.ObjectKeys() {
+		opMsg := OpMsgFromJson(registeredResults.GetByPath(key).GetPtr())
+		opMsg.Meta = key
+		opMsgs = append(opMsgs, opMsg)
+	}
+	return opMsgs
+}
+
+func aggregationDeadlinePassed(aggregationPack *easyjson.JSON, now time.Time) bool {
+	deadline := int64(aggregationPack.GetByPath("deadline").AsNumericDefault(0))
+	return deadline > 0 && now.UnixNano() > deadline
+}
+
+// aggregationDeadlineOpMsgs returns results collected so far followed by an incomplete OpMsg with the non-responding workers
+func aggregationDeadlineOpMsgs(aggregationPack *easyjson.JSON) []OpMsg {
+	registeredResults := aggregationPack.GetByPath("results")
+	opMsgs := aggregationResultsOpMsgs(&registeredResults)
+
+	nonResponders := []string{}
+	workers := aggregationPack.GetByPath("workers")
+	for _, worker := range workers.ObjectKeys() {
+		if !registeredResults.PathExists(worker) {
+			nonResponders = append(nonResponders, worker)
+		}
+	}
+	sort.Strings(nonResponders)
+
+	data := easyjson.NewJSONObject()
+	data.SetByPath("results", registeredResults)
+	data.SetByPath("non_responders", easyjson.JSONFromArray(nonResponders))
+	return append(opMsgs, MakeOpMsg(SYNC_OP_STATUS_INCOMPLETE, fmt.Sprintf("aggregation deadline exceeded, no reply from: %s", strings.Join(nonResponders, ", ")), "", data))
+}
+
 func (om *OpMediator) AddIntermediateResult(ctx *sfPlugins.StatefunContextProcessor, intermediateResult *easyjson.JSON) {
 	msg := MakeOpMsg(SYNC_OP_STATUS_OK, "", "", *intermediateResult)
 
@@ -163,17 +254,6 @@ func (om *OpMediator) GetLastSyncOp() OpMsg {
 }
 
 func (om *OpMediator) GetStatus() OpStatus {
-	var status *OpStatus = nil
-	for _, som := range om.opMsgs {
-		if status == nil {
-			status = &som.Status
-		} else {
-			*status = OpStatusMatrix[*status][som.Status]
-		}
-	}
-	if status != nil {
-		return *status
-	}
 	return GetSyncOpIntegratedStatusWithDefault(om.opMsgs, SYNC_OP_STATUS_IDLE)
 }
 
@@ -201,6 +281,12 @@ func (om *OpMediator) releaseAggPackOnAggregated() *easyjson.JSON {
 		aggregationPack := funcContext.GetByPath(aggrPackPath)
 		if aggregationPack.IsNonEmptyObject() {
 			funcContext.SetByPath(aggrPackPath, easyjson.NewJSONObject()) // Do not delete, just make empty - for loops to be detected
+			if aggregationPack.PathExists("deadline") {
+				cancelDeadlineWakeUp(deadlineWakeUpKey(om.ctx.Self, om.mediatorId))
+				now := ctxClock(om.ctx).Now()
+				removeExpiredFinishedMarkers(funcContext, now)
+				funcContext.SetByPath(fmt.Sprintf(aggrFinishedTempl, om.mediatorId), easyjson.NewJSON(now.UnixNano()))
+			}
 			om.ctx.SetFunctionContext(funcContext)
 			om.ctx.SetContextExpirationAfter(time.Duration(gcIntervalSec) * time.Second)
 			return &aggregationPack
@@ -330,6 +416,7 @@ func (om *OpMediator) SignalWithAggregation(provider sfPlugins.SignalProvider, t
 	registeredCallbacks := int(aggregationPack.GetByPath("callbacks").AsNumericDefault(0))
 	registeredCallbacks++
 	aggregationPack.SetByPath("callbacks", easyjson.NewJSON(registeredCallbacks))
+	aggregationPack.SetByPath(fmt.Sprintf("workers.%s:%s", strings.ReplaceAll(typename, ".", "_"), om.ctx.Domain.CreateObjectIDWithThisDomain(id, false)), easyjson.NewJSON(true))
 
 	// Create an aggreagtion pack -------------------------
 	if !aggregationPack.PathExists("responseContext") {
@@ -353,7 +440,98 @@ func (om *OpMediator) SignalWithAggregation(provider sfPlugins.SignalProvider, t
 	funcContext.SetByPath(aggrPackPath, aggregationPack)
 	// ----------------------------------------------------
 	om.ctx.SetFunctionContext(funcContext)
-	om.ctx.SetContextExpirationAfter(time.Duration(gcIntervalSec) * time.Second)
+	om.ctx.SetContextExpirationAfter(om.aggregationContextExpiration(&aggregationPack))
 
 	return nil
 }
+
+/*
+SetAggregationDeadline limits the time of waiting for replies from workers tasked by SignalWithAggregation.
+When the deadline passes, the handler is called with AggregatedWorkersOp: aggregated OpMsgs contain the results
+collected so far and a final SYNC_OP_STATUS_INCOMPLETE OpMsg with the list of non-responding workers in its data:
+
+	data:
+		results: json // Results collected so far
+		non_responders: []string // "<typename_with_underscores>:<id>"
+
+Replies arriving within aggrFinishedLifetimeSec after the aggregation is finished are delivered with DiscardedOp and
+must be ignored. The marker of the finished aggregation is removed when a later aggregation of the same function
+finishes or with the expired function context.
+
+The deadline is stored in the aggregation pack of the function context and checked on every worker reply. The wake
+up at the deadline is kept in memory only and is cancelled when the aggregation finishes earlier: if the runtime
+restarts before it, the aggregation finishes on the next worker reply or, for function types with
+FunctionTypeConfig.SetContextExpireSignal, when GC signals the expiring context (within the GC interval after the
+deadline).
+*/
+func (om *OpMediator) SetAggregationDeadline(timeout time.Duration) {
+	funcContext := om.ctx.GetFunctionContext()
+	aggrPackPath := fmt.Sprintf(aggrPackTempl, om.mediatorId)
+	aggregationPack := funcContext.GetByPath(aggrPackPath)
+	if !aggregationPack.IsNonEmptyObject() {
+		aggregationPack = easyjson.NewJSONObject()
+	}
+	clock := ctxClock(om.ctx)
+	aggregationPack.SetByPath("deadline", easyjson.NewJSON(clock.Now().UnixNano()+timeout.Nanoseconds()))
+	funcContext.SetByPath(aggrPackPath, aggregationPack)
+	om.ctx.SetFunctionContext(funcContext)
+	om.ctx.SetContextExpirationAfter(om.aggregationContextExpiration(&aggregationPack))
+
+	// Wake up the aggregator when the deadline passes even if no worker replies
+	signal := om.ctx.Signal
+	self := om.ctx.Self
+	payload := easyjson.NewJSONObjectWithKeyValue(aggrDeadlinePayloadPath, easyjson.NewJSON(om.mediatorId))
+	wakeUpKey := deadlineWakeUpKey(self, om.mediatorId)
+	cancel := make(chan struct{})
+	cancelDeadlineWakeUp(wakeUpKey) // Deadline is moved
+	deadlineWakeUpsMutex.Lock()
+	deadlineWakeUps[wakeUpKey] = cancel
+	deadlineWakeUpsMutex.Unlock()
+	go func() {
+		select {
+		case <-clock.After(timeout):
+			deadlineWakeUpsMutex.Lock()
+			if deadlineWakeUps[wakeUpKey] == cancel {
+				delete(deadlineWakeUps, wakeUpKey)
+			}
+			deadlineWakeUpsMutex.Unlock()
+			system.MsgOnErrorReturn(signal(sfPlugins.AutoSignalSelect, self.Typename, self.ID, &payload, nil))
+		case <-cancel:
+		}
+	}()
+}
+
+func deadlineWakeUpKey(self sfPlugins.StatefunAddress, mediatorId string) string {
+	return self.Typename + ":" + self.ID + ":" + mediatorId
+}
+
+func cancelDeadlineWakeUp(wakeUpKey string) {
+	deadlineWakeUpsMutex.Lock()
+	defer deadlineWakeUpsMutex.Unlock()
+	if cancel, ok := deadlineWakeUps[wakeUpKey]; ok {
+		close(cancel)
+		delete(deadlineWakeUps, wakeUpKey)
+	}
+}
+
+// removeExpiredFinishedMarkers removes markers of aggregations finished long enough ago for late replies not to arrive
+func removeExpiredFinishedMarkers(funcContext *easyjson.JSON, now time.Time) {
+	markers := funcContext.GetByPath(aggrFinished)
+	for _, mediatorId := range markers.ObjectKeys() {
+		finishedAt := int64(markers.GetByPath(mediatorId).AsNumericDefault(0))
+		if now.UnixNano()-finishedAt > int64(aggrFinishedLifetimeSec)*int64(time.Second) {
+			funcContext.RemoveByPath(fmt.Sprintf(aggrFinishedTempl, mediatorId))
+		}
+	}
+}
+
+// aggregationContextExpiration keeps the function context alive at least until the aggregation deadline
+func (om *OpMediator) aggregationContextExpiration(aggregationPack *easyjson.JSON) time.Duration {
+	expiration := time.Duration(gcIntervalSec) * time.Second
+	if deadline := int64(aggregationPack.GetByPath("deadline").AsNumericDefault(0)); deadline > 0 {
+		if untilDeadline := time.Duration(deadline - ctxClock(om.ctx).Now().UnixNano()); untilDeadline > 0 {
+			expiration += untilDeadline
+		}
+	}
+	return expiration
+}
@@ -0,0 +1,249 @@
+package mediator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+	sfTest "github.com/foliagecp/sdk/statefun/test"
+)
+
+const aggregationDeadline = 10 * time.Second
+
+type mediatorSuite struct {
+	sfTest.StatefunMemoryTestSuite
+}
+
+// registerFunctions registers functions.test.aggregator, which tasks workers "fast" and "slow" with a deadline and
+// records the outcome in its context, and functions.test.worker, where only "fast" replies
+func (s *mediatorSuite) registerFunctions(aggregatorConfig *statefun.FunctionTypeConfig) {
+	s.RegisterFunction("functions.test.aggregator", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		om := NewOpMediator(ctx)
+		funcCtx := ctx.GetFunctionContext()
+		switch om.GetOpType() {
+		case MereOp:
+			if restored := ctx.Payload.GetByPath("restore"); restored.IsObject() {
+				// State left by a runtime which restarted before the deadline
+				funcCtx.SetByPath(fmt.Sprintf(aggrPackTempl, "restored"), restored)
+				ctx.SetFunctionContext(funcCtx)
+				ctx.SetContextExpirationAfter(time.Second)
+				return
+			}
+			om.SetAggregationDeadline(aggregationDeadline)
+			for _, worker := range []string{"fast", "slow"} {
+				s.NoError(om.SignalWithAggregation(sfPlugins.JetstreamGlobalSignal, "functions.test.worker", worker, nil, nil))
+			}
+		case AggregatedWorkersOp:
+			funcCtx.SetByPath("aggregated", easyjson.NewJSON(funcCtx.GetByPath("aggregated").AsNumericDefault(0)+1))
+			funcCtx.SetByPath("status", easyjson.NewJSON(OpStatusNames[om.GetStatus()]))
+			funcCtx.SetByPath("last", om.GetLastSyncOp().Data)
+			ctx.SetFunctionContext(funcCtx)
+			_ = om.ReplyWithData(nil)
+		case DiscardedOp:
+			funcCtx.SetByPath("discarded", easyjson.NewJSON(funcCtx.GetByPath("discarded").AsNumericDefault(0)+1))
+			ctx.SetFunctionContext(funcCtx)
+		}
+	}, *aggregatorConfig)
+
+	s.RegisterFunction("functions.test.worker", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		om := NewOpMediator(ctx)
+		if strings.HasSuffix(ctx.Self.ID, "fast") {
+			s.NoError(om.AggregateOpMsg(OpMsgOk(easyjson.NewJSON("done"))).ReplyWithData(nil))
+		}
+	}, *statefun.NewFunctionTypeConfig())
+}
+
+func (s *mediatorSuite) aggregatorContext() *easyjson.JSON {
+	funcCtx, err := s.FunctionContext("functions.test.aggregator", "a")
+	s.Require().NoError(err)
+	return funcCtx
+}
+
+// reply sends a worker's reply to the aggregation of the aggregator
+func (s *mediatorSuite) reply(aggregationId string) {
+	payload := OpMsgOk(easyjson.NewJSON("late")).ToJson()
+	payload.SetByPath("__mAggregationIdReply", easyjson.NewJSON(aggregationId))
+	s.Require().NoError(s.Signal("functions.test.aggregator", "a", payload, nil))
+}
+
+func (s *mediatorSuite) TestDeadline() {
+	s.registerFunctions(statefun.NewFunctionTypeConfig())
+	s.Require().NoError(s.StartRuntime())
+
+	s.Require().NoError(s.Signal("functions.test.aggregator", "a", nil, nil))
+	aggregationIds := s.aggregatorContext().GetByPath(aggrPack).ObjectKeys()
+	s.Require().Len(aggregationIds, 1)
+	s.Require().Zero(s.aggregatorContext().GetByPath("aggregated").AsNumericDefault(0), "slow worker did not reply")
+
+	s.Clock().BlockUntil(2) // GC ticker and the deadline
+	s.Advance(aggregationDeadline + time.Second)
+	s.Require().Eventually(func() bool { return s.aggregatorContext().GetByPath("aggregated").AsNumericDefault(0) == 1 }, time.Second, time.Millisecond)
+	s.Require().Equal("incomplete", s.aggregatorContext().GetByPath("status").AsStringDefault(""))
+	nonResponders, _ := s.aggregatorContext().GetByPath("last.non_responders").AsArrayString()
+	s.Require().Equal([]string{"functions_test_worker:hub/slow"}, nonResponders)
+
+	s.reply(aggregationIds[0])
+	s.Require().Equal(float64(1), s.aggregatorContext().GetByPath("discarded").AsNumericDefault(0), "late reply is discarded")
+	s.Require().Equal(float64(1), s.aggregatorContext().GetByPath("aggregated").AsNumericDefault(0))
+}
+
+func (s *mediatorSuite) TestDeadlineWakeUpIsCancelled() {
+	s.registerFunctions(statefun.NewFunctionTypeConfig())
+	s.Require().NoError(s.StartRuntime())
+
+	s.Require().NoError(s.Signal("functions.test.aggregator", "a", nil, nil))
+	aggregationIds := s.aggregatorContext().GetByPath(aggrPack).ObjectKeys()
+	s.Require().Len(aggregationIds, 1)
+	wakeUpKey := deadlineWakeUpKey(sfPlugins.StatefunAddress{Typename: "functions.test.aggregator", ID: "hub/a"}, aggregationIds[0])
+	pending := func() bool {
+		deadlineWakeUpsMutex.Lock()
+		defer deadlineWakeUpsMutex.Unlock()
+		_, ok := deadlineWakeUps[wakeUpKey]
+		return ok
+	}
+	s.Require().True(pending())
+
+	s.reply(aggregationIds[0]) // Slow worker replies before the deadline
+	s.Require().Equal(float64(1), s.aggregatorContext().GetByPath("aggregated").AsNumericDefault(0))
+	s.Require().Equal("ok", s.aggregatorContext().GetByPath("status").AsStringDefault(""))
+	s.Require().False(pending())
+
+	s.Advance(aggregationDeadline + time.Second)
+	time.Sleep(10 * time.Millisecond)
+	s.Require().Zero(s.aggregatorContext().GetByPath("discarded").AsNumericDefault(0), "no wake up after the aggregation")
+}
+
+func (s *mediatorSuite) TestFinishedMarkersAreRemoved() {
+	s.registerFunctions(statefun.NewFunctionTypeConfig())
+	s.Require().NoError(s.StartRuntime())
+
+	finish := func() string {
+		s.Require().NoError(s.Signal("functions.test.aggregator", "a", nil, nil))
+		packs := s.aggregatorContext().GetByPath(aggrPack)
+		for _, id := range packs.ObjectKeys() {
+			if packs.GetByPath(id).IsNonEmptyObject() {
+				s.reply(id)
+				return id
+			}
+		}
+		s.FailNow("no aggregation is running")
+		return ""
+	}
+	first := finish()
+	second := finish()
+	s.Require().ElementsMatch([]string{first, second}, s.aggregatorContext().GetByPath(aggrFinished).ObjectKeys())
+
+	s.Advance((aggrFinishedLifetimeSec + 1) * time.Second)
+	third := finish()
+	s.Require().Equal([]string{third}, s.aggregatorContext().GetByPath(aggrFinished).ObjectKeys())
+}
+
+func (s *mediatorSuite) TestReplyWithoutDeadlineIsNotDiscarded() {
+	s.registerFunctions(statefun.NewFunctionTypeConfig())
+	s.Require().NoError(s.StartRuntime())
+
+	s.reply("never_started")
+	s.Require().Zero(s.aggregatorContext().GetByPath("discarded").AsNumericDefault(0))
+	s.Require().Equal(float64(1), s.aggregatorContext().GetByPath("aggregated").AsNumericDefault(0))
+	s.Require().Equal("ok", s.aggregatorContext().GetByPath("status").AsStringDefault(""))
+}
+
+func (s *mediatorSuite) TestDeadlineAfterRestart() {
+	s.RuntimeConfig().SetGCIntervalSec(1)
+	s.registerFunctions(statefun.NewFunctionTypeConfig().SetContextExpireSignal(true))
+	s.Require().NoError(s.StartRuntime())
+
+	restored := easyjson.NewJSONObject()
+	restored.SetByPath("callbacks", easyjson.NewJSON(1))
+	restored.SetByPath("deadline", easyjson.NewJSON(s.Clock().Now().Add(time.Second).UnixNano()))
+	restored.SetByPath("workers.functions_test_worker:hub/slow", easyjson.NewJSON(true))
+	restored.SetByPath("results", easyjson.NewJSONObject())
+	s.Require().NoError(s.Signal("functions.test.aggregator", "a", easyjson.NewJSONObjectWithKeyValue("restore", restored).GetPtr(), nil))
+
+	for i := 0; i < 3 && s.aggregatorContext().GetByPath("aggregated").AsNumericDefault(0) == 0; i++ {
+		s.Advance(time.Second)
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Require().Eventually(func() bool { return s.aggregatorContext().GetByPath("aggregated").AsNumericDefault(0) == 1 }, time.Second, time.Millisecond)
+	s.Require().Equal("incomplete", s.aggregatorContext().GetByPath("status").AsStringDefault(""))
+
+	s.reply("restored")
+	s.Require().Equal(float64(1), s.aggregatorContext().GetByPath("discarded").AsNumericDefault(0))
+}
+
+// registerRequester registers functions.test.requester, which requests workers listed in the payload one at a time
+// and records the status and the metas of the aggregation, and functions.test.worker, which fails on "bad" ids
+func (s *mediatorSuite) registerRequester() {
+	s.RegisterFunction("functions.test.requester", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		om := NewOpMediator(ctx)
+		workers, _ := ctx.Payload.GetByPath("workers").AsArrayString()
+		targets := []AggregationTarget{}
+		for _, worker := range workers {
+			targets = append(targets, AggregationTarget{Typename: "functions.test.worker", ID: worker})
+		}
+		policy := AggregationCollectAll
+		if ctx.Payload.GetByPath("fail_fast").AsBoolDefault(false) {
+			policy = AggregationFailFast
+		}
+		status := om.RequestWithAggregation(targets, nil, 1, policy)
+
+		funcCtx := ctx.GetFunctionContext()
+		funcCtx.SetByPath("status", easyjson.NewJSON(OpStatusNames[status]))
+		statuses := []string{}
+		for _, opMsg := range om.GetAggregatedOpMsgs() {
+			statuses = append(statuses, opMsg.Meta+"="+OpStatusNames[opMsg.Status])
+		}
+		funcCtx.SetByPath("statuses", easyjson.JSONFromArray(statuses))
+		ctx.SetFunctionContext(funcCtx)
+	}, *statefun.NewFunctionTypeConfig())
+
+	s.RegisterFunction("functions.test.worker", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		om := NewOpMediator(ctx)
+		if strings.HasSuffix(ctx.Self.ID, "bad") {
+			s.NoError(om.AggregateOpMsg(OpMsgFailed("broken")).ReplyWithData(nil))
+			return
+		}
+		s.NoError(om.AggregateOpMsg(OpMsgOk(easyjson.NewJSON("done"))).ReplyWithData(nil))
+	}, *statefun.NewFunctionTypeConfig())
+}
+
+func (s *mediatorSuite) TestRequestWithAggregation() {
+	s.registerRequester()
+	s.Require().NoError(s.StartRuntime())
+
+	request := func(failFast bool, workers ...string) (string, []string) {
+		payload := easyjson.NewJSONObjectWithKeyValue("workers", easyjson.JSONFromArray(workers))
+		payload.SetByPath("fail_fast", easyjson.NewJSON(failFast))
+		s.Require().NoError(s.Signal("functions.test.requester", "r", &payload, nil))
+		funcCtx, err := s.FunctionContext("functions.test.requester", "r")
+		s.Require().NoError(err)
+		statuses, _ := funcCtx.GetByPath("statuses").AsArrayString()
+		return funcCtx.GetByPath("status").AsStringDefault(""), statuses
+	}
+
+	status, statuses := request(false, "a", "b")
+	s.Require().Equal("ok", status)
+	s.Require().Equal([]string{"functions_test_worker:a=ok", "functions_test_worker:b=ok"}, statuses)
+
+	status, statuses = request(false, "a", "bad", "c")
+	s.Require().Equal("incomplete", status)
+	s.Require().Equal([]string{"functions_test_worker:a=ok", "functions_test_worker:bad=failed", "functions_test_worker:c=ok"}, statuses)
+
+	status, statuses = request(true, "a", "bad", "c")
+	s.Require().Equal("incomplete", status)
+	s.Require().Equal([]string{"functions_test_worker:a=ok", "functions_test_worker:bad=failed", "functions_test_worker:c=idle"}, statuses, "c is not requested")
+}
+
+func TestMediatorSuite(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	suite.Run(t, new(mediatorSuite))
+}
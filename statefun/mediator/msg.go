@@ -108,17 +108,15 @@ func (som OpMsg) ToJson() *easyjson.JSON {
 	return &reply
 }
 
+// GetSyncOpIntegratedStatusWithDefault merges statuses of all messages in their order via OpStatusMatrix, defaultStatus
+// if there are none
 func GetSyncOpIntegratedStatusWithDefault(statuses []OpMsg, defaultStatus OpStatus) OpStatus {
-	var status *OpStatus = nil
-	for _, som := range statuses {
-		if status == nil {
-			status = &som.Status
-		} else {
-			*status = OpStatusMatrix[*status][som.Status]
-		}
+	if len(statuses) == 0 {
+		return defaultStatus
 	}
-	if status != nil {
-		return *status
+	status := statuses[0].Status
+	for _, som := range statuses[1:] {
+		status = OpStatusMatrix[status][som.Status]
 	}
-	return defaultStatus
+	return status
 }
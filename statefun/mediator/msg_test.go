@@ -0,0 +1,33 @@
+package mediator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSyncOpIntegratedStatusWithDefault(t *testing.T) {
+	for name, tc := range map[string]struct {
+		statuses []OpStatus
+		merged   OpStatus
+	}{
+		"none":             {nil, SYNC_OP_STATUS_IDLE},
+		"single":           {[]OpStatus{SYNC_OP_STATUS_FAILED}, SYNC_OP_STATUS_FAILED},
+		"all ok":           {[]OpStatus{SYNC_OP_STATUS_OK, SYNC_OP_STATUS_OK, SYNC_OP_STATUS_OK}, SYNC_OP_STATUS_OK},
+		"ok and idle":      {[]OpStatus{SYNC_OP_STATUS_IDLE, SYNC_OP_STATUS_OK}, SYNC_OP_STATUS_OK},
+		"all failed":       {[]OpStatus{SYNC_OP_STATUS_FAILED, SYNC_OP_STATUS_FAILED}, SYNC_OP_STATUS_FAILED},
+		"ok then failed":   {[]OpStatus{SYNC_OP_STATUS_OK, SYNC_OP_STATUS_FAILED}, SYNC_OP_STATUS_INCOMPLETE},
+		"failed in middle": {[]OpStatus{SYNC_OP_STATUS_OK, SYNC_OP_STATUS_FAILED, SYNC_OP_STATUS_OK}, SYNC_OP_STATUS_INCOMPLETE},
+		"failed then idle": {[]OpStatus{SYNC_OP_STATUS_FAILED, SYNC_OP_STATUS_IDLE}, SYNC_OP_STATUS_FAILED},
+	} {
+		t.Run(name, func(t *testing.T) {
+			opMsgs := []OpMsg{}
+			for _, status := range tc.statuses {
+				opMsgs = append(opMsgs, MakeOpMsg(status, "", "", OpMsgIdle("").Data))
+			}
+			require.Equal(t, tc.merged, GetSyncOpIntegratedStatusWithDefault(opMsgs, SYNC_OP_STATUS_IDLE))
+			om := &OpMediator{opMsgs: opMsgs}
+			require.Equal(t, tc.merged, om.GetStatus())
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package mediator
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/foliagecp/easyjson"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+type AggregationErrorPolicy int
+
+const (
+	AggregationCollectAll AggregationErrorPolicy = iota // Request all targets regardless of failures
+	AggregationFailFast                                 // Stop issuing new requests after the first failed reply
+)
+
+type AggregationTarget struct {
+	Typename string
+	ID       string
+	Payload  *easyjson.JSON // Optional, overrides the common payload
+	Options  *easyjson.JSON // Optional
+}
+
+/*
+RequestWithAggregation requests all targets in parallel, running at most maxParallel requests at a time (all at once if
+maxParallel <= 0), and aggregates their replies via AggregateOpMsg in the order of targets. Meta of every aggregated
+OpMsg is "<typename_with_underscores>:<id>" of the target.
+With AggregationFailFast targets not requested because of a failure are aggregated as SYNC_OP_STATUS_IDLE OpMsgs.
+Returns the status of all replies merged by GetSyncOpIntegratedStatusWithDefault.
+*/
+func (om *OpMediator) RequestWithAggregation(targets []AggregationTarget, payload *easyjson.JSON, maxParallel int, errorPolicy ...AggregationErrorPolicy) OpStatus {
+	policy := AggregationCollectAll
+	if len(errorPolicy) > 0 {
+		policy = errorPolicy[0]
+	}
+	if maxParallel <= 0 || maxParallel > len(targets) {
+		maxParallel = len(targets)
+	}
+
+	opMsgs := make([]OpMsg, len(targets))
+	requested := make([]bool, len(targets))
+
+	var wg sync.WaitGroup
+	var failedMutex sync.Mutex
+	failed := false
+	slots := make(chan struct{}, maxParallel)
+
+	for i, target := range targets {
+		slots <- struct{}{}
+
+		failedMutex.Lock()
+		stop := failed && policy == AggregationFailFast
+		failedMutex.Unlock()
+		if stop {
+			<-slots
+			break
+		}
+
+		targetPayload := target.Payload
+		if targetPayload == nil && payload != nil {
+			targetPayload = payload.Clone().GetPtr() // Every request gets its own copy, prevents concurrent access
+		}
+
+		requested[i] = true
+		wg.Add(1)
+		go func(i int, target AggregationTarget, targetPayload *easyjson.JSON) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			msg := OpMsgFromSfReply(om.ctx.Request(sfPlugins.AutoRequestSelect, target.Typename, target.ID, targetPayload, target.Options))
+			opMsgs[i] = msg
+			if msg.Status == SYNC_OP_STATUS_FAILED {
+				failedMutex.Lock()
+				failed = true
+				failedMutex.Unlock()
+			}
+		}(i, target, targetPayload)
+	}
+	wg.Wait()
+
+	for i, target := range targets {
+		msg := opMsgs[i]
+		if !requested[i] {
+			msg = OpMsgIdle(fmt.Sprintf("%s:%s was not requested due to a previous failure", target.Typename, target.ID))
+		}
+		msg.Meta = fmt.Sprintf("%s:%s", strings.ReplaceAll(target.Typename, ".", "_"), target.ID)
+		opMsgs[i] = msg
+		om.AggregateOpMsg(msg)
+	}
+
+	return GetSyncOpIntegratedStatusWithDefault(opMsgs, SYNC_OP_STATUS_IDLE)
+}
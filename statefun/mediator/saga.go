@@ -0,0 +1,213 @@
+package mediator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/foliagecp/easyjson"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+const (
+	sagaStateTempl = "__saga.%s"
+)
+
+const (
+	SagaStatusRunning            = "running"
+	SagaStatusCompensating       = "compensating"
+	SagaStatusCompleted          = "completed"
+	SagaStatusCompensated        = "compensated"
+	SagaStatusCompensationFailed = "compensation_failed"
+)
+
+// SagaStepFunc executes a saga step or its compensation.
+// results - data of all successfully executed steps keyed by step name.
+type SagaStepFunc func(ctx *sfPlugins.StatefunContextProcessor, results *easyjson.JSON) OpMsg
+
+type sagaStep struct {
+	name         string
+	request      SagaStepFunc
+	compensation SagaStepFunc
+}
+
+/*
+Saga executes steps one by one. When a step fails, compensations of all previously succeeded steps run in reverse order.
+Saga state is persisted in the function context after every step, so a saga which is run again for the same function
+id (e.g. after a restart and message redelivery) continues from where it stopped. Once finished, the saga keeps
+returning its final OpMsg until Reset is called.
+
+Saga state in the function context:
+
+	__saga.<name>:
+		status: string // "running" | "compensating" | "completed" | "compensated" | "compensation_failed"
+		step: int // Index of the next step to run
+		compensate: int // Index of the next step to compensate
+		results: json // Data of succeeded steps keyed by step name
+		failure: json // OpMsg of the failed step
+		failed_step: string
+		compensation_failures: json // OpMsgs of failed compensations keyed by step name
+*/
+type Saga struct {
+	ctx   *sfPlugins.StatefunContextProcessor
+	name  string
+	steps []sagaStep
+}
+
+func NewSaga(ctx *sfPlugins.StatefunContextProcessor, name string) *Saga {
+	return &Saga{ctx: ctx, name: strings.ReplaceAll(name, ".", "_")}
+}
+
+// Step adds a step to the saga. compensation may be nil if the step does not need to be undone.
+func (s *Saga) Step(name string, request SagaStepFunc, compensation SagaStepFunc) *Saga {
+	s.steps = append(s.steps, sagaStep{name: strings.ReplaceAll(name, ".", "_"), request: request, compensation: compensation})
+	return s
+}
+
+// SagaRequest creates a step function which requests a stateful function and converts its reply into OpMsg
+func SagaRequest(typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) SagaStepFunc {
+	return func(ctx *sfPlugins.StatefunContextProcessor, _ *easyjson.JSON) OpMsg {
+		return OpMsgFromSfReply(ctx.Request(sfPlugins.AutoRequestSelect, typename, id, payload, options))
+	}
+}
+
+// SagaSignal creates a step function which signals a stateful function, the step succeeds once the signal is sent
+func SagaSignal(provider sfPlugins.SignalProvider, typename string, id string, payload *easyjson.JSON, options *easyjson.JSON) SagaStepFunc {
+	return func(ctx *sfPlugins.StatefunContextProcessor, _ *easyjson.JSON) OpMsg {
+		if err := ctx.Signal(provider, typename, id, payload, options); err != nil {
+			return OpMsgFailed(err.Error())
+		}
+		return OpMsgOk(easyjson.NewJSONNull())
+	}
+}
+
+func (s *Saga) statePath() string {
+	return fmt.Sprintf(sagaStateTempl, s.name)
+}
+
+func (s *Saga) loadState() easyjson.JSON {
+	state := s.ctx.GetFunctionContext().GetByPath(s.statePath())
+	if !state.IsNonEmptyObject() {
+		state = easyjson.NewJSONObject()
+		state.SetByPath("status", easyjson.NewJSON(SagaStatusRunning))
+		state.SetByPath("step", easyjson.NewJSON(0))
+		state.SetByPath("results", easyjson.NewJSONObject())
+	}
+	return state
+}
+
+func (s *Saga) saveState(state easyjson.JSON) {
+	funcContext := s.ctx.GetFunctionContext()
+	funcContext.SetByPath(s.statePath(), state)
+	s.ctx.SetFunctionContext(funcContext)
+}
+
+// Status returns current status of the saga or empty string if it was never run
+func (s *Saga) Status() string {
+	return s.ctx.GetFunctionContext().GetByPath(s.statePath() + ".status").AsStringDefault("")
+}
+
+// Reset removes the persisted state, so the saga can be run again from the first step
+func (s *Saga) Reset() {
+	funcContext := s.ctx.GetFunctionContext()
+	funcContext.RemoveByPath(s.statePath())
+	s.ctx.SetFunctionContext(funcContext)
+}
+
+func sagaStepFailed(msg OpMsg) bool {
+	return msg.Status == SYNC_OP_STATUS_FAILED || msg.Status == SYNC_OP_STATUS_INCOMPLETE
+}
+
+// Run executes (or resumes) the saga and returns its final status
+func (s *Saga) Run() OpMsg {
+	names := map[string]struct{}{}
+	for _, step := range s.steps {
+		if _, ok := names[step.name]; ok {
+			return OpMsgFailed(fmt.Sprintf("saga %s: duplicate step name %s", s.name, step.name))
+		}
+		names[step.name] = struct{}{}
+	}
+
+	state := s.loadState()
+
+	if state.GetByPath("status").AsStringDefault("") == SagaStatusRunning {
+		results := state.GetByPath("results")
+		for i := int(state.GetByPath("step").AsNumericDefault(0)); i < len(s.steps); i++ {
+			step := s.steps[i]
+			msg := step.request(s.ctx, &results)
+			if sagaStepFailed(msg) {
+				state.SetByPath("status", easyjson.NewJSON(SagaStatusCompensating))
+				state.SetByPath("compensate", easyjson.NewJSON(i-1))
+				state.SetByPath("failed_step", easyjson.NewJSON(step.name))
+				state.SetByPath("failure", *msg.ToJson())
+				state.SetByPath("compensation_failures", easyjson.NewJSONObject())
+				s.saveState(state)
+				break
+			}
+			results.SetByPath(step.name, msg.Data)
+			state.SetByPath("results", results)
+			state.SetByPath("step", easyjson.NewJSON(i+1))
+			if i+1 == len(s.steps) {
+				state.SetByPath("status", easyjson.NewJSON(SagaStatusCompleted))
+			}
+			s.saveState(state)
+		}
+		if len(s.steps) == 0 {
+			state.SetByPath("status", easyjson.NewJSON(SagaStatusCompleted))
+			s.saveState(state)
+		}
+	}
+
+	if state.GetByPath("status").AsStringDefault("") == SagaStatusCompensating {
+		results := state.GetByPath("results")
+		compensationFailures := state.GetByPath("compensation_failures")
+		for j := int(state.GetByPath("compensate").AsNumericDefault(-1)); j >= 0 && j < len(s.steps); j-- {
+			step := s.steps[j]
+			if step.compensation != nil {
+				if msg := step.compensation(s.ctx, &results); sagaStepFailed(msg) {
+					compensationFailures.SetByPath(step.name, *msg.ToJson())
+					state.SetByPath("compensation_failures", compensationFailures)
+				}
+			}
+			state.SetByPath("compensate", easyjson.NewJSON(j-1))
+			s.saveState(state)
+		}
+		if compensationFailures.KeysCount() > 0 {
+			state.SetByPath("status", easyjson.NewJSON(SagaStatusCompensationFailed))
+		} else {
+			state.SetByPath("status", easyjson.NewJSON(SagaStatusCompensated))
+		}
+		s.saveState(state)
+	}
+
+	return s.result(state)
+}
+
+func (s *Saga) result(state easyjson.JSON) OpMsg {
+	status := state.GetByPath("status").AsStringDefault("")
+
+	data := easyjson.NewJSONObject()
+	data.SetByPath("saga", easyjson.NewJSON(s.name))
+	data.SetByPath("status", easyjson.NewJSON(status))
+	data.SetByPath("results", state.GetByPath("results"))
+
+	switch status {
+	case SagaStatusCompleted:
+		return OpMsgOk(data)
+	case SagaStatusCompensated, SagaStatusCompensationFailed:
+		failedStep := state.GetByPath("failed_step").AsStringDefault("")
+		failure := OpMsgFromJson(state.GetByPath("failure").GetPtr())
+		data.SetByPath("failed_step", easyjson.NewJSON(failedStep))
+		data.SetByPath("failure", state.GetByPath("failure"))
+		if status == SagaStatusCompensated {
+			return MakeOpMsg(SYNC_OP_STATUS_FAILED, fmt.Sprintf("saga %s failed at step %s and was compensated: %s", s.name, failedStep, failure.Details), "", data)
+		}
+		compensationFailures := state.GetByPath("compensation_failures")
+		data.SetByPath("compensation_failures", compensationFailures)
+		failedCompensations := compensationFailures.ObjectKeys()
+		sort.Strings(failedCompensations)
+		return MakeOpMsg(SYNC_OP_STATUS_INCOMPLETE, fmt.Sprintf("saga %s failed at step %s, compensation failed for steps: %s", s.name, failedStep, strings.Join(failedCompensations, ", ")), "", data)
+	}
+	return OpMsgIncomplete(fmt.Sprintf("saga %s is in unexpected status %s", s.name, status))
+}
@@ -0,0 +1,139 @@
+package mediator
+
+import (
+	"fmt"
+
+	"github.com/foliagecp/easyjson"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// registerSaga registers functions.test.saga, which runs saga "order" of steps a, b, c and d recording every call
+// into calls, steps listed in payload "fail" fail, compensations listed in payload "fail_compensation" fail.
+// Payload "restore" is put as the saga state instead, as left by a runtime which stopped in the middle of the saga.
+func (s *mediatorSuite) registerSaga(calls *[]string, result *OpMsg) {
+	s.RegisterFunction("functions.test.saga", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		if restored := ctx.Payload.GetByPath("restore"); restored.IsObject() {
+			funcCtx := ctx.GetFunctionContext()
+			funcCtx.SetByPath(fmt.Sprintf(sagaStateTempl, "order"), restored)
+			ctx.SetFunctionContext(funcCtx)
+			return
+		}
+		failing := func(path string, name string) bool {
+			names, _ := ctx.Payload.GetByPath(path).AsArrayString()
+			for _, n := range names {
+				if n == name {
+					return true
+				}
+			}
+			return false
+		}
+		step := func(name string) SagaStepFunc {
+			return func(_ *sfPlugins.StatefunContextProcessor, _ *easyjson.JSON) OpMsg {
+				*calls = append(*calls, name)
+				if failing("fail", name) {
+					return OpMsgFailed(name + " failed")
+				}
+				return OpMsgOk(easyjson.NewJSON(name + " done"))
+			}
+		}
+		compensation := func(name string) SagaStepFunc {
+			return func(_ *sfPlugins.StatefunContextProcessor, results *easyjson.JSON) OpMsg {
+				*calls = append(*calls, "undo "+name+" of "+results.GetByPath(name).AsStringDefault(""))
+				if failing("fail_compensation", name) {
+					return OpMsgFailed("undo " + name + " failed")
+				}
+				return OpMsgOk(easyjson.NewJSONNull())
+			}
+		}
+
+		saga := NewSaga(ctx, "order").
+			Step("a", step("a"), compensation("a")).
+			Step("b", step("b"), compensation("b")).
+			Step("c", step("c"), nil).
+			Step("d", step("d"), compensation("d"))
+		if ctx.Payload.GetByPath("reset").AsBoolDefault(false) {
+			saga.Reset()
+		}
+		*result = saga.Run()
+	}, *statefun.NewFunctionTypeConfig())
+}
+
+func (s *mediatorSuite) runSaga(payload easyjson.JSON) {
+	s.Require().NoError(s.Signal("functions.test.saga", "o", &payload, nil))
+}
+
+func (s *mediatorSuite) TestSagaCompensationOrder() {
+	var calls []string
+	var result OpMsg
+	s.registerSaga(&calls, &result)
+	s.Require().NoError(s.StartRuntime())
+
+	s.runSaga(easyjson.NewJSONObjectWithKeyValue("fail", easyjson.JSONFromArray([]string{"d"})))
+	s.Require().Equal([]string{"a", "b", "c", "d", "undo b of b done", "undo a of a done"}, calls, "c has no compensation")
+	s.Require().Equal(SYNC_OP_STATUS_FAILED, result.Status)
+	s.Require().Equal(SagaStatusCompensated, result.Data.GetByPath("status").AsStringDefault(""))
+	s.Require().Equal("d", result.Data.GetByPath("failed_step").AsStringDefault(""))
+
+	// A finished saga keeps its result
+	calls = nil
+	s.runSaga(easyjson.NewJSONObject())
+	s.Require().Empty(calls)
+	s.Require().Equal(SagaStatusCompensated, result.Data.GetByPath("status").AsStringDefault(""))
+
+	// Reset runs it from the first step
+	s.runSaga(easyjson.NewJSONObjectWithKeyValue("reset", easyjson.NewJSON(true)))
+	s.Require().Equal([]string{"a", "b", "c", "d"}, calls)
+	s.Require().Equal(SYNC_OP_STATUS_OK, result.Status)
+	s.Require().Equal(SagaStatusCompleted, result.Data.GetByPath("status").AsStringDefault(""))
+}
+
+func (s *mediatorSuite) TestSagaCompensationFailure() {
+	var calls []string
+	var result OpMsg
+	s.registerSaga(&calls, &result)
+	s.Require().NoError(s.StartRuntime())
+
+	payload := easyjson.NewJSONObjectWithKeyValue("fail", easyjson.JSONFromArray([]string{"c"}))
+	payload.SetByPath("fail_compensation", easyjson.JSONFromArray([]string{"b"}))
+	s.runSaga(payload)
+	s.Require().Equal([]string{"a", "b", "c", "undo b of b done", "undo a of a done"}, calls, "a failed compensation does not stop the others")
+	s.Require().Equal(SYNC_OP_STATUS_INCOMPLETE, result.Status)
+	s.Require().Equal(SagaStatusCompensationFailed, result.Data.GetByPath("status").AsStringDefault(""))
+	s.Require().Equal([]string{"b"}, result.Data.GetByPath("compensation_failures").ObjectKeys())
+}
+
+func (s *mediatorSuite) TestSagaResumesAfterRestart() {
+	var calls []string
+	var result OpMsg
+	s.registerSaga(&calls, &result)
+	s.Require().NoError(s.StartRuntime())
+
+	// Stopped after step a succeeded
+	running := easyjson.NewJSONObject()
+	running.SetByPath("status", easyjson.NewJSON(SagaStatusRunning))
+	running.SetByPath("step", easyjson.NewJSON(1))
+	running.SetByPath("results", easyjson.NewJSONObjectWithKeyValue("a", easyjson.NewJSON("a done before restart")))
+	s.runSaga(easyjson.NewJSONObjectWithKeyValue("restore", running))
+	s.runSaga(easyjson.NewJSONObject())
+	s.Require().Equal([]string{"b", "c", "d"}, calls, "a is not run again")
+	s.Require().Equal(SYNC_OP_STATUS_OK, result.Status)
+	s.Require().Equal("a done before restart", result.Data.GetByPath("results.a").AsStringDefault(""))
+
+	// Stopped while compensating a failure of step c, b was already compensated
+	calls = nil
+	compensating := easyjson.NewJSONObject()
+	compensating.SetByPath("status", easyjson.NewJSON(SagaStatusCompensating))
+	compensating.SetByPath("step", easyjson.NewJSON(2))
+	compensating.SetByPath("compensate", easyjson.NewJSON(0))
+	compensating.SetByPath("results", easyjson.NewJSONObjectWithKeyValue("a", easyjson.NewJSON("a done before restart")))
+	compensating.SetByPath("failed_step", easyjson.NewJSON("c"))
+	compensating.SetByPath("failure", *OpMsgFailed("c failed").ToJson())
+	compensating.SetByPath("compensation_failures", easyjson.NewJSONObject())
+	s.runSaga(easyjson.NewJSONObjectWithKeyValue("restore", compensating))
+	s.runSaga(easyjson.NewJSONObject())
+	s.Require().Equal([]string{"undo a of a done before restart"}, calls)
+	s.Require().Equal(SagaStatusCompensated, result.Data.GetByPath("status").AsStringDefault(""))
+	s.Require().Equal("c", result.Data.GetByPath("failed_step").AsStringDefault(""))
+}
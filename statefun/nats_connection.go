@@ -0,0 +1,355 @@
+package statefun
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/statefun/envelope"
+)
+
+/*
+NatsConnectionConfig configures how runtimes (RuntimeConfig.SetNatsConnection) and clients (clients/go/db constructors)
+connect to NATS in addition to the URL:
+
+  - authentication: credentials file (JWT + NKey), NKey seed file, token or user/password;
+  - TLS: client certificate, custom CA bundles, server name, insecure verification for self-signed certificates;
+  - reconnects: max attempts, exponential backoff with jitter, reconnect buffer, connection timeout and pings;
+  - connection name shown by the NATS server monitoring.
+
+Zero values keep defaults of nats.go.
+
+Clients also take the envelope signing config of their requests from it (SetEnvelopeSigning), runtimes sign with
+RuntimeConfig.SetEnvelopeSigning. The caller domain and principal clients put into their requests for caller ACLs are
+set with SetCaller, they are signed with the envelope.
+*/
+
+const (
+	NatsReconnectBackoffMax = 30 * time.Second
+)
+
+type NatsConnectionConfig struct {
+	name string
+
+	credentialsFile string
+	nkeySeedFile    string
+	token           string
+	user            string
+	password        string
+
+	tls                bool
+	clientCertFile     string
+	clientKeyFile      string
+	caFiles            []string
+	tlsServerName      string
+	insecureSkipVerify bool
+
+	maxReconnects        *int
+	reconnectWait        time.Duration
+	reconnectBackoffMax  time.Duration
+	reconnectJitter      time.Duration
+	reconnectBufSize     int
+	retryOnFailedConnect bool
+	connectTimeout       time.Duration
+	pingInterval         time.Duration
+	maxPingsOutstanding  int
+
+	envelopeSigning *envelope.Config
+	callerDomain    string
+	callerPrincipal string
+}
+
+func NewNatsConnectionConfig() *NatsConnectionConfig {
+	return &NatsConnectionConfig{}
+}
+
+// SetName sets the connection name
+func (nc *NatsConnectionConfig) SetName(name string) *NatsConnectionConfig {
+	nc.name = name
+	return nc
+}
+
+// SetCredentialsFile sets a .creds file with a user JWT and an NKey seed
+func (nc *NatsConnectionConfig) SetCredentialsFile(credentialsFile string) *NatsConnectionConfig {
+	nc.credentialsFile = credentialsFile
+	return nc
+}
+
+// SetNKeySeedFile sets a file with an NKey user seed
+func (nc *NatsConnectionConfig) SetNKeySeedFile(nkeySeedFile string) *NatsConnectionConfig {
+	nc.nkeySeedFile = nkeySeedFile
+	return nc
+}
+
+func (nc *NatsConnectionConfig) SetToken(token string) *NatsConnectionConfig {
+	nc.token = token
+	return nc
+}
+
+// SetUserInfo sets user and password, it is an alternative to the credentials embedded into the URL
+func (nc *NatsConnectionConfig) SetUserInfo(user string, password string) *NatsConnectionConfig {
+	nc.user = user
+	nc.password = password
+	return nc
+}
+
+// SetTLS requires TLS even if the URL scheme is nats://
+func (nc *NatsConnectionConfig) SetTLS(enableTLS bool) *NatsConnectionConfig {
+	nc.tls = enableTLS
+	return nc
+}
+
+// SetClientCertificate sets PEM files of the client certificate and its key, enables TLS
+func (nc *NatsConnectionConfig) SetClientCertificate(certFile string, keyFile string) *NatsConnectionConfig {
+	nc.clientCertFile = certFile
+	nc.clientKeyFile = keyFile
+	nc.tls = true
+	return nc
+}
+
+// AddCAFile adds a PEM bundle the server certificate is verified with instead of the system pool, enables TLS
+func (nc *NatsConnectionConfig) AddCAFile(caFile string) *NatsConnectionConfig {
+	nc.caFiles = append(nc.caFiles, caFile)
+	nc.tls = true
+	return nc
+}
+
+func (nc *NatsConnectionConfig) SetTLSServerName(tlsServerName string) *NatsConnectionConfig {
+	nc.tlsServerName = tlsServerName
+	return nc
+}
+
+// SetInsecureSkipVerify disables server certificate verification, for self-signed certificates only
+func (nc *NatsConnectionConfig) SetInsecureSkipVerify(insecureSkipVerify bool) *NatsConnectionConfig {
+	nc.insecureSkipVerify = insecureSkipVerify
+	return nc
+}
+
+// SetMaxReconnects sets the number of reconnect attempts, -1 - unlimited
+func (nc *NatsConnectionConfig) SetMaxReconnects(maxReconnects int) *NatsConnectionConfig {
+	nc.maxReconnects = &maxReconnects
+	return nc
+}
+
+// SetReconnectWait sets a constant delay between reconnect attempts to the same server
+func (nc *NatsConnectionConfig) SetReconnectWait(reconnectWait time.Duration) *NatsConnectionConfig {
+	nc.reconnectWait = reconnectWait
+	nc.reconnectBackoffMax = 0
+	return nc
+}
+
+// SetReconnectBackoff makes the delay between reconnect attempts start from initial and double up to max
+// (0 - nats.DefaultReconnectWait and NatsReconnectBackoffMax)
+func (nc *NatsConnectionConfig) SetReconnectBackoff(initial time.Duration, max time.Duration) *NatsConnectionConfig {
+	if initial <= 0 {
+		initial = nats.DefaultReconnectWait
+	}
+	if max <= 0 {
+		max = NatsReconnectBackoffMax
+	}
+	nc.reconnectWait = initial
+	nc.reconnectBackoffMax = max
+	return nc
+}
+
+// SetReconnectJitter adds a random delay up to jitter to every reconnect attempt
+func (nc *NatsConnectionConfig) SetReconnectJitter(reconnectJitter time.Duration) *NatsConnectionConfig {
+	nc.reconnectJitter = reconnectJitter
+	return nc
+}
+
+// SetReconnectBufSize sets how many bytes published while reconnecting are buffered
+func (nc *NatsConnectionConfig) SetReconnectBufSize(reconnectBufSize int) *NatsConnectionConfig {
+	nc.reconnectBufSize = reconnectBufSize
+	return nc
+}
+
+// SetRetryOnFailedConnect makes the initial connect be retried like a reconnect instead of failing
+func (nc *NatsConnectionConfig) SetRetryOnFailedConnect(retryOnFailedConnect bool) *NatsConnectionConfig {
+	nc.retryOnFailedConnect = retryOnFailedConnect
+	return nc
+}
+
+func (nc *NatsConnectionConfig) SetConnectTimeout(connectTimeout time.Duration) *NatsConnectionConfig {
+	nc.connectTimeout = connectTimeout
+	return nc
+}
+
+func (nc *NatsConnectionConfig) SetPingInterval(pingInterval time.Duration, maxPingsOutstanding int) *NatsConnectionConfig {
+	nc.pingInterval = pingInterval
+	nc.maxPingsOutstanding = maxPingsOutstanding
+	return nc
+}
+
+// SetEnvelopeSigning makes clients (clients/go/db constructors) sign envelopes of their requests, see
+// RuntimeConfig.SetEnvelopeSigning
+func (nc *NatsConnectionConfig) SetEnvelopeSigning(envelopeSigning *envelope.Config) *NatsConnectionConfig {
+	nc.envelopeSigning = envelopeSigning
+	return nc
+}
+
+// EnvelopeSigning returns the envelope signing config of clients, nil - requests are not signed
+func (nc *NatsConnectionConfig) EnvelopeSigning() *envelope.Config {
+	if nc == nil {
+		return nil
+	}
+	return nc.envelopeSigning
+}
+
+// SetCaller sets the caller domain and principal clients (clients/go/db constructors) put into their requests, see
+// FunctionTypeConfig.SetAllowedCallerDomains and SetAllowedCallerPrincipals
+func (nc *NatsConnectionConfig) SetCaller(domain string, principal string) *NatsConnectionConfig {
+	nc.callerDomain = domain
+	nc.callerPrincipal = principal
+	return nc
+}
+
+// Caller returns the caller domain and principal of clients, empty if not set
+func (nc *NatsConnectionConfig) Caller() (domain string, principal string) {
+	if nc == nil {
+		return "", ""
+	}
+	return nc.callerDomain, nc.callerPrincipal
+}
+
+// Options builds nats.go options, files are read here so misconfiguration is reported before connecting
+func (nc *NatsConnectionConfig) Options() ([]nats.Option, error) {
+	opts := []nats.Option{}
+	if nc == nil {
+		return opts, nil
+	}
+
+	if len(nc.name) > 0 {
+		opts = append(opts, nats.Name(nc.name))
+	}
+
+	if len(nc.credentialsFile) > 0 && len(nc.nkeySeedFile) > 0 {
+		return nil, fmt.Errorf("credentials file and nkey seed file cannot be used together")
+	}
+	if len(nc.credentialsFile) > 0 {
+		if _, err := os.Stat(nc.credentialsFile); err != nil {
+			return nil, fmt.Errorf("credentials file: %w", err)
+		}
+		opts = append(opts, nats.UserCredentials(nc.credentialsFile))
+	}
+	if len(nc.nkeySeedFile) > 0 {
+		opt, err := nats.NkeyOptionFromSeed(nc.nkeySeedFile)
+		if err != nil {
+			return nil, fmt.Errorf("nkey seed file: %w", err)
+		}
+		opts = append(opts, opt)
+	}
+	if len(nc.token) > 0 {
+		opts = append(opts, nats.Token(nc.token))
+	}
+	if len(nc.user) > 0 {
+		opts = append(opts, nats.UserInfo(nc.user, nc.password))
+	}
+
+	if nc.tls {
+		tlsConfig, err := nc.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Secure(tlsConfig))
+	}
+
+	if nc.maxReconnects != nil {
+		opts = append(opts, nats.MaxReconnects(*nc.maxReconnects))
+	}
+	if nc.reconnectBackoffMax > 0 {
+		opts = append(opts, nats.CustomReconnectDelay(reconnectBackoff(nc.reconnectWait, nc.reconnectBackoffMax, nc.reconnectJitter)))
+	} else {
+		if nc.reconnectWait > 0 {
+			opts = append(opts, nats.ReconnectWait(nc.reconnectWait))
+		}
+		if nc.reconnectJitter > 0 {
+			opts = append(opts, nats.ReconnectJitter(nc.reconnectJitter, nc.reconnectJitter))
+		}
+	}
+	if nc.reconnectBufSize != 0 {
+		opts = append(opts, nats.ReconnectBufSize(nc.reconnectBufSize))
+	}
+	if nc.retryOnFailedConnect {
+		opts = append(opts, nats.RetryOnFailedConnect(true))
+	}
+	if nc.connectTimeout > 0 {
+		opts = append(opts, nats.Timeout(nc.connectTimeout))
+	}
+	if nc.pingInterval > 0 {
+		opts = append(opts, nats.PingInterval(nc.pingInterval))
+	}
+	if nc.maxPingsOutstanding > 0 {
+		opts = append(opts, nats.MaxPingsOutstanding(nc.maxPingsOutstanding))
+	}
+	return opts, nil
+}
+
+// withInsecureTLS returns a copy with TLS enabled without server certificate verification
+func (nc *NatsConnectionConfig) withInsecureTLS() *NatsConnectionConfig {
+	insecure := NatsConnectionConfig{}
+	if nc != nil {
+		insecure = *nc
+	}
+	insecure.tls = true
+	insecure.insecureSkipVerify = true
+	return &insecure
+}
+
+func (nc *NatsConnectionConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         nc.tlsServerName,
+		InsecureSkipVerify: nc.insecureSkipVerify,
+	}
+	if len(nc.clientCertFile) > 0 || len(nc.clientKeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(nc.clientCertFile, nc.clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if len(nc.caFiles) > 0 {
+		pool := x509.NewCertPool()
+		for _, caFile := range nc.caFiles {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("ca file: %w", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("ca file %s has no PEM certificates", caFile)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+func reconnectBackoff(initial time.Duration, max time.Duration, jitter time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		delay := max
+		if attempts < 32 {
+			if d := initial << (attempts - 1); d > 0 && d < max {
+				delay = d
+			}
+		}
+		if jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(jitter)))
+		}
+		return delay
+	}
+}
+
+// ConnectNats connects to NATS at natsURL with the connection config, nil config - URL only
+func ConnectNats(natsURL string, connection *NatsConnectionConfig) (*nats.Conn, error) {
+	opts, err := connection.Options()
+	if err != nil {
+		return nil, err
+	}
+	return nats.Connect(natsURL, opts...)
+}
@@ -0,0 +1,45 @@
+package statefun
+
+import (
+	"testing"
+	"time"
+
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNatsConnectionToken(t *testing.T) {
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	opts.Authorization = "s3cret"
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+
+	_, err := ConnectNats(srv.ClientURL(), NewNatsConnectionConfig().SetToken("wrong"))
+	require.Error(t, err)
+
+	nc, err := ConnectNats(srv.ClientURL(), NewNatsConnectionConfig().SetToken("s3cret").SetName("statefun-test"))
+	require.NoError(t, err)
+	defer nc.Close()
+	require.Equal(t, "statefun-test", nc.Opts.Name)
+}
+
+func TestNatsConnectionOptionsErrors(t *testing.T) {
+	_, err := NewNatsConnectionConfig().AddCAFile("/nonexistent/ca.pem").Options()
+	require.Error(t, err)
+
+	_, err = NewNatsConnectionConfig().SetCredentialsFile("a.creds").SetNKeySeedFile("a.nk").Options()
+	require.Error(t, err)
+
+	_, err = NewNatsConnectionConfig().SetClientCertificate("/nonexistent/cert.pem", "/nonexistent/key.pem").Options()
+	require.Error(t, err)
+}
+
+func TestNatsReconnectBackoff(t *testing.T) {
+	delay := reconnectBackoff(100*time.Millisecond, time.Second, 0)
+	require.Equal(t, 100*time.Millisecond, delay(1))
+	require.Equal(t, 200*time.Millisecond, delay(2))
+	require.Equal(t, 800*time.Millisecond, delay(4))
+	require.Equal(t, time.Second, delay(5))
+	require.Equal(t, time.Second, delay(1000))
+}
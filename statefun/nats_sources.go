@@ -124,6 +124,32 @@ func handleNatsMsg(ft *FunctionType, msg *nats.Msg, requestReply bool) (err erro
 		caller.ID, _ = data.GetByPath("caller_id").AsString()
 	}
 
+	if ft.runtime.envelopeVerifier != nil || ft.config.hasCallerACL() {
+		callerDomain, _ := data.GetByPath(CallerDomainNatsDataPath).AsString()
+		callerPrincipal, _ := data.GetByPath(CallerPrincipalNatsDataPath).AsString()
+		callerInfo := callerInfo{address: caller, domain: callerDomain, principal: callerPrincipal}
+		path := "nats_signal"
+		if requestReply {
+			path = "nats_request"
+		}
+		refuse := func(reason string, err error) {
+			if requestReply {
+				system.MsgOnErrorReturn(msg.Respond(ft.callerRefusalReply(reason, callerInfo, err).ToBytes()))
+			} else {
+				system.MsgOnErrorReturn(msg.Ack()) // Redelivery will not change the decision
+			}
+		}
+		if err := ft.verifyEnvelope(&data, id, msg, requestReply); err != nil {
+			ft.auditDeniedCall(callRefusalReasonSignature, id, callerInfo, path, err)
+			refuse(callRefusalReasonSignature, err)
+			return nil
+		}
+		if err := ft.checkCaller(id, callerInfo, path); err != nil {
+			refuse(callRefusalReasonACL, err)
+			return nil
+		}
+	}
+
 	// Create function message ------------------------
 	functionMsg := FunctionTypeMsg{
 		Caller:  &caller,
@@ -167,3 +193,18 @@ func handleNatsMsg(ft *FunctionType, msg *nats.Msg, requestReply bool) (err erro
 
 	return
 }
+
+func (ft *FunctionType) verifyEnvelope(data *easyjson.JSON, id string, msg *nats.Msg, requestReply bool) error {
+	if ft.runtime.envelopeVerifier == nil {
+		return nil
+	}
+	receivedAt := time.Now()
+	var sequence uint64
+	if !requestReply {
+		if meta, err := msg.Metadata(); err == nil {
+			receivedAt = meta.Timestamp
+			sequence = meta.Sequence.Stream
+		}
+	}
+	return ft.runtime.envelopeVerifier.Verify(data, ft.name+"."+id, receivedAt, sequence)
+}
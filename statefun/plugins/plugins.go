@@ -8,6 +8,7 @@ import (
 
 	"github.com/foliagecp/sdk/statefun/cache"
 	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
 
 	"github.com/foliagecp/easyjson"
 )
@@ -31,6 +32,10 @@ const (
 	GolangLocalSignal
 )
 
+// ContextExpiredPayloadKey is in the payload of the signal GC sends to a function before its expired context is deleted,
+// see statefun.FunctionTypeConfig.SetContextExpireSignal
+const ContextExpiredPayloadKey = "__context_expired"
+
 type RequestProvider int
 
 const (
@@ -47,6 +52,7 @@ type SFEgressFunc func(egressProvider EgressProvider, payload *easyjson.JSON, cu
 
 const (
 	NatsCoreEgress EgressProvider = iota
+	HTTPWebhookEgress
 )
 
 type SyncReply struct {
@@ -96,7 +102,14 @@ type StatefunContextProcessor struct {
 	SetObjectContext          func(*easyjson.JSON)
 	ObjectMutexLock           func(objectId string, errorOnLocked bool) error
 	ObjectMutexUnlock         func(objectId string) error
+	ObjectRWMutexLock         func(objectId string, exclusive bool, errorOnLocked bool) error
+	ObjectRWMutexLockUpdate   func(objectId string) error // Prolongs a lock kept after the handler returned
+	ObjectRWMutexUnlock       func(objectId string) error
+	ObjectSemaphoreAcquire    func(objectId string, permits int, maxPermits int, errorOnLocked bool) error
+	ObjectSemaphoreUpdate     func(objectId string) error // Prolongs permits kept after the handler returned
+	ObjectSemaphoreRelease    func(objectId string) error
 	Domain                    Domain
+	Clock                     system.Clock // Time source of the runtime
 	// TODO: DownstreamSignal(<function type>, <links filters>, <payload>, <options>)
 	Signal  SFSignalFunc
 	Request SFRequestFunc
@@ -0,0 +1,190 @@
+package statefun
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+/*
+Recorder writes messages entering selected function types (RuntimeConfig.SetRecorder) into a file, one JSON object
+per line, after the message is handled:
+
+	{
+		"seq": 12,                                   // order in which messages entered function types
+		"received_at": "2024-05-01T10:00:00.123Z",   // time of the runtime clock
+		"duration_ms": 1.5,
+		"typename": "functions.cmdb.api.link.create",
+		"id": "hub/a",
+		"caller": {"typename": "ingress", "id": "request"},
+		"request": true,
+		"payload": {...},
+		"options": {...},                            // options of the message, not merged with function type options
+		"reply": {...}                               // requests only, missing if the reply was overridden by the handler
+	}
+
+ReadRecording reads the file back and Runtime.Replay feeds it into another runtime.
+*/
+
+type RecorderConfig struct {
+	path      string
+	typenames map[string]struct{}
+}
+
+// NewRecorderConfig records messages of typenames into the file at path (appended if exists), no typenames - all
+func NewRecorderConfig(path string, typenames ...string) *RecorderConfig {
+	rc := &RecorderConfig{path: path, typenames: map[string]struct{}{}}
+	return rc.AddTypenames(typenames...)
+}
+
+func (rc *RecorderConfig) AddTypenames(typenames ...string) *RecorderConfig {
+	for _, typename := range typenames {
+		rc.typenames[typename] = struct{}{}
+	}
+	return rc
+}
+
+type RecordedMessage struct {
+	Seq        uint64
+	ReceivedAt time.Time
+	Duration   time.Duration
+	Typename   string
+	ID         string
+	Caller     sfPlugins.StatefunAddress
+	Request    bool
+	Payload    *easyjson.JSON
+	Options    *easyjson.JSON
+	Reply      *easyjson.JSON
+}
+
+type recorder struct {
+	config *RecorderConfig
+	seq    atomic.Uint64
+	mutex  sync.Mutex
+	file   *os.File
+}
+
+func newRecorder(config *RecorderConfig) (*recorder, error) {
+	file, err := os.OpenFile(config.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("recorder: %w", err)
+	}
+	return &recorder{config: config, file: file}, nil
+}
+
+// begin returns a record for the message or nil if the typename is not recorded
+func (rec *recorder) begin(typename string, id string, msg FunctionTypeMsg, receivedAt time.Time) *RecordedMessage {
+	if rec == nil {
+		return nil
+	}
+	if _, ok := rec.config.typenames[typename]; !ok && len(rec.config.typenames) > 0 {
+		return nil
+	}
+	rm := &RecordedMessage{
+		Seq:        rec.seq.Add(1),
+		ReceivedAt: receivedAt,
+		Typename:   typename,
+		ID:         id,
+		Request:    msg.RequestCallback != nil,
+	}
+	if msg.Caller != nil {
+		rm.Caller = *msg.Caller
+	}
+	if msg.Payload != nil {
+		rm.Payload = msg.Payload.Clone().GetPtr()
+	}
+	if msg.Options != nil {
+		rm.Options = msg.Options.Clone().GetPtr()
+	}
+	return rm
+}
+
+func (rec *recorder) write(rm *RecordedMessage) {
+	if rec == nil || rm == nil {
+		return
+	}
+	line := append(rm.toJSON().ToBytes(), '\n')
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.file == nil {
+		return
+	}
+	if _, err := rec.file.Write(line); err != nil {
+		lg.Logf(lg.ErrorLevel, "Recorder cannot write message %d: %s", rm.Seq, err)
+	}
+}
+
+func (rec *recorder) close() {
+	if rec == nil {
+		return
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.file != nil {
+		if err := rec.file.Close(); err != nil {
+			lg.Logf(lg.ErrorLevel, "Recorder cannot close %s: %s", rec.config.path, err)
+		}
+		rec.file = nil
+	}
+}
+
+func (rm *RecordedMessage) toJSON() *easyjson.JSON {
+	j := easyjson.NewJSONObject()
+	j.SetByPath("seq", easyjson.NewJSON(rm.Seq))
+	j.SetByPath("received_at", easyjson.NewJSON(rm.ReceivedAt.UTC().Format(time.RFC3339Nano)))
+	j.SetByPath("duration_ms", easyjson.NewJSON(float64(rm.Duration.Microseconds())/1000))
+	j.SetByPath("typename", easyjson.NewJSON(rm.Typename))
+	j.SetByPath("id", easyjson.NewJSON(rm.ID))
+	j.SetByPath("caller.typename", easyjson.NewJSON(rm.Caller.Typename))
+	j.SetByPath("caller.id", easyjson.NewJSON(rm.Caller.ID))
+	j.SetByPath("request", easyjson.NewJSON(rm.Request))
+	if rm.Payload != nil {
+		j.SetByPath("payload", *rm.Payload)
+	}
+	if rm.Options != nil {
+		j.SetByPath("options", *rm.Options)
+	}
+	if rm.Reply != nil {
+		j.SetByPath("reply", *rm.Reply)
+	}
+	return &j
+}
+
+func recordedMessageFromJSON(j *easyjson.JSON) (RecordedMessage, error) {
+	rm := RecordedMessage{
+		Seq:      uint64(j.GetByPath("seq").AsNumericDefault(0)),
+		Duration: time.Duration(j.GetByPath("duration_ms").AsNumericDefault(0) * float64(time.Millisecond)),
+		Typename: j.GetByPath("typename").AsStringDefault(""),
+		ID:       j.GetByPath("id").AsStringDefault(""),
+		Caller: sfPlugins.StatefunAddress{
+			Typename: j.GetByPath("caller.typename").AsStringDefault(""),
+			ID:       j.GetByPath("caller.id").AsStringDefault(""),
+		},
+		Request: j.GetByPath("request").AsBoolDefault(false),
+	}
+	if len(rm.Typename) == 0 || len(rm.ID) == 0 {
+		return rm, fmt.Errorf("typename and id are required")
+	}
+	receivedAt, err := time.Parse(time.RFC3339Nano, j.GetByPath("received_at").AsStringDefault(""))
+	if err != nil {
+		return rm, fmt.Errorf("received_at: %w", err)
+	}
+	rm.ReceivedAt = receivedAt
+	if j.PathExists("payload") {
+		rm.Payload = j.GetByPath("payload").GetPtr()
+	}
+	if j.PathExists("options") {
+		rm.Options = j.GetByPath("options").GetPtr()
+	}
+	if j.PathExists("reply") {
+		rm.Reply = j.GetByPath("reply").GetPtr()
+	}
+	return rm, nil
+}
@@ -0,0 +1,157 @@
+package statefun
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+type ReplayConfig struct {
+	speed             float64
+	ignoreReplyPaths  []string
+	wait              func(d time.Duration)
+	keepNestedRecords bool
+}
+
+func NewReplayConfig() *ReplayConfig {
+	return &ReplayConfig{wait: time.Sleep}
+}
+
+// SetTiming makes replay keep intervals between recorded messages divided by speed, 0 - no delays
+func (rc *ReplayConfig) SetTiming(speed float64) *ReplayConfig {
+	rc.speed = speed
+	return rc
+}
+
+// SetIgnoreReplyPaths sets paths removed from both replies before they are compared, e.g. generated ids and times
+func (rc *ReplayConfig) SetIgnoreReplyPaths(paths ...string) *ReplayConfig {
+	rc.ignoreReplyPaths = append(rc.ignoreReplyPaths, paths...)
+	return rc
+}
+
+// SetWait sets the function delaying messages when timing is kept, e.g. Advance of a virtual clock
+func (rc *ReplayConfig) SetWait(wait func(d time.Duration)) *ReplayConfig {
+	rc.wait = wait
+	return rc
+}
+
+// SetKeepNestedRecords makes replay send messages whose caller is a recorded function type too. By default they are
+// skipped, because the replayed caller sends them again.
+func (rc *ReplayConfig) SetKeepNestedRecords(keep bool) *ReplayConfig {
+	rc.keepNestedRecords = keep
+	return rc
+}
+
+type ReplayMismatch struct {
+	Seq      uint64
+	Typename string
+	ID       string
+	Recorded *easyjson.JSON
+	Replayed *easyjson.JSON
+	Err      error
+}
+
+type ReplayReport struct {
+	Signals    int
+	Requests   int
+	Skipped    int
+	Mismatches []ReplayMismatch
+}
+
+// ReadRecording reads a file written by the recorder, records are returned in the order of Seq
+func ReadRecording(path string) ([]RecordedMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []RecordedMessage{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		j, ok := easyjson.JSONFromBytes(scanner.Bytes())
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: invalid JSON", path, line)
+		}
+		rm, err := recordedMessageFromJSON(&j)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		records = append(records, rm)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Seq < records[j].Seq })
+	return records, nil
+}
+
+// Replay sends recorded messages to the runtime one by one in their order and compares replies of requests
+// with the recorded ones. Records without a recorded reply are sent but not compared.
+func (r *Runtime) Replay(records []RecordedMessage, config *ReplayConfig) ReplayReport {
+	if config == nil {
+		config = NewReplayConfig()
+	}
+
+	recordedTypenames := map[string]struct{}{}
+	for _, rm := range records {
+		recordedTypenames[rm.Typename] = struct{}{}
+	}
+
+	report := ReplayReport{}
+	var prevReceivedAt time.Time
+	for _, rm := range records {
+		if _, nested := recordedTypenames[rm.Caller.Typename]; nested && !config.keepNestedRecords {
+			report.Skipped++
+			continue
+		}
+
+		if config.speed > 0 && !prevReceivedAt.IsZero() {
+			if d := time.Duration(float64(rm.ReceivedAt.Sub(prevReceivedAt)) / config.speed); d > 0 {
+				config.wait(d)
+			}
+		}
+		prevReceivedAt = rm.ReceivedAt
+
+		if !rm.Request {
+			report.Signals++
+			if err := r.signal(sfPlugins.AutoSignalSelect, rm.Caller.Typename, rm.Caller.ID, rm.Typename, rm.ID, rm.Payload, rm.Options); err != nil {
+				report.Mismatches = append(report.Mismatches, ReplayMismatch{Seq: rm.Seq, Typename: rm.Typename, ID: rm.ID, Err: err})
+			}
+			continue
+		}
+
+		report.Requests++
+		reply, err := r.request(sfPlugins.AutoRequestSelect, rm.Caller.Typename, rm.Caller.ID, rm.Typename, rm.ID, rm.Payload, rm.Options)
+		if err != nil {
+			report.Mismatches = append(report.Mismatches, ReplayMismatch{Seq: rm.Seq, Typename: rm.Typename, ID: rm.ID, Recorded: rm.Reply, Err: err})
+			continue
+		}
+		if rm.Reply != nil && !bytes.Equal(comparableReply(rm.Reply, config.ignoreReplyPaths), comparableReply(reply, config.ignoreReplyPaths)) {
+			report.Mismatches = append(report.Mismatches, ReplayMismatch{Seq: rm.Seq, Typename: rm.Typename, ID: rm.ID, Recorded: rm.Reply, Replayed: reply})
+		}
+	}
+	return report
+}
+
+func comparableReply(reply *easyjson.JSON, ignorePaths []string) []byte {
+	if reply == nil {
+		return nil
+	}
+	j := reply.Clone()
+	for _, path := range ignorePaths {
+		j.RemoveByPath(path)
+	}
+	return j.ToBytes()
+}
@@ -0,0 +1,55 @@
+package statefun
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.jsonl")
+	start := func(config *RuntimeConfig, step float64) (*Runtime, func()) {
+		return startInMemoryTestRuntime(t, config, func(r *Runtime) { registerCounterFunctions(t, r, step) })
+	}
+
+	r, stop := start(NewRuntimeConfigSimple("", "test_app").SetRecorder(NewRecorderConfig(path)), 1)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.counter", "x", nil, nil))
+	}
+	reply, err := r.Request(sfPlugins.AutoRequestSelect, "functions.test.counter", "x", nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 3.0, reply.GetByPath("count").AsNumericDefault(0))
+	stop()
+
+	records, err := ReadRecording(path)
+	require.NoError(t, err)
+	require.Len(t, records, 9)
+	require.Equal(t, "functions.test.counter", records[0].Typename)
+	require.Equal(t, "ingress", records[0].Caller.Typename)
+	require.Equal(t, "functions.test.log", records[1].Typename)
+	require.Equal(t, "functions.test.counter", records[1].Caller.Typename)
+	require.True(t, records[6].Request)
+	require.Equal(t, 3.0, records[6].Reply.GetByPath("count").AsNumericDefault(0))
+
+	// Same handlers: messages sent by recorded function types are not replayed twice
+	r, stop = start(NewRuntimeConfigSimple("", "test_app"), 1)
+	report := r.Replay(records, nil)
+	require.Equal(t, 2, report.Signals)
+	require.Equal(t, 1, report.Requests)
+	require.Equal(t, 6, report.Skipped)
+	require.Empty(t, report.Mismatches)
+	require.Equal(t, "first;second;first;second;first;second;", r.ObjectContext("x").GetByPath("log").AsStringDefault(""))
+	stop()
+
+	// Changed handler: the reply regression is reported
+	r, stop = start(NewRuntimeConfigSimple("", "test_app"), 2)
+	report = r.Replay(records, nil)
+	require.Len(t, report.Mismatches, 1)
+	require.Equal(t, records[6].Seq, report.Mismatches[0].Seq)
+	require.Equal(t, 6.0, report.Mismatches[0].Replayed.GetByPath("count").AsNumericDefault(0))
+	require.Empty(t, r.Replay(records, NewReplayConfig().SetIgnoreReplyPaths("count")).Mismatches)
+	stop()
+}
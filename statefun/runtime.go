@@ -2,8 +2,8 @@ package statefun
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,8 +12,10 @@ import (
 	"github.com/foliagecp/sdk/statefun/system"
 	"github.com/nats-io/nats.go"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 
 	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/envelope"
 	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
 )
 
@@ -32,12 +34,27 @@ type Runtime struct {
 	Domain *Domain
 
 	registeredFunctionTypes       map[string]*FunctionType
+	functionTypesMutex            sync.RWMutex // Guards registeredFunctionTypes against registration while the runtime reads it
 	onAfterStartFunctionsWithMode []onAfterStartFunctionWithMode
+	isActiveInstance              atomic.Bool
 
 	gt0  int64 // Global time 0 - time of the very first message receiving by any function type
 	glce int64 // Global last call ended - time of last call of last function handling id of any function type
 	gc   int64 // Global counter - max total id handlers for all function types
 
+	instanceID      string
+	lockInfoSources lockInfoSources
+	healthChecks    runtimeHealthChecks
+
+	tenantMessagesLimiter *rate.Limiter
+	tenantStorageExceeded atomic.Bool
+
+	envelopeVerifier *envelope.Verifier
+
+	memory   *memoryTransport // Set by NewInMemoryRuntime
+	recorder *recorder
+	chaos    *chaos
+
 	shutdown chan struct{}
 	wg       sync.WaitGroup
 }
@@ -47,20 +64,34 @@ func NewRuntime(config RuntimeConfig) (*Runtime, error) {
 	r := &Runtime{
 		config:                  config,
 		registeredFunctionTypes: make(map[string]*FunctionType),
+		instanceID:              config.name + "-" + system.GetUniqueStrID(),
 		shutdown:                make(chan struct{}),
+		chaos:                   newChaos(config.chaos),
 	}
 
 	var err error
 
-	if r.config.enableTLS {
-		opts := []nats.Option{
-			nats.Secure(&tls.Config{InsecureSkipVerify: true}), // for self-assigned certificates
+	if err = validateTenant(config.tenant); err != nil {
+		return nil, err
+	}
+	r.initTenantQuota()
+	if config.recorder != nil {
+		if r.recorder, err = newRecorder(config.recorder); err != nil {
+			return nil, err
+		}
+	}
+	if config.envelopeSigning != nil {
+		r.envelopeVerifier = envelope.NewVerifier(config.envelopeSigning)
+		if maxAge := config.envelopeSigning.GetMaxDurableMessageAge(); config.ftStreamMaxAge <= 0 || config.ftStreamMaxAge > maxAge {
+			lg.Logf(lg.WarnLevel, "Function stream max age %s exceeds the max durable message age %s of envelope signing, signals waiting longer will be refused", config.ftStreamMaxAge, maxAge)
 		}
-		r.nc, err = nats.Connect(config.natsURL, opts...)
-	} else {
-		r.nc, err = nats.Connect(config.natsURL)
 	}
 
+	natsConnection := config.natsConnection
+	if r.config.enableTLS && (natsConnection == nil || !natsConnection.tls) {
+		natsConnection = natsConnection.withInsecureTLS() // for self-assigned certificates
+	}
+	r.nc, err = ConnectNats(config.natsURL, natsConnection)
 	if err != nil {
 		return nil, err
 	}
@@ -87,9 +118,10 @@ func NewRuntime(config RuntimeConfig) (*Runtime, error) {
 		maxMsgs:       config.kvStreamMaxMsgs,
 		maxBytes:      config.kvStreamMaxBytes,
 		maxAge:        config.kvStreamMaxAge,
+		history:       config.kvHistory,
 	}
 
-	r.Domain, err = NewDomain(r.nc, r.js, config.desiredHUBDomainName, ftStreamConfig, sysStreamConfig, kvStreamConfig)
+	r.Domain, err = NewDomain(r.nc, r.js, config.tenant, config.desiredHUBDomainName, ftStreamConfig, sysStreamConfig, kvStreamConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -109,12 +141,34 @@ func (r *Runtime) RegisterOnAfterStartFunction(f OnAfterStartFunction, async boo
 // Start initializes streams and starts function subscriptions.
 // It also handles graceful shutdown via context.Context.
 func (r *Runtime) Start(ctx context.Context, cacheConfig *cache.Config) error {
+	defer r.recorder.close()
+
+	if r.memory != nil {
+		return r.startInMemory(ctx, cacheConfig)
+	}
+
 	if intervalMins := system.GetEnvMustProceed("HEAP_WATCHER_INTERVAL_MINS", 0); intervalMins > 0 {
 		go system.StartHeapWatcher(float32(intervalMins))
 	}
 
 	logger := lg.NewLogger(lg.Options{ReportCaller: true, Level: lg.InfoLevel})
 
+	// Expose readiness and liveness of the runtime.
+	r.registerHealthChecks()
+	defer r.unregisterHealthChecks()
+
+	if cacheConfig.GetClock() == nil {
+		cacheConfig.SetClock(r.config.clock)
+	}
+	if r.chaos != nil && cacheConfig.GetKVWriteFault() == nil {
+		cacheConfig.SetKVWriteFault(r.chaos.kvWriteFault)
+	}
+
+	// Namespace cache keys with the tenant.
+	if len(r.Domain.tenant) > 0 {
+		cacheConfig.SetKVStorePrefix(r.Domain.tenantName(cacheConfig.GetKVStorePrefix()))
+	}
+
 	// Create streams if they do not exist.
 	if err := r.createStreams(ctx); err != nil {
 		return err
@@ -125,23 +179,34 @@ func (r *Runtime) Start(ctx context.Context, cacheConfig *cache.Config) error {
 		return err
 	}
 
+	// Start webhook egress outbox delivery.
+	if r.config.webhookEgress != nil {
+		if err := r.createWebhookOutboxStream(); err != nil {
+			return err
+		}
+		if err := r.runWebhookEgressDispatcher(ctx); err != nil {
+			return err
+		}
+	}
+
 	if r.config.activePassiveMode {
 		revID, err := KeyMutexLock(ctx, r, system.GetHashStr(RuntimeName), true)
 		if err != nil {
 			if errors.Is(err, ErrMutexLocked) {
 				lg.Logf(lg.DebugLevel, "Cant lock. Another runtime is already active")
-				r.config.isActiveInstance = false
+				r.isActiveInstance.Store(false)
 			} else {
 				return err
 			}
 		} else {
+			r.isActiveInstance.Store(true)
 			r.config.activeRevID = revID
 			defer func() {
 				system.MsgOnErrorReturn(KeyMutexUnlock(ctx, r, system.GetHashStr(RuntimeName), revID))
 			}()
 		}
 	} else {
-		r.config.isActiveInstance = true
+		r.isActiveInstance.Store(true)
 	}
 
 	// Handle single-instance functions.
@@ -151,7 +216,7 @@ func (r *Runtime) Start(ctx context.Context, cacheConfig *cache.Config) error {
 	}
 
 	// Start function subscriptions.
-	if r.config.isActiveInstance {
+	if r.isActiveInstance.Load() {
 		if err := r.startFunctionSubscriptions(ctx, singleInstanceFunctionRevisions); err != nil {
 			return err
 		}
@@ -164,6 +229,18 @@ func (r *Runtime) Start(ctx context.Context, cacheConfig *cache.Config) error {
 	r.wg.Add(1)
 	go r.runGarbageCollector(ctx)
 
+	// Start tenant storage quota watcher.
+	if len(r.Domain.tenant) > 0 && r.config.tenantQuota != nil && r.config.tenantQuota.maxStorageBytes > 0 {
+		r.wg.Add(1)
+		go r.runTenantStorageWatcher(ctx)
+	}
+
+	// Start lock deadlock detector.
+	if r.config.lockDeadlockDetectionIntervalSec > 0 {
+		r.wg.Add(1)
+		go r.runLockDeadlockDetector(ctx)
+	}
+
 	// Wait for shutdown signal.
 	<-r.shutdown
 
@@ -178,6 +255,45 @@ func (r *Runtime) Shutdown() {
 	close(r.shutdown)
 }
 
+func (r *Runtime) clock() system.Clock {
+	if r.config.clock == nil {
+		return system.RealClock
+	}
+	return r.config.clock
+}
+
+// InstanceID returns the unique id of this runtime instance used to identify lock owners.
+func (r *Runtime) InstanceID() string {
+	return r.instanceID
+}
+
+// RegisteredFunctionTypes returns sorted names of all function types registered in the runtime.
+func (r *Runtime) RegisteredFunctionTypes() []string {
+	r.functionTypesMutex.RLock()
+	defer r.functionTypesMutex.RUnlock()
+	typenames := make([]string, 0, len(r.registeredFunctionTypes))
+	for typename := range r.registeredFunctionTypes {
+		typenames = append(typenames, typename)
+	}
+	sort.Strings(typenames)
+	return typenames
+}
+
+func (r *Runtime) functionType(typename string) (*FunctionType, bool) {
+	r.functionTypesMutex.RLock()
+	defer r.functionTypesMutex.RUnlock()
+	ft, ok := r.registeredFunctionTypes[typename]
+	return ft, ok
+}
+
+// FunctionTypeConfig returns the config a function type was registered with.
+func (r *Runtime) FunctionTypeConfig(typename string) (FunctionTypeConfig, bool) {
+	if ft, ok := r.functionType(typename); ok {
+		return ft.config, true
+	}
+	return FunctionTypeConfig{}, false
+}
+
 // createStreams ensures that the necessary NATS streams exist.
 func (r *Runtime) createStreams(ctx context.Context) error {
 	logger := lg.NewLogger(lg.Options{ReportCaller: true, Level: lg.InfoLevel})
@@ -188,7 +304,7 @@ func (r *Runtime) createStreams(ctx context.Context) error {
 		existingStreams = append(existingStreams, info.Config.Name)
 	}
 
-	for _, ft := range r.registeredFunctionTypes {
+	for _, ft := range r.functionTypes() {
 		if ft.config.IsSignalProviderAllowed(sfPlugins.JetstreamGlobalSignal) {
 			if !contains(existingStreams, ft.getStreamName()) {
 				_, err := r.js.AddStream(&nats.StreamConfig{
@@ -212,7 +328,8 @@ func (r *Runtime) createStreams(ctx context.Context) error {
 
 // handleSingleInstanceFunctions manages single-instance function locks.
 func (r *Runtime) handleSingleInstanceFunctions(ctx context.Context, revisions map[string]uint64) error {
-	for ftName, ft := range r.registeredFunctionTypes {
+	for _, ft := range r.functionTypes() {
+		ftName := ft.name
 		if !ft.config.multipleInstancesAllowed {
 			revID, err := KeyMutexLock(ctx, r, system.GetHashStr(ftName), true)
 			if err != nil {
@@ -238,7 +355,7 @@ func (r *Runtime) handleSingleInstanceFunctions(ctx context.Context, revisions m
 
 // startFunctionSubscriptions starts the function subscriptions based on the configuration.
 func (r *Runtime) startFunctionSubscriptions(ctx context.Context, revisions map[string]uint64) error {
-	for _, ft := range r.registeredFunctionTypes {
+	for _, ft := range r.functionTypes() {
 		revision, exist := revisions[ft.name]
 		if !exist {
 			lg.Logf(lg.WarnLevel, "Function type %s is not registered; skipping", ft.name)
@@ -287,7 +404,7 @@ func (r *Runtime) runAfterStartFunctions(ctx context.Context) {
 // runGarbageCollector periodically cleans up expired function instances.
 func (r *Runtime) runGarbageCollector(ctx context.Context) {
 	defer r.wg.Done()
-	ticker := time.NewTicker(time.Duration(r.config.gcIntervalSec) * time.Second)
+	ticker := r.clock().NewTicker(time.Duration(r.config.gcIntervalSec) * time.Second)
 	defer ticker.Stop()
 
 	for {
@@ -296,7 +413,7 @@ func (r *Runtime) runGarbageCollector(ctx context.Context) {
 			return
 		case <-r.shutdown:
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			r.collectGarbage()
 		}
 	}
@@ -313,7 +430,7 @@ func (r *Runtime) collectGarbage() {
 		lg.Logf(lg.ErrorLevel, "Error ensuring GaugeVec: %v", err)
 	}
 
-	for _, ft := range r.registeredFunctionTypes {
+	for _, ft := range r.functionTypes() {
 		collected, running := ft.gc(r.config.functionTypeIDLifetimeMs)
 		totalGarbageCollected += collected
 		totalHandlersRunning += running
@@ -346,7 +463,7 @@ func (r *Runtime) reportPerformanceMetrics() {
 // singleInstanceFunctionLocksUpdater periodically updates locks for single-instance functions.
 func (r *Runtime) singleInstanceFunctionLocksUpdater(ctx context.Context, revisions map[string]uint64) {
 	defer r.wg.Done()
-	ticker := time.NewTicker(time.Duration(r.config.kvMutexLifeTimeSec) / 2 * time.Second)
+	ticker := r.clock().NewTicker(time.Duration(r.config.kvMutexLifeTimeSec) / 2 * time.Second)
 	defer ticker.Stop()
 
 	//release all functions
@@ -363,9 +480,9 @@ func (r *Runtime) singleInstanceFunctionLocksUpdater(ctx context.Context, revisi
 			return
 		case <-r.shutdown:
 			return
-		case <-ticker.C:
+		case <-ticker.C():
 			if r.config.activePassiveMode {
-				if r.config.isActiveInstance {
+				if r.isActiveInstance.Load() {
 					newRevID, err := KeyMutexLockUpdate(ctx, r, system.GetHashStr(RuntimeName), r.config.activeRevID)
 					if err != nil {
 						lg.Logf(lg.ErrorLevel, "KeyMutexLockUpdate failed for %s: %v", RuntimeName, err)
@@ -383,7 +500,7 @@ func (r *Runtime) singleInstanceFunctionLocksUpdater(ctx context.Context, revisi
 							return
 						}
 					} else {
-						r.config.isActiveInstance = true
+						r.isActiveInstance.Store(true)
 						r.config.activeRevID = newRevID
 					}
 				}
@@ -0,0 +1,108 @@
+package statefun
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// runtimeHealthChecks keeps names of checks the runtime registered, to unregister them when it stops
+type runtimeHealthChecks struct {
+	mutex     sync.Mutex
+	liveness  []string
+	readiness []string
+}
+
+// healthCheckName namespaces the check with the runtime instance, several runtimes may share the /healthz and
+// /readyz endpoints of the process
+func (r *Runtime) healthCheckName(name string) string {
+	return r.instanceID + "/" + name
+}
+
+// RegisterReadinessCheck plugs an application readiness check into the /readyz endpoint as <instance_id>/<name>
+func (r *Runtime) RegisterReadinessCheck(name string, check system.HealthCheckFunc) {
+	name = r.healthCheckName(name)
+	r.healthChecks.mutex.Lock()
+	r.healthChecks.readiness = append(r.healthChecks.readiness, name)
+	r.healthChecks.mutex.Unlock()
+	system.GlobalPrometrics.RegisterReadinessCheck(name, check)
+}
+
+// RegisterHealthCheck plugs an application liveness check into the /healthz endpoint as <instance_id>/<name>
+func (r *Runtime) RegisterHealthCheck(name string, check system.HealthCheckFunc) {
+	name = r.healthCheckName(name)
+	r.healthChecks.mutex.Lock()
+	r.healthChecks.liveness = append(r.healthChecks.liveness, name)
+	r.healthChecks.mutex.Unlock()
+	system.GlobalPrometrics.RegisterHealthCheck(name, check)
+}
+
+func (r *Runtime) unregisterHealthChecks() {
+	r.healthChecks.mutex.Lock()
+	defer r.healthChecks.mutex.Unlock()
+	for _, name := range r.healthChecks.liveness {
+		system.GlobalPrometrics.UnregisterHealthCheck(name)
+	}
+	for _, name := range r.healthChecks.readiness {
+		system.GlobalPrometrics.UnregisterReadinessCheck(name)
+	}
+	r.healthChecks.liveness = nil
+	r.healthChecks.readiness = nil
+}
+
+// functionTypes returns registered function types, safe to call while function types are registered
+func (r *Runtime) functionTypes() []*FunctionType {
+	r.functionTypesMutex.RLock()
+	defer r.functionTypesMutex.RUnlock()
+	functionTypes := make([]*FunctionType, 0, len(r.registeredFunctionTypes))
+	for _, ft := range r.registeredFunctionTypes {
+		functionTypes = append(functionTypes, ft)
+	}
+	return functionTypes
+}
+
+func (r *Runtime) registerHealthChecks() {
+	r.RegisterReadinessCheck("nats", func() error {
+		if !r.nc.IsConnected() {
+			return fmt.Errorf("nats connection status is %s", r.nc.Status())
+		}
+		return nil
+	})
+	r.RegisterReadinessCheck("domain", func() error {
+		if !r.Domain.routersReady.Load() {
+			return fmt.Errorf("domain streams and routers are not created yet")
+		}
+		return nil
+	})
+	r.RegisterReadinessCheck("cache", func() error {
+		if r.Domain.Cache() == nil {
+			return fmt.Errorf("cache initial sync with kv is not finished yet")
+		}
+		return nil
+	})
+	r.RegisterReadinessCheck("active_instance", func() error {
+		if r.config.activePassiveMode && !r.isActiveInstance.Load() && !r.config.passiveInstanceIsReady {
+			return fmt.Errorf("instance is passive")
+		}
+		return nil
+	})
+
+	r.RegisterHealthCheck("worker_pools", func() error {
+		stuckTimeout := time.Duration(r.config.workerPoolStuckTimeoutSec) * time.Second
+		stuck := []string{}
+		for _, ft := range r.functionTypes() {
+			if ft.sfWorkerPool.IsStuck(stuckTimeout) {
+				stuck = append(stuck, ft.name)
+			}
+		}
+		if len(stuck) > 0 {
+			sort.Strings(stuck)
+			return fmt.Errorf("worker pools are deadlocked: %s", strings.Join(stuck, ", "))
+		}
+		return nil
+	})
+}
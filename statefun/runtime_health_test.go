@@ -0,0 +1,107 @@
+package statefun
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// newHealthTestRuntime returns a runtime which is not started, only the parts health checks look at are set
+func newHealthTestRuntime(t *testing.T, nc *nats.Conn, instanceID string) *Runtime {
+	r := &Runtime{
+		config:                  *NewRuntimeConfigSimple("", "test_app").SetActivePassiveMode(true),
+		nc:                      nc,
+		Domain:                  &Domain{name: DefaultHubDomainName},
+		registeredFunctionTypes: map[string]*FunctionType{},
+		instanceID:              instanceID,
+	}
+	r.registerHealthChecks()
+	t.Cleanup(r.unregisterHealthChecks)
+	return r
+}
+
+func readinessStatuses() map[string]string {
+	_, statuses := system.GlobalPrometrics.ReadinessChecks().Run()
+	return statuses
+}
+
+func TestHealthChecksPerRuntime(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	r1 := newHealthTestRuntime(t, nc, "r1")
+	r2 := newHealthTestRuntime(t, nc, "r2")
+
+	statuses := readinessStatuses()
+	for _, name := range []string{"r1/domain", "r1/cache", "r1/active_instance", "r2/domain", "r2/cache", "r2/active_instance"} {
+		require.NotEqual(t, "ok", statuses[name], name)
+	}
+	require.Equal(t, "ok", statuses["r1/nats"])
+
+	// Readiness of one runtime does not hide or replace the other one's
+	r1.Domain.routersReady.Store(true)
+	r1.Domain.cache.Store(&cache.Store{})
+	r1.isActiveInstance.Store(true)
+	statuses = readinessStatuses()
+	for _, name := range []string{"r1/domain", "r1/cache", "r1/active_instance"} {
+		require.Equal(t, "ok", statuses[name], name)
+	}
+	require.NotEqual(t, "ok", statuses["r2/domain"])
+
+	r2.unregisterHealthChecks()
+	statuses = readinessStatuses()
+	require.NotContains(t, statuses, "r2/domain")
+	require.Contains(t, statuses, "r1/domain")
+}
+
+func TestHealthChecksRunWhileRuntimeChanges(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+
+	r := newHealthTestRuntime(t, nc, "r")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			r.isActiveInstance.Store(i%2 == 0)
+			NewFunctionType(r, fmt.Sprintf("functions.test.health%d", i), func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {}, *NewFunctionTypeConfig())
+		}
+		r.Domain.cache.Store(&cache.Store{})
+	}()
+	for i := 0; i < 100; i++ {
+		system.GlobalPrometrics.ReadinessChecks().Run()
+		system.GlobalPrometrics.HealthChecks().Run()
+		r.FunctionTypeConfig(fmt.Sprintf("functions.test.health%d", i))
+	}
+	wg.Wait()
+
+	require.Len(t, r.RegisteredFunctionTypes(), 100)
+	_, statuses := system.GlobalPrometrics.HealthChecks().Run()
+	require.Equal(t, "ok", statuses["r/worker_pools"])
+}
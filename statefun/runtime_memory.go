@@ -0,0 +1,268 @@
+package statefun
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/nats-io/nats.go"
+
+	"github.com/foliagecp/sdk/embedded/nats/kv"
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+In-memory runtime (NewInMemoryRuntime) runs function types without NATS, it is meant for unit tests of handlers:
+
+  - the cache is kept in kv.MemoryKeyValue, so contexts, locks and history work as with a JetStream bucket;
+  - signals of any provider are queued and handled one by one in the order they were sent, signals sent by a handler
+    are handled after it returns, Runtime.Signal returns when the queue is empty;
+  - requests of any provider are handled synchronously by the calling goroutine;
+  - egress messages of any provider are recorded and returned by TakeEgress;
+  - only this domain exists, calls to other domains and to shadow objects fail.
+
+Provider permissions of function types are not checked, caller ACLs are. Message handling is deterministic
+as long as the runtime is driven from a single goroutine.
+*/
+
+// EgressMessage is an egress call recorded by the in-memory runtime
+type EgressMessage struct {
+	Provider sfPlugins.EgressProvider
+	Typename string
+	ID       string
+	Payload  *easyjson.JSON
+}
+
+type memoryTransport struct {
+	mutex    sync.Mutex
+	signals  []func()
+	draining bool
+	egress   []EgressMessage
+}
+
+// NewInMemoryRuntime creates a runtime with in-memory transport and KV, NATS settings of the config are ignored
+func NewInMemoryRuntime(config RuntimeConfig) (*Runtime, error) {
+	r := &Runtime{
+		config:                  config,
+		registeredFunctionTypes: make(map[string]*FunctionType),
+		instanceID:              config.name + "-" + system.GetUniqueStrID(),
+		shutdown:                make(chan struct{}),
+		memory:                  &memoryTransport{},
+		chaos:                   newChaos(config.chaos),
+	}
+
+	if err := validateTenant(config.tenant); err != nil {
+		return nil, err
+	}
+	r.initTenantQuota()
+	if config.recorder != nil {
+		recorder, err := newRecorder(config.recorder)
+		if err != nil {
+			return nil, err
+		}
+		r.recorder = recorder
+	}
+
+	hubDomainName := config.desiredHUBDomainName
+	if hubDomainName == "" {
+		hubDomainName = DefaultHubDomainName
+	}
+	hubJSDomainName := hubDomainName
+	hubDomainName = tenantName(config.tenant, hubDomainName)
+	r.Domain = &Domain{
+		tenant:             config.tenant,
+		hubDomainName:      hubDomainName,
+		hubJSDomainName:    hubJSDomainName,
+		name:               hubDomainName,
+		weakClusterDomains: map[string]struct{}{hubDomainName: {}},
+		kvSC: streamConfig{
+			maxAge:  config.kvStreamMaxAge,
+			history: config.kvHistory,
+		},
+	}
+	r.config.desiredHUBDomainName = r.Domain.hubDomainName
+
+	return r, nil
+}
+
+// InMemory tells whether the runtime was created by NewInMemoryRuntime
+func (r *Runtime) InMemory() bool {
+	return r.memory != nil
+}
+
+func (r *Runtime) startInMemory(ctx context.Context, cacheConfig *cache.Config) error {
+	if cacheConfig.GetClock() == nil {
+		cacheConfig.SetClock(r.config.clock)
+	}
+	if r.chaos != nil && cacheConfig.GetKVWriteFault() == nil {
+		cacheConfig.SetKVWriteFault(r.chaos.kvWriteFault)
+	}
+	if len(r.Domain.tenant) > 0 {
+		cacheConfig.SetKVStorePrefix(r.Domain.tenantName(cacheConfig.GetKVStorePrefix()))
+	}
+
+	if err := r.Domain.startInMemory(cacheConfig); err != nil {
+		return err
+	}
+	r.isActiveInstance.Store(true)
+
+	r.runAfterStartFunctions(ctx)
+
+	r.wg.Add(1)
+	go r.runGarbageCollector(ctx)
+
+	if r.config.lockDeadlockDetectionIntervalSec > 0 {
+		r.wg.Add(1)
+		go r.runLockDeadlockDetector(ctx)
+	}
+
+	<-r.shutdown
+	r.wg.Wait()
+	return nil
+}
+
+func (dm *Domain) startInMemory(cacheConfig *cache.Config) error {
+	memoryKV, err := kv.NewMemoryKeyValue(&nats.KeyValueConfig{
+		Bucket:  fmt.Sprintf("%s_%s_cache_bucket", dm.name, cacheConfig.GetId()),
+		TTL:     dm.kvSC.maxAge,
+		History: dm.kvSC.history,
+	})
+	if err != nil {
+		return err
+	}
+	dm.kv = memoryKV
+	dm.routersReady.Store(true)
+	dm.cache.Store(cache.NewCacheStore(context.Background(), cacheConfig, nil, dm.kv))
+	return nil
+}
+
+// memoryTarget returns the function type handling the call in the in-memory runtime
+func (r *Runtime) memoryTarget(targetTypename string, targetID string, options *easyjson.JSON) (*FunctionType, error) {
+	shadowObjectCanBeReceiver := false
+	if options != nil {
+		shadowObjectCanBeReceiver = options.GetByPath(ShadowObjectCallParamOptionPath).AsBoolDefault(false)
+	}
+	if !shadowObjectCanBeReceiver && r.Domain.IsShadowObject(targetID) {
+		return nil, fmt.Errorf("in-memory runtime cannot call shadow object %s", targetID)
+	}
+	if targetDomain := r.Domain.GetDomainFromObjectID(targetID); targetDomain != r.Domain.name {
+		return nil, fmt.Errorf("in-memory runtime cannot call %s in domain %s", targetID, targetDomain)
+	}
+	ft, ok := r.functionType(targetTypename)
+	if !ok {
+		return nil, fmt.Errorf("function type %s is not registered", targetTypename)
+	}
+	return ft, nil
+}
+
+func (r *Runtime) memorySignal(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON) error {
+	targetFT, err := r.memoryTarget(targetTypename, targetID, options)
+	if err != nil {
+		return err
+	}
+	if err := targetFT.checkCaller(targetID, r.localCallerInfo(callerTypename, callerID), "golang_signal"); err != nil {
+		return err
+	}
+
+	// Do not send original data, the sender may change it before the signal is handled
+	functionMsg := FunctionTypeMsg{
+		Caller: &sfPlugins.StatefunAddress{Typename: callerTypename, ID: callerID},
+	}
+	if payload != nil {
+		functionMsg.Payload = payload.Clone().GetPtr()
+	}
+	if options != nil {
+		functionMsg.Options = options.Clone().GetPtr()
+	}
+
+	r.memory.mutex.Lock()
+	r.memory.signals = append(r.memory.signals, func() {
+		targetFT.workerTaskExecutor(targetID, functionMsg)
+	})
+	r.memory.mutex.Unlock()
+	r.memory.run(func() {})
+	return nil
+}
+
+func (r *Runtime) memoryRequest(callerTypename string, callerID string, targetTypename string, targetID string, payload *easyjson.JSON, options *easyjson.JSON, timeout time.Duration) (reply *easyjson.JSON, err error) {
+	targetFT, err := r.memoryTarget(targetTypename, targetID, options)
+	if err != nil {
+		return nil, err
+	}
+	r.memory.run(func() {
+		reply, err = r.localRequest(targetFT, callerTypename, callerID, targetID, payload, options, timeout)
+	})
+	return
+}
+
+// run calls f, signals sent meanwhile are handled after it by the outermost run
+func (mt *memoryTransport) run(f func()) {
+	mt.mutex.Lock()
+	outermost := !mt.draining
+	mt.draining = true
+	mt.mutex.Unlock()
+
+	f()
+	if !outermost {
+		return
+	}
+
+	for {
+		mt.mutex.Lock()
+		if len(mt.signals) == 0 {
+			mt.draining = false
+			mt.mutex.Unlock()
+			return
+		}
+		handle := mt.signals[0]
+		mt.signals = mt.signals[1:]
+		mt.mutex.Unlock()
+
+		handle()
+	}
+}
+
+func (mt *memoryTransport) recordEgress(egressProvider sfPlugins.EgressProvider, callerTypename string, callerID string, payload *easyjson.JSON) error {
+	msg := EgressMessage{Provider: egressProvider, Typename: callerTypename, ID: callerID}
+	if payload != nil {
+		msg.Payload = payload.Clone().GetPtr()
+	}
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+	mt.egress = append(mt.egress, msg)
+	return nil
+}
+
+// TakeEgress returns egress messages recorded by the in-memory runtime since the previous call
+func (r *Runtime) TakeEgress() []EgressMessage {
+	if r.memory == nil {
+		return nil
+	}
+	r.memory.mutex.Lock()
+	defer r.memory.mutex.Unlock()
+	egress := r.memory.egress
+	r.memory.egress = nil
+	return egress
+}
+
+// FunctionContext returns the function context of the typename instance with the id, empty object if it is not set
+func (r *Runtime) FunctionContext(typename string, id string) (*easyjson.JSON, error) {
+	ft, ok := r.functionType(typename)
+	if !ok {
+		return nil, fmt.Errorf("function type %s is not registered", typename)
+	}
+	return ft.loadContext(FunctionState, ft.name+"."+r.Domain.CreateObjectIDWithThisDomain(id, false)), nil
+}
+
+// ObjectContext returns the object context of the id, empty object if it is not set
+func (r *Runtime) ObjectContext(id string) *easyjson.JSON {
+	if j, err := r.Domain.Cache().GetValueAsJSON(r.Domain.CreateObjectIDWithThisDomain(id, false)); err == nil {
+		return j
+	}
+	j := easyjson.NewJSONObject()
+	return &j
+}
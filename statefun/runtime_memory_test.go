@@ -0,0 +1,98 @@
+package statefun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/statefun/cache"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// startInMemoryTestRuntime starts an in-memory runtime with function types registered by register, the returned
+// function stops it
+func startInMemoryTestRuntime(t *testing.T, config *RuntimeConfig, register func(r *Runtime)) (*Runtime, func()) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+
+	r, err := NewInMemoryRuntime(*config)
+	require.NoError(t, err)
+	if register != nil {
+		register(r)
+	}
+
+	started := make(chan struct{})
+	r.RegisterOnAfterStartFunction(func(ctx context.Context, runtime *Runtime) error {
+		close(started)
+		return nil
+	}, false)
+	stopped := make(chan error, 1)
+	go func() { stopped <- r.Start(context.Background(), cache.NewCacheConfig("test_cache")) }()
+	<-started
+	return r, func() {
+		r.Shutdown()
+		require.NoError(t, <-stopped)
+	}
+}
+
+// registerCounterFunctions registers functions.test.counter, which adds step to its count, signals
+// functions.test.log twice, sends its context to egress and replies with it, and functions.test.log, which appends
+// the step of the payload to the log of the object context
+func registerCounterFunctions(t *testing.T, r *Runtime, step float64) {
+	NewFunctionType(r, "functions.test.counter", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		funcCtx := ctx.GetFunctionContext()
+		count := funcCtx.GetByPath("count").AsNumericDefault(0) + step
+		funcCtx.SetByPath("count", easyjson.NewJSON(count))
+		ctx.SetFunctionContext(funcCtx)
+
+		for _, step := range []string{"first", "second"} {
+			payload := easyjson.NewJSONObjectWithKeyValue("step", easyjson.NewJSON(step))
+			assert.NoError(t, ctx.Signal(sfPlugins.JetstreamGlobalSignal, "functions.test.log", ctx.Self.ID, &payload, nil))
+		}
+		assert.NoError(t, ctx.Egress(sfPlugins.NatsCoreEgress, funcCtx))
+		if ctx.Reply != nil {
+			ctx.Reply.With(funcCtx)
+		}
+	}, *NewFunctionTypeConfig())
+
+	NewFunctionType(r, "functions.test.log", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		objCtx := ctx.GetObjectContext()
+		objCtx.SetByPath("log", easyjson.NewJSON(objCtx.GetByPath("log").AsStringDefault("")+ctx.Payload.GetByPath("step").AsStringDefault("")+";"))
+		ctx.SetObjectContext(objCtx)
+	}, *NewFunctionTypeConfig().SetAllowedCallerTypenames("functions.test.counter"))
+}
+
+func TestInMemoryRuntime(t *testing.T) {
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app"), func(r *Runtime) {
+		registerCounterFunctions(t, r, 1)
+	})
+	defer stop()
+
+	// Signals sent by the handler are handled before Signal returns, in order
+	require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.counter", "a", nil, nil))
+	require.Equal(t, "first;second;", r.ObjectContext("a").GetByPath("log").AsStringDefault(""))
+
+	reply, err := r.Request(sfPlugins.NatsCoreGlobalRequest, "functions.test.counter", "a", nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2.0, reply.GetByPath("count").AsNumericDefault(0))
+	require.Equal(t, "first;second;first;second;", r.ObjectContext("a").GetByPath("log").AsStringDefault(""))
+
+	funcCtx, err := r.FunctionContext("functions.test.counter", "a")
+	require.NoError(t, err)
+	require.Equal(t, 2.0, funcCtx.GetByPath("count").AsNumericDefault(0))
+
+	egress := r.TakeEgress()
+	require.Len(t, egress, 2)
+	require.Equal(t, "functions.test.counter", egress[0].Typename)
+	require.Equal(t, 1.0, egress[0].Payload.GetByPath("count").AsNumericDefault(0))
+	require.Empty(t, r.TakeEgress())
+
+	require.Error(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.unknown", "a", nil, nil))
+	require.Error(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.counter", "edge/a", nil, nil))
+	require.Error(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.log", "a", nil, nil), "caller ACL is checked")
+}
@@ -0,0 +1,35 @@
+package system
+
+import "time"
+
+/*
+Clock is the time source of runtime and cache logic that depends on time: context expiration, function type GC,
+mutex and lease lifetimes, request and ack timeouts, cache value timestamps.
+RealClock is used unless a runtime or a cache is configured with another clock, e.g. a virtual clock of statefun/test.
+Throttling and polling delays always use real time.
+*/
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.ticker.C }
+func (t realTicker) Stop()               { t.ticker.Stop() }
@@ -0,0 +1,94 @@
+package system
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	HealthzPattern = "/healthz"
+	ReadyzPattern  = "/readyz"
+)
+
+// HealthCheckFunc returns nil when the checked subsystem is fine, otherwise an error describing the problem
+type HealthCheckFunc func() error
+
+type HealthChecks struct {
+	mutex  sync.Mutex
+	checks map[string]HealthCheckFunc
+}
+
+func NewHealthChecks() *HealthChecks {
+	return &HealthChecks{checks: map[string]HealthCheckFunc{}}
+}
+
+// Register adds a named check, a check with the same name is replaced
+func (hc *HealthChecks) Register(name string, check HealthCheckFunc) {
+	if hc == nil || check == nil {
+		return
+	}
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	hc.checks[name] = check
+}
+
+func (hc *HealthChecks) Unregister(name string) {
+	if hc == nil {
+		return
+	}
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	delete(hc.checks, name)
+}
+
+// Run executes all registered checks and returns overall result with per check statuses
+func (hc *HealthChecks) Run() (ok bool, statuses map[string]string) {
+	ok = true
+	statuses = map[string]string{}
+	if hc == nil {
+		return
+	}
+
+	hc.mutex.Lock()
+	names := make([]string, 0, len(hc.checks))
+	checks := make([]HealthCheckFunc, 0, len(hc.checks))
+	for name := range hc.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		checks = append(checks, hc.checks[name])
+	}
+	hc.mutex.Unlock()
+
+	for i, check := range checks {
+		if err := check(); err != nil {
+			ok = false
+			statuses[names[i]] = err.Error()
+		} else {
+			statuses[names[i]] = "ok"
+		}
+	}
+	return
+}
+
+// ServeHTTP replies with 200 when all checks passed and with 503 otherwise
+func (hc *HealthChecks) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	ok, statuses := hc.Run()
+
+	status := "ok"
+	code := http.StatusOK
+	if !ok {
+		status = "failed"
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	MsgOnErrorReturn(json.NewEncoder(w).Encode(map[string]any{
+		"status": status,
+		"checks": statuses,
+	}))
+}
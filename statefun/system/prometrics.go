@@ -24,6 +24,8 @@ type Prometrics struct {
 	metricsMutex    *sync.Mutex
 	metrics         map[string]any
 	routinesCounter *RoutinesCounter
+	livenessChecks  *HealthChecks
+	readinessChecks *HealthChecks
 	cancelFunc      context.CancelFunc
 }
 
@@ -33,6 +35,8 @@ func NewPrometrics(pattern string, addr string) *Prometrics {
 		metricsMutex:    &sync.Mutex{},
 		metrics:         map[string]any{},
 		routinesCounter: &RoutinesCounter{},
+		livenessChecks:  NewHealthChecks(),
+		readinessChecks: NewHealthChecks(),
 		cancelFunc:      cancel,
 	}
 
@@ -47,6 +51,8 @@ func NewPrometrics(pattern string, addr string) *Prometrics {
 
 		mux := http.NewServeMux()
 		mux.Handle(pattern, promhttp.Handler())
+		mux.Handle(HealthzPattern, pm.livenessChecks)
+		mux.Handle(ReadyzPattern, pm.readinessChecks)
 		server := &http.Server{
 			Addr:    addr,
 			Handler: mux,
@@ -111,6 +117,52 @@ func (pm *Prometrics) GetRoutinesCounter() *RoutinesCounter {
 	return pm.routinesCounter
 }
 
+// RegisterHealthCheck adds a check served by the /healthz endpoint
+func (pm *Prometrics) RegisterHealthCheck(name string, check HealthCheckFunc) {
+	if pm == nil {
+		return
+	}
+	pm.livenessChecks.Register(name, check)
+}
+
+// RegisterReadinessCheck adds a check served by the /readyz endpoint
+func (pm *Prometrics) RegisterReadinessCheck(name string, check HealthCheckFunc) {
+	if pm == nil {
+		return
+	}
+	pm.readinessChecks.Register(name, check)
+}
+
+func (pm *Prometrics) UnregisterHealthCheck(name string) {
+	if pm == nil {
+		return
+	}
+	pm.livenessChecks.Unregister(name)
+}
+
+func (pm *Prometrics) UnregisterReadinessCheck(name string) {
+	if pm == nil {
+		return
+	}
+	pm.readinessChecks.Unregister(name)
+}
+
+// HealthChecks returns checks served by the /healthz endpoint
+func (pm *Prometrics) HealthChecks() *HealthChecks {
+	if pm == nil {
+		return nil
+	}
+	return pm.livenessChecks
+}
+
+// ReadinessChecks returns checks served by the /readyz endpoint
+func (pm *Prometrics) ReadinessChecks() *HealthChecks {
+	if pm == nil {
+		return nil
+	}
+	return pm.readinessChecks
+}
+
 func (pm *Prometrics) Exists(id string) bool {
 	if pm == nil {
 		return false
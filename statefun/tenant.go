@@ -0,0 +1,211 @@
+package statefun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+
+	lg "github.com/foliagecp/sdk/statefun/logger"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+/*
+A tenant namespaces everything a runtime creates on a shared NATS cluster:
+
+	domain names:     <tenant>-<domain> // So subjects, KV buckets and object (graph vertex) ids: <tenant>-hub/<id>,
+	                                    // JetStream domains (API prefixes $JS.<domain>.API) stay as they are
+	stream names:     <tenant>-<stream> // Except the hub stream (hub_events), see below
+	cache KV keys:    <tenant>-<kv_store_prefix>.<key>
+	core egress:      <tenant>.egress.<typename>.<id>
+
+The hub stream captures signal.> of every domain in the JetStream domain of the hub, so it is shared by all tenants and
+cannot be namespaced: NATS subject wildcards cannot match a prefix of the domain token. Hub runtimes attribute its
+usage to their tenant by the per-subject state of the stream: messages to domains of the tenant multiplied by the
+average message size of the stream.
+
+Runtime.signal and Runtime.request refuse targets in domains of other tenants (or without a tenant). Tenants must
+still be restricted with NATS permissions against clients which publish into their subjects directly. Quotas do not
+apply to calls made by the runtime itself (context expire signals of GC), so GC keeps freeing the storage.
+*/
+
+const (
+	TenantSeparator                 = "-"
+	TenantStorageCheckIntervalSec   = 10
+	tenantEgressSubjectsPrefixTmpl  = "%s.egress"
+	defaultEgressSubjectsPrefixTmpl = "egress"
+)
+
+var (
+	ErrTenantIsolation     = errors.New("target belongs to another tenant")
+	ErrTenantQuotaExceeded = errors.New("tenant quota exceeded")
+
+	tenantNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+)
+
+type TenantQuota struct {
+	maxMessagesPerSec int
+	maxStorageBytes   int64
+}
+
+// NewTenantQuota returns a quota without limits
+func NewTenantQuota() *TenantQuota {
+	return &TenantQuota{}
+}
+
+// SetMaxMessagesPerSec limits signals and requests sent by the runtime, 0 - unlimited
+func (tq *TenantQuota) SetMaxMessagesPerSec(maxMessagesPerSec int) *TenantQuota {
+	tq.maxMessagesPerSec = maxMessagesPerSec
+	return tq
+}
+
+// SetMaxStorageBytes limits bytes stored in all tenant's streams and KV buckets, 0 - unlimited. When the limit is
+// reached the runtime refuses to send signals and requests until the storage is freed.
+func (tq *TenantQuota) SetMaxStorageBytes(maxStorageBytes int64) *TenantQuota {
+	tq.maxStorageBytes = maxStorageBytes
+	return tq
+}
+
+func validateTenant(tenant string) error {
+	if len(tenant) > 0 && !tenantNameRegexp.MatchString(tenant) {
+		return fmt.Errorf("invalid tenant name %q: only letters, digits and _ are allowed", tenant)
+	}
+	return nil
+}
+
+// Tenant returns the tenant of the domain, empty when tenants are not used
+func (dm *Domain) Tenant() string {
+	return dm.tenant
+}
+
+// tenantName namespaces a domain or stream name with the tenant
+func tenantName(tenant string, name string) string {
+	if len(tenant) == 0 || strings.HasPrefix(name, tenant+TenantSeparator) {
+		return name
+	}
+	return tenant + TenantSeparator + name
+}
+
+func (dm *Domain) tenantName(name string) string {
+	return tenantName(dm.tenant, name)
+}
+
+func (dm *Domain) streamName(name string) string {
+	return dm.tenantName(name)
+}
+
+// BelongsToTenant tells if the domain may be communicated with from this domain
+func (dm *Domain) BelongsToTenant(domain string) bool {
+	return len(dm.tenant) == 0 || strings.HasPrefix(domain, dm.tenant+TenantSeparator)
+}
+
+func (dm *Domain) egressSubjectsPrefix() string {
+	if len(dm.tenant) == 0 {
+		return defaultEgressSubjectsPrefixTmpl
+	}
+	return fmt.Sprintf(tenantEgressSubjectsPrefixTmpl, dm.tenant)
+}
+
+// checkTenantCall returns an error if a signal or request to the target must not be sent
+func (r *Runtime) checkTenantCall(callerTypename string, targetID string) error {
+	if len(r.Domain.tenant) > 0 {
+		if targetDomain := r.Domain.GetDomainFromObjectID(targetID); !r.Domain.BelongsToTenant(targetDomain) {
+			return fmt.Errorf("%w: domain %s is outside of tenant %s", ErrTenantIsolation, targetDomain, r.Domain.tenant)
+		}
+		if shadowDomain, _, err := r.Domain.GetShadowObjectDomainAndID(targetID); err == nil && !r.Domain.BelongsToTenant(shadowDomain) {
+			return fmt.Errorf("%w: domain %s is outside of tenant %s", ErrTenantIsolation, shadowDomain, r.Domain.tenant)
+		}
+	}
+	if isInternalCaller(callerTypename) {
+		return nil
+	}
+	if r.tenantStorageExceeded.Load() {
+		return fmt.Errorf("%w: storage", ErrTenantQuotaExceeded)
+	}
+	if r.tenantMessagesLimiter != nil && !r.tenantMessagesLimiter.Allow() {
+		return fmt.Errorf("%w: messages per second", ErrTenantQuotaExceeded)
+	}
+	return nil
+}
+
+func (r *Runtime) initTenantQuota() {
+	if r.config.tenantQuota != nil && r.config.tenantQuota.maxMessagesPerSec > 0 {
+		r.tenantMessagesLimiter = rate.NewLimiter(rate.Limit(r.config.tenantQuota.maxMessagesPerSec), r.config.tenantQuota.maxMessagesPerSec)
+	}
+}
+
+// tenantStorageBytes sums bytes of all streams and KV buckets of the tenant and its share of the hub stream
+func (r *Runtime) tenantStorageBytes(ctx context.Context) uint64 {
+	var bytes uint64
+	for info := range r.js.StreamsInfo(nats.Context(ctx)) {
+		name := strings.TrimPrefix(info.Config.Name, "KV_")
+		if strings.HasPrefix(name, r.Domain.tenant+TenantSeparator) {
+			bytes += info.State.Bytes
+		}
+	}
+	if r.Domain.hubDomainName == r.Domain.name {
+		bytes += r.tenantHubStreamBytes(ctx)
+	}
+	return bytes
+}
+
+// tenantHubStreamBytes estimates bytes of the shared hub stream taken by signals to domains of the tenant
+func (r *Runtime) tenantHubStreamBytes(ctx context.Context) uint64 {
+	info, err := r.js.StreamInfo(hubEventStreamName, nats.Context(ctx), &nats.StreamInfoRequest{SubjectsFilter: SignalPrefix + ".>"})
+	if err != nil || info.State.Msgs == 0 {
+		return 0
+	}
+	var msgs uint64
+	for subject, count := range info.State.Subjects {
+		tokens := strings.SplitN(subject, ".", 3) // signal.<domain>.<typename>.<id>
+		if len(tokens) > 1 && strings.HasPrefix(tokens[1], r.Domain.tenant+TenantSeparator) {
+			msgs += count
+		}
+	}
+	return msgs * (info.State.Bytes / info.State.Msgs)
+}
+
+func (r *Runtime) runTenantStorageWatcher(ctx context.Context) {
+	defer r.wg.Done()
+	system.GlobalPrometrics.GetRoutinesCounter().Started("tenant_storage_watcher")
+	defer system.GlobalPrometrics.GetRoutinesCounter().Stopped("tenant_storage_watcher")
+
+	gaugeVec, err := system.GlobalPrometrics.EnsureGaugeVecSimple("tenant_storage_bytes", "Bytes stored in streams and KV buckets of the tenant", []string{"tenant"})
+	if err != nil {
+		lg.Logf(lg.ErrorLevel, "Error ensuring GaugeVec: %v", err)
+	}
+
+	ticker := r.clock().NewTicker(TenantStorageCheckIntervalSec * time.Second)
+	defer ticker.Stop()
+
+	for {
+		checkCtx, cancel := context.WithTimeout(ctx, TenantStorageCheckIntervalSec*time.Second)
+		bytes := r.tenantStorageBytes(checkCtx)
+		cancel()
+		if gaugeVec != nil {
+			gaugeVec.With(prometheus.Labels{"tenant": r.Domain.tenant}).Set(float64(bytes))
+		}
+		exceeded := bytes >= uint64(r.config.tenantQuota.maxStorageBytes)
+		if r.tenantStorageExceeded.Swap(exceeded) != exceeded {
+			if exceeded {
+				lg.Logf(lg.WarnLevel, "Tenant %s storage quota is exceeded: %d >= %d bytes", r.Domain.tenant, bytes, r.config.tenantQuota.maxStorageBytes)
+			} else {
+				lg.Logf(lg.InfoLevel, "Tenant %s storage is back within quota: %d bytes", r.Domain.tenant, bytes)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.shutdown:
+			return
+		case <-ticker.C():
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package statefun
+
+import (
+	"context"
+	"testing"
+
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+)
+
+func registerNoopFunction(r *Runtime) {
+	NewFunctionType(r, "functions.test.noop", func(_ sfPlugins.StatefunExecutor, _ *sfPlugins.StatefunContextProcessor) {}, *NewFunctionTypeConfig())
+}
+
+func TestTenantIsolation(t *testing.T) {
+	r, stop := startInMemoryTestRuntime(t, NewRuntimeConfigSimple("", "test_app").SetTenant("t1"), registerNoopFunction)
+	defer stop()
+
+	require.Equal(t, "t1-hub", r.Domain.Name())
+	require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.noop", "a", nil, nil))
+
+	for _, id := range []string{"t2-hub/a", "hub/a", "t1-hub/t2-hub#a"} {
+		require.ErrorIs(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.noop", id, nil, nil), ErrTenantIsolation, id)
+		_, err := r.Request(sfPlugins.AutoRequestSelect, "functions.test.noop", id, nil, nil)
+		require.ErrorIs(t, err, ErrTenantIsolation, id)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	config := NewRuntimeConfigSimple("", "test_app").SetTenant("t1").SetTenantQuota(NewTenantQuota().SetMaxMessagesPerSec(1))
+	r, stop := startInMemoryTestRuntime(t, config, registerNoopFunction)
+	defer stop()
+
+	require.NoError(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.noop", "a", nil, nil))
+	require.ErrorIs(t, r.Signal(sfPlugins.AutoSignalSelect, "functions.test.noop", "a", nil, nil), ErrTenantQuotaExceeded)
+	require.NoError(t, r.checkTenantCall(ContextExpiryCallerTypename, "t1-hub/a"), "GC is not limited")
+
+	r.tenantStorageExceeded.Store(true)
+	require.ErrorIs(t, r.checkTenantCall("functions.test.noop", "t1-hub/a"), ErrTenantQuotaExceeded)
+	require.NoError(t, r.checkTenantCall(ContextExpiryCallerTypename, "t1-hub/a"), "GC frees the storage")
+	require.ErrorIs(t, r.checkTenantCall(ContextExpiryCallerTypename, "t2-hub/a"), ErrTenantIsolation)
+}
+
+func TestTenantKeepsJetStreamDomain(t *testing.T) {
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.JetStreamDomain = "leaf"
+	opts.StoreDir = t.TempDir()
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+
+	dm, err := NewDomain(nc, js, "t1", "hub", streamConfig{}, streamConfig{}, streamConfig{})
+	require.NoError(t, err)
+	require.Equal(t, "t1-leaf", dm.Name())
+	require.Equal(t, "t1-hub", dm.HubDomainName())
+	require.Equal(t, "hub", dm.hubJSDomainName, "API prefix $JS.<domain>.API uses the JetStream domain")
+}
+
+func TestTenantHubStreamBytes(t *testing.T) {
+	opts := natsservertest.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+
+	nc, err := nats.Connect(srv.ClientURL())
+	require.NoError(t, err)
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: hubEventStreamName, Subjects: []string{SignalPrefix + ".>"}})
+	require.NoError(t, err)
+	for _, subject := range []string{"signal.t1-hub.functions.test.noop.a", "signal.t1-leaf.functions.test.noop.a", "signal.t2-hub.functions.test.noop.a"} {
+		_, err := js.Publish(subject, []byte(`{"payload":{}}`))
+		require.NoError(t, err)
+	}
+
+	r := &Runtime{js: js, Domain: &Domain{tenant: "t1", name: "t1-hub", hubDomainName: "t1-hub"}}
+	info, err := js.StreamInfo(hubEventStreamName)
+	require.NoError(t, err)
+	require.Equal(t, 2*(info.State.Bytes/3), r.tenantHubStreamBytes(context.Background()))
+	require.Equal(t, r.tenantHubStreamBytes(context.Background()), r.tenantStorageBytes(context.Background()), "hub stream is not prefixed with the tenant")
+}
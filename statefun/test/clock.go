@@ -0,0 +1,118 @@
+package test
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+// VirtualClock is a system.Clock which moves only by Advance. Set it with RuntimeConfig.SetClock to test
+// context expiration, GC, lock lifetimes and timeouts without waiting for them.
+type VirtualClock struct {
+	mutex   sync.Mutex
+	pending *sync.Cond
+	now     time.Time
+	timers  []*virtualTimer
+}
+
+type virtualTimer struct {
+	clock  *VirtualClock
+	at     time.Time
+	period time.Duration // 0 - fires once
+	ch     chan time.Time
+}
+
+func NewVirtualClock(now time.Time) *VirtualClock {
+	c := &VirtualClock{now: now}
+	c.pending = sync.NewCond(&c.mutex)
+	return c
+}
+
+func (c *VirtualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *VirtualClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &virtualTimer{clock: c, at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t.ch
+	}
+	c.addTimer(t)
+	return t.ch
+}
+
+func (c *VirtualClock) NewTicker(d time.Duration) system.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for VirtualClock.NewTicker")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	t := &virtualTimer{clock: c, at: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.addTimer(t)
+	return t
+}
+
+// Advance moves the time forward by d and fires due timers and tickers in the order of their deadlines.
+// Like time.Ticker a ticker drops ticks its receiver is not ready for.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	target := c.now.Add(d)
+	for len(c.timers) > 0 && !c.timers[0].at.After(target) {
+		t := c.timers[0]
+		c.now = t.at
+		select {
+		case t.ch <- t.at:
+		default:
+		}
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+			c.sortTimers()
+		} else {
+			c.timers = c.timers[1:]
+		}
+	}
+	c.now = target
+}
+
+// BlockUntil waits until at least n timers and tickers are pending, e.g. until background loops of a just started
+// runtime created their tickers, so the following Advance fires them
+func (c *VirtualClock) BlockUntil(n int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for len(c.timers) < n {
+		c.pending.Wait()
+	}
+}
+
+func (c *VirtualClock) addTimer(t *virtualTimer) {
+	c.timers = append(c.timers, t)
+	c.sortTimers()
+	c.pending.Broadcast()
+}
+
+func (c *VirtualClock) sortTimers() {
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+}
+
+func (t *virtualTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *virtualTimer) Stop() {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+	for i, timer := range t.clock.timers {
+		if timer == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return
+		}
+	}
+}
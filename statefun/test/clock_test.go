@@ -0,0 +1,72 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/foliagecp/sdk/statefun"
+	sfPlugins "github.com/foliagecp/sdk/statefun/plugins"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+func TestVirtualClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewVirtualClock(start)
+
+	after := c.After(10 * time.Second)
+	ticker := c.NewTicker(3 * time.Second)
+	c.BlockUntil(2)
+
+	c.Advance(9 * time.Second)
+	require.Equal(t, start.Add(9*time.Second), c.Now())
+	require.Len(t, after, 0)
+	require.Equal(t, start.Add(3*time.Second), <-ticker.C(), "ticks the receiver was not ready for are dropped")
+	require.Len(t, ticker.C(), 0)
+
+	c.Advance(time.Second)
+	require.Equal(t, start.Add(10*time.Second), <-after)
+
+	ticker.Stop()
+	c.Advance(time.Minute)
+	require.Len(t, ticker.C(), 0)
+}
+
+type clockSuite struct {
+	StatefunMemoryTestSuite
+}
+
+func (s *clockSuite) TestContextExpiration() {
+	s.RuntimeConfig().SetGCIntervalSec(1)
+	s.RegisterFunction("functions.test.session", func(_ sfPlugins.StatefunExecutor, ctx *sfPlugins.StatefunContextProcessor) {
+		funcCtx := ctx.GetFunctionContext()
+		funcCtx.SetByPath("user", ctx.Payload.GetByPath("user"))
+		ctx.SetFunctionContext(funcCtx)
+		ctx.SetContextExpirationAfter(10 * time.Second)
+	}, *statefun.NewFunctionTypeConfig())
+	s.Require().NoError(s.StartRuntime())
+
+	payload := easyjson.NewJSONObjectWithKeyValue("user", easyjson.NewJSON("alice"))
+	s.Require().NoError(s.Signal("functions.test.session", "s1", &payload, nil))
+
+	sessionUser := func() string {
+		funcCtx, err := s.FunctionContext("functions.test.session", "s1")
+		s.Require().NoError(err)
+		return funcCtx.GetByPath("user").AsStringDefault("")
+	}
+	s.Advance(5 * time.Second)
+	s.Require().Equal("alice", sessionUser())
+
+	s.Advance(6 * time.Second)
+	s.Require().Eventually(func() bool { return sessionUser() == "" }, time.Second, time.Millisecond)
+}
+
+func TestClockSuite(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+	suite.Run(t, new(clockSuite))
+}
@@ -0,0 +1,125 @@
+package test
+
+import (
+	"context"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/plugins"
+)
+
+// statefunMemoryTestEnvironment runs the runtime without NATS and with a virtual clock, see statefun.NewInMemoryRuntime
+type statefunMemoryTestEnvironment struct {
+	runtime    *statefun.Runtime
+	runtimeCfg *statefun.RuntimeConfig
+	cacheCfg   *cache.Config
+	clock      *VirtualClock
+	stopped    chan error
+}
+
+func newStatefunMemoryTestEnvironment() *statefunMemoryTestEnvironment {
+	clock := NewVirtualClock(time.Now())
+	return &statefunMemoryTestEnvironment{
+		runtimeCfg: statefun.NewRuntimeConfigSimple("", defaultRuntimeName).SetClock(clock),
+		cacheCfg:   cache.NewCacheConfig(defaultCacheID),
+		clock:      clock,
+		stopped:    make(chan error, 1),
+	}
+}
+
+// RuntimeConfig can be changed until the runtime is created by the first call of Runtime, RegisterFunction or StartRuntime
+func (env *statefunMemoryTestEnvironment) RuntimeConfig() *statefun.RuntimeConfig {
+	return env.runtimeCfg
+}
+
+// StartRuntime returns when the runtime is ready and its GC waits for the clock, function types must be registered before
+func (env *statefunMemoryTestEnvironment) StartRuntime() error {
+	started := make(chan struct{})
+	env.Runtime().RegisterOnAfterStartFunction(func(ctx context.Context, runtime *statefun.Runtime) error {
+		close(started)
+		return nil
+	}, false)
+
+	go func() {
+		env.stopped <- env.Runtime().Start(context.TODO(), env.cacheCfg)
+	}()
+
+	select {
+	case err := <-env.stopped:
+		return err
+	case <-started:
+	}
+	env.clock.BlockUntil(1)
+	return nil
+}
+
+func (env *statefunMemoryTestEnvironment) Runtime() *statefun.Runtime {
+	if env.runtime == nil {
+		runtime, err := statefun.NewInMemoryRuntime(*env.runtimeCfg)
+		if err != nil {
+			panic(err)
+		}
+		env.runtime = runtime
+	}
+	return env.runtime
+}
+
+func (env *statefunMemoryTestEnvironment) Clock() *VirtualClock {
+	return env.clock
+}
+
+// Advance moves the virtual clock of the runtime forward, see VirtualClock.Advance
+func (env *statefunMemoryTestEnvironment) Advance(d time.Duration) {
+	env.clock.Advance(d)
+}
+
+func (env *statefunMemoryTestEnvironment) RegisterFunction(name string, handler statefun.FunctionLogicHandler, cfg statefun.FunctionTypeConfig) {
+	statefun.NewFunctionType(env.Runtime(), name, handler, cfg)
+}
+
+func (env *statefunMemoryTestEnvironment) Stop() {
+	if env.runtime == nil {
+		return
+	}
+	env.runtime.Shutdown()
+	select {
+	case <-env.stopped:
+	case <-time.After(time.Second):
+	}
+}
+
+// Signal returns when the signal and all signals sent while handling it are handled
+func (env *statefunMemoryTestEnvironment) Signal(typename, id string, payload, options *easyjson.JSON) error {
+	return env.Runtime().Signal(plugins.AutoSignalSelect, typename, id, payload, options)
+}
+
+func (env *statefunMemoryTestEnvironment) Request(typename, id string, payload, options *easyjson.JSON, timeout ...time.Duration) (*easyjson.JSON, error) {
+	return env.Runtime().Request(plugins.AutoRequestSelect, typename, id, payload, options, timeout...)
+}
+
+func (env *statefunMemoryTestEnvironment) TakeEgress() []statefun.EgressMessage {
+	return env.Runtime().TakeEgress()
+}
+
+func (env *statefunMemoryTestEnvironment) FunctionContext(typename, id string) (*easyjson.JSON, error) {
+	return env.Runtime().FunctionContext(typename, id)
+}
+
+func (env *statefunMemoryTestEnvironment) ObjectContext(id string) *easyjson.JSON {
+	return env.Runtime().ObjectContext(id)
+}
+
+// Replay feeds a file written by the recorder (statefun.RecorderConfig) into the runtime, recorded intervals
+// advance the virtual clock instead of sleeping
+func (env *statefunMemoryTestEnvironment) Replay(path string, cfg *statefun.ReplayConfig) (statefun.ReplayReport, error) {
+	records, err := statefun.ReadRecording(path)
+	if err != nil {
+		return statefun.ReplayReport{}, err
+	}
+	if cfg == nil {
+		cfg = statefun.NewReplayConfig()
+	}
+	return env.Runtime().Replay(records, cfg.SetWait(env.clock.Advance)), nil
+}
@@ -14,3 +14,17 @@ func (s *StatefunTestSuite) SetupTest() {
 func (s *StatefunTestSuite) AfterTest(suiteName, testName string) {
 	s.Stop()
 }
+
+// StatefunMemoryTestSuite runs every test against a fresh in-memory runtime without NATS
+type StatefunMemoryTestSuite struct {
+	suite.Suite
+	*statefunMemoryTestEnvironment
+}
+
+func (s *StatefunMemoryTestSuite) SetupTest() {
+	s.statefunMemoryTestEnvironment = newStatefunMemoryTestEnvironment()
+}
+
+func (s *StatefunMemoryTestSuite) AfterTest(suiteName, testName string) {
+	s.Stop()
+}
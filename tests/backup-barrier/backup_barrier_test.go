@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/foliagecp/easyjson"
+	natsservertest "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/foliagecp/sdk/clients/go/db"
+	"github.com/foliagecp/sdk/statefun"
+	"github.com/foliagecp/sdk/statefun/cache"
+	"github.com/foliagecp/sdk/statefun/system"
+)
+
+const backupTestObjects = 50
+
+var testObjectKeyRegexp = regexp.MustCompile(`^store\.hub/test_[0-9]+$`)
+
+// TestBackupRoundTrip backs up a bucket shared by two runtimes, deletes the objects and restores them
+func TestBackupRoundTrip(t *testing.T) {
+	if system.GlobalPrometrics == nil {
+		system.GlobalPrometrics = system.NewPrometrics("", ":0")
+	}
+
+	opts := natsservertest.DefaultTestOptions
+	opts.JetStream = true
+	opts.JetStreamDomain = "hub"
+	opts.Port = -1
+	opts.StoreDir = t.TempDir()
+	srv := natsservertest.RunServer(&opts)
+	defer srv.Shutdown()
+	NatsURL = srv.ClientURL()
+
+	runtimes := []*statefun.Runtime{}
+	for i := 0; i < 2; i++ {
+		runtime, err := statefun.NewRuntime(*statefun.NewRuntimeConfigSimple(NatsURL, "backup_barrier").UseJSDomainAsHubDomainName())
+		require.NoError(t, err)
+		RegisterFunctionTypes(runtime)
+		started := make(chan struct{})
+		runtime.RegisterOnAfterStartFunction(func(ctx context.Context, runtime *statefun.Runtime) error {
+			close(started)
+			return nil
+		}, true)
+		go func() {
+			system.MsgOnErrorReturn(runtime.Start(context.Background(), cache.NewCacheConfig("main_cache")))
+		}()
+		select {
+		case <-started:
+		case <-time.After(30 * time.Second):
+			t.Fatal("runtime did not start")
+		}
+		defer runtime.Shutdown()
+		runtimes = append(runtimes, runtime)
+	}
+
+	require.NoError(t, initKVConnection())
+	dbc, err := db.NewDBSyncClientFromRequestFunction(runtimes[0].Request)
+	require.NoError(t, err)
+	dbClient = dbc
+
+	body := easyjson.NewJSONObject()
+	require.NoError(t, dbClient.CMDB.TypeUpdate("typea", body, true, true))
+	for i := 0; i < backupTestObjects; i++ {
+		body.SetByPath("object_index", easyjson.NewJSON(i))
+		require.NoError(t, dbClient.CMDB.ObjectCreate(fmt.Sprintf("test_%d", i), "typea", body))
+	}
+	waitForTestObjects(t, backupTestObjects)
+
+	archive := bytes.Buffer{}
+	manifest, err := runtimes[0].Domain.Cache().Backup(context.Background(), &archive, cache.NewBackupConfig())
+	require.NoError(t, err)
+	require.Len(t, manifest.Members, 2)
+	require.GreaterOrEqual(t, manifest.Keys, backupTestObjects)
+	archiveBytes := archive.Bytes()
+
+	for i := 0; i < backupTestObjects; i++ {
+		require.NoError(t, dbClient.CMDB.ObjectDelete(fmt.Sprintf("test_%d", i)))
+	}
+	waitForTestObjects(t, 0)
+
+	// Into an empty bucket
+	emptyKV, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "backup_barrier_restored"})
+	require.NoError(t, err)
+	_, report, err := cache.Restore(context.Background(), js, emptyKV, bytes.NewReader(archiveBytes), cache.NewRestoreConfig())
+	require.NoError(t, err)
+	require.Equal(t, manifest.Keys, report.Restored)
+	require.Equal(t, backupTestObjects, countTestObjects(t, emptyKV))
+
+	// Into the existing bucket, the type and other untouched keys are conflicts
+	_, _, err = cache.Restore(context.Background(), js, kv, bytes.NewReader(archiveBytes), cache.NewRestoreConfig().SetConflictPolicy(cache.RestoreFailOnConflict))
+	require.Error(t, err)
+	_, report, err = cache.Restore(context.Background(), js, kv, bytes.NewReader(archiveBytes), cache.NewRestoreConfig().SetConflictPolicy(cache.RestoreSkipExisting))
+	require.NoError(t, err)
+	require.Greater(t, report.Skipped, 0)
+	require.Equal(t, backupTestObjects, countTestObjects(t, kv))
+
+	// A truncated archive is refused
+	_, _, err = cache.Restore(context.Background(), js, emptyKV, bytes.NewReader(archiveBytes[:len(archiveBytes)/2]), cache.NewRestoreConfig())
+	require.Error(t, err)
+}
+
+func waitForTestObjects(t *testing.T, expected int) {
+	deadline := time.Now().Add(30 * time.Second)
+	for countTestObjects(t, kv) != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d test objects in KV, found %d", expected, countTestObjects(t, kv))
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+func countTestObjects(t *testing.T, bucket nats.KeyValue) int {
+	keys, err := bucket.Keys()
+	require.NoError(t, err)
+	count := 0
+	for _, key := range keys {
+		if testObjectKeyRegexp.MatchString(key) {
+			count++
+		}
+	}
+	return count
+}
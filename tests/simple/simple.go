@@ -12,6 +12,8 @@ import (
 
 	graphDebug "github.com/foliagecp/sdk/embedded/graph/debug"
 	"github.com/foliagecp/sdk/embedded/graph/jpgql"
+	"github.com/foliagecp/sdk/embedded/locks"
+	"github.com/foliagecp/sdk/embedded/state"
 	"github.com/foliagecp/sdk/statefun"
 	"github.com/foliagecp/sdk/statefun/cache"
 	"github.com/foliagecp/sdk/statefun/system"
@@ -30,6 +32,8 @@ func RegisterFunctionTypes(runtime *statefun.Runtime) {
 	jpgql.RegisterAllFunctionTypes(runtime)
 	fpl.RegisterAllFunctionTypes(runtime)
 	search.RegisterAllFunctionTypes(runtime)
+	locks.RegisterAllFunctionTypes(runtime)
+	state.RegisterAllFunctionTypes(runtime)
 }
 
 func Start() {